@@ -16,19 +16,31 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/pkg/errors"
 	"go.opencensus.io/exporter/prometheus"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
 	"go.uber.org/zap"
 	"gopkg.in/alecthomas/kingpin.v2"
+	"k8s.io/apimachinery/pkg/labels"
 	client "k8s.io/client-go/kubernetes"
+	metrics "k8s.io/metrics/pkg/client/clientset_generated/clientset"
 
 	"github.com/planetlabs/kostanza/internal/consumer"
 	"github.com/planetlabs/kostanza/internal/coster"
 	"github.com/planetlabs/kostanza/internal/kubernetes"
+	"github.com/planetlabs/kostanza/internal/lister"
 	"github.com/planetlabs/kostanza/internal/log"
 )
 
@@ -37,25 +49,135 @@ const name = "kostanza"
 var (
 	app       = kingpin.New("kostanza", "A Kubernetes component to emit cost metrics for services.")
 	verbosity = app.Flag("verbosity", "Logging verbosity level.").Short('v').Counter()
-	config    = app.Flag("config", "Path to configuration json.").Required().File()
+	config    = app.Flag("config", "Path to configuration json, or yaml if it has a .yaml or .yml extension, or a csv cost table if it has a .csv extension. May be repeated to merge configurations in order.").ExistingFiles()
 
 	collect                    = app.Command("collect", "Starts up kostanza in cost data collection mode.")
-	collectListenAddr          = collect.Flag("listen-addr", "Listen address for prometheus metrics and health checks.").Default(":5000").String()
+	collectListenAddr          = collect.Flag("listen-addr", "Listen address for prometheus metrics and health checks. Set to an empty string to disable.").Default(":5000").String()
 	collectKubecfg             = collect.Flag("kubeconfig", "Path to kubeconfig file. Leave unset to use in-cluster config.").String()
 	collectApiserver           = collect.Flag("master", "Address of Kubernetes API server. Leave unset to use in-cluster config.").String()
+	collectContext             = collect.Flag("context", "Name of the kubeconfig context to use. Leave unset to use the current context.").String()
 	collectInterval            = collect.Flag("interval", "Cost calculation interval.").Default("10s").Duration()
+	collectLagSmoothing        = collect.Flag("lag-smoothing", "Smoothing factor in (0, 1] of the exponential moving average of calculation lag recorded as lag_smoothed. Set to 0 to disable.").Default("0.1").Float64()
+	collectIntervalJitter      = collect.Flag("interval-jitter", "Fraction in [0, 1) of the interval to randomly vary the wait between calculations by, so that replicas do not publish in synchronized bursts. Set to 0 to calculate on fixed ticks.").Default("0").Float64()
+	collectMaxInterval         = collect.Flag("max-interval", "Maximum duration priced by a single calculation when calculations fall behind. Set to 0 to disable.").Default("0s").Duration()
 	collectPubsubFlushInterval = collect.Flag("pubsub-flush-interval", "Pubsub buffer flush interval").Default("300s").Duration()
 	collectPubsubTopic         = collect.Flag("pubsub-topic", "Pubsub topic name for publishing cost metrics.").String()
 	collectPubsubProject       = collect.Flag("pubsub-project", "Pubsub project name for publishing cost metrics.").String()
+	collectPubsubMaxAttempts   = collect.Flag("pubsub-max-attempts", "Maximum attempts to publish each pubsub message.").Default(strconv.Itoa(coster.DefaultPubsubMaxAttempts)).Int()
+	collectPubsubRetryDelay    = collect.Flag("pubsub-retry-delay", "Delay before retrying a failed pubsub publish, doubling on each subsequent retry.").Default(coster.DefaultPubsubRetryDelay.String()).Duration()
+	collectKafkaBrokers        = collect.Flag("kafka-brokers", "Kafka broker address for publishing cost metrics. May be repeated.").Strings()
+	collectKafkaTopic          = collect.Flag("kafka-topic", "Kafka topic name for publishing cost metrics.").String()
+	collectKafkaKeyDimension   = collect.Flag("kafka-key-dimension", "Mapper destination whose value keys and partitions kafka messages. Leave unset to distribute messages round-robin.").String()
+	collectCloudEventsSource   = collect.Flag("cloudevents-source", "Wrap pubsub and kafka cost data in CloudEvents envelopes with this source, e.g. //kostanza/my-cluster. Leave unset to publish bare cost data.").String()
+	collectKafkaFlushInterval  = collect.Flag("kafka-flush-interval", "Kafka buffer flush interval").Default("300s").Duration()
+	collectNamespaces          = collect.Flag("namespace", "Only account for pods in this namespace. May be repeated.").Strings()
+	collectExcludeNamespaces   = collect.Flag("exclude-namespace", "Do not account for pods in this namespace. May be repeated.").Strings()
+	collectPodSelector         = collect.Flag("pod-selector", "Only account for pods matching this label selector, e.g. cost-exempt!=true.").String()
+	collectPodSelection        = collect.Flag("pod-selection", "Which pods to account for: running pods only, or every pod scheduled to a node.").Default("running").Enum("running", "scheduled")
+	collectPodResync           = collect.Flag("pod-resync", "Interval at which the pod cache is fully resynced. Set to 0 to disable periodic resyncs.").Default(lister.DefaultResyncPeriod.String()).Duration()
+	collectNodeResync          = collect.Flag("node-resync", "Interval at which the node cache is fully resynced. Set to 0 to disable periodic resyncs.").Default(lister.DefaultResyncPeriod.String()).Duration()
+	collectWatchConfig         = collect.Flag("watch-config", "Reload pricing and mapping configuration when the config file changes.").Bool()
+	collectConfigMap           = collect.Flag("config-configmap", "Read configuration from the key of a ConfigMap, as namespace/name/key, instead of --config. The ConfigMap is watched and reloaded on change.").String()
+	collectStdout              = collect.Flag("stdout", "Write cost data to stdout as JSON lines.").Bool()
+	collectStdoutPretty        = collect.Flag("stdout-pretty", "Pretty print cost data written via --stdout.").Bool()
+	collectOutputFile          = collect.Flag("output-file", "Append cost data as JSON lines to this file.").String()
+	collectOutputMaxSize       = collect.Flag("output-file-max-size", "Size in megabytes at which the output file is rotated.").Default("100").Int()
+	collectOutputMaxBackups    = collect.Flag("output-file-max-backups", "Number of rotated output files to retain. Set to 0 to retain all of them.").Default("5").Int()
+	collectPushgatewayURL      = collect.Flag("pushgateway-url", "Prometheus Pushgateway URL to push cost metrics to.").String()
+	collectPushgatewayJob      = collect.Flag("pushgateway-job", "Job label used when pushing cost metrics to the Pushgateway.").Default(name).String()
+	collectPushgatewayInterval = collect.Flag("pushgateway-interval", "Pushgateway push interval. Set to 0 to only push on shutdown.").Default("60s").Duration()
+	collectCloudWatch          = collect.Flag("cloudwatch", "Publish cost metrics to AWS CloudWatch.").Bool()
+	collectCloudWatchNamespace = collect.Flag("cloudwatch-namespace", "CloudWatch namespace for publishing cost metrics.").Default(coster.DefaultCloudWatchNamespace).String()
+	collectCloudWatchRegion    = collect.Flag("cloudwatch-region", "AWS region for publishing cost metrics. Leave unset to use the AWS SDK defaults.").String()
+	collectCloudWatchInterval  = collect.Flag("cloudwatch-flush-interval", "CloudWatch publish interval.").Default("60s").Duration()
+	collectStackdriverProject  = collect.Flag("stackdriver-project", "Google Cloud project to write cost metrics to Cloud Monitoring in.").String()
+	collectStackdriverInterval = collect.Flag("stackdriver-flush-interval", "Cloud Monitoring write interval.").Default("60s").Duration()
+	collectStartupTimeout      = collect.Flag("startup-timeout", "Maximum time to wait for exporters to finish setting up, e.g. provisioning the pubsub topic. Set to 0 to wait indefinitely.").Default(coster.DefaultStartupTimeout.String()).Duration()
+	collectDogstatsdAddr       = collect.Flag("dogstatsd-addr", "Address of a DogStatsD agent to send cost metrics to, e.g. localhost:8125.").String()
+	collectDogstatsdMetricType = collect.Flag("dogstatsd-metric-type", "DogStatsD metric type cost metrics are sent as.").Default(coster.DatadogMetricCount).Enum(coster.DatadogMetricCount, coster.DatadogMetricGauge)
+	collectShutdownTimeout     = collect.Flag("shutdown-timeout", "Maximum time to wait for buffered cost data to be flushed on shutdown.").Default("10s").Duration()
+	collectGRPCListenAddr      = collect.Flag("grpc-listen-addr", "Listen address for serving a stream of cost data to grpc subscribers, e.g. :5001.").String()
+	collectGRPCBackpressure    = collect.Flag("grpc-backpressure", "How cost data is handled for grpc subscribers that are not keeping up.").Default(coster.GRPCBackpressureDropOldest).Enum(coster.GRPCBackpressureDropOldest, coster.GRPCBackpressureBlock)
+	collectGRPCBlockTimeout    = collect.Flag("grpc-block-timeout", "Maximum time to wait for a grpc subscriber that is not keeping up with --grpc-backpressure=block.").Default("1s").Duration()
+	collectClusterName         = collect.Flag("cluster-name", "Value of the cluster dimension added to all cost data.").String()
+	collectEnvironment         = collect.Flag("environment", "Value of the environment dimension added to all cost data.").String()
+	collectEnablePprof         = collect.Flag("enable-pprof", "Serve net/http/pprof profiles under /debug/pprof/ on the listen address.").Bool()
+	collectLogSummary          = collect.Flag("log-summary", "Log a summary of each cost calculation at info level. Always enabled with -v.").Bool()
+	collectTLSCertFile         = collect.Flag("tls-cert-file", "Path of a PEM encoded certificate to serve the listen address over TLS with, alongside --tls-key-file.").ExistingFile()
+	collectTLSKeyFile          = collect.Flag("tls-key-file", "Path of the PEM encoded key of --tls-cert-file.").ExistingFile()
+	collectBasicAuthUsername   = collect.Flag("basic-auth-username", "Require HTTP basic authentication with this username on the listen address, alongside --basic-auth-password-file.").String()
+	collectBasicAuthPassword   = collect.Flag("basic-auth-password-file", "Path of a file containing the basic authentication password.").ExistingFile()
+	collectBearerTokenFile     = collect.Flag("bearer-token-file", "Require a bearer token matching the contents of this file on the listen address.").ExistingFile()
+	collectResolveWorkloads    = collect.Flag("resolve-workloads", "Resolve the owning workload of pods by watching ReplicaSets and Deployments rather than inferring it from labels.").Bool()
+	collectUsageStrategy       = collect.Flag("usage-strategy", "Also price pods by the cpu and memory usage reported by metrics-server, via the UsagePricingStrategy.").Bool()
+	collectPriceEntryDimension = collect.Flag("price-entry-dimension", "Add the price_entry dimension, identifying the pricing entry that priced each cost, to exported cost data.").Bool()
+	collectNodeDimension       = collect.Flag("node-dimension", "Add the node dimension, holding the name of the node each cost was priced on, to exported cost data.").Bool()
+	collectNodeLabelDimensions = collect.Flag("node-label-dimension", "Add a dimension holding the value of a node label to exported cost data, as DIMENSION=LABEL. May be repeated.").StringMap()
+	collectDryRun              = collect.Flag("dry-run", "Log cost data instead of sending it to any configured exporter.").Bool()
+	collectNoStats             = collect.Flag("no-stats", "Do not export cost data as prometheus metrics. With --dry-run, cost data is not exported at all.").Bool()
+	collectStatsDimensions     = collect.Flag("stats-dimension", "Dimension to record as a prometheus label. May be repeated. Leave unset to record every mapped dimension.").Strings()
+	collectStatsSampleRate     = collect.Flag("stats-sample-rate", "Record 1 in N cost data at random as prometheus metrics, scaling the recorded cost by N. Leave unset to record every cost datum.").Default("1").Int()
+
+	calculate           = app.Command("calculate", "Performs a single cost calculation, printing the resulting cost items as JSON.")
+	calculateKubecfg    = calculate.Flag("kubeconfig", "Path to kubeconfig file. Leave unset to use in-cluster config.").String()
+	calculateApiserver  = calculate.Flag("master", "Address of Kubernetes API server. Leave unset to use in-cluster config.").String()
+	calculateContext    = calculate.Flag("context", "Name of the kubeconfig context to use. Leave unset to use the current context.").String()
+	calculateInterval   = calculate.Flag("interval", "Duration to calculate costs over.").Default("1h").Duration()
+	calculateNamespaces = calculate.Flag("namespace", "Only account for pods in this namespace. May be repeated.").Strings()
 
 	aggregate                   = app.Command("aggregate", "Starts up kostanza in pubsub consumption mode.")
 	aggregateListenAddr         = aggregate.Flag("listen-addr", "Listen address for prometheus metrics and health checks.").Default(":5000").String()
 	aggregatePubsubTopic        = aggregate.Flag("pubsub-topic", "Pubsub topic name for binding the cost subscription automatically.").Required().String()
 	aggregatePubsubSubscription = aggregate.Flag("pubsub-subscription", "Pubsub subscription name for pulling cost metrics.").Required().String()
 	aggregatePubsubProject      = aggregate.Flag("pubsub-project", "Pubsub project name for publishing cost metrics.").Required().String()
-	aggregateBigQueryProject    = aggregate.Flag("bigquery-project", "Project containing the BigQuery database for collecting cost metrics.").Required().String()
-	aggregateBigQueryDataset    = aggregate.Flag("bigquery-dataset", "Name of the BigQuery dataset to push cost data into.").Required().String()
-	aggregateBigQueryTable      = aggregate.Flag("bigquery-table", "Name of the BigQuery table within the specified dataset to push cost data into.").Required().String()
+	aggregateBigQueryProject    = aggregate.Flag("bigquery-project", "Project containing the BigQuery database for collecting cost metrics.").String()
+	aggregateBigQueryDataset    = aggregate.Flag("bigquery-dataset", "Name of the BigQuery dataset to push cost data into.").String()
+	aggregateBigQueryTable      = aggregate.Flag("bigquery-table", "Name of the BigQuery table within the specified dataset to push cost data into.").String()
+	aggregatePartitioning       = aggregate.Flag("bigquery-partitioning", "Granularity of the EndTime partitions of a provisioned BigQuery table.").Default(consumer.PartitionDay).Enum(consumer.PartitionDay, consumer.PartitionHour)
+	aggregateClusterDimensions  = aggregate.Flag("bigquery-cluster-dimensions", "Number of mapping destinations, in order, to cluster a provisioned BigQuery table by.").Default("0").Int()
+	aggregatePostgresDSN        = aggregate.Flag("postgres-dsn", "Connection string of a PostgreSQL database to push cost data into, alongside BigQuery if it is configured.").String()
+	aggregatePostgresTable      = aggregate.Flag("postgres-table", "Name of the PostgreSQL table to push cost data into.").Default("costs").String()
+	aggregateBatchSize          = aggregate.Flag("bigquery-batch-size", "Maximum number of rows to insert at once.").Default(strconv.Itoa(consumer.DefaultBatchSize)).Int()
+	aggregateBatchLatency       = aggregate.Flag("bigquery-batch-latency", "Maximum time to wait for a batch of rows to fill before inserting it.").Default(consumer.DefaultBatchLatency.String()).Duration()
+	aggregateEnablePprof        = aggregate.Flag("enable-pprof", "Serve net/http/pprof profiles under /debug/pprof/ on the listen address.").Bool()
+	aggregateTLSCertFile        = aggregate.Flag("tls-cert-file", "Path of a PEM encoded certificate to serve the listen address over TLS with, alongside --tls-key-file.").ExistingFile()
+	aggregateTLSKeyFile         = aggregate.Flag("tls-key-file", "Path of the PEM encoded key of --tls-cert-file.").ExistingFile()
+	aggregateBasicAuthUsername  = aggregate.Flag("basic-auth-username", "Require HTTP basic authentication with this username on the listen address, alongside --basic-auth-password-file.").String()
+	aggregateBasicAuthPassword  = aggregate.Flag("basic-auth-password-file", "Path of a file containing the basic authentication password.").ExistingFile()
+	aggregateBearerTokenFile    = aggregate.Flag("bearer-token-file", "Require a bearer token matching the contents of this file on the listen address.").ExistingFile()
+	aggregateStartupTimeout     = aggregate.Flag("startup-timeout", "Maximum time to wait for the subscription and destination table to be provisioned. Set to 0 to wait indefinitely.").Default(coster.DefaultStartupTimeout.String()).Duration()
+	aggregateAckDeadline        = aggregate.Flag("ack-deadline", "Ack deadline of the subscription, if it is created.").Default(consumer.DefaultAckDeadline.String()).Duration()
+	aggregateRetentionDuration  = aggregate.Flag("retention-duration", "Duration the subscription retains unacknowledged messages for, if it is created.").Default(consumer.DefaultRetentionDuration.String()).Duration()
+	aggregateExpiration         = aggregate.Flag("subscription-expiration", "Period of inactivity after which the subscription is deleted, if it is created. Set to 0 to never expire.").Default(consumer.DefaultSubscriptionExpiration.String()).Duration()
+	aggregateMaxAttempts        = aggregate.Flag("max-delivery-attempts", "Number of times a message may fail to aggregate before it is given up on. Set to 0 to retry indefinitely.").Default("5").Int()
+	aggregateDeadLetterTopic    = aggregate.Flag("dead-letter-topic", "Pubsub topic that messages which are given up on are published to. Leave unset to drop them.").String()
+	aggregateMaxMessages        = aggregate.Flag("max-messages", "Exit once this many messages have been aggregated. Set to 0 to consume indefinitely.").Int()
+	aggregateBreakerThreshold   = aggregate.Flag("circuit-breaker-threshold", "Consecutive aggregation failures after which messages are nacked without aggregating them for --circuit-breaker-cooldown. Set to 0 to disable.").Default("0").Int()
+	aggregateBreakerCooldown    = aggregate.Flag("circuit-breaker-cooldown", "Time to stop aggregating for once the circuit breaker opens, before probing for recovery.").Default(consumer.DefaultCircuitCooldown.String()).Duration()
+	aggregateDrainTimeout       = aggregate.Flag("drain-timeout", "Exit once no message has been received for this long. Set to 0 to consume indefinitely.").Duration()
+
+	replay                  = app.Command("replay", "Aggregates saved cost data, read as newline delimited JSON, without consuming from pubsub.")
+	replayInput             = replay.Flag("input", "Path or gs://bucket/object of the cost data to replay.").Required().String()
+	replayBigQueryProject   = replay.Flag("bigquery-project", "Project containing the BigQuery database for collecting cost metrics.").String()
+	replayBigQueryDataset   = replay.Flag("bigquery-dataset", "Name of the BigQuery dataset to push cost data into.").String()
+	replayBigQueryTable     = replay.Flag("bigquery-table", "Name of the BigQuery table within the specified dataset to push cost data into.").String()
+	replayPartitioning      = replay.Flag("bigquery-partitioning", "Granularity of the EndTime partitions of a provisioned BigQuery table.").Default(consumer.PartitionDay).Enum(consumer.PartitionDay, consumer.PartitionHour)
+	replayClusterDimensions = replay.Flag("bigquery-cluster-dimensions", "Number of mapping destinations, in order, to cluster a provisioned BigQuery table by.").Default("0").Int()
+	replayPostgresDSN       = replay.Flag("postgres-dsn", "Connection string of a PostgreSQL database to push cost data into, alongside BigQuery if it is configured.").String()
+	replayPostgresTable     = replay.Flag("postgres-table", "Name of the PostgreSQL table to push cost data into.").Default("costs").String()
+	replayBatchSize         = replay.Flag("bigquery-batch-size", "Maximum number of rows to insert at once.").Default(strconv.Itoa(consumer.DefaultBatchSize)).Int()
+	replayBatchLatency      = replay.Flag("bigquery-batch-latency", "Maximum time to wait for a batch of rows to fill before inserting it.").Default(consumer.DefaultBatchLatency.String()).Duration()
+	replayStartupTimeout    = replay.Flag("startup-timeout", "Maximum time to wait for the destination table to be provisioned. Set to 0 to wait indefinitely.").Default(coster.DefaultStartupTimeout.String()).Duration()
+
+	query                = app.Command("query", "Reports the total cost of each value of a dimension from BigQuery.")
+	queryBigQueryProject = query.Flag("bigquery-project", "Project containing the BigQuery database cost data was aggregated into.").Required().String()
+	queryBigQueryDataset = query.Flag("bigquery-dataset", "Name of the BigQuery dataset cost data was aggregated into.").Required().String()
+	queryBigQueryTable   = query.Flag("bigquery-table", "Name of the BigQuery table within the specified dataset cost data was aggregated into.").Required().String()
+	queryDimension       = query.Flag("dimension", "Mapping destination to group costs by, e.g. service.").Required().String()
+	queryKind            = query.Flag("kind", "Kind of cost to report.").Default(string(coster.ResourceCostWeighted)).String()
+	querySince           = query.Flag("since", "Report costs that ended within this long of now.").Default("24h").Duration()
+	queryTop             = query.Flag("top", "Number of most costly dimension values to report.").Default(strconv.Itoa(consumer.DefaultQueryLimit)).Int()
+	queryUnit            = query.Flag("unit", "Unit to report costs in.").Default(string(coster.CostUnitDollars)).Enum(string(coster.CostUnitMicroCents), string(coster.CostUnitCents), string(coster.CostUnitDollars))
 )
 
 var (
@@ -75,6 +197,22 @@ var (
 		TagKeys:     []tag.Key{},
 	}
 
+	viewKafkaErrors = &view.View{
+		Name:        "kafka_errors_total",
+		Measure:     coster.MeasureKafkaWriteErrors,
+		Description: "Total kafka write errors.",
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{},
+	}
+
+	viewBufferDepth = &view.View{
+		Name:        "buffer_depth",
+		Measure:     coster.MeasureBufferDepth,
+		Description: "Number of cost data buffered for export.",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{coster.TagExporter},
+	}
+
 	viewCycles = &view.View{
 		Name:        "cycles",
 		Measure:     coster.MeasureCycles,
@@ -83,6 +221,22 @@ var (
 		TagKeys:     []tag.Key{},
 	}
 
+	viewCalculationErrors = &view.View{
+		Name:        "calculation_errors",
+		Measure:     coster.MeasureCalculationErrors,
+		Description: "Total errors encountered calculating costs, by kind.",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{coster.TagErrorKind},
+	}
+
+	viewCostEntryMisses = &view.View{
+		Name:        "cost_entry_misses_total",
+		Measure:     coster.MeasureCostEntryMissByLabels,
+		Description: "Total node pricing entry lookups that matched no entry, by strategy and instance type.",
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{coster.TagStrategy, coster.TagInstanceType},
+	}
+
 	viewLag = &view.View{
 		Name:        "lag",
 		Measure:     coster.MeasureLag,
@@ -91,6 +245,46 @@ var (
 		TagKeys:     []tag.Key{},
 	}
 
+	viewLagSmoothed = &view.View{
+		Name:        "lag_smoothed",
+		Measure:     coster.MeasureLagSmoothed,
+		Description: "Exponential moving average of the lag time of cost calculation loops.",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{},
+	}
+
+	viewOrphanedPods = &view.View{
+		Name:        "orphaned_pods_total",
+		Measure:     coster.MeasureOrphanedPods,
+		Description: "Total pods skipped by cost calculations as their node could not be found.",
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{},
+	}
+
+	viewTotalClusterCost = &view.View{
+		Name:        "total_cluster_cost",
+		Measure:     coster.MeasureTotalClusterCost,
+		Description: "Total cost of all nodes in the most recent calculation in millionths of a cent.",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{},
+	}
+
+	viewGRPCDropped = &view.View{
+		Name:        "grpc_dropped_total",
+		Measure:     coster.MeasureGRPCDropped,
+		Description: "Total cost data dropped for grpc subscribers that were not keeping up.",
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{},
+	}
+
+	viewCalculationDuration = &view.View{
+		Name:        "calculation_duration",
+		Measure:     coster.MeasureCalculationDuration,
+		Description: "Time taken by cost calculations in milliseconds.",
+		Aggregation: view.Distribution(10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000),
+		TagKeys:     []tag.Key{},
+	}
+
 	viewConsume = &view.View{
 		Name:        "consume_consumed_total",
 		Measure:     consumer.MeasureConsume,
@@ -98,6 +292,14 @@ var (
 		Aggregation: view.Sum(),
 		TagKeys:     []tag.Key{consumer.TagConsumeStatus},
 	}
+
+	viewCircuitState = &view.View{
+		Name:        "aggregator_circuit_state",
+		Measure:     consumer.MeasureCircuitState,
+		Description: "State of the aggregator circuit breaker: 0 closed, 1 half-open, 2 open.",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{},
+	}
 )
 
 func main() {
@@ -111,16 +313,45 @@ func main() {
 
 	switch parsed {
 	case collect.FullCommand():
+		selector, err := labels.Parse(*collectPodSelector)
+		kingpin.FatalIfError(err, "invalid pod selector")
+
+		if *collectLagSmoothing < 0 || *collectLagSmoothing > 1 {
+			kingpin.Fatalf("--lag-smoothing must be between 0 and 1, got %v", *collectLagSmoothing)
+		}
+		if *collectIntervalJitter < 0 || *collectIntervalJitter >= 1 {
+			kingpin.Fatalf("--interval-jitter must be at least 0 and less than 1, got %v", *collectIntervalJitter)
+		}
+
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
+		cancelOnSignal(cancel)
 
-		c, err := kubernetes.BuildConfigFromFlags(*collectApiserver, *collectKubecfg)
+		// Exporters that buffered data is flushed to outlive ctx, so that the
+		// final flush on shutdown can still be exported.
+		ectx, ecancel := context.WithCancel(context.Background())
+		defer ecancel()
+
+		c, err := kubernetes.BuildConfigFromFlags(*collectApiserver, *collectKubecfg, *collectContext)
 		kingpin.FatalIfError(err, "cannot create Kubernetes client configuration")
 
 		cs, err := client.NewForConfig(c)
 		kingpin.FatalIfError(err, "cannot create Kubernetes client")
 
-		cf, err := coster.NewConfigFromReader(*config)
+		var cf *coster.Config
+		var cmRef coster.ConfigMapRef
+		var cmData string
+		if *collectConfigMap != "" {
+			if len(*config) > 0 {
+				kingpin.Fatalf("--config and --config-configmap are mutually exclusive")
+			}
+			cmRef, err = coster.ParseConfigMapRef(*collectConfigMap)
+			kingpin.FatalIfError(err, "invalid --config-configmap")
+
+			cf, cmData, err = coster.NewConfigFromConfigMap(cs, cmRef)
+		} else {
+			cf, err = loadConfigFiles()
+		}
 		kingpin.FatalIfError(err, "cannot read configuration data")
 
 		p, err := prometheus.NewExporter(prometheus.Options{Namespace: name})
@@ -129,68 +360,529 @@ func main() {
 		mk, err := cf.Mapper.TagKeys()
 		kingpin.FatalIfError(err, "could not prepare metric tags from mapping")
 
+		// Unlike the static dimensions the team varies by cost item, so it
+		// can't be added by the prometheus configuration.
+		if cf.Teams.Enabled() && len(allowedTagKeys(mk, []string{coster.DimensionTeam})) == 0 {
+			tk, err := tag.NewKey(coster.DimensionTeam)
+			kingpin.FatalIfError(err, "could not prepare team metric tag")
+			mk = append(mk, tk)
+		}
+
+		if len(*collectStatsDimensions) > 0 {
+			mk = allowedTagKeys(mk, *collectStatsDimensions)
+		}
 		viewCosts.TagKeys = append(viewCosts.TagKeys, mk...)
-		kingpin.FatalIfError(view.Register(viewCosts, viewPubsubErrors, viewCycles, viewLag), "cannot register metrics")
+		kingpin.FatalIfError(view.Register(viewCosts, viewPubsubErrors, viewKafkaErrors, viewBufferDepth, viewCycles, viewCalculationErrors, viewCostEntryMisses, viewLag, viewLagSmoothed, viewCalculationDuration, viewOrphanedPods, viewTotalClusterCost, viewGRPCDropped), "cannot register metrics")
 		view.RegisterExporter(p)
 
-		ces := []coster.CostExporter{
-			coster.NewStatsCostExporter(&cf.Mapper),
+		var ces []coster.CostExporter
+		var pse *coster.PubsubCostExporter
+		var pge *coster.PushgatewayCostExporter
+		var cwe *coster.CloudWatchCostExporter
+		var sde *coster.StackdriverCostExporter
+		var ke *coster.KafkaCostExporter
+		var fe *coster.FileCostExporter
+		var dde *coster.DatadogCostExporter
+		var ge *coster.GRPCCostExporter
+		var buffers []*coster.BufferingCostExporter
+		switch {
+		case *collectDryRun && *collectNoStats:
+			log.Log.Info("dry run enabled without stats, cost data will be discarded")
+		case *collectDryRun:
+			log.Log.Info("dry run enabled, cost data will only be logged")
+			ces = []coster.CostExporter{coster.NewLogCostExporter(nil)}
+		default:
+			if !*collectNoStats {
+				sce := coster.NewStatsCostExporter(&cf.Mapper)
+				sce.AllowedDimensions = *collectStatsDimensions
+				sce.SampleRate = *collectStatsSampleRate
+				ces = append(ces, sce)
+			}
+
+			if *collectPubsubTopic != "" {
+				log.Log.Infow(
+					"pubsub exporter enabled",
+					zap.String("topic", *collectPubsubTopic),
+					zap.String("project", *collectPubsubProject),
+				)
+
+				pse, err = coster.NewPubsubCostExporter(
+					ectx,
+					*collectStartupTimeout,
+					*collectPubsubTopic,
+					*collectPubsubProject,
+					coster.WithPublishRetry(*collectPubsubMaxAttempts, *collectPubsubRetryDelay),
+					coster.WithCloudEvents(*collectCloudEventsSource),
+				)
+				kingpin.FatalIfError(err, "could not create pubsub cost exporter")
+
+				bce, err := coster.NewBufferingCostExporter(ctx, "pubsub", *collectPubsubFlushInterval, pse)
+				kingpin.FatalIfError(err, "could not create buffering cost exporter")
+				buffers = append(buffers, bce)
+
+				ces = append(ces, bce)
+			}
+
+			if *collectKafkaTopic != "" {
+				log.Log.Infow(
+					"kafka exporter enabled",
+					zap.String("topic", *collectKafkaTopic),
+					zap.Strings("brokers", *collectKafkaBrokers),
+				)
+
+				ke, err = coster.NewKafkaCostExporter(ectx, *collectKafkaBrokers, *collectKafkaTopic, *collectKafkaKeyDimension, coster.WithKafkaCloudEvents(*collectCloudEventsSource))
+				kingpin.FatalIfError(err, "could not create kafka cost exporter")
+
+				bce, err := coster.NewBufferingCostExporter(ctx, "kafka", *collectKafkaFlushInterval, ke)
+				kingpin.FatalIfError(err, "could not create buffering cost exporter")
+				buffers = append(buffers, bce)
+
+				ces = append(ces, bce)
+			}
+
+			if *collectStdout {
+				log.Log.Info("stdout exporter enabled")
+				ces = append(ces, coster.NewStdoutCostExporter(os.Stdout, *collectStdoutPretty))
+			}
+
+			if *collectOutputFile != "" {
+				log.Log.Infow("file exporter enabled", zap.String("path", *collectOutputFile))
+
+				fe, err = coster.NewFileCostExporter(*collectOutputFile, *collectOutputMaxSize, *collectOutputMaxBackups)
+				kingpin.FatalIfError(err, "could not create file cost exporter")
+
+				ces = append(ces, fe)
+			}
+
+			if *collectPushgatewayURL != "" {
+				log.Log.Infow(
+					"pushgateway exporter enabled",
+					zap.String("url", *collectPushgatewayURL),
+					zap.String("job", *collectPushgatewayJob),
+				)
+
+				pge, err = coster.NewPushgatewayCostExporter(ctx, *collectPushgatewayURL, *collectPushgatewayJob, *collectPushgatewayInterval, &cf.Mapper)
+				kingpin.FatalIfError(err, "could not create pushgateway cost exporter")
+
+				ces = append(ces, pge)
+			}
+
+			if *collectCloudWatch {
+				log.Log.Infow(
+					"cloudwatch exporter enabled",
+					zap.String("namespace", *collectCloudWatchNamespace),
+					zap.String("region", *collectCloudWatchRegion),
+				)
+
+				cwe, err = coster.NewCloudWatchCostExporter(ctx, *collectCloudWatchNamespace, *collectCloudWatchRegion, *collectCloudWatchInterval)
+				kingpin.FatalIfError(err, "could not create cloudwatch cost exporter")
+
+				ces = append(ces, cwe)
+			}
+
+			if *collectStackdriverProject != "" {
+				log.Log.Infow("stackdriver exporter enabled", zap.String("project", *collectStackdriverProject))
+
+				sde, err = coster.NewStackdriverCostExporter(ctx, *collectStackdriverProject, *collectStackdriverInterval)
+				kingpin.FatalIfError(err, "could not create stackdriver cost exporter")
+
+				ces = append(ces, sde)
+			}
+
+			if *collectDogstatsdAddr != "" {
+				log.Log.Infow(
+					"datadog exporter enabled",
+					zap.String("addr", *collectDogstatsdAddr),
+					zap.String("type", *collectDogstatsdMetricType),
+				)
+
+				dde, err = coster.NewDatadogCostExporter(*collectDogstatsdAddr, *collectDogstatsdMetricType)
+				kingpin.FatalIfError(err, "could not create datadog cost exporter")
+
+				ces = append(ces, dde)
+			}
+
+			if *collectGRPCListenAddr != "" {
+				log.Log.Infow(
+					"grpc exporter enabled",
+					zap.String("addr", *collectGRPCListenAddr),
+					zap.String("backpressure", *collectGRPCBackpressure),
+				)
+
+				lis, err := net.Listen("tcp", *collectGRPCListenAddr) // nolint: vetshadow
+				kingpin.FatalIfError(err, "could not listen for grpc subscribers")
+
+				ge = coster.NewGRPCCostExporter(coster.DefaultGRPCSubscriberBuffer, *collectGRPCBackpressure, *collectGRPCBlockTimeout)
+				go func() {
+					if err := ge.Serve(lis); err != nil {
+						log.Log.Errorw("grpc server exited with error", zap.Error(err))
+					}
+				}()
+
+				ces = append(ces, ge)
+			}
+
+			if len(ces) == 0 {
+				kingpin.Fatalf("no cost exporters configured; remove --no-stats, configure an exporter, or use --dry-run")
+			}
 		}
 
-		if *collectPubsubTopic != "" {
-			log.Log.Infow(
-				"pubsub exporter enabled",
-				zap.String("topic", *collectPubsubTopic),
-				zap.String("project", *collectPubsubProject),
-			)
+		opts := []coster.Option{
+			coster.WithPodFilters(
+				coster.NamespaceIncludeFilter(*collectNamespaces...),
+				coster.NamespaceExcludeFilter(*collectExcludeNamespaces...),
+				coster.SelectorPodFilter(selector),
+			),
+			coster.WithMaxInterval(*collectMaxInterval),
+			coster.WithLagSmoothing(*collectLagSmoothing),
+			coster.WithIntervalJitter(*collectIntervalJitter),
+			coster.WithResyncPeriods(*collectPodResync, *collectNodeResync),
+			coster.WithStaticDimensions(map[string]string{
+				coster.DimensionCluster:     *collectClusterName,
+				coster.DimensionEnvironment: *collectEnvironment,
+			}),
+		}
+		if *collectPodSelection == "scheduled" {
+			opts = append(opts, coster.WithScheduledPods())
+		}
+		if *collectEnablePprof {
+			opts = append(opts, coster.WithPprof())
+		}
+		if *collectLogSummary || *verbosity > 0 {
+			opts = append(opts, coster.WithCycleSummary())
+		}
+		ss, err := serverSecurity(*collectTLSCertFile, *collectTLSKeyFile, *collectBasicAuthUsername, *collectBasicAuthPassword, *collectBearerTokenFile)
+		kingpin.FatalIfError(err, "invalid server security settings")
+		opts = append(opts, coster.WithServerSecurity(ss))
+		if *collectResolveWorkloads {
+			opts = append(opts, coster.WithWorkloadResolution())
+		}
+		if *collectPriceEntryDimension {
+			opts = append(opts, coster.WithPriceEntryDimension())
+		}
+		if *collectNodeDimension {
+			opts = append(opts, coster.WithNodeDimension())
+		}
+		if len(*collectNodeLabelDimensions) > 0 {
+			opts = append(opts, coster.WithNodeLabelDimensions(*collectNodeLabelDimensions))
+		}
+		if *collectUsageStrategy {
+			mc, err := metrics.NewForConfig(c) // nolint: vetshadow
+			kingpin.FatalIfError(err, "cannot create Kubernetes metrics client")
+			opts = append(opts, coster.WithUsagePricing(lister.NewKubernetesPodMetricsLister(mc)))
+		}
 
-			ce, err := coster.NewPubsubCostExporter(ctx, *collectPubsubTopic, *collectPubsubProject) // nolint: vetshadow
-			kingpin.FatalIfError(err, "could not create pubsub cost exporter")
+		kc, err := coster.NewKubernetesCoster(*collectInterval, cf, cs, p, *collectListenAddr, ces, opts...)
+		if err == coster.ErrNoPodMetricsLister {
+			kingpin.Fatalf("the UsagePricingStrategy requires --usage-strategy")
+		}
+		kingpin.FatalIfError(err, "cannot create coster")
 
-			bce, err := coster.NewBufferingCostExporter(ctx, *collectPubsubFlushInterval, ce)
-			kingpin.FatalIfError(err, "could not create buffering cost exporter")
+		if *collectConfigMap != "" {
+			go func() {
+				if err := coster.WatchConfigMap(ctx, cs, cmRef, cmData, kc.ReloadConfig); err != nil {
+					log.Log.Errorw("could not watch configuration", zap.Error(err))
+				}
+			}()
+		} else if *collectWatchConfig {
+			go func() {
+				if err := coster.WatchConfigFiles(ctx, *config, kc.ReloadConfig); err != nil {
+					log.Log.Errorw("could not watch configuration", zap.Error(err))
+				}
+			}()
+		}
 
-			ces = append(ces, bce)
+		err = kc.Run(ctx)
+		cancel()
+		awaitFlush(buffers, *collectShutdownTimeout)
+		if pse != nil {
+			if perr := pse.Close(); perr != nil {
+				log.Log.Errorw("could not publish final cost data to pubsub", zap.Error(perr))
+			}
+		}
+		if pge != nil {
+			if perr := pge.Close(); perr != nil {
+				log.Log.Errorw("could not push final cost data to pushgateway", zap.Error(perr))
+			}
+		}
+		if ke != nil {
+			if kerr := ke.Close(); kerr != nil {
+				log.Log.Errorw("could not write final cost data to kafka", zap.Error(kerr))
+			}
+		}
+		if cwe != nil {
+			if cerr := cwe.Close(); cerr != nil {
+				log.Log.Errorw("could not publish final cost data to cloudwatch", zap.Error(cerr))
+			}
+		}
+		if sde != nil {
+			if serr := sde.Close(); serr != nil {
+				log.Log.Errorw("could not write final cost data to stackdriver", zap.Error(serr))
+			}
+		}
+		if fe != nil {
+			if ferr := fe.Close(); ferr != nil {
+				log.Log.Errorw("could not close output file", zap.Error(ferr))
+			}
 		}
+		if dde != nil {
+			if derr := dde.Close(); derr != nil {
+				log.Log.Errorw("could not send final cost data to dogstatsd", zap.Error(derr))
+			}
+		}
+		if ge != nil {
+			ge.Close() // nolint: errcheck, gosec
+		}
+		kingpin.FatalIfError(err, "exited with error")
+	case calculate.FullCommand():
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c, err := kubernetes.BuildConfigFromFlags(*calculateApiserver, *calculateKubecfg, *calculateContext)
+		kingpin.FatalIfError(err, "cannot create Kubernetes client configuration")
+
+		cs, err := client.NewForConfig(c)
+		kingpin.FatalIfError(err, "cannot create Kubernetes client")
+
+		cf, err := loadConfigFiles()
+		kingpin.FatalIfError(err, "cannot read configuration data")
 
-		coster, err := coster.NewKubernetesCoster(*collectInterval, cf, cs, p, *collectListenAddr, ces)
+		filters := coster.WithPodFilters(coster.NamespaceIncludeFilter(*calculateNamespaces...))
+		kc, err := coster.NewKubernetesCoster(*calculateInterval, cf, cs, nil, "", nil, filters)
 		kingpin.FatalIfError(err, "cannot create coster")
 
-		kingpin.FatalIfError(coster.Run(ctx), "exited with error")
+		cis, cerr := kc.CalculateOnce(ctx)
+		if cis != nil {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			kingpin.FatalIfError(enc.Encode(cis), "cannot write cost items")
+		}
+		kingpin.FatalIfError(cerr, "cost calculation failed")
 	case aggregate.FullCommand():
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
-		cf, err := coster.NewConfigFromReader(*config)
+		cf, err := loadConfigFiles()
 		kingpin.FatalIfError(err, "cannot read configuration data")
 
 		p, err := prometheus.NewExporter(prometheus.Options{Namespace: name})
 		kingpin.FatalIfError(err, "cannot export metrics")
 
-		kingpin.FatalIfError(view.Register(viewConsume), "cannot register metrics")
+		kingpin.FatalIfError(view.Register(viewConsume, viewCircuitState), "cannot register metrics")
 		view.RegisterExporter(p)
 
-		agg, err := consumer.NewBigQueryAggregator(
+		aggs, err := newAggregators(
 			ctx,
-			*aggregatePubsubProject,
+			*aggregateStartupTimeout,
+			&cf.Mapper,
+			*aggregatePostgresDSN,
+			*aggregatePostgresTable,
+			*aggregateBigQueryProject,
 			*aggregateBigQueryDataset,
 			*aggregateBigQueryTable,
-			&cf.Mapper,
+			consumer.TableLayout{Partitioning: *aggregatePartitioning, ClusterDimensions: *aggregateClusterDimensions},
+			consumer.WithBatching(*aggregateBatchSize, *aggregateBatchLatency),
 		)
 		kingpin.FatalIfError(err, "could not create aggregator")
 
+		consumerOpts := []consumer.ConsumerOption{
+			consumer.WithSubscriptionSettings(consumer.SubscriptionSettings{
+				AckDeadline:       *aggregateAckDeadline,
+				RetentionDuration: *aggregateRetentionDuration,
+				Expiration:        *aggregateExpiration,
+			}),
+			consumer.WithDeadLetter(*aggregateDeadLetterTopic, *aggregateMaxAttempts),
+			consumer.WithDrain(*aggregateMaxMessages, *aggregateDrainTimeout),
+			consumer.WithCircuitBreaker(*aggregateBreakerThreshold, *aggregateBreakerCooldown),
+		}
+		if *aggregateEnablePprof {
+			consumerOpts = append(consumerOpts, consumer.WithConsumerPprof())
+		}
+		ss, err := serverSecurity(*aggregateTLSCertFile, *aggregateTLSKeyFile, *aggregateBasicAuthUsername, *aggregateBasicAuthPassword, *aggregateBearerTokenFile)
+		kingpin.FatalIfError(err, "invalid server security settings")
+		consumerOpts = append(consumerOpts, consumer.WithConsumerServerSecurity(ss))
+
 		con, err := consumer.NewPubsubConsumer(
 			ctx,
+			*aggregateStartupTimeout,
 			p,
 			*aggregateListenAddr,
-			*aggregateBigQueryProject,
+			*aggregatePubsubProject,
 			*aggregatePubsubTopic,
 			*aggregatePubsubSubscription,
-			agg,
+			aggs,
+			consumerOpts...,
 		)
 		kingpin.FatalIfError(err, "could not create pubsub consumer")
 
 		kingpin.FatalIfError(con.Consume(ctx), "failed consumption loop")
+	case replay.FullCommand():
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cancelOnSignal(cancel)
+
+		cf, err := loadConfigFiles()
+		kingpin.FatalIfError(err, "cannot read configuration data")
+
+		aggs, err := newAggregators(
+			ctx,
+			*replayStartupTimeout,
+			&cf.Mapper,
+			*replayPostgresDSN,
+			*replayPostgresTable,
+			*replayBigQueryProject,
+			*replayBigQueryDataset,
+			*replayBigQueryTable,
+			consumer.TableLayout{Partitioning: *replayPartitioning, ClusterDimensions: *replayClusterDimensions},
+			consumer.WithBatching(*replayBatchSize, *replayBatchLatency),
+		)
+		kingpin.FatalIfError(err, "could not create aggregator")
+
+		r, err := consumer.OpenReplayInput(ctx, *replayInput)
+		kingpin.FatalIfError(err, "cannot open replay input")
+		defer r.Close() // nolint: errcheck
+
+		// Aggregating a full batch at once lets each batch fill without
+		// waiting out the batch latency.
+		n, err := consumer.Replay(ctx, r, consumer.MultiAggregator(aggs), *replayBatchSize)
+		log.Log.Infow("replayed cost data", zap.Int("records", n), zap.String("input", *replayInput))
+		kingpin.FatalIfError(err, "replay failed")
+	case query.FullCommand():
+		ctx := context.Background()
+
+		r, err := consumer.NewBigQueryReporter(ctx, *queryBigQueryProject, *queryBigQueryDataset, *queryBigQueryTable)
+		kingpin.FatalIfError(err, "could not create bigquery reporter")
+		defer r.Close() // nolint: errcheck
+
+		end := time.Now()
+		costs, err := r.CostByDimension(ctx, consumer.CostQuery{
+			Dimension: *queryDimension,
+			Kind:      coster.ResourceCostKind(*queryKind),
+			Start:     end.Add(-*querySince),
+			End:       end,
+			Limit:     *queryTop,
+		})
+		kingpin.FatalIfError(err, "cost query failed")
+		kingpin.FatalIfError(consumer.WriteCostReport(os.Stdout, *queryDimension, coster.CostUnit(*queryUnit), costs), "cannot write cost report")
+	}
+}
+
+// allowedTagKeys returns the tag keys named by one of the allowed dimensions.
+func allowedTagKeys(keys []tag.Key, allowed []string) []tag.Key {
+	filtered := []tag.Key{}
+	for _, k := range keys {
+		for _, a := range allowed {
+			if k.Name() == a {
+				filtered = append(filtered, k)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// loadConfigFiles loads the configuration merged from every --config file.
+func loadConfigFiles() (*coster.Config, error) {
+	if len(*config) == 0 {
+		return nil, errors.New("--config is required")
+	}
+	return coster.NewConfigFromFiles(*config...)
+}
+
+// newAggregators returns a PostgreSQL aggregator if a dsn is provided and a
+// BigQuery aggregator if a project, dataset and table are provided, so that
+// cost data can be mirrored to both.
+func newAggregators(
+	ctx context.Context,
+	startupTimeout time.Duration,
+	mapper *coster.Mapper,
+	postgresDSN, postgresTable string,
+	bigQueryProject, bigQueryDataset, bigQueryTable string,
+	layout consumer.TableLayout,
+	opts ...consumer.AggregatorOption,
+) ([]consumer.Aggregator, error) {
+	aggs := []consumer.Aggregator{}
+	if postgresDSN != "" {
+		pa, err := consumer.NewPostgresAggregator(ctx, startupTimeout, postgresDSN, postgresTable, mapper, opts...)
+		if err != nil {
+			return nil, err
+		}
+		aggs = append(aggs, pa)
+	}
+	if bigQueryProject != "" && bigQueryDataset != "" && bigQueryTable != "" {
+		ba, err := consumer.NewBigQueryAggregator(ctx, startupTimeout, bigQueryProject, bigQueryDataset, bigQueryTable, mapper, layout, opts...)
+		if err != nil {
+			return nil, err
+		}
+		aggs = append(aggs, ba)
+	}
+	if len(aggs) == 0 {
+		return nil, errors.New("--postgres-dsn and/or all of --bigquery-project, --bigquery-dataset and --bigquery-table are required")
+	}
+	return aggs, nil
+}
+
+// serverSecurity returns the TLS and authentication settings of a listen
+// address, reading the basic auth password and bearer token from the provided
+// files.
+func serverSecurity(certFile, keyFile, username, passwordFile, tokenFile string) (coster.ServerSecurity, error) {
+	ss := coster.ServerSecurity{
+		TLSCertFile:       certFile,
+		TLSKeyFile:        keyFile,
+		BasicAuthUsername: username,
+	}
+
+	var err error
+	if ss.BasicAuthPassword, err = readSecretFile(passwordFile); err != nil {
+		return ss, errors.Wrap(err, "could not read basic auth password")
+	}
+	if ss.BearerToken, err = readSecretFile(tokenFile); err != nil {
+		return ss, errors.Wrap(err, "could not read bearer token")
+	}
+	return ss, ss.Validate()
+}
+
+// readSecretFile returns the contents of path without surrounding whitespace,
+// or an empty string if path is empty. Empty files are rejected rather than
+// silently disabling authentication.
+func readSecretFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	b, err := ioutil.ReadFile(path) // nolint: gosec
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", errors.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
+// cancelOnSignal cancels the provided function when the process is asked to
+// terminate, allowing it to shut down gracefully.
+func cancelOnSignal(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		s := <-sigs
+		log.Log.Infow("received signal, shutting down", zap.String("signal", s.String()))
+		cancel()
+	}()
+}
+
+// awaitFlush waits up to timeout for the provided buffering exporters to
+// flush their remaining data after their context has been cancelled.
+func awaitFlush(buffers []*coster.BufferingCostExporter, timeout time.Duration) {
+	deadline := time.After(timeout)
+	for _, b := range buffers {
+		select {
+		case <-b.Stopped():
+		case <-deadline:
+			log.Log.Warnw("timed out waiting for buffered cost data to flush", zap.Duration("timeout", timeout))
+			return
+		}
 	}
 }
 
@@ -0,0 +1,95 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"sync"
+	"time"
+)
+
+// attemptsPruneInterval is the minimum interval between sweeps of expired
+// attempt counts.
+const attemptsPruneInterval = time.Minute
+
+// attemptCounter counts the delivery attempts of messages by ID. Messages that
+// are never attempted again, e.g. because they were redelivered to another
+// consumer or expired, are forgotten once they have not been attempted for the
+// ttl so that their counts are not retained for the life of the process.
+type attemptCounter struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mux      sync.Mutex
+	attempts map[string]attempt
+	pruned   time.Time
+}
+
+type attempt struct {
+	count int
+	last  time.Time
+}
+
+// add records an attempt of the message, returning the number of attempts
+// recorded for it.
+func (ac *attemptCounter) add(id string) int {
+	ac.mux.Lock()
+	defer ac.mux.Unlock()
+
+	now := time.Now()
+	if ac.now != nil {
+		now = ac.now()
+	}
+	if ac.attempts == nil {
+		ac.attempts = map[string]attempt{}
+	}
+	if now.Sub(ac.pruned) >= attemptsPruneInterval {
+		ac.prune(now)
+	}
+
+	a := ac.attempts[id]
+	a.count++
+	a.last = now
+	ac.attempts[id] = a
+	return a.count
+}
+
+// prune forgets the attempts of messages last attempted longer than the ttl
+// ago. Callers must hold ac.mux.
+func (ac *attemptCounter) prune(now time.Time) {
+	ttl := ac.ttl
+	if ttl <= 0 {
+		ttl = DefaultRetentionDuration
+	}
+	for id, a := range ac.attempts {
+		if now.Sub(a.last) > ttl {
+			delete(ac.attempts, id)
+		}
+	}
+	ac.pruned = now
+}
+
+// forget drops the attempts recorded for the message.
+func (ac *attemptCounter) forget(id string) {
+	ac.mux.Lock()
+	defer ac.mux.Unlock()
+	delete(ac.attempts, id)
+}
+
+// len returns the number of messages with recorded attempts.
+func (ac *attemptCounter) len() int {
+	ac.mux.Lock()
+	defer ac.mux.Unlock()
+	return len(ac.attempts)
+}
@@ -0,0 +1,49 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttemptCounter(t *testing.T) {
+	now := time.Unix(0, 0)
+	ac := &attemptCounter{ttl: time.Hour, now: func() time.Time { return now }}
+
+	for i := 1; i <= 3; i++ {
+		if got := ac.add("a"); got != i {
+			t.Fatalf("expected attempt %d, got %d", i, got)
+		}
+	}
+	ac.add("b")
+	ac.forget("a")
+	if got := ac.add("a"); got != 1 {
+		t.Fatalf("expected forgotten attempts to restart at 1, got %d", got)
+	}
+
+	// Messages not attempted within the ttl are forgotten, while those
+	// attempted since are retained.
+	now = now.Add(45 * time.Minute)
+	ac.add("c")
+	now = now.Add(30 * time.Minute)
+	ac.add("d")
+	if got := ac.len(); got != 2 {
+		t.Fatalf("expected only the recently attempted messages to be retained, got %d", got)
+	}
+	if got := ac.add("c"); got != 2 {
+		t.Fatalf("expected the retained attempts to be counted, got %d", got)
+	}
+}
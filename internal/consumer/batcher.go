@@ -0,0 +1,169 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"time"
+
+	"github.com/planetlabs/kostanza/internal/coster"
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+const (
+	// DefaultBatchSize is the default maximum number of rows an aggregator
+	// inserts in a single request.
+	DefaultBatchSize = 500
+	// DefaultBatchLatency is the default maximum time an aggregator waits for
+	// a batch to fill before inserting it.
+	DefaultBatchLatency = time.Second
+)
+
+// AggregatorOption configures optional behavior of an Aggregator.
+type AggregatorOption func(b *batcher)
+
+// WithBatching configures an aggregator to insert up to size rows at a time,
+// waiting at most latency for a batch to fill.
+func WithBatching(size int, latency time.Duration) AggregatorOption {
+	return func(b *batcher) {
+		b.size = size
+		b.latency = latency
+	}
+}
+
+// batchInserter inserts a batch of cost data, returning an error for each row
+// that could not be inserted. A nil slice indicates every row was inserted.
+type batchInserter func(ctx context.Context, batch []coster.CostData) []error
+
+// pendingRow is a row awaiting insertion. The outcome of its insertion is
+// sent on done.
+type pendingRow struct {
+	data coster.CostData
+	done chan error
+}
+
+// batcher accumulates cost data from concurrent callers and inserts it in
+// batches, notifying each caller of the outcome for its row.
+type batcher struct {
+	size    int
+	latency time.Duration
+	rows    chan pendingRow
+	insert  batchInserter
+}
+
+// newBatcher returns a batcher that inserts batches using the provided
+// inserter until ctx is cancelled.
+func newBatcher(ctx context.Context, insert batchInserter, opts ...AggregatorOption) *batcher {
+	b := &batcher{
+		size:    DefaultBatchSize,
+		latency: DefaultBatchLatency,
+		insert:  insert,
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	if b.size < 1 {
+		b.size = 1
+	}
+	b.rows = make(chan pendingRow, b.size)
+
+	go func() {
+		log.Log.Debug("starting batch loop")
+		b.start(ctx)
+		log.Log.Debug("batch loop completed")
+	}()
+
+	return b
+}
+
+// add enqueues the provided cost data and blocks until the batch containing
+// it has been inserted, returning any error inserting it.
+func (b *batcher) add(ctx context.Context, cd coster.CostData) error {
+	pr := pendingRow{data: cd, done: make(chan error, 1)}
+
+	select {
+	case b.rows <- pr:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-pr.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// start accumulates pending rows, inserting them whenever size rows are
+// pending or latency has passed since the first pending row.
+func (b *batcher) start(ctx context.Context) {
+	batch := []pendingRow{}
+	var flush <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			for _, pr := range batch {
+				pr.done <- ctx.Err()
+			}
+			return
+		case pr := <-b.rows:
+			batch = append(batch, pr)
+			if len(batch) == 1 {
+				flush = time.After(b.latency)
+			}
+			if len(batch) < b.size {
+				continue
+			}
+		case <-flush:
+		}
+
+		b.flush(ctx, batch)
+		batch = []pendingRow{}
+		flush = nil
+	}
+}
+
+func (b *batcher) flush(ctx context.Context, batch []pendingRow) {
+	data := make([]coster.CostData, len(batch))
+	for i, pr := range batch {
+		data[i] = pr.data
+	}
+
+	errs := b.insert(ctx, data)
+	for i, pr := range batch {
+		if i < len(errs) {
+			pr.done <- errs[i]
+		} else {
+			pr.done <- nil
+		}
+	}
+}
+
+// batchErrors returns a slice reporting err for every row in a batch of n.
+func batchErrors(err error, n int) []error {
+	if err == nil {
+		return nil
+	}
+
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
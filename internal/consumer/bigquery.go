@@ -19,9 +19,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/pubsub"
+	pubsubadmin "cloud.google.com/go/pubsub/apiv1"
+	"github.com/pkg/errors"
 	"go.opencensus.io/exporter/prometheus"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
@@ -41,6 +44,7 @@ var (
 
 	tagStatusSucceeded = "succeeded"
 	tagStatusFailed    = "failed"
+	tagStatusRejected  = "rejected"
 )
 
 func isAlreadyExistsError(err error) bool {
@@ -65,6 +69,9 @@ func isNotFoundError(err error) bool {
 // purposes via the bigquery.Uploader.
 type CostRow struct {
 	coster.CostData
+	// columns, when set, limits the saved fields to those of the table's
+	// schema, as BigQuery rejects rows with fields it has no column for.
+	columns map[string]bool
 }
 
 // Save prepares a CostRow for import into BigQuery.
@@ -81,11 +88,27 @@ func (ce CostRow) Save() (row map[string]bigquery.Value, insertID string, err er
 		"EndTime":    ce.CostData.EndTime,
 		"Dimensions": string(dims),
 	}
+	if !ce.CostData.StartTime.IsZero() {
+		e["StartTime"] = ce.CostData.StartTime
+	}
+	if ce.CostData.Unit != "" {
+		e["Unit"] = string(ce.CostData.Unit)
+		e["UnitValue"] = ce.CostData.UnitValue
+	}
 
 	for k, v := range ce.CostData.Dimensions {
 		e["Dimensions_"+k] = v
 	}
 
+	if ce.columns != nil {
+		for k := range e {
+			if !ce.columns[k] {
+				log.Log.Debugw("omitting field missing from table schema", zap.String("field", k))
+				delete(e, k)
+			}
+		}
+	}
+
 	log.Log.Debugf("insertion data: %#v", e)
 
 	return e, "", nil
@@ -96,19 +119,37 @@ func defaultSchema() bigquery.Schema {
 		{Name: "Kind", Type: bigquery.StringFieldType},
 		{Name: "Strategy", Type: bigquery.StringFieldType},
 		{Name: "Value", Type: bigquery.IntegerFieldType},
+		{Name: "Unit", Type: bigquery.StringFieldType},
+		{Name: "UnitValue", Type: bigquery.FloatFieldType},
+		{Name: "StartTime", Type: bigquery.TimestampFieldType},
 		{Name: "EndTime", Type: bigquery.TimestampFieldType},
 		{Name: "Dimensions", Type: bigquery.StringFieldType},
+		{Name: "Dimensions_" + coster.DimensionCluster, Type: bigquery.StringFieldType},
+		{Name: "Dimensions_" + coster.DimensionEnvironment, Type: bigquery.StringFieldType},
+		{Name: "Dimensions_" + coster.DimensionPriceEntry, Type: bigquery.StringFieldType},
+		{Name: "Dimensions_" + coster.DimensionTeam, Type: bigquery.StringFieldType},
+		{Name: "Dimensions_" + coster.DimensionNode, Type: bigquery.StringFieldType},
 	}
 }
 
 // MapperToSchema creates a BigQuery schema representation for the provided
-// coster.Mapper configuration.
+// coster.Mapper configuration. Columns for the static dimensions, such as
+// coster.DimensionCluster, are always included.
 func MapperToSchema(mapper *coster.Mapper) bigquery.Schema {
 	// For a quality example of creating a schema by hand see:
 	// https://cloud.google.com/bigquery/docs/nested-repeatedThe
 	s := defaultSchema()
+	names := map[string]bool{}
+	for _, f := range s {
+		names[f.Name] = true
+	}
 
 	for _, m := range mapper.Entries {
+		if names["Dimensions_"+m.Destination] {
+			continue
+		}
+		names["Dimensions_"+m.Destination] = true
+
 		f := &bigquery.FieldSchema{
 			Name: "Dimensions_" + m.Destination,
 			Type: bigquery.StringFieldType,
@@ -126,38 +167,160 @@ type Consumer interface {
 }
 
 // PubsubConsumer consumers messages from pubsub and forwards them to the
-// provided aggregator.
+// provided aggregators.
 type PubsubConsumer struct {
-	subscription       *pubsub.Subscription
+	subscription       messageReceiver
 	aggregator         Aggregator
 	listenAddr         string
 	prometheusExporter *prometheus.Exporter
+	pprof              bool
+	security           coster.ServerSecurity
+	settings           SubscriptionSettings
+	deadLetterTopic    string
+	deadLetter         func(ctx context.Context, data []byte) error
+	maxAttempts        int
+	attempts           attemptCounter
+	drain              *drainer
+}
+
+// ConsumerOption configures optional behavior of a PubsubConsumer.
+type ConsumerOption func(pc *PubsubConsumer)
+
+// WithConsumerPprof serves the net/http/pprof profiling handlers under
+// /debug/pprof/ on the consumer's listen address.
+func WithConsumerPprof() ConsumerOption {
+	return func(pc *PubsubConsumer) {
+		pc.pprof = true
+	}
+}
+
+// WithConsumerServerSecurity serves metrics on the consumer's listen address
+// with the provided TLS and authentication settings. Health checks are served
+// without authentication.
+func WithConsumerServerSecurity(ss coster.ServerSecurity) ConsumerOption {
+	return func(pc *PubsubConsumer) {
+		pc.security = ss
+	}
+}
+
+// WithSubscriptionSettings configures the subscription provisioned by the
+// consumer if it does not exist, in place of DefaultSubscriptionSettings.
+func WithSubscriptionSettings(settings SubscriptionSettings) ConsumerOption {
+	return func(pc *PubsubConsumer) {
+		pc.settings = settings
+	}
+}
+
+// WithDeadLetter gives up on messages that fail to aggregate maxAttempts
+// times, acknowledging them so that they are not redelivered indefinitely.
+// If topic is not empty such messages are first published to it, and are
+// otherwise dropped. Attempts are counted by each consumer process, so a
+// message may be attempted more often across replicas or restarts. Counts are
+// forgotten once a message has not been attempted for the subscription's
+// retention duration, after which pubsub no longer redelivers it.
+func WithDeadLetter(topic string, maxAttempts int) ConsumerOption {
+	return func(pc *PubsubConsumer) {
+		pc.deadLetterTopic = topic
+		pc.maxAttempts = maxAttempts
+	}
+}
+
+// WithDrain stops consumption once maxMessages messages have been aggregated,
+// or once no message has been received for drainTimeout, rather than
+// consuming indefinitely. A zero maxMessages or drainTimeout disables the
+// respective limit.
+func WithDrain(maxMessages int, drainTimeout time.Duration) ConsumerOption {
+	return func(pc *PubsubConsumer) {
+		if maxMessages <= 0 && drainTimeout <= 0 {
+			pc.drain = nil
+			return
+		}
+		pc.drain = &drainer{maxMessages: maxMessages, timeout: drainTimeout}
+	}
+}
+
+// WithCircuitBreaker configures the PubsubConsumer to stop aggregating once
+// aggregation has failed threshold consecutive times, nacking messages without
+// aggregating them until cooldown has passed, see CircuitBreaker. Messages
+// nacked while the circuit is open do not count towards the maximum delivery
+// attempts. A zero threshold disables the breaker.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) ConsumerOption {
+	return func(pc *PubsubConsumer) {
+		if threshold <= 0 {
+			return
+		}
+		pc.aggregator = NewCircuitBreaker(pc.aggregator, threshold, cooldown)
+	}
 }
 
-// NewPubsubConsumer consumes messages from pubsub and invokes the provider
-// aggregator with the message contents.
-func NewPubsubConsumer(ctx context.Context, prometheusExporter *prometheus.Exporter, listenAddr string, project string, topic string, subscription string, aggregator Aggregator) (*PubsubConsumer, error) {
+// NewPubsubConsumer consumes messages from pubsub and invokes each of the
+// provided aggregators with the message contents, acknowledging messages only
+// once all of them succeed. Provisioning the subscription must complete within
+// startupTimeout.
+func NewPubsubConsumer(ctx context.Context, startupTimeout time.Duration, prometheusExporter *prometheus.Exporter, listenAddr string, project string, topic string, subscription string, aggregators []Aggregator, opts ...ConsumerOption) (*PubsubConsumer, error) {
+	var aggregator Aggregator
+	switch len(aggregators) {
+	case 0:
+		return nil, errors.New("at least one aggregator is required")
+	case 1:
+		aggregator = aggregators[0]
+	default:
+		aggregator = MultiAggregator(aggregators)
+	}
+
+	pc := &PubsubConsumer{
+		listenAddr:         listenAddr,
+		aggregator:         aggregator,
+		prometheusExporter: prometheusExporter,
+		settings:           DefaultSubscriptionSettings(),
+	}
+	for _, opt := range opts {
+		opt(pc)
+	}
+	pc.attempts.ttl = pc.settings.RetentionDuration
+
 	psClient, err := pubsub.NewClient(ctx, project)
 	if err != nil {
 		log.Log.Errorw("could not create pubsub client", zap.Error(err))
 		return nil, err
 	}
 
-	sub, err := createSubscriptionIfNotExists(ctx, psClient, subscription, topic)
+	admin, err := pubsubadmin.NewSubscriberClient(ctx)
 	if err != nil {
+		log.Log.Errorw("could not create pubsub subscriber client", zap.Error(err))
 		return nil, err
 	}
+	defer admin.Close() // nolint: errcheck
 
-	return &PubsubConsumer{
-		subscription:       sub,
-		listenAddr:         listenAddr,
-		aggregator:         aggregator,
-		prometheusExporter: prometheusExporter,
-	}, nil
+	sctx, cancel := coster.StartupContext(ctx, startupTimeout)
+	defer cancel()
+
+	if err := createSubscriptionIfNotExists(sctx, admin, project, subscription, topic, pc.settings); err != nil {
+		return nil, coster.StartupError(sctx, err, startupTimeout)
+	}
+	pc.subscription = subscriptionReceiver{subscription: psClient.Subscription(subscription)}
+
+	if pc.deadLetterTopic != "" {
+		t := psClient.Topic(pc.deadLetterTopic)
+		ok, err := t.Exists(sctx)
+		if err != nil {
+			return nil, coster.StartupError(sctx, err, startupTimeout)
+		} else if !ok {
+			return nil, errors.Errorf("dead letter topic %s does not exist", pc.deadLetterTopic)
+		}
+		pc.deadLetter = func(ctx context.Context, data []byte) error {
+			_, err := t.Publish(ctx, &pubsub.Message{Data: data}).Get(ctx)
+			return err
+		}
+	}
+
+	return pc, nil
 }
 
 // Consume begins the message consumption loop. It also registers and serves the
-// `/metrics` and `/healthz` endpoints for monitoring purposes.
+// `/metrics` and `/healthz` endpoints for monitoring purposes. Consume returns
+// once the provided context is cancelled or, if the consumer was configured
+// WithDrain, once it has drained.
 func (pc *PubsubConsumer) Consume(ctx context.Context) error {
 	ctx, done := context.WithCancel(ctx)
 	g, ctx := errgroup.WithContext(ctx)
@@ -165,18 +328,9 @@ func (pc *PubsubConsumer) Consume(ctx context.Context) error {
 	g.Go(func() error {
 		defer done()
 
-		mux := http.NewServeMux()
-		mux.Handle("/metrics", pc.prometheusExporter)
-		mux.Handle("/healthz", http.HandlerFunc(
-			func(w http.ResponseWriter, r *http.Request) {
-				defer r.Body.Close() // nolint: errcheck
-				fmt.Fprintf(w, "ok") // nolint: errcheck
-			},
-		))
-
 		s := http.Server{
 			Addr:    pc.listenAddr,
-			Handler: mux,
+			Handler: pc.handler(),
 		}
 		log.Log.Infof("starting server on %s", pc.listenAddr)
 
@@ -185,8 +339,8 @@ func (pc *PubsubConsumer) Consume(ctx context.Context) error {
 			s.Shutdown(ctx) // nolint: gosec, errcheck
 		}()
 
-		err := s.ListenAndServe()
-		if err != nil {
+		err := pc.security.ListenAndServe(&s)
+		if err != nil && err != http.ErrServerClosed {
 			log.Log.Errorw("error listening", zap.Error(err))
 			return err
 		}
@@ -199,33 +353,107 @@ func (pc *PubsubConsumer) Consume(ctx context.Context) error {
 		log.Log.Debug("starting cost calculation loop")
 		defer log.Log.Debug("exiting cost calculation loop")
 
-		return pc.subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-			var ce coster.CostData
-			if err := json.Unmarshal(msg.Data, &ce); err != nil {
-				log.Log.Errorw("could not decode message data", zap.Error(err), zap.ByteString("data", msg.Data))
-				msg.Ack()
+		pc.drain.start(done)
+		defer pc.drain.close()
 
-				ctx, _ = tag.New(ctx, tag.Upsert(TagConsumeStatus, tagStatusFailed)) // nolint: gosec
-				stats.Record(ctx, MeasureConsume.M(1))
-				return
-			}
+		return pc.subscription.Receive(ctx, pc.receive)
+	})
 
-			if err := pc.aggregator.Aggregate(ctx, ce); err != nil {
-				log.Log.Errorw("could not aggregate cost data", zap.Error(err))
-				msg.Ack()
+	return g.Wait()
+}
 
-				ctx, _ = tag.New(ctx, tag.Upsert(TagConsumeStatus, tagStatusFailed)) // nolint: gosec
-				stats.Record(ctx, MeasureConsume.M(1))
-				return
-			}
+// handler returns the handler served on the consumer's listen address, which
+// authenticates requests other than health checks if configured to.
+func (pc *PubsubConsumer) handler() http.Handler {
+	return pc.security.Handler(pc.serveMux(), "/healthz")
+}
 
-			msg.Ack()
-			ctx, _ = tag.New(ctx, tag.Upsert(TagConsumeStatus, tagStatusSucceeded)) // nolint: gosec
-			stats.Record(ctx, MeasureConsume.M(1))
-		})
-	})
+// serveMux returns the handlers served on the consumer's listen address.
+func (pc *PubsubConsumer) serveMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", pc.prometheusExporter)
+	mux.Handle("/healthz", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close() // nolint: errcheck
+			fmt.Fprintf(w, "ok") // nolint: errcheck
+		},
+	))
+	if pc.pprof {
+		coster.RegisterPprofHandlers(mux)
+	}
+	return mux
+}
 
-	return g.Wait()
+// receive handles a pubsub message, reporting whether it should be
+// acknowledged. Messages that have failed to aggregate too many times are
+// acknowledged once they have been published to the dead letter topic, if any.
+// Messages received once a draining consumer has aggregated enough are nacked
+// so that they are redelivered.
+func (pc *PubsubConsumer) receive(ctx context.Context, id string, data []byte) bool {
+	if !pc.drain.acquire() {
+		return false
+	}
+	defer pc.drain.release()
+
+	ack, err := pc.handleMessage(ctx, data)
+	if ack {
+		pc.attempts.forget(id)
+		return true
+	}
+	if pc.maxAttempts <= 0 || err == ErrCircuitOpen {
+		return false
+	}
+
+	attempts := pc.attempts.add(id)
+	if attempts < pc.maxAttempts {
+		return false
+	}
+
+	if pc.deadLetter != nil {
+		if err := pc.deadLetter(ctx, data); err != nil {
+			log.Log.Errorw("could not publish message to dead letter topic", zap.Error(err), zap.String("id", id))
+			return false
+		}
+	}
+
+	log.Log.Warnw("giving up on message", zap.String("id", id), zap.Int("attempts", attempts), zap.String("deadLetterTopic", pc.deadLetterTopic))
+	pc.attempts.forget(id)
+	return true
+}
+
+// handleMessage decodes and aggregates the data of a pubsub message, reporting
+// whether the message should be acknowledged along with any aggregation error.
+// Malformed messages are acknowledged since they will never succeed, while
+// aggregation failures may be transient and are not, so that the message is
+// redelivered.
+func (pc *PubsubConsumer) handleMessage(ctx context.Context, data []byte) (bool, error) {
+	ce, err := coster.UnmarshalCostData(data)
+	if err != nil {
+		log.Log.Errorw("could not decode message data", zap.Error(err), zap.ByteString("data", data))
+
+		ctx, _ = tag.New(ctx, tag.Upsert(TagConsumeStatus, tagStatusFailed)) // nolint: gosec
+		stats.Record(ctx, MeasureConsume.M(1))
+		return true, nil
+	}
+
+	if err := pc.aggregator.Aggregate(ctx, ce); err != nil {
+		status := tagStatusFailed
+		if err == ErrCircuitOpen {
+			log.Log.Debug("circuit open, not aggregating cost data")
+			status = tagStatusRejected
+		} else {
+			log.Log.Errorw("could not aggregate cost data", zap.Error(err))
+		}
+
+		ctx, _ = tag.New(ctx, tag.Upsert(TagConsumeStatus, status)) // nolint: gosec
+		stats.Record(ctx, MeasureConsume.M(1))
+		return false, err
+	}
+
+	pc.drain.aggregated()
+	ctx, _ = tag.New(ctx, tag.Upsert(TagConsumeStatus, tagStatusSucceeded)) // nolint: gosec
+	stats.Record(ctx, MeasureConsume.M(1))
+	return true, nil
 }
 
 // Aggregator coalesces and persists coster.CostData from kostanza.
@@ -233,89 +461,106 @@ type Aggregator interface {
 	Aggregate(ctx context.Context, ce coster.CostData) error
 }
 
+// rowUploader inserts rows into BigQuery, as implemented by bigquery.Uploader.
+type rowUploader interface {
+	Put(ctx context.Context, src interface{}) error
+}
+
 // BigQueryAggregator coalesces and persists coster.CosData data to BigQuery.
+// Rows are buffered and inserted in batches.
 type BigQueryAggregator struct {
 	table    *bigquery.Table
-	uploader *bigquery.Uploader
+	uploader rowUploader
+	columns  map[string]bool
+	batcher  *batcher
 }
 
 // NewBigQueryAggregator creates a new Aggregator that publishes consumed pubsub
 // events to the named BigQuery dataset and table. It will attempt to provision
 // the table using a schema inferred from the current version of the
-// application if the table does not yet exist.
-func NewBigQueryAggregator(ctx context.Context, project string, dataset string, table string, mapper *coster.Mapper) (*BigQueryAggregator, error) {
+// application and the provided layout if the table does not yet exist, which
+// must complete within startupTimeout. Only the fields of cost data that the
+// table has columns for are inserted. Batches are inserted in the background
+// until the provided context is cancelled.
+func NewBigQueryAggregator(ctx context.Context, startupTimeout time.Duration, project string, dataset string, table string, mapper *coster.Mapper, layout TableLayout, opts ...AggregatorOption) (*BigQueryAggregator, error) {
+	if err := layout.Validate(); err != nil {
+		return nil, err
+	}
+
 	bqClient, err := bigquery.NewClient(ctx, project)
 	if err != nil {
 		log.Log.Errorw("could not create bigquery client", zap.Error(err))
 		return nil, err
 	}
 
+	sctx, cancel := coster.StartupContext(ctx, startupTimeout)
+	defer cancel()
+
 	ds := bqClient.Dataset(dataset)
-	if err := ds.Create(ctx, nil); err != nil && !isAlreadyExistsError(err) {
+	if err := ds.Create(sctx, nil); err != nil && !isAlreadyExistsError(err) {
 		log.Log.Errorw("could not create dataset", zap.Error(err))
-		return nil, err
+		return nil, coster.StartupError(sctx, err, startupTimeout)
 	}
 
 	tbl := ds.Table(table)
-	if err := createTableIfNotExists(ctx, tbl, mapper); err != nil {
+	at, err := newAPITable(ctx, tbl)
+	if err != nil {
+		log.Log.Errorw("could not create bigquery api client", zap.Error(err))
 		return nil, err
 	}
+	schema, err := createTableIfNotExists(sctx, at, mapper, layout)
+	if err != nil {
+		return nil, coster.StartupError(sctx, err, startupTimeout)
+	}
 
-	return &BigQueryAggregator{
-		table:    tbl,
-		uploader: tbl.Uploader(),
-	}, nil
+	ba := newBigQueryAggregator(ctx, tbl, tbl.Uploader(), opts...)
+	ba.columns = schemaColumns(schema)
+	return ba, nil
 }
 
-func createSubscriptionIfNotExists(ctx context.Context, client *pubsub.Client, subscriptionName string, topicName string) (*pubsub.Subscription, error) {
-	sub := client.Subscription(subscriptionName)
-
-	if exists, err := sub.Exists(ctx); err != nil {
-		log.Log.Errorw("could not create pubsub client", zap.Error(err))
-		return nil, err
-	} else if exists {
-		return sub, nil
-	}
-
-	if _, err := client.CreateSubscription(ctx, subscriptionName, pubsub.SubscriptionConfig{Topic: client.Topic(topicName)}); err != nil {
-		log.Log.Errorw("could not create subscription", zap.Error(err))
-		return nil, err
+func newBigQueryAggregator(ctx context.Context, table *bigquery.Table, uploader rowUploader, opts ...AggregatorOption) *BigQueryAggregator {
+	ba := &BigQueryAggregator{
+		table:    table,
+		uploader: uploader,
 	}
+	ba.batcher = newBatcher(ctx, ba.insert, opts...)
+	return ba
+}
 
-	return sub, nil
+// Aggregate pushes coster.CostData to BigQuery. It blocks until the batch
+// containing the data has been inserted, returning any error inserting it.
+func (ba *BigQueryAggregator) Aggregate(ctx context.Context, ce coster.CostData) error {
+	log.Log.Debugw("aggregating object", zap.Object("CostData", &ce))
+	return ba.batcher.add(ctx, ce)
 }
 
-func createTableIfNotExists(ctx context.Context, table *bigquery.Table, mapper *coster.Mapper) error {
-	meta, err := table.Metadata(ctx)
+// insert puts the batch of rows into BigQuery. If only some rows fail to
+// insert, only those rows report an error.
+func (ba *BigQueryAggregator) insert(ctx context.Context, batch []coster.CostData) []error {
+	rows := make([]CostRow, len(batch))
+	for i, cd := range batch {
+		rows[i] = CostRow{CostData: cd, columns: ba.columns}
+	}
+
+	log.Log.Debugw("inserting batch", zap.Int("rows", len(rows)))
+	err := ba.uploader.Put(ctx, rows)
 	if err == nil {
-		log.Log.Debugw("got metadata for table", zap.String("id", meta.FullID))
 		return nil
-	} else if err != nil && !isNotFoundError(err) {
-		log.Log.Errorw("could not get metadata", zap.Error(err))
-		return err
 	}
 
-	schema := MapperToSchema(mapper)
-	if err := table.Create(ctx, &bigquery.TableMetadata{Schema: schema}); err != nil {
-		log.Log.Errorw("could not create table", zap.Error(err))
-		return err
+	log.Log.Errorw("could not insert rows", zap.Error(err))
+	pmErr, ok := err.(bigquery.PutMultiError)
+	if !ok {
+		return batchErrors(err, len(batch))
 	}
 
-	return nil
-}
-
-// Aggregate pushes coster.CostData to BigQuery.
-func (ba *BigQueryAggregator) Aggregate(ctx context.Context, ce coster.CostData) error {
-	cr := CostRow{ce}
-	log.Log.Debugw("aggregating object", zap.Object("CostData", &ce))
-	if err := ba.uploader.Put(ctx, cr); err != nil {
-		log.Log.Errorw("could not insert row", zap.Error(err))
-		if pmErr, ok := err.(bigquery.PutMultiError); ok {
-			for _, rowInsertionError := range pmErr {
-				log.Log.Debugw("row insertion error", zap.Error(&rowInsertionError))
-			}
+	errs := make([]error, len(batch))
+	for i := range pmErr {
+		rowInsertionError := pmErr[i]
+		log.Log.Debugw("row insertion error", zap.Error(&rowInsertionError))
+		if rowInsertionError.RowIndex >= 0 && rowInsertionError.RowIndex < len(errs) {
+			errs[rowInsertionError.RowIndex] = &rowInsertionError
 		}
-		return err
 	}
-	return nil
+	return errs
 }
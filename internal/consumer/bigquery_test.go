@@ -15,10 +15,16 @@
 package consumer
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/go-test/deep"
+	"github.com/pkg/errors"
 
 	"github.com/planetlabs/kostanza/internal/coster"
 )
@@ -48,6 +54,18 @@ var mapperToSchemaCases = []struct {
 			&bigquery.FieldSchema{Name: "Dimensions_Service", Type: bigquery.StringFieldType},
 		),
 	},
+	{
+		name: "mapper with a static dimension",
+		mapper: &coster.Mapper{
+			Entries: []coster.Mapping{
+				coster.Mapping{
+					Source:      "{.Node.ObjectMeta.Labels.cluster}",
+					Destination: coster.DimensionCluster,
+				},
+			},
+		},
+		expectedSchema: defaultSchema(),
+	},
 }
 
 func TestMapperToSchema(t *testing.T) {
@@ -60,3 +78,351 @@ func TestMapperToSchema(t *testing.T) {
 		})
 	}
 }
+
+var costRowSaveCases = []struct {
+	name     string
+	unit     coster.CostUnit
+	start    time.Time
+	columns  map[string]bool
+	expected map[string]bigquery.Value
+}{
+	{
+		name: "every field is saved without a schema",
+		expected: map[string]bigquery.Value{
+			"Kind":                     string(coster.ResourceCostCPU),
+			"Strategy":                 coster.StrategyNameCPU,
+			"Value":                    int64(5),
+			"EndTime":                  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			"Dimensions":               `{"instance_type":"m5.large","node":"node-a"}`,
+			"Dimensions_instance_type": "m5.large",
+			"Dimensions_node":          "node-a",
+		},
+	},
+	{
+		name: "the unit is saved when set",
+		unit: coster.CostUnitDollars,
+		expected: map[string]bigquery.Value{
+			"Kind":                     string(coster.ResourceCostCPU),
+			"Strategy":                 coster.StrategyNameCPU,
+			"Value":                    int64(5),
+			"Unit":                     "dollars",
+			"UnitValue":                5e-8,
+			"EndTime":                  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			"Dimensions":               `{"instance_type":"m5.large","node":"node-a"}`,
+			"Dimensions_instance_type": "m5.large",
+			"Dimensions_node":          "node-a",
+		},
+	},
+	{
+		name:  "the start time is saved when set",
+		start: time.Date(2019, 12, 31, 23, 0, 0, 0, time.UTC),
+		expected: map[string]bigquery.Value{
+			"Kind":                     string(coster.ResourceCostCPU),
+			"Strategy":                 coster.StrategyNameCPU,
+			"Value":                    int64(5),
+			"StartTime":                time.Date(2019, 12, 31, 23, 0, 0, 0, time.UTC),
+			"EndTime":                  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			"Dimensions":               `{"instance_type":"m5.large","node":"node-a"}`,
+			"Dimensions_instance_type": "m5.large",
+			"Dimensions_node":          "node-a",
+		},
+	},
+	{
+		name:    "fields without a column are omitted",
+		columns: schemaColumns(defaultSchema()),
+		expected: map[string]bigquery.Value{
+			"Kind":            string(coster.ResourceCostCPU),
+			"Strategy":        coster.StrategyNameCPU,
+			"Value":           int64(5),
+			"EndTime":         time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			"Dimensions":      `{"instance_type":"m5.large","node":"node-a"}`,
+			"Dimensions_node": "node-a",
+		},
+	},
+	{
+		name:    "dimensions added to tables predating them are omitted",
+		columns: map[string]bool{"Kind": true, "Strategy": true, "Value": true, "EndTime": true, "Dimensions": true},
+		expected: map[string]bigquery.Value{
+			"Kind":       string(coster.ResourceCostCPU),
+			"Strategy":   coster.StrategyNameCPU,
+			"Value":      int64(5),
+			"EndTime":    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			"Dimensions": `{"instance_type":"m5.large","node":"node-a"}`,
+		},
+	},
+}
+
+func TestCostRowSave(t *testing.T) {
+	cd := coster.CostData{
+		Kind:       coster.ResourceCostCPU,
+		Strategy:   coster.StrategyNameCPU,
+		Value:      5,
+		EndTime:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Dimensions: map[string]string{coster.DimensionNode: "node-a", "instance_type": "m5.large"},
+	}
+
+	for _, tt := range costRowSaveCases {
+		t.Run(tt.name, func(t *testing.T) {
+			cd := cd
+			cd.StartTime = tt.start
+			if tt.unit != "" {
+				cd.Unit = tt.unit
+				cd.UnitValue = tt.unit.Convert(cd.Value)
+			}
+
+			row, _, err := CostRow{CostData: cd, columns: tt.columns}.Save()
+			if err != nil {
+				t.Fatalf("unexpected error saving row: %v", err)
+			}
+			if diff := deep.Equal(row, tt.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+type fakeUploader struct {
+	mux     sync.Mutex
+	batches [][]CostRow
+	err     error
+}
+
+func (fu *fakeUploader) Put(ctx context.Context, src interface{}) error {
+	fu.mux.Lock()
+	defer fu.mux.Unlock()
+	fu.batches = append(fu.batches, src.([]CostRow))
+	return fu.err
+}
+
+func (fu *fakeUploader) batchSizes() []int {
+	fu.mux.Lock()
+	defer fu.mux.Unlock()
+	sizes := []int{}
+	for _, b := range fu.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+// aggregateAll concurrently aggregates count rows, returning their errors.
+func aggregateAll(ba *BigQueryAggregator, count int) []error {
+	errs := make([]error, count)
+	wg := sync.WaitGroup{}
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = ba.Aggregate(context.Background(), coster.CostData{Value: int64(i)})
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestBigQueryAggregatorBatchesBySize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fu := &fakeUploader{}
+	ba := newBigQueryAggregator(ctx, nil, fu, WithBatching(5, time.Hour))
+
+	for i, err := range aggregateAll(ba, 10) {
+		if err != nil {
+			t.Fatalf("unexpected error aggregating row %d: %v", i, err)
+		}
+	}
+
+	if diff := deep.Equal(fu.batchSizes(), []int{5, 5}); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestBigQueryAggregatorBatchesByLatency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fu := &fakeUploader{}
+	ba := newBigQueryAggregator(ctx, nil, fu, WithBatching(100, 10*time.Millisecond))
+
+	for i, err := range aggregateAll(ba, 3) {
+		if err != nil {
+			t.Fatalf("unexpected error aggregating row %d: %v", i, err)
+		}
+	}
+
+	if diff := deep.Equal(fu.batchSizes(), []int{3}); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestBigQueryAggregatorPartialFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fu := &fakeUploader{err: bigquery.PutMultiError{bigquery.RowInsertionError{RowIndex: 1}}}
+	ba := newBigQueryAggregator(ctx, nil, fu, WithBatching(2, time.Hour))
+
+	failures := 0
+	for _, err := range aggregateAll(ba, 2) {
+		if err != nil {
+			failures++
+		}
+	}
+
+	if failures != 1 {
+		t.Fatalf("expected only the failed row to report an error, got %d failures", failures)
+	}
+}
+
+func TestBigQueryAggregatorFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fu := &fakeUploader{err: errors.New("unavailable")}
+	ba := newBigQueryAggregator(ctx, nil, fu, WithBatching(2, time.Hour))
+
+	for i, err := range aggregateAll(ba, 2) {
+		if err == nil {
+			t.Fatalf("expected row %d to report the insertion error", i)
+		}
+	}
+}
+
+// flakyAggregator fails its first aggregation and succeeds thereafter.
+type flakyAggregator struct {
+	calls int
+}
+
+func (fa *flakyAggregator) Aggregate(ctx context.Context, ce coster.CostData) error {
+	fa.calls++
+	if fa.calls == 1 {
+		return errors.New("transient aggregation failure")
+	}
+	return nil
+}
+
+func TestHandleMessage(t *testing.T) {
+	fa := &flakyAggregator{}
+	pc := &PubsubConsumer{aggregator: fa}
+	data := []byte(`{"Kind": "cpu", "Value": 1}`)
+
+	if ack, _ := pc.handleMessage(context.Background(), data); ack {
+		t.Fatal("expected a failed aggregation to nack the message")
+	}
+
+	if ack, _ := pc.handleMessage(context.Background(), data); !ack {
+		t.Fatal("expected a redelivered message to be acked once aggregated")
+	}
+
+	if ack, _ := pc.handleMessage(context.Background(), []byte(`{`)); !ack {
+		t.Fatal("expected a malformed message to be acked")
+	}
+
+	if fa.calls != 2 {
+		t.Fatalf("expected malformed messages not to be aggregated, got %d calls", fa.calls)
+	}
+}
+
+func TestHandleMessageCloudEvents(t *testing.T) {
+	ra := &recordingAggregator{}
+	pc := &PubsubConsumer{aggregator: ra}
+	data := []byte(`{"specversion": "1.0", "type": "io.kostanza.cost", "source": "//kostanza/test", "id": "1", "data": {"Kind": "cpu", "Value": 1}}`)
+
+	if ack, _ := pc.handleMessage(context.Background(), data); !ack {
+		t.Fatal("expected a cloudevent to be acked once aggregated")
+	}
+	if len(ra.data) != 1 || ra.data[0].Kind != coster.ResourceCostCPU || ra.data[0].Value != 1 {
+		t.Fatalf("expected the cloudevent data to be aggregated, got %#v", ra.data)
+	}
+}
+
+// failingAggregator fails every aggregation.
+type failingAggregator struct{}
+
+func (failingAggregator) Aggregate(ctx context.Context, ce coster.CostData) error {
+	return errors.New("poison message")
+}
+
+func TestReceiveDeadLetter(t *testing.T) {
+	var deadLettered [][]byte
+	pc := &PubsubConsumer{aggregator: failingAggregator{}}
+	WithDeadLetter("dead-letters", 3)(pc)
+	pc.deadLetter = func(ctx context.Context, data []byte) error {
+		deadLettered = append(deadLettered, data)
+		return nil
+	}
+	data := []byte(`{"Kind": "cpu", "Value": 1}`)
+
+	for i := 1; i < 3; i++ {
+		if pc.receive(context.Background(), "poison", data) {
+			t.Fatalf("expected attempt %d to nack the message", i)
+		}
+	}
+	if !pc.receive(context.Background(), "poison", data) {
+		t.Fatal("expected the final attempt to ack the message")
+	}
+	if diff := deep.Equal(deadLettered, [][]byte{data}); diff != nil {
+		t.Fatal(diff)
+	}
+	if n := pc.attempts.len(); n != 0 {
+		t.Fatalf("expected attempts to be forgotten, got %d", n)
+	}
+}
+
+func TestReceiveDeadLetterPublishFailure(t *testing.T) {
+	pc := &PubsubConsumer{aggregator: failingAggregator{}}
+	WithDeadLetter("dead-letters", 1)(pc)
+	pc.deadLetter = func(ctx context.Context, data []byte) error {
+		return errors.New("unavailable")
+	}
+
+	if pc.receive(context.Background(), "poison", []byte(`{}`)) {
+		t.Fatal("expected messages that could not be dead lettered to be nacked")
+	}
+}
+
+func TestReceiveWithoutMaxAttempts(t *testing.T) {
+	pc := &PubsubConsumer{aggregator: failingAggregator{}}
+	for i := 0; i < 10; i++ {
+		if pc.receive(context.Background(), "poison", []byte(`{}`)) {
+			t.Fatal("expected failed messages to be nacked indefinitely")
+		}
+	}
+}
+
+func TestConsumerServeMuxPprof(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		pc := &PubsubConsumer{}
+		if enabled {
+			WithConsumerPprof()(pc)
+		}
+
+		rec := httptest.NewRecorder()
+		pc.serveMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+
+		expected := http.StatusNotFound
+		if enabled {
+			expected = http.StatusOK
+		}
+		if rec.Code != expected {
+			t.Errorf("expected status %d with pprof enabled %v, got %d", expected, enabled, rec.Code)
+		}
+	}
+}
+
+func TestConsumerHandlerSecurity(t *testing.T) {
+	pc := &PubsubConsumer{}
+	WithConsumerServerSecurity(coster.ServerSecurity{BearerToken: "s3cr3t"})(pc)
+
+	rec := httptest.NewRecorder()
+	pc.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected unauthenticated metrics requests to be rejected, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	pc.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected health checks to be public, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/stats"
+	"go.uber.org/zap"
+
+	"github.com/planetlabs/kostanza/internal/coster"
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+const (
+	// CircuitClosed is the state of a CircuitBreaker passing cost data to its
+	// aggregator.
+	CircuitClosed int64 = iota
+	// CircuitHalfOpen is the state of a CircuitBreaker probing whether its
+	// aggregator has recovered.
+	CircuitHalfOpen
+	// CircuitOpen is the state of a CircuitBreaker rejecting cost data without
+	// passing it to its aggregator.
+	CircuitOpen
+
+	// DefaultCircuitCooldown is the default time a CircuitBreaker stays open
+	// before probing its aggregator.
+	DefaultCircuitCooldown = 30 * time.Second
+)
+
+var (
+	// MeasureCircuitState records the state of the aggregator circuit breaker,
+	// one of CircuitClosed, CircuitHalfOpen or CircuitOpen.
+	MeasureCircuitState = stats.Int64("kostanza_aggregator/measures/circuit_state", "State of the aggregator circuit breaker: 0 closed, 1 half-open, 2 open", stats.UnitDimensionless)
+
+	// ErrCircuitOpen is returned by a CircuitBreaker that rejected cost data
+	// without aggregating it.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+// CircuitBreaker is an Aggregator that stops calling its aggregator once it
+// has failed too many times in a row, e.g. because BigQuery is unavailable,
+// so that messages are nacked quickly instead of each failing slowly. After a
+// cooldown a single probe is let through; the circuit closes again if it
+// succeeds and reopens if it fails.
+type CircuitBreaker struct {
+	next      Aggregator
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mux      sync.Mutex
+	state    int64
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker returns a CircuitBreaker that opens once next has failed
+// threshold consecutive times, probing it again after cooldown.
+func NewCircuitBreaker(next Aggregator, threshold int, cooldown time.Duration) *CircuitBreaker {
+	cb := &CircuitBreaker{
+		next:      next,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+	cb.record(CircuitClosed)
+	return cb
+}
+
+// Aggregate passes the cost data to the breaker's aggregator unless the
+// circuit is open, in which case it returns ErrCircuitOpen.
+func (cb *CircuitBreaker) Aggregate(ctx context.Context, ce coster.CostData) error {
+	if !cb.allow() {
+		return ErrCircuitOpen
+	}
+
+	err := cb.next.Aggregate(ctx, ce)
+	cb.done(err)
+	return err
+}
+
+// State returns the current state of the circuit.
+func (cb *CircuitBreaker) State() int64 {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	return cb.state
+}
+
+// allow reports whether cost data may be passed to the aggregator, moving an
+// open circuit whose cooldown has elapsed to half-open. Only one probe is let
+// through a half-open circuit at a time.
+func (cb *CircuitBreaker) allow() bool {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if cb.now().Sub(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		log.Log.Infow("probing aggregator", zap.Duration("cooldown", cb.cooldown))
+		cb.transition(CircuitHalfOpen)
+		cb.probing = true
+		return true
+	case CircuitHalfOpen:
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// done records the result of passing cost data to the aggregator.
+func (cb *CircuitBreaker) done(err error) {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	if cb.state == CircuitHalfOpen {
+		cb.probing = false
+	}
+
+	if err == nil {
+		cb.failures = 0
+		if cb.state != CircuitClosed {
+			log.Log.Info("aggregator recovered, closing circuit")
+			cb.transition(CircuitClosed)
+		}
+		return
+	}
+
+	cb.failures++
+	if cb.state == CircuitHalfOpen || (cb.state == CircuitClosed && cb.failures >= cb.threshold) {
+		log.Log.Warnw("opening circuit", zap.Int("failures", cb.failures), zap.Duration("cooldown", cb.cooldown))
+		cb.openedAt = cb.now()
+		cb.transition(CircuitOpen)
+	}
+}
+
+// transition moves the circuit to the provided state. It must be called with
+// the mutex held.
+func (cb *CircuitBreaker) transition(state int64) {
+	cb.state = state
+	cb.record(state)
+}
+
+func (cb *CircuitBreaker) record(state int64) {
+	stats.Record(context.Background(), MeasureCircuitState.M(state))
+}
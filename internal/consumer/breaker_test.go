@@ -0,0 +1,164 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/planetlabs/kostanza/internal/coster"
+)
+
+// unreliableAggregator fails while err is set, counting every call.
+type unreliableAggregator struct {
+	mux   sync.Mutex
+	err   error
+	calls int
+}
+
+func (ua *unreliableAggregator) Aggregate(ctx context.Context, ce coster.CostData) error {
+	ua.mux.Lock()
+	defer ua.mux.Unlock()
+	ua.calls++
+	return ua.err
+}
+
+func (ua *unreliableAggregator) fail(err error) {
+	ua.mux.Lock()
+	defer ua.mux.Unlock()
+	ua.err = err
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	now := time.Unix(0, 0)
+	ua := &unreliableAggregator{err: errors.New("bigquery unavailable")}
+	cb := NewCircuitBreaker(ua, 3, time.Minute)
+	cb.now = func() time.Time { return now }
+
+	aggregate := func() error {
+		return cb.Aggregate(context.Background(), coster.CostData{Kind: coster.ResourceCostCPU, Value: 1})
+	}
+
+	// Failures below the threshold leave the circuit closed.
+	for i := 0; i < 2; i++ {
+		if err := aggregate(); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("expected the aggregator's error, got %v", err)
+		}
+		if s := cb.State(); s != CircuitClosed {
+			t.Fatalf("expected a closed circuit after %d failures, got %d", i+1, s)
+		}
+	}
+
+	if err := aggregate(); err == nil || err == ErrCircuitOpen {
+		t.Fatalf("expected the aggregator's error, got %v", err)
+	}
+	if s := cb.State(); s != CircuitOpen {
+		t.Fatalf("expected an open circuit after 3 failures, got %d", s)
+	}
+
+	// An open circuit rejects cost data without calling the aggregator.
+	now = now.Add(30 * time.Second)
+	if err := aggregate(); err != ErrCircuitOpen {
+		t.Fatalf("expected %v, got %v", ErrCircuitOpen, err)
+	}
+	if ua.calls != 3 {
+		t.Fatalf("expected an open circuit not to call the aggregator, got %d calls", ua.calls)
+	}
+
+	// A failed probe reopens the circuit for another cooldown.
+	now = now.Add(30 * time.Second)
+	if err := aggregate(); err == nil || err == ErrCircuitOpen {
+		t.Fatalf("expected the probe to fail with the aggregator's error, got %v", err)
+	}
+	if s := cb.State(); s != CircuitOpen {
+		t.Fatalf("expected a failed probe to reopen the circuit, got %d", s)
+	}
+	if err := aggregate(); err != ErrCircuitOpen {
+		t.Fatalf("expected %v after a failed probe, got %v", ErrCircuitOpen, err)
+	}
+
+	// A successful probe closes the circuit.
+	now = now.Add(time.Minute)
+	ua.fail(nil)
+	if !cb.allow() {
+		t.Fatal("expected a probe once the cooldown elapsed")
+	}
+	if s := cb.State(); s != CircuitHalfOpen {
+		t.Fatalf("expected a half-open circuit while probing, got %d", s)
+	}
+	if cb.allow() {
+		t.Fatal("expected a single probe at a time")
+	}
+	cb.done(nil)
+	if s := cb.State(); s != CircuitClosed {
+		t.Fatalf("expected a successful probe to close the circuit, got %d", s)
+	}
+
+	if err := aggregate(); err != nil {
+		t.Fatalf("unexpected error from a closed circuit: %v", err)
+	}
+	if ua.calls != 5 {
+		t.Fatalf("expected 5 calls to the aggregator, got %d", ua.calls)
+	}
+}
+
+func TestCircuitBreakerResetsFailures(t *testing.T) {
+	ua := &unreliableAggregator{}
+	cb := NewCircuitBreaker(ua, 2, time.Minute)
+	ctx := context.Background()
+
+	for _, err := range []error{errors.New("transient"), nil, errors.New("transient")} {
+		ua.fail(err)
+		cb.Aggregate(ctx, coster.CostData{}) // nolint: errcheck, gosec
+	}
+	if s := cb.State(); s != CircuitClosed {
+		t.Fatalf("expected failures separated by a success to leave the circuit closed, got %d", s)
+	}
+}
+
+func TestReceiveCircuitOpen(t *testing.T) {
+	ua := &unreliableAggregator{err: errors.New("bigquery unavailable")}
+	pc := &PubsubConsumer{aggregator: ua, maxAttempts: 2}
+	WithCircuitBreaker(1, time.Hour)(pc)
+	data := []byte(`{"Kind": "cpu", "Value": 1}`)
+
+	if pc.receive(context.Background(), "message", data) {
+		t.Fatal("expected a failed aggregation to nack the message")
+	}
+
+	// Rejected messages are nacked without counting towards the maximum
+	// delivery attempts, so the message is never given up on.
+	for i := 0; i < 5; i++ {
+		if pc.receive(context.Background(), "message", data) {
+			t.Fatal("expected an open circuit to nack the message")
+		}
+	}
+	if ua.calls != 1 {
+		t.Fatalf("expected an open circuit not to call the aggregator, got %d calls", ua.calls)
+	}
+}
+
+func TestWithCircuitBreakerDisabled(t *testing.T) {
+	ua := &unreliableAggregator{}
+	pc := &PubsubConsumer{aggregator: ua}
+	WithCircuitBreaker(0, time.Hour)(pc)
+	if pc.aggregator != Aggregator(ua) {
+		t.Fatal("expected a zero threshold not to wrap the aggregator")
+	}
+}
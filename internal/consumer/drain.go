@@ -0,0 +1,132 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// messageReceiver delivers messages to f until ctx is cancelled, acking those
+// that f reports should be acknowledged and nacking the rest.
+type messageReceiver interface {
+	Receive(ctx context.Context, f func(ctx context.Context, id string, data []byte) bool) error
+}
+
+// subscriptionReceiver receives messages from a pubsub subscription.
+type subscriptionReceiver struct {
+	subscription *pubsub.Subscription
+}
+
+func (sr subscriptionReceiver) Receive(ctx context.Context, f func(ctx context.Context, id string, data []byte) bool) error {
+	return sr.subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		if f(ctx, msg.ID, msg.Data) {
+			msg.Ack()
+		} else {
+			msg.Nack()
+		}
+	})
+}
+
+// drainer stops a consumer once it has aggregated maxMessages messages, or
+// once no message has been received for timeout. A zero maxMessages or timeout
+// disables the respective limit.
+type drainer struct {
+	maxMessages int
+	timeout     time.Duration
+
+	mux      sync.Mutex
+	stop     func()
+	timer    *time.Timer
+	pending  int
+	consumed int
+}
+
+// start arms the drain timeout, calling stop once a limit is reached.
+func (d *drainer) start(stop func()) {
+	if d == nil {
+		return
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.stop = stop
+	if d.timeout > 0 {
+		d.timer = time.AfterFunc(d.timeout, stop)
+	}
+}
+
+// acquire reports whether a newly received message should be handled. Once
+// enough messages have been or are being aggregated to reach maxMessages,
+// further messages are rejected so that they are redelivered to a later
+// consumer. Each acquired message must be released.
+func (d *drainer) acquire() bool {
+	if d == nil {
+		return true
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.timer != nil {
+		d.timer.Reset(d.timeout)
+	}
+	if d.maxMessages > 0 && d.consumed+d.pending >= d.maxMessages {
+		return false
+	}
+	d.pending++
+	return true
+}
+
+// aggregated records that a message was aggregated.
+func (d *drainer) aggregated() {
+	if d == nil {
+		return
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.consumed++
+}
+
+// release completes the handling of a message that was acquired, stopping the
+// consumer once maxMessages have been aggregated.
+func (d *drainer) release() {
+	if d == nil {
+		return
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.pending--
+	if d.maxMessages > 0 && d.consumed >= d.maxMessages && d.stop != nil {
+		d.stop()
+	}
+}
+
+// close stops the drain timeout.
+func (d *drainer) close() {
+	if d == nil {
+		return
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
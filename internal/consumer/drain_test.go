@@ -0,0 +1,148 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeSubscription delivers a bounded set of messages and then blocks until
+// its context is cancelled.
+type fakeSubscription struct {
+	messages [][]byte
+}
+
+func (fs *fakeSubscription) Receive(ctx context.Context, f func(ctx context.Context, id string, data []byte) bool) error {
+	for i, data := range fs.messages {
+		if ctx.Err() != nil {
+			return nil
+		}
+		f(ctx, fmt.Sprintf("msg-%d", i), data)
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func fakeMessages(n int) [][]byte {
+	msgs := make([][]byte, n)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf(`{"Kind": "cpu", "Value": %d}`, i+1))
+	}
+	return msgs
+}
+
+var consumeDrainCases = []struct {
+	name         string
+	messages     [][]byte
+	maxMessages  int
+	drainTimeout time.Duration
+	expected     int
+}{
+	{
+		name:        "stops after max messages",
+		messages:    fakeMessages(5),
+		maxMessages: 3,
+		expected:    3,
+	},
+	{
+		name:         "stops once drained",
+		messages:     fakeMessages(5),
+		drainTimeout: 50 * time.Millisecond,
+		expected:     5,
+	},
+	{
+		name:         "drains before reaching max messages",
+		messages:     fakeMessages(2),
+		maxMessages:  3,
+		drainTimeout: 50 * time.Millisecond,
+		expected:     2,
+	},
+	{
+		name:         "does not count malformed messages",
+		messages:     append([][]byte{[]byte(`{`)}, fakeMessages(2)...),
+		maxMessages:  2,
+		drainTimeout: time.Minute,
+		expected:     2,
+	},
+}
+
+func TestConsumeDrain(t *testing.T) {
+	for _, tt := range consumeDrainCases {
+		t.Run(tt.name, func(t *testing.T) {
+			ra := &recordingAggregator{}
+			fs := &fakeSubscription{messages: tt.messages}
+			pc := &PubsubConsumer{
+				subscription: fs,
+				aggregator:   ra,
+				listenAddr:   "127.0.0.1:0",
+			}
+			WithDrain(tt.maxMessages, tt.drainTimeout)(pc)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			if err := pc.Consume(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ctx.Err() != nil {
+				t.Fatal("expected the consumer to stop before its context was cancelled")
+			}
+			if len(ra.data) != tt.expected {
+				t.Fatalf("expected %d aggregations, got %d", tt.expected, len(ra.data))
+			}
+		})
+	}
+}
+
+func TestDrainerRejectsPastMaxMessages(t *testing.T) {
+	stopped := false
+	d := &drainer{maxMessages: 2}
+	d.start(func() { stopped = true })
+
+	if !d.acquire() || !d.acquire() {
+		t.Fatal("expected messages to be accepted up to max messages")
+	}
+	if d.acquire() {
+		t.Fatal("expected messages in excess of max messages to be rejected")
+	}
+
+	// A failed aggregation frees its slot for a redelivered message.
+	d.release()
+	if !d.acquire() {
+		t.Fatal("expected a failed message's slot to be reusable")
+	}
+
+	d.aggregated()
+	d.release()
+	d.aggregated()
+	d.release()
+	if !stopped {
+		t.Fatal("expected the consumer to be stopped once max messages were aggregated")
+	}
+}
+
+func TestWithDrainDisabled(t *testing.T) {
+	pc := &PubsubConsumer{}
+	WithDrain(0, 0)(pc)
+	if pc.drain != nil {
+		t.Fatal("expected a consumer without limits not to drain")
+	}
+	if !pc.drain.acquire() {
+		t.Fatal("expected a consumer without limits to accept every message")
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/planetlabs/kostanza/internal/coster"
+)
+
+// MultiAggregator is an Aggregator that fans cost data out to each of its
+// aggregators. Aggregation fails if any of them fails, so that the message is
+// redelivered to all of them, including those that already aggregated it.
+type MultiAggregator []Aggregator
+
+// Aggregate aggregates the cost data with every aggregator concurrently, as
+// batching aggregators block until their batch is inserted. It returns an
+// error describing every failure.
+func (ma MultiAggregator) Aggregate(ctx context.Context, ce coster.CostData) error {
+	errs := make([]error, len(ma))
+
+	var wg sync.WaitGroup
+	for i, a := range ma {
+		wg.Add(1)
+		go func(i int, a Aggregator) {
+			defer wg.Done()
+			errs[i] = a.Aggregate(ctx, ce)
+		}(i, a)
+	}
+	wg.Wait()
+
+	failed := []string{}
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("%d of %d aggregators failed: %s", len(failed), len(ma), strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestMultiAggregator(t *testing.T) {
+	ok := &recordingAggregator{}
+	pc := &PubsubConsumer{aggregator: MultiAggregator{ok, &recordingAggregator{}}}
+	data := []byte(`{"Kind": "cpu", "Value": 1}`)
+
+	if ack, _ := pc.handleMessage(context.Background(), data); !ack {
+		t.Fatal("expected the message to be acked once every aggregator succeeded")
+	}
+	if len(ok.data) != 1 {
+		t.Fatalf("expected the cost data to be aggregated once, got %d", len(ok.data))
+	}
+}
+
+func TestMultiAggregatorFailure(t *testing.T) {
+	ok := &recordingAggregator{}
+	failing := &recordingAggregator{err: errors.New("postgres unavailable")}
+	pc := &PubsubConsumer{aggregator: MultiAggregator{ok, failing}}
+	data := []byte(`{"Kind": "cpu", "Value": 1}`)
+
+	if ack, _ := pc.handleMessage(context.Background(), data); ack {
+		t.Fatal("expected the message to be nacked when an aggregator failed")
+	}
+
+	// Every aggregator is attempted, even though one failed.
+	if len(ok.data) != 1 {
+		t.Fatalf("expected the cost data to be aggregated by the healthy aggregator, got %d", len(ok.data))
+	}
+
+	err := MultiAggregator{ok, failing}.Aggregate(context.Background(), ok.data[0])
+	if err == nil || err.Error() != "1 of 2 aggregators failed: postgres unavailable" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/planetlabs/kostanza/internal/coster"
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+// PostgresAggregator coalesces and persists coster.CostData to a PostgreSQL
+// table whose columns mirror the BigQuery schema. Rows are buffered and
+// inserted in batches, each within a single transaction.
+type PostgresAggregator struct {
+	db         *sql.DB
+	table      string
+	dimensions []string
+	batcher    *batcher
+}
+
+// NewPostgresAggregator creates a new Aggregator that inserts consumed pubsub
+// events into the named table of the database at dsn. The table is created,
+// with a column per mapper destination, if it does not yet exist, which must
+// complete within startupTimeout. Columns added to the table format since it
+// was created, such as Unit and StartTime, are added to existing tables.
+func NewPostgresAggregator(ctx context.Context, startupTimeout time.Duration, dsn string, table string, mapper *coster.Mapper, opts ...AggregatorOption) (*PostgresAggregator, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Log.Errorw("could not open postgres database", zap.Error(err))
+		return nil, err
+	}
+
+	pa := &PostgresAggregator{
+		db:         db,
+		table:      table,
+		dimensions: mapperDimensions(mapper),
+	}
+
+	sctx, cancel := coster.StartupContext(ctx, startupTimeout)
+	defer cancel()
+
+	if _, err := db.ExecContext(sctx, pa.createTableStatement()); err != nil {
+		log.Log.Errorw("could not create table", zap.Error(err))
+		return nil, coster.StartupError(sctx, err, startupTimeout)
+	}
+	if _, err := db.ExecContext(sctx, pa.addColumnsStatement()); err != nil {
+		log.Log.Errorw("could not add columns to table", zap.Error(err))
+		return nil, coster.StartupError(sctx, err, startupTimeout)
+	}
+
+	pa.batcher = newBatcher(ctx, pa.insert, opts...)
+	return pa, nil
+}
+
+func mapperDimensions(mapper *coster.Mapper) []string {
+	dims := []string{}
+	for _, m := range mapper.Entries {
+		dims = append(dims, m.Destination)
+	}
+	return dims
+}
+
+// postgresColumns are the columns of the table that precede its dimensions,
+// with their types.
+var postgresColumns = []struct {
+	name string
+	typ  string
+}{
+	{"Kind", "text"},
+	{"Strategy", "text"},
+	{"Value", "bigint"},
+	{"Unit", "text"},
+	{"UnitValue", "double precision"},
+	{"StartTime", "timestamptz"},
+	{"EndTime", "timestamptz"},
+	{"Dimensions", "jsonb"},
+}
+
+// columns returns the quoted column names of the table in insertion order.
+func (pa *PostgresAggregator) columns() []string {
+	cols := []string{}
+	for _, c := range postgresColumns {
+		cols = append(cols, c.name)
+	}
+	for _, d := range pa.dimensions {
+		cols = append(cols, "Dimensions_"+d)
+	}
+
+	for i, c := range cols {
+		cols[i] = pq.QuoteIdentifier(c)
+	}
+	return cols
+}
+
+func (pa *PostgresAggregator) createTableStatement() string {
+	cols := pa.columns()
+	defs := []string{}
+	for i, c := range postgresColumns {
+		defs = append(defs, cols[i]+" "+c.typ)
+	}
+	for _, c := range cols[len(postgresColumns):] {
+		defs = append(defs, c+" text")
+	}
+
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", pq.QuoteIdentifier(pa.table), strings.Join(defs, ", "))
+}
+
+// addColumnsStatement adds the columns preceding the dimensions to tables
+// created before they were introduced, such as Unit and StartTime.
+func (pa *PostgresAggregator) addColumnsStatement() string {
+	defs := []string{}
+	for _, c := range postgresColumns {
+		defs = append(defs, fmt.Sprintf("ADD COLUMN IF NOT EXISTS %s %s", pq.QuoteIdentifier(c.name), c.typ))
+	}
+
+	return fmt.Sprintf("ALTER TABLE %s %s", pq.QuoteIdentifier(pa.table), strings.Join(defs, ", "))
+}
+
+func (pa *PostgresAggregator) insertStatement() string {
+	cols := pa.columns()
+	params := make([]string, len(cols))
+	for i := range params {
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", pq.QuoteIdentifier(pa.table), strings.Join(cols, ", "), strings.Join(params, ", "))
+}
+
+// values returns the insertion parameters for the provided cost data, in the
+// same order as the table's columns.
+func (pa *PostgresAggregator) values(cd coster.CostData) ([]interface{}, error) {
+	dims, err := json.Marshal(cd.Dimensions)
+	if err != nil {
+		return nil, err
+	}
+
+	// The unit is left null when the cost data was not converted to one.
+	var unit, unitValue interface{}
+	if cd.Unit != "" {
+		unit, unitValue = string(cd.Unit), cd.UnitValue
+	}
+
+	// Likewise the start time, which cost data predating it lacks.
+	var start interface{}
+	if !cd.StartTime.IsZero() {
+		start = cd.StartTime
+	}
+
+	vals := []interface{}{string(cd.Kind), cd.Strategy, cd.Value, unit, unitValue, start, cd.EndTime, string(dims)}
+	for _, d := range pa.dimensions {
+		vals = append(vals, cd.Dimensions[d])
+	}
+	return vals, nil
+}
+
+// Aggregate inserts coster.CostData into PostgreSQL. It blocks until the batch
+// containing the data has been inserted, returning any error inserting it.
+func (pa *PostgresAggregator) Aggregate(ctx context.Context, ce coster.CostData) error {
+	log.Log.Debugw("aggregating object", zap.Object("CostData", &ce))
+	return pa.batcher.add(ctx, ce)
+}
+
+// insert inserts the batch using a prepared statement within a transaction,
+// so that either every row or no row in the batch is inserted.
+func (pa *PostgresAggregator) insert(ctx context.Context, batch []coster.CostData) []error {
+	log.Log.Debugw("inserting batch", zap.Int("rows", len(batch)))
+	if err := pa.insertTx(ctx, batch); err != nil {
+		log.Log.Errorw("could not insert rows", zap.Error(err))
+		return batchErrors(err, len(batch))
+	}
+	return nil
+}
+
+func (pa *PostgresAggregator) insertTx(ctx context.Context, batch []coster.CostData) error {
+	tx, err := pa.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not begin transaction")
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pa.insertStatement())
+	if err != nil {
+		tx.Rollback() // nolint: errcheck, gosec
+		return errors.Wrap(err, "could not prepare insert")
+	}
+
+	for _, cd := range batch {
+		vals, err := pa.values(cd)
+		if err != nil {
+			tx.Rollback() // nolint: errcheck, gosec
+			return errors.Wrap(err, "could not prepare row")
+		}
+
+		if _, err := stmt.ExecContext(ctx, vals...); err != nil {
+			tx.Rollback() // nolint: errcheck, gosec
+			return errors.Wrap(err, "could not insert row")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "could not commit transaction")
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+
+	"github.com/planetlabs/kostanza/internal/coster"
+)
+
+var testPostgresMapper = &coster.Mapper{
+	Entries: []coster.Mapping{
+		coster.Mapping{Destination: "service"},
+		coster.Mapping{Destination: "component"},
+	},
+}
+
+func TestPostgresStatements(t *testing.T) {
+	pa := &PostgresAggregator{table: "costs", dimensions: mapperDimensions(testPostgresMapper)}
+
+	create := `CREATE TABLE IF NOT EXISTS "costs" ("Kind" text, "Strategy" text, "Value" bigint, "Unit" text, "UnitValue" double precision, "StartTime" timestamptz, "EndTime" timestamptz, "Dimensions" jsonb, "Dimensions_service" text, "Dimensions_component" text)`
+	if got := pa.createTableStatement(); got != create {
+		t.Fatalf("expected create statement\n%s\ngot\n%s", create, got)
+	}
+
+	alter := `ALTER TABLE "costs" ADD COLUMN IF NOT EXISTS "Kind" text, ADD COLUMN IF NOT EXISTS "Strategy" text, ADD COLUMN IF NOT EXISTS "Value" bigint, ADD COLUMN IF NOT EXISTS "Unit" text, ADD COLUMN IF NOT EXISTS "UnitValue" double precision, ADD COLUMN IF NOT EXISTS "StartTime" timestamptz, ADD COLUMN IF NOT EXISTS "EndTime" timestamptz, ADD COLUMN IF NOT EXISTS "Dimensions" jsonb`
+	if got := pa.addColumnsStatement(); got != alter {
+		t.Fatalf("expected alter statement\n%s\ngot\n%s", alter, got)
+	}
+
+	insert := `INSERT INTO "costs" ("Kind", "Strategy", "Value", "Unit", "UnitValue", "StartTime", "EndTime", "Dimensions", "Dimensions_service", "Dimensions_component") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	if got := pa.insertStatement(); got != insert {
+		t.Fatalf("expected insert statement\n%s\ngot\n%s", insert, got)
+	}
+}
+
+var postgresValuesCases = []struct {
+	name     string
+	unit     coster.CostUnit
+	start    time.Time
+	expected []interface{}
+}{
+	{
+		name:     "cost data without a unit or start time leaves them null",
+		expected: []interface{}{"weighted", "WeightedPricingStrategy", int64(42000000), nil, nil, nil, time.Unix(1542000000, 0), `{"service":"foo"}`, "foo", ""},
+	},
+	{
+		name:     "cost data with a unit",
+		unit:     coster.CostUnitDollars,
+		expected: []interface{}{"weighted", "WeightedPricingStrategy", int64(42000000), "dollars", 0.42, nil, time.Unix(1542000000, 0), `{"service":"foo"}`, "foo", ""},
+	},
+	{
+		name:     "cost data with a start time",
+		start:    time.Unix(1541996400, 0),
+		expected: []interface{}{"weighted", "WeightedPricingStrategy", int64(42000000), nil, nil, time.Unix(1541996400, 0), time.Unix(1542000000, 0), `{"service":"foo"}`, "foo", ""},
+	},
+}
+
+func TestPostgresValues(t *testing.T) {
+	pa := &PostgresAggregator{table: "costs", dimensions: mapperDimensions(testPostgresMapper)}
+
+	for _, tt := range postgresValuesCases {
+		t.Run(tt.name, func(t *testing.T) {
+			cd := coster.CostData{
+				Kind:       coster.ResourceCostWeighted,
+				Strategy:   coster.StrategyNameWeighted,
+				Value:      42000000,
+				Dimensions: map[string]string{"service": "foo"},
+				StartTime:  tt.start,
+				EndTime:    time.Unix(1542000000, 0),
+			}
+			if tt.unit != "" {
+				cd.Unit = tt.unit
+				cd.UnitValue = tt.unit.Convert(cd.Value)
+			}
+
+			vals, err := pa.values(cd)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := deep.Equal(vals, tt.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
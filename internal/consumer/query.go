@@ -0,0 +1,218 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+
+	"github.com/planetlabs/kostanza/internal/coster"
+)
+
+// DefaultQueryLimit is the default number of dimension values a CostQuery
+// returns.
+const DefaultQueryLimit = 10
+
+// validDimension matches the mapping destinations that may be queried. The
+// dimension names a column, so unlike the other query inputs it can not be a
+// query parameter.
+var validDimension = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// CostQuery selects the total cost of the values of a dimension over a time
+// range, e.g. the ten most expensive services over the last day.
+type CostQuery struct {
+	// Dimension is the mapping destination costs are grouped by.
+	Dimension string
+	// Kind limits the query to cost data of one kind. As strategies price the
+	// same resources in different ways, summing every kind counts costs more
+	// than once.
+	Kind coster.ResourceCostKind
+	// Start and End bound the EndTime of the cost data summed. Start is
+	// inclusive; End is exclusive.
+	Start time.Time
+	End   time.Time
+	// Limit is the maximum number of dimension values returned. Defaults to
+	// DefaultQueryLimit.
+	Limit int
+}
+
+// DimensionCost is the total cost of one value of a dimension.
+type DimensionCost struct {
+	// Value is the dimension value, empty for cost data without the dimension.
+	Value string
+	// Cost is the total cost in microcents.
+	Cost int64
+}
+
+// sql returns the standard SQL and parameters of the query against the fully
+// qualified table provided.
+func (q CostQuery) sql(table string) (string, []bigquery.QueryParameter, error) {
+	if !validDimension.MatchString(q.Dimension) {
+		return "", nil, errors.Errorf("invalid dimension %q", q.Dimension)
+	}
+	if !q.End.After(q.Start) {
+		return "", nil, errors.New("query end must be after its start")
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+
+	sql := fmt.Sprintf(
+		"SELECT IFNULL(Dimensions_%s, '') AS value, SUM(Value) AS cost "+
+			"FROM `%s` "+
+			"WHERE Kind = @kind AND EndTime >= @start AND EndTime < @end "+
+			"GROUP BY value "+
+			"ORDER BY cost DESC, value "+
+			"LIMIT %d",
+		q.Dimension, table, limit,
+	)
+	params := []bigquery.QueryParameter{
+		{Name: "kind", Value: string(q.Kind)},
+		{Name: "start", Value: q.Start},
+		{Name: "end", Value: q.End},
+	}
+	return sql, params, nil
+}
+
+// rowIterator iterates over query results, as implemented by
+// bigquery.RowIterator.
+type rowIterator interface {
+	Next(dst interface{}) error
+}
+
+// queryReader runs queries, returning their results.
+type queryReader interface {
+	Read(ctx context.Context, sql string, params []bigquery.QueryParameter) (rowIterator, error)
+	Close() error
+}
+
+// clientQueryReader runs queries with a bigquery.Client.
+type clientQueryReader struct {
+	client *bigquery.Client
+}
+
+func (cr clientQueryReader) Read(ctx context.Context, sql string, params []bigquery.QueryParameter) (rowIterator, error) {
+	q := cr.client.Query(sql)
+	q.Parameters = params
+	return q.Read(ctx)
+}
+
+func (cr clientQueryReader) Close() error {
+	return cr.client.Close()
+}
+
+// BigQueryReporter reports on the cost data aggregated into a BigQuery table
+// by a BigQueryAggregator.
+type BigQueryReporter struct {
+	table  string
+	reader queryReader
+}
+
+// NewBigQueryReporter returns a BigQueryReporter querying the named BigQuery
+// dataset and table.
+func NewBigQueryReporter(ctx context.Context, project string, dataset string, table string) (*BigQueryReporter, error) {
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create bigquery client")
+	}
+	return newBigQueryReporter(fmt.Sprintf("%s.%s.%s", project, dataset, table), clientQueryReader{client}), nil
+}
+
+func newBigQueryReporter(table string, reader queryReader) *BigQueryReporter {
+	return &BigQueryReporter{table: table, reader: reader}
+}
+
+// Close closes the BigQuery client used to run queries.
+func (br *BigQueryReporter) Close() error {
+	return br.reader.Close()
+}
+
+// CostByDimension returns the total cost of each value of the query's
+// dimension, most expensive first. Grouping and ordering are delegated to
+// the query; rows are returned in the order BigQuery reads them.
+func (br *BigQueryReporter) CostByDimension(ctx context.Context, q CostQuery) ([]DimensionCost, error) {
+	sql, params, err := q.sql(br.table)
+	if err != nil {
+		return nil, err
+	}
+
+	it, err := br.reader.Read(ctx, sql, params)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not query costs")
+	}
+
+	costs := []DimensionCost{}
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			return costs, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read query results")
+		}
+
+		dc, err := dimensionCost(row)
+		if err != nil {
+			return nil, err
+		}
+		costs = append(costs, dc)
+	}
+}
+
+// dimensionCost converts a row of query results into a DimensionCost.
+func dimensionCost(row []bigquery.Value) (DimensionCost, error) {
+	if len(row) != 2 {
+		return DimensionCost{}, errors.Errorf("expected 2 columns, got %d", len(row))
+	}
+
+	value, ok := row[0].(string)
+	if !ok {
+		return DimensionCost{}, errors.Errorf("unexpected dimension value %#v", row[0])
+	}
+
+	// SUM is NULL only if every summed Value is, which is treated as zero.
+	cost, ok := row[1].(int64)
+	if !ok && row[1] != nil {
+		return DimensionCost{}, errors.Errorf("unexpected cost %#v", row[1])
+	}
+	return DimensionCost{Value: value, Cost: cost}, nil
+}
+
+// WriteCostReport writes the costs of a dimension's values to w as a table,
+// converting them to the provided unit.
+func WriteCostReport(w io.Writer, dimension string, unit coster.CostUnit, costs []DimensionCost) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tCOST (%s)\n", strings.ToUpper(dimension), unit) // nolint: errcheck, gosec
+	for _, dc := range costs {
+		value := dc.Value
+		if value == "" {
+			value = "(none)"
+		}
+		fmt.Fprintf(tw, "%s\t%.2f\n", value, unit.Convert(dc.Cost)) // nolint: errcheck, gosec
+	}
+	return tw.Flush()
+}
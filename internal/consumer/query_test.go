@@ -0,0 +1,203 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/go-test/deep"
+	"google.golang.org/api/iterator"
+
+	"github.com/planetlabs/kostanza/internal/coster"
+)
+
+// fakeRows iterates over recorded query results.
+type fakeRows [][]bigquery.Value
+
+func (fr *fakeRows) Next(dst interface{}) error {
+	if len(*fr) == 0 {
+		return iterator.Done
+	}
+	*(dst.(*[]bigquery.Value)) = (*fr)[0]
+	*fr = (*fr)[1:]
+	return nil
+}
+
+// fakeQueryReader records the queries it runs, returning rows for each.
+type fakeQueryReader struct {
+	rows   fakeRows
+	sql    string
+	params []bigquery.QueryParameter
+	closed bool
+}
+
+func (fr *fakeQueryReader) Read(ctx context.Context, sql string, params []bigquery.QueryParameter) (rowIterator, error) {
+	fr.sql = sql
+	fr.params = params
+	return &fr.rows, nil
+}
+
+func (fr *fakeQueryReader) Close() error {
+	fr.closed = true
+	return nil
+}
+
+var testQueryStart = time.Date(2018, 11, 12, 0, 0, 0, 0, time.UTC)
+
+func TestCostByDimension(t *testing.T) {
+	fr := &fakeQueryReader{rows: fakeRows{
+		{"checkout", int64(3000)},
+		{"search", int64(2000)},
+		{"", int64(1000)},
+		{"idle", nil},
+	}}
+	br := newBigQueryReporter("project.dataset.costs", fr)
+
+	costs, err := br.CostByDimension(context.Background(), CostQuery{
+		Dimension: "service",
+		Kind:      coster.ResourceCostWeighted,
+		Start:     testQueryStart,
+		End:       testQueryStart.Add(24 * time.Hour),
+		Limit:     5,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []DimensionCost{
+		{Value: "checkout", Cost: 3000},
+		{Value: "search", Cost: 2000},
+		{Value: "", Cost: 1000},
+		{Value: "idle", Cost: 0},
+	}
+	if diff := deep.Equal(costs, expected); diff != nil {
+		t.Error(diff)
+	}
+
+	expectedSQL := "SELECT IFNULL(Dimensions_service, '') AS value, SUM(Value) AS cost " +
+		"FROM `project.dataset.costs` " +
+		"WHERE Kind = @kind AND EndTime >= @start AND EndTime < @end " +
+		"GROUP BY value " +
+		"ORDER BY cost DESC, value " +
+		"LIMIT 5"
+	if fr.sql != expectedSQL {
+		t.Errorf("expected query %q, got %q", expectedSQL, fr.sql)
+	}
+
+	expectedParams := []bigquery.QueryParameter{
+		{Name: "kind", Value: "weighted"},
+		{Name: "start", Value: testQueryStart},
+		{Name: "end", Value: testQueryStart.Add(24 * time.Hour)},
+	}
+	if diff := deep.Equal(fr.params, expectedParams); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// TestCostByDimensionPreservesQueryOrder ensures the reporter neither groups
+// nor reorders rows, as both are left to the query's GROUP BY and ORDER BY.
+func TestCostByDimensionPreservesQueryOrder(t *testing.T) {
+	fr := &fakeQueryReader{rows: fakeRows{
+		{"search", int64(2000)},
+		{"checkout", int64(3000)},
+		{"search", int64(1000)},
+	}}
+	q := CostQuery{Dimension: "service", Start: testQueryStart, End: testQueryStart.Add(time.Hour)}
+	costs, err := newBigQueryReporter("project.dataset.costs", fr).CostByDimension(context.Background(), q)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []DimensionCost{
+		{Value: "search", Cost: 2000},
+		{Value: "checkout", Cost: 3000},
+		{Value: "search", Cost: 1000},
+	}
+	if diff := deep.Equal(costs, expected); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestBigQueryReporterClose(t *testing.T) {
+	fr := &fakeQueryReader{}
+	if err := newBigQueryReporter("project.dataset.costs", fr).Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !fr.closed {
+		t.Fatal("expected closing the reporter to close its reader")
+	}
+}
+
+var invalidCostQueryCases = []struct {
+	name  string
+	query CostQuery
+}{
+	{
+		name:  "invalid dimension",
+		query: CostQuery{Dimension: "service` UNION ALL SELECT", Start: testQueryStart, End: testQueryStart.Add(time.Hour)},
+	},
+	{
+		name:  "empty range",
+		query: CostQuery{Dimension: "service", Start: testQueryStart, End: testQueryStart},
+	},
+}
+
+func TestCostByDimensionInvalidQuery(t *testing.T) {
+	for _, tt := range invalidCostQueryCases {
+		t.Run(tt.name, func(t *testing.T) {
+			fr := &fakeQueryReader{}
+			if _, err := newBigQueryReporter("project.dataset.costs", fr).CostByDimension(context.Background(), tt.query); err == nil {
+				t.Fatal("expected an invalid query to be rejected")
+			}
+			if fr.sql != "" {
+				t.Fatalf("expected an invalid query not to run, ran %q", fr.sql)
+			}
+		})
+	}
+}
+
+func TestCostByDimensionDefaultLimit(t *testing.T) {
+	fr := &fakeQueryReader{}
+	q := CostQuery{Dimension: "service", Start: testQueryStart, End: testQueryStart.Add(time.Hour)}
+	if _, err := newBigQueryReporter("project.dataset.costs", fr).CostByDimension(context.Background(), q); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if suffix := "LIMIT 10"; fr.sql[len(fr.sql)-len(suffix):] != suffix {
+		t.Fatalf("expected the default limit, got %q", fr.sql)
+	}
+}
+
+func TestWriteCostReport(t *testing.T) {
+	b := &bytes.Buffer{}
+	costs := []DimensionCost{
+		{Value: "checkout", Cost: 123456789012},
+		{Value: "", Cost: 50000000},
+	}
+	if err := WriteCostReport(b, "service", coster.CostUnitDollars, costs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "" +
+		"SERVICE   COST (dollars)\n" +
+		"checkout  1234.57\n" +
+		"(none)    0.50\n"
+	if b.String() != expected {
+		t.Fatalf("expected report:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/planetlabs/kostanza/internal/coster"
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+const (
+	// gcsScheme prefixes replay inputs that are read from Google Cloud
+	// Storage, e.g. gs://bucket/path/to/costs.json.
+	gcsScheme = "gs://"
+	// maxReplayLineSize is the largest record Replay will decode.
+	maxReplayLineSize = 1024 * 1024
+)
+
+// OpenReplayInput opens the provided path for replay. Paths of the form
+// gs://bucket/object are read from Google Cloud Storage, and all others from
+// the local filesystem.
+func OpenReplayInput(ctx context.Context, path string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(path, gcsScheme) {
+		f, err := os.Open(path) // nolint: gosec
+		return f, errors.Wrap(err, "could not open replay input")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(path, gcsScheme), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.Errorf("invalid gcs object %q, expected gs://bucket/object", path)
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create storage client")
+	}
+
+	r, err := client.Bucket(parts[0]).Object(parts[1]).NewReader(ctx)
+	if err != nil {
+		client.Close() // nolint: errcheck, gosec
+		return nil, errors.Wrapf(err, "could not read %s", path)
+	}
+	return &gcsReader{Reader: r, client: client}, nil
+}
+
+// gcsReader closes the storage client along with the object it reads.
+type gcsReader struct {
+	*storage.Reader
+	client *storage.Client
+}
+
+func (g *gcsReader) Close() error {
+	err := g.Reader.Close()
+	if cerr := g.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Replay decodes cost data from r as newline delimited JSON, as written by the
+// file and stdout exporters, and aggregates each record using the provided
+// aggregator. Up to concurrency records are aggregated at once so that
+// batching aggregators can fill their batches. Records that cannot be decoded
+// are logged and skipped, as in pubsub consumption, while the first
+// aggregation failure stops the replay. Replay returns the number of records
+// aggregated, along with the context's error if it was interrupted.
+func Replay(ctx context.Context, r io.Reader, aggregator Aggregator, concurrency int) (int, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, concurrency)
+	var replayed int64
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxReplayLineSize)
+
+	line := 0
+scan:
+	for scanner.Scan() {
+		line++
+		data := scanner.Bytes()
+		if len(strings.TrimSpace(string(data))) == 0 {
+			continue
+		}
+
+		cd, err := coster.UnmarshalCostData(data)
+		if err != nil {
+			log.Log.Errorw("could not decode cost data", zap.Int("line", line), zap.Error(err))
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-gctx.Done():
+			break scan
+		}
+
+		l := line
+		g.Go(func() error {
+			defer func() { <-sem }()
+			if err := aggregator.Aggregate(gctx, cd); err != nil {
+				return errors.Wrapf(err, "could not aggregate cost data on line %d", l)
+			}
+			atomic.AddInt64(&replayed, 1)
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return int(replayed), err
+	}
+	if err := ctx.Err(); err != nil {
+		return int(replayed), errors.Wrap(err, "replay interrupted")
+	}
+	return int(replayed), errors.Wrap(scanner.Err(), "could not read replay input")
+}
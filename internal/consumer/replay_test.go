@@ -0,0 +1,145 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+
+	"github.com/planetlabs/kostanza/internal/coster"
+)
+
+const replayInput = `{"Kind":"cpu","Value":1,"Dimensions":{"service":"web"}}
+{"Kind":"memory","Value":2,"Dimensions":{"service":"web"}}
+
+{"Kind":"cpu","Value":
+{"Kind":"cpu","Value":3,"Dimensions":{"service":"db"}}
+`
+
+// recordingAggregator records the cost data it aggregates, failing with err
+// if it is set.
+type recordingAggregator struct {
+	mux  sync.Mutex
+	data []coster.CostData
+	err  error
+}
+
+func (ra *recordingAggregator) Aggregate(ctx context.Context, cd coster.CostData) error {
+	ra.mux.Lock()
+	defer ra.mux.Unlock()
+	if ra.err != nil {
+		return ra.err
+	}
+	ra.data = append(ra.data, cd)
+	return nil
+}
+
+func writeReplayInput(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "costs.json")
+	if err := ioutil.WriteFile(path, []byte(replayInput), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReplay(t *testing.T) {
+	path := writeReplayInput(t)
+	defer os.RemoveAll(filepath.Dir(path)) // nolint: errcheck
+
+	r, err := OpenReplayInput(context.Background(), path)
+	if err != nil {
+		t.Fatalf("unexpected error opening replay input: %v", err)
+	}
+	defer r.Close() // nolint: errcheck
+
+	ra := &recordingAggregator{}
+	n, err := Replay(context.Background(), r, ra, 2)
+	if err != nil {
+		t.Fatalf("unexpected error replaying: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 records to be replayed, got %d", n)
+	}
+
+	sort.Slice(ra.data, func(i, j int) bool { return ra.data[i].Value < ra.data[j].Value })
+	expected := []coster.CostData{
+		coster.CostData{Kind: coster.ResourceCostCPU, Value: 1, Dimensions: map[string]string{"service": "web"}},
+		coster.CostData{Kind: coster.ResourceCostMemory, Value: 2, Dimensions: map[string]string{"service": "web"}},
+		coster.CostData{Kind: coster.ResourceCostCPU, Value: 3, Dimensions: map[string]string{"service": "db"}},
+	}
+	if diff := deep.Equal(ra.data, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestReplayBigQuery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fu := &fakeUploader{}
+	ba := newBigQueryAggregator(ctx, nil, fu, WithBatching(3, time.Hour))
+
+	n, err := Replay(ctx, strings.NewReader(replayInput), ba, 3)
+	if err != nil {
+		t.Fatalf("unexpected error replaying: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 records to be replayed, got %d", n)
+	}
+	if diff := deep.Equal(fu.batchSizes(), []int{3}); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestReplayAggregationFailure(t *testing.T) {
+	ra := &recordingAggregator{err: errors.New("unavailable")}
+	if _, err := Replay(context.Background(), strings.NewReader(replayInput), ra, 1); err == nil {
+		t.Fatal("expected aggregation failures to stop the replay")
+	}
+}
+
+func TestReplayInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ra := &recordingAggregator{}
+	if _, err := Replay(ctx, strings.NewReader(replayInput), ra, 1); errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected an interrupted replay to return the context's error, got %v", err)
+	}
+}
+
+func TestOpenReplayInputInvalidObject(t *testing.T) {
+	for _, path := range []string{"gs://", "gs://bucket", "gs://bucket/"} {
+		if _, err := OpenReplayInput(context.Background(), path); err == nil {
+			t.Errorf("expected %q to be rejected", path)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	gax "github.com/googleapis/gax-go"
+	"go.uber.org/zap"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+const (
+	// DefaultAckDeadline is the default ack deadline of auto-provisioned
+	// subscriptions. It is well above the pubsub default of ten seconds so
+	// that slow batch inserts do not cause messages to be redelivered.
+	DefaultAckDeadline = time.Minute
+	// DefaultRetentionDuration is the default duration auto-provisioned
+	// subscriptions retain unacknowledged messages for.
+	DefaultRetentionDuration = 7 * 24 * time.Hour
+	// DefaultSubscriptionExpiration is the default period of inactivity
+	// after which auto-provisioned subscriptions are deleted.
+	DefaultSubscriptionExpiration = 31 * 24 * time.Hour
+)
+
+// SubscriptionSettings configures subscriptions provisioned by a
+// PubsubConsumer. They are only applied when the subscription is created.
+type SubscriptionSettings struct {
+	// AckDeadline is the time pubsub waits for a message to be acknowledged
+	// before redelivering it. Zero uses the pubsub default.
+	AckDeadline time.Duration
+	// RetentionDuration is how long unacknowledged messages are retained.
+	// Zero uses the pubsub default.
+	RetentionDuration time.Duration
+	// Expiration is the period of inactivity after which the subscription is
+	// deleted. Zero never expires the subscription.
+	Expiration time.Duration
+}
+
+// DefaultSubscriptionSettings returns the settings subscriptions are
+// provisioned with unless otherwise configured.
+func DefaultSubscriptionSettings() SubscriptionSettings {
+	return SubscriptionSettings{
+		AckDeadline:       DefaultAckDeadline,
+		RetentionDuration: DefaultRetentionDuration,
+		Expiration:        DefaultSubscriptionExpiration,
+	}
+}
+
+// subscriptionAdmin gets and creates subscriptions, as implemented by the
+// pubsub apiv1 SubscriberClient. It is used in place of pubsub.Client as the
+// latter cannot configure subscription expiration.
+type subscriptionAdmin interface {
+	GetSubscription(ctx context.Context, req *pubsubpb.GetSubscriptionRequest, opts ...gax.CallOption) (*pubsubpb.Subscription, error)
+	CreateSubscription(ctx context.Context, req *pubsubpb.Subscription, opts ...gax.CallOption) (*pubsubpb.Subscription, error)
+}
+
+// toProto returns the subscription named name on topic configured with these
+// settings.
+func (s SubscriptionSettings) toProto(name, topic string) *pubsubpb.Subscription {
+	sub := &pubsubpb.Subscription{
+		Name:               name,
+		Topic:              topic,
+		AckDeadlineSeconds: int32(s.AckDeadline / time.Second),
+		// An expiration policy without a ttl never expires.
+		ExpirationPolicy: &pubsubpb.ExpirationPolicy{},
+	}
+	if s.RetentionDuration > 0 {
+		sub.MessageRetentionDuration = ptypes.DurationProto(s.RetentionDuration)
+	}
+	if s.Expiration > 0 {
+		sub.ExpirationPolicy.Ttl = ptypes.DurationProto(s.Expiration)
+	}
+	return sub
+}
+
+func createSubscriptionIfNotExists(ctx context.Context, admin subscriptionAdmin, project, subscriptionName, topicName string, settings SubscriptionSettings) error {
+	name := fmt.Sprintf("projects/%s/subscriptions/%s", project, subscriptionName)
+
+	_, err := admin.GetSubscription(ctx, &pubsubpb.GetSubscriptionRequest{Subscription: name})
+	if err == nil {
+		return nil
+	} else if status.Code(err) != codes.NotFound {
+		log.Log.Errorw("could not get subscription", zap.Error(err))
+		return err
+	}
+
+	topic := fmt.Sprintf("projects/%s/topics/%s", project, topicName)
+	if _, err := admin.CreateSubscription(ctx, settings.toProto(name, topic)); err != nil {
+		log.Log.Errorw("could not create subscription", zap.Error(err))
+		return err
+	}
+
+	log.Log.Infow("pubsub subscription did not exist, created it", zap.String("subscription", subscriptionName))
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/golang/protobuf/ptypes"
+	gax "github.com/googleapis/gax-go"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeSubscriptionAdmin records the subscriptions it is asked to create.
+// Subscriptions in Existing are reported to exist.
+type fakeSubscriptionAdmin struct {
+	Existing map[string]bool
+	Created  []*pubsubpb.Subscription
+}
+
+func (fa *fakeSubscriptionAdmin) GetSubscription(ctx context.Context, req *pubsubpb.GetSubscriptionRequest, opts ...gax.CallOption) (*pubsubpb.Subscription, error) {
+	if !fa.Existing[req.Subscription] {
+		return nil, status.Error(codes.NotFound, "not found")
+	}
+	return &pubsubpb.Subscription{Name: req.Subscription}, nil
+}
+
+func (fa *fakeSubscriptionAdmin) CreateSubscription(ctx context.Context, req *pubsubpb.Subscription, opts ...gax.CallOption) (*pubsubpb.Subscription, error) {
+	fa.Created = append(fa.Created, req)
+	return req, nil
+}
+
+var createSubscriptionCases = []struct {
+	name     string
+	settings SubscriptionSettings
+	expected *pubsubpb.Subscription
+}{
+	{
+		name:     "default settings",
+		settings: DefaultSubscriptionSettings(),
+		expected: &pubsubpb.Subscription{
+			Name:                     "projects/p/subscriptions/costs",
+			Topic:                    "projects/p/topics/costs",
+			AckDeadlineSeconds:       60,
+			MessageRetentionDuration: ptypes.DurationProto(7 * 24 * time.Hour),
+			ExpirationPolicy:         &pubsubpb.ExpirationPolicy{Ttl: ptypes.DurationProto(31 * 24 * time.Hour)},
+		},
+	},
+	{
+		name: "custom settings",
+		settings: SubscriptionSettings{
+			AckDeadline:       5 * time.Minute,
+			RetentionDuration: time.Hour,
+			Expiration:        48 * time.Hour,
+		},
+		expected: &pubsubpb.Subscription{
+			Name:                     "projects/p/subscriptions/costs",
+			Topic:                    "projects/p/topics/costs",
+			AckDeadlineSeconds:       300,
+			MessageRetentionDuration: ptypes.DurationProto(time.Hour),
+			ExpirationPolicy:         &pubsubpb.ExpirationPolicy{Ttl: ptypes.DurationProto(48 * time.Hour)},
+		},
+	},
+	{
+		name:     "zero settings never expire",
+		settings: SubscriptionSettings{},
+		expected: &pubsubpb.Subscription{
+			Name:             "projects/p/subscriptions/costs",
+			Topic:            "projects/p/topics/costs",
+			ExpirationPolicy: &pubsubpb.ExpirationPolicy{},
+		},
+	},
+}
+
+func TestCreateSubscriptionIfNotExists(t *testing.T) {
+	for _, tt := range createSubscriptionCases {
+		t.Run(tt.name, func(t *testing.T) {
+			fa := &fakeSubscriptionAdmin{}
+			if err := createSubscriptionIfNotExists(context.Background(), fa, "p", "costs", "costs", tt.settings); err != nil {
+				t.Fatalf("unexpected error creating subscription: %v", err)
+			}
+			if diff := deep.Equal(fa.Created, []*pubsubpb.Subscription{tt.expected}); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestCreateSubscriptionIfNotExistsExisting(t *testing.T) {
+	fa := &fakeSubscriptionAdmin{Existing: map[string]bool{"projects/p/subscriptions/costs": true}}
+	if err := createSubscriptionIfNotExists(context.Background(), fa, "p", "costs", "costs", DefaultSubscriptionSettings()); err != nil {
+		t.Fatalf("unexpected error creating subscription: %v", err)
+	}
+	if len(fa.Created) != 0 {
+		t.Fatalf("expected existing subscriptions not to be created, got %v", fa.Created)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+	"go.uber.org/zap"
+	bq "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+
+	"github.com/planetlabs/kostanza/internal/coster"
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+const (
+	// PartitionDay partitions provisioned tables by the day of EndTime.
+	PartitionDay = "DAY"
+	// PartitionHour partitions provisioned tables by the hour of EndTime.
+	PartitionHour = "HOUR"
+
+	// MaxClusterDimensions is the maximum number of columns BigQuery clusters a
+	// table by.
+	MaxClusterDimensions = 4
+
+	// bigQueryEndpoint is the BigQuery API endpoint tables are provisioned
+	// through.
+	bigQueryEndpoint = "https://www.googleapis.com/bigquery/v2/"
+)
+
+// TableLayout configures how a provisioned BigQuery table is laid out, so that
+// queries filtering by time or by dimension scan less of it. Tables that
+// already exist are left untouched.
+type TableLayout struct {
+	// Partitioning is the granularity EndTime partitions are created at,
+	// either PartitionDay or PartitionHour. Defaults to PartitionDay.
+	Partitioning string
+	// ClusterDimensions is the number of mapper destinations, in mapping
+	// order, the table is clustered by. At most MaxClusterDimensions.
+	ClusterDimensions int
+}
+
+// Validate returns an error if the layout can not be provisioned.
+func (tl TableLayout) Validate() error {
+	switch tl.Partitioning {
+	case "", PartitionDay, PartitionHour:
+	default:
+		return fmt.Errorf("unsupported table partitioning %q", tl.Partitioning)
+	}
+	if tl.ClusterDimensions < 0 || tl.ClusterDimensions > MaxClusterDimensions {
+		return fmt.Errorf("tables may be clustered by 0 to %d dimensions, not %d", MaxClusterDimensions, tl.ClusterDimensions)
+	}
+	return nil
+}
+
+// resource returns the BigQuery table resource provisioned for the provided
+// mapper.
+func (tl TableLayout) resource(mapper *coster.Mapper) *bq.Table {
+	partitioning := tl.Partitioning
+	if partitioning == "" {
+		partitioning = PartitionDay
+	}
+
+	t := &bq.Table{
+		Schema:           tableSchema(MapperToSchema(mapper)),
+		TimePartitioning: &bq.TimePartitioning{Type: partitioning, Field: "EndTime"},
+	}
+
+	fields := []string{}
+	seen := map[string]bool{}
+	for _, m := range mapper.Entries {
+		if len(fields) == tl.ClusterDimensions {
+			break
+		}
+		if seen[m.Destination] {
+			continue
+		}
+		seen[m.Destination] = true
+		fields = append(fields, "Dimensions_"+m.Destination)
+	}
+	if len(fields) > 0 {
+		t.Clustering = &bq.Clustering{Fields: fields}
+	}
+
+	return t
+}
+
+// tableSchema converts a bigquery.Schema into its BigQuery API representation.
+func tableSchema(s bigquery.Schema) *bq.TableSchema {
+	ts := &bq.TableSchema{}
+	for _, f := range s {
+		mode := "NULLABLE"
+		if f.Repeated {
+			mode = "REPEATED"
+		} else if f.Required {
+			mode = "REQUIRED"
+		}
+
+		ts.Fields = append(ts.Fields, &bq.TableFieldSchema{
+			Name:        f.Name,
+			Description: f.Description,
+			Type:        string(f.Type),
+			Mode:        mode,
+		})
+	}
+	return ts
+}
+
+// tableProvisioner creates BigQuery tables. The bigquery client in use can
+// only create tables partitioned by day, so tables are created through the
+// BigQuery API directly.
+type tableProvisioner interface {
+	Metadata(ctx context.Context) (*bigquery.TableMetadata, error)
+	Create(ctx context.Context, t *bq.Table) error
+}
+
+// apiTable provisions a bigquery.Table through the BigQuery API.
+type apiTable struct {
+	table   *bigquery.Table
+	service *bq.Service
+}
+
+func newAPITable(ctx context.Context, table *bigquery.Table) (*apiTable, error) {
+	hc, endpoint, err := htransport.NewClient(ctx, option.WithEndpoint(bigQueryEndpoint), option.WithScopes(bigquery.Scope))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := bq.New(hc)
+	if err != nil {
+		return nil, err
+	}
+	s.BasePath = endpoint
+
+	return &apiTable{table: table, service: s}, nil
+}
+
+// Metadata returns the metadata of the table.
+func (at *apiTable) Metadata(ctx context.Context) (*bigquery.TableMetadata, error) {
+	return at.table.Metadata(ctx)
+}
+
+// Create creates the table from the provided resource.
+func (at *apiTable) Create(ctx context.Context, t *bq.Table) error {
+	t.TableReference = &bq.TableReference{
+		ProjectId: at.table.ProjectID,
+		DatasetId: at.table.DatasetID,
+		TableId:   at.table.TableID,
+	}
+	_, err := at.service.Tables.Insert(at.table.ProjectID, at.table.DatasetID, t).Context(ctx).Do()
+	return err
+}
+
+// createTableIfNotExists provisions the table if it does not yet exist,
+// returning the schema of the table.
+func createTableIfNotExists(ctx context.Context, table tableProvisioner, mapper *coster.Mapper, layout TableLayout) (bigquery.Schema, error) {
+	meta, err := table.Metadata(ctx)
+	if err == nil {
+		log.Log.Debugw("got metadata for table", zap.String("id", meta.FullID))
+		return meta.Schema, nil
+	} else if err != nil && !isNotFoundError(err) {
+		log.Log.Errorw("could not get metadata", zap.Error(err))
+		return nil, err
+	}
+
+	if err := table.Create(ctx, layout.resource(mapper)); err != nil {
+		log.Log.Errorw("could not create table", zap.Error(err))
+		return nil, err
+	}
+
+	return MapperToSchema(mapper), nil
+}
+
+// schemaColumns returns the set of top level column names in the schema.
+func schemaColumns(s bigquery.Schema) map[string]bool {
+	columns := map[string]bool{}
+	for _, f := range s {
+		columns[f.Name] = true
+	}
+	return columns
+}
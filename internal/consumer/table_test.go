@@ -0,0 +1,166 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/go-test/deep"
+	bq "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+
+	"github.com/planetlabs/kostanza/internal/coster"
+)
+
+// fakeTableProvisioner records the tables it is asked to create.
+type fakeTableProvisioner struct {
+	exists  bool
+	schema  bigquery.Schema
+	created []*bq.Table
+}
+
+func (ft *fakeTableProvisioner) Metadata(ctx context.Context) (*bigquery.TableMetadata, error) {
+	if ft.exists {
+		return &bigquery.TableMetadata{FullID: "project:dataset.table", Schema: ft.schema}, nil
+	}
+	return nil, &googleapi.Error{Code: 404}
+}
+
+func (ft *fakeTableProvisioner) Create(ctx context.Context, t *bq.Table) error {
+	ft.created = append(ft.created, t)
+	return nil
+}
+
+var testTableMapper = &coster.Mapper{Entries: []coster.Mapping{
+	coster.Mapping{Destination: "service", Source: "{.Pod.ObjectMeta.Labels.service}"},
+	coster.Mapping{Destination: "service", Source: "{.Pod.ObjectMeta.Labels.app}"},
+	coster.Mapping{Destination: "team", Source: "{.Pod.ObjectMeta.Labels.team}"},
+	coster.Mapping{Destination: "pod", Source: "{.Pod.ObjectMeta.Name}"},
+}}
+
+var createTableCases = []struct {
+	name                 string
+	layout               TableLayout
+	expectedPartitioning *bq.TimePartitioning
+	expectedClustering   *bq.Clustering
+}{
+	{
+		name:                 "default layout",
+		layout:               TableLayout{},
+		expectedPartitioning: &bq.TimePartitioning{Type: PartitionDay, Field: "EndTime"},
+	},
+	{
+		name:                 "hourly partitions",
+		layout:               TableLayout{Partitioning: PartitionHour},
+		expectedPartitioning: &bq.TimePartitioning{Type: PartitionHour, Field: "EndTime"},
+	},
+	{
+		name:                 "clustered by distinct dimensions",
+		layout:               TableLayout{Partitioning: PartitionDay, ClusterDimensions: 2},
+		expectedPartitioning: &bq.TimePartitioning{Type: PartitionDay, Field: "EndTime"},
+		expectedClustering:   &bq.Clustering{Fields: []string{"Dimensions_service", "Dimensions_team"}},
+	},
+	{
+		name:                 "clustered by more dimensions than mapped",
+		layout:               TableLayout{ClusterDimensions: MaxClusterDimensions},
+		expectedPartitioning: &bq.TimePartitioning{Type: PartitionDay, Field: "EndTime"},
+		expectedClustering:   &bq.Clustering{Fields: []string{"Dimensions_service", "Dimensions_team", "Dimensions_pod"}},
+	},
+}
+
+func TestCreateTableIfNotExists(t *testing.T) {
+	for _, tt := range createTableCases {
+		t.Run(tt.name, func(t *testing.T) {
+			ft := &fakeTableProvisioner{}
+			schema, err := createTableIfNotExists(context.Background(), ft, testTableMapper, tt.layout)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := deep.Equal(schema, MapperToSchema(testTableMapper)); diff != nil {
+				t.Error(diff)
+			}
+
+			if len(ft.created) != 1 {
+				t.Fatalf("expected a single table to be created, got %d", len(ft.created))
+			}
+			created := ft.created[0]
+
+			if diff := deep.Equal(created.TimePartitioning, tt.expectedPartitioning); diff != nil {
+				t.Error(diff)
+			}
+			if diff := deep.Equal(created.Clustering, tt.expectedClustering); diff != nil {
+				t.Error(diff)
+			}
+			if diff := deep.Equal(created.Schema, tableSchema(MapperToSchema(testTableMapper))); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestCreateTableIfNotExistsLeavesExistingTables(t *testing.T) {
+	existing := bigquery.Schema{{Name: "Kind", Type: bigquery.StringFieldType}}
+	ft := &fakeTableProvisioner{exists: true, schema: existing}
+	schema, err := createTableIfNotExists(context.Background(), ft, testTableMapper, TableLayout{Partitioning: PartitionHour})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ft.created) != 0 {
+		t.Fatalf("expected the existing table to be left untouched, got %d creations", len(ft.created))
+	}
+	if diff := deep.Equal(schema, existing); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestTableSchema(t *testing.T) {
+	s := bigquery.Schema{
+		{Name: "Value", Type: bigquery.IntegerFieldType, Required: true},
+		{Name: "Tags", Type: bigquery.StringFieldType, Repeated: true},
+		{Name: "Dimensions", Type: bigquery.StringFieldType, Description: "JSON encoded dimensions"},
+	}
+	expected := &bq.TableSchema{Fields: []*bq.TableFieldSchema{
+		&bq.TableFieldSchema{Name: "Value", Type: "INTEGER", Mode: "REQUIRED"},
+		&bq.TableFieldSchema{Name: "Tags", Type: "STRING", Mode: "REPEATED"},
+		&bq.TableFieldSchema{Name: "Dimensions", Type: "STRING", Mode: "NULLABLE", Description: "JSON encoded dimensions"},
+	}}
+	if diff := deep.Equal(tableSchema(s), expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+var tableLayoutValidateCases = []struct {
+	name    string
+	layout  TableLayout
+	wantErr bool
+}{
+	{name: "default", layout: TableLayout{}},
+	{name: "hourly", layout: TableLayout{Partitioning: PartitionHour, ClusterDimensions: MaxClusterDimensions}},
+	{name: "unsupported partitioning", layout: TableLayout{Partitioning: "MONTH"}, wantErr: true},
+	{name: "negative cluster dimensions", layout: TableLayout{ClusterDimensions: -1}, wantErr: true},
+	{name: "too many cluster dimensions", layout: TableLayout{ClusterDimensions: MaxClusterDimensions + 1}, wantErr: true},
+}
+
+func TestTableLayoutValidate(t *testing.T) {
+	for _, tt := range tableLayoutValidateCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.layout.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time and tickers to a coster, so that tests may
+// control the passage of time.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals, as per time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealClock is a Clock backed by the time package.
+type RealClock struct{}
+
+// Now returns the current local time.
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker returns a Ticker backed by a time.Ticker.
+func (RealClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (rt realTicker) C() <-chan time.Time {
+	return rt.t.C
+}
+
+func (rt realTicker) Stop() {
+	rt.t.Stop()
+}
+
+// FakeClock provides a mock Clock implementation whose time only moves when
+// advanced.
+type FakeClock struct {
+	mux     sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFakeClock returns a FakeClock set to the provided time.
+func NewFakeClock(now time.Time) *FakeClock {
+	fc := &FakeClock{now: now}
+	fc.cond = sync.NewCond(&fc.mux)
+	return fc
+}
+
+// Now returns the fake current time.
+func (fc *FakeClock) Now() time.Time {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	return fc.now
+}
+
+// NewTicker returns a Ticker that ticks every d as the clock is advanced.
+func (fc *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+
+	ft := &fakeTicker{
+		clock:  fc,
+		c:      make(chan time.Time, 1),
+		period: d,
+		next:   fc.now.Add(d),
+	}
+	fc.tickers = append(fc.tickers, ft)
+	fc.cond.Broadcast()
+	return ft
+}
+
+// Advance moves the clock forward by d, delivering the ticks due in that time.
+// As with time.Ticker, ticks are dropped while a ticker's previous tick has
+// not been received.
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+
+	fc.now = fc.now.Add(d)
+	for _, ft := range fc.tickers {
+		for !ft.next.After(fc.now) {
+			select {
+			case ft.c <- ft.next:
+			default:
+			}
+			ft.next = ft.next.Add(ft.period)
+		}
+	}
+}
+
+// BlockUntil blocks until at least n tickers that have not been stopped are
+// waiting on the clock, e.g. so that a test only advances it once the code
+// under test is ready to tick.
+func (fc *FakeClock) BlockUntil(n int) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	for len(fc.tickers) < n {
+		fc.cond.Wait()
+	}
+}
+
+type fakeTicker struct {
+	clock  *FakeClock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func (ft *fakeTicker) C() <-chan time.Time {
+	return ft.c
+}
+
+func (ft *fakeTicker) Stop() {
+	ft.clock.mux.Lock()
+	defer ft.clock.mux.Unlock()
+
+	for i, t := range ft.clock.tickers {
+		if t == ft {
+			ft.clock.tickers = append(ft.clock.tickers[:i], ft.clock.tickers[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start)
+	tk := fc.NewTicker(time.Minute)
+	fc.BlockUntil(1)
+
+	fc.Advance(30 * time.Second)
+	select {
+	case tick := <-tk.C():
+		t.Fatalf("unexpected tick at %v", tick)
+	default:
+	}
+
+	fc.Advance(30 * time.Second)
+	if tick := <-tk.C(); !tick.Equal(start.Add(time.Minute)) {
+		t.Fatalf("expected a tick at %v, got %v", start.Add(time.Minute), tick)
+	}
+	if now := fc.Now(); !now.Equal(start.Add(time.Minute)) {
+		t.Fatalf("expected the clock to be advanced to %v, got %v", start.Add(time.Minute), now)
+	}
+
+	// Ticks due while the previous tick is unreceived are dropped.
+	fc.Advance(3 * time.Minute)
+	if tick := <-tk.C(); !tick.Equal(start.Add(2 * time.Minute)) {
+		t.Fatalf("expected a tick at %v, got %v", start.Add(2*time.Minute), tick)
+	}
+	select {
+	case tick := <-tk.C():
+		t.Fatalf("expected later ticks to be dropped, got %v", tick)
+	default:
+	}
+
+	tk.Stop()
+	fc.Advance(time.Hour)
+	select {
+	case tick := <-tk.C():
+		t.Fatalf("unexpected tick after stopping at %v", tick)
+	default:
+	}
+}
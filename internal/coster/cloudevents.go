@@ -0,0 +1,117 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// CloudEventType is the type of CloudEvents wrapping CostData.
+	CloudEventType = "io.kostanza.cost"
+	// CloudEventsSpecVersion is the version of the CloudEvents specification
+	// envelopes conform to.
+	CloudEventsSpecVersion = "1.0"
+
+	cloudEventContentType = "application/json"
+)
+
+// CloudEvent is a CloudEvents structured mode JSON envelope wrapping CostData.
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	Type            string    `json:"type"`
+	Source          string    `json:"source"`
+	ID              string    `json:"id"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            CostData  `json:"data"`
+}
+
+// NewCloudEvent wraps the CostData in a CloudEvent from the provided source,
+// with a random id. The event time is the end of the cost data's interval.
+func NewCloudEvent(source string, cd CostData) (CloudEvent, error) {
+	id, err := newEventID()
+	if err != nil {
+		return CloudEvent{}, err
+	}
+
+	return CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		Type:            CloudEventType,
+		Source:          source,
+		ID:              id,
+		Time:            cd.EndTime,
+		DataContentType: cloudEventContentType,
+		Data:            cd,
+	}, nil
+}
+
+// newEventID returns a random version 4 UUID.
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "could not generate event id")
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// MarshalCostData encodes the CostData as JSON, wrapped in a CloudEvent from
+// the provided source unless source is empty.
+func MarshalCostData(cd CostData, source string) ([]byte, error) {
+	if source == "" {
+		return json.Marshal(cd)
+	}
+
+	ev, err := NewCloudEvent(source, cd)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ev)
+}
+
+// UnmarshalCostData decodes CostData from JSON, transparently unwrapping it
+// from a CloudEvent envelope if present.
+func UnmarshalCostData(data []byte) (CostData, error) {
+	var probe struct {
+		SpecVersion string          `json:"specversion"`
+		Type        string          `json:"type"`
+		Data        json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return CostData{}, err
+	}
+
+	var cd CostData
+	if probe.SpecVersion == "" {
+		err := json.Unmarshal(data, &cd)
+		return cd, err
+	}
+
+	if probe.Type != CloudEventType {
+		return CostData{}, errors.Errorf("unexpected cloudevent type %q", probe.Type)
+	}
+	if len(probe.Data) == 0 {
+		return CostData{}, errors.New("cloudevent has no data")
+	}
+	err := json.Unmarshal(probe.Data, &cd)
+	return cd, err
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+var cloudEventsTestCostData = CostData{
+	Kind:       ResourceCostCPU,
+	Strategy:   StrategyNameCPU,
+	Value:      42,
+	Dimensions: map[string]string{"service": "api"},
+	StartTime:  time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC),
+	EndTime:    time.Date(2018, 10, 1, 0, 1, 0, 0, time.UTC),
+}
+
+var costDataRoundTripCases = []struct {
+	name   string
+	source string
+}{
+	{
+		name: "raw cost data",
+	},
+	{
+		name:   "cloudevents envelope",
+		source: "//kostanza/test-cluster",
+	},
+}
+
+func TestCostDataRoundTrip(t *testing.T) {
+	for _, tt := range costDataRoundTripCases {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := MarshalCostData(cloudEventsTestCostData, tt.source)
+			if err != nil {
+				t.Fatalf("could not marshal cost data: %v", err)
+			}
+
+			cd, err := UnmarshalCostData(data)
+			if err != nil {
+				t.Fatalf("could not unmarshal cost data: %v", err)
+			}
+			if diff := deep.Equal(cd, cloudEventsTestCostData); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestCloudEventEnvelope(t *testing.T) {
+	data, err := MarshalCostData(cloudEventsTestCostData, "//kostanza/test-cluster")
+	if err != nil {
+		t.Fatalf("could not marshal cost data: %v", err)
+	}
+
+	var ev map[string]interface{}
+	if err := json.Unmarshal(data, &ev); err != nil {
+		t.Fatalf("could not unmarshal envelope: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"specversion":     "1.0",
+		"type":            "io.kostanza.cost",
+		"source":          "//kostanza/test-cluster",
+		"time":            "2018-10-01T00:01:00Z",
+		"datacontenttype": "application/json",
+	}
+	for k, v := range expected {
+		if ev[k] != v {
+			t.Errorf("expected %s of %v, got %v", k, v, ev[k])
+		}
+	}
+	if id, _ := ev["id"].(string); len(id) != 36 {
+		t.Errorf("expected a uuid id, got %v", ev["id"])
+	}
+	if _, ok := ev["data"].(map[string]interface{}); !ok {
+		t.Errorf("expected structured data, got %v", ev["data"])
+	}
+}
+
+func TestUnmarshalCostDataRejectsOtherEvents(t *testing.T) {
+	if _, err := UnmarshalCostData([]byte(`{"specversion": "1.0", "type": "io.example.other", "data": {}}`)); err == nil {
+		t.Fatal("expected an error unmarshalling an event of another type")
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+const (
+	// DefaultCloudWatchNamespace is the CloudWatch namespace cost metrics are
+	// published to by default.
+	DefaultCloudWatchNamespace = "Kostanza"
+
+	// cloudWatchMaxDatums is the maximum number of datums CloudWatch accepts
+	// in a single PutMetricData call.
+	cloudWatchMaxDatums = 20
+	// cloudWatchMaxDimensions is the maximum number of dimensions CloudWatch
+	// accepts for a single datum.
+	cloudWatchMaxDimensions = 10
+)
+
+// CloudWatchCostExporter publishes cost data to AWS CloudWatch as one metric
+// per cost Kind, with the mapped dimensions as CloudWatch dimensions. Data is
+// buffered and published in batches.
+type CloudWatchCostExporter struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	client    cloudwatchiface.CloudWatchAPI
+	namespace string
+	interval  time.Duration
+	mux       sync.Mutex
+	buffer    []*cloudwatch.MetricDatum
+}
+
+// NewCloudWatchCostExporter returns a CloudWatchCostExporter that publishes to
+// the provided namespace in region every interval. An empty region defers to
+// the AWS SDK's default configuration chain.
+func NewCloudWatchCostExporter(ctx context.Context, namespace, region string, interval time.Duration) (*CloudWatchCostExporter, error) {
+	cfg := aws.NewConfig()
+	if region != "" {
+		cfg = cfg.WithRegion(region)
+	}
+
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create aws session")
+	}
+
+	return newCloudWatchCostExporter(ctx, cloudwatch.New(sess), namespace, interval), nil
+}
+
+func newCloudWatchCostExporter(ctx context.Context, client cloudwatchiface.CloudWatchAPI, namespace string, interval time.Duration) *CloudWatchCostExporter {
+	ctx, cancel := context.WithCancel(ctx)
+	ce := &CloudWatchCostExporter{
+		ctx:       ctx,
+		cancel:    cancel,
+		client:    client,
+		namespace: namespace,
+		interval:  interval,
+	}
+
+	if interval > 0 {
+		go func() {
+			log.Log.Debug("starting background cloudwatch flush loop")
+			ce.startFlusher()
+			log.Log.Debug("background cloudwatch flush loop completed")
+		}()
+	}
+
+	return ce
+}
+
+// ExportCost enqueues the CostData provided for the next flush.
+func (ce *CloudWatchCostExporter) ExportCost(cd CostData) {
+	ce.mux.Lock()
+	defer ce.mux.Unlock()
+	ce.buffer = append(ce.buffer, cloudWatchDatum(cd))
+}
+
+func (ce *CloudWatchCostExporter) startFlusher() {
+	ticker := time.NewTicker(ce.interval)
+	defer ticker.Stop()
+	done := ce.ctx.Done()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := ce.Flush(); err != nil {
+				log.Log.Errorw("could not publish to cloudwatch", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Flush publishes all buffered cost data in batches of at most 20 datums.
+// Batches that fail to publish are dropped and the first error is returned.
+func (ce *CloudWatchCostExporter) Flush() error {
+	ce.mux.Lock()
+	buffer := ce.buffer
+	ce.buffer = nil
+	ce.mux.Unlock()
+
+	var ferr error
+	for len(buffer) > 0 {
+		n := len(buffer)
+		if n > cloudWatchMaxDatums {
+			n = cloudWatchMaxDatums
+		}
+
+		// Publishing uses a background context so that Close can flush after
+		// the exporter's context is cancelled.
+		_, err := ce.client.PutMetricDataWithContext(context.Background(), &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(ce.namespace),
+			MetricData: buffer[:n],
+		})
+		if err != nil && ferr == nil {
+			ferr = errors.Wrap(err, "could not put cloudwatch metric data")
+		}
+		buffer = buffer[n:]
+	}
+	return ferr
+}
+
+// Close stops periodic flushes and publishes any remaining cost data.
+func (ce *CloudWatchCostExporter) Close() error {
+	ce.cancel()
+	return ce.Flush()
+}
+
+// cloudWatchDatum converts CostData into a CloudWatch MetricDatum. Dimensions
+// are sorted by name and truncated to the CloudWatch limit; empty values are
+// omitted as CloudWatch rejects them.
+func cloudWatchDatum(cd CostData) *cloudwatch.MetricDatum {
+	names := make([]string, 0, len(cd.Dimensions))
+	for k, v := range cd.Dimensions {
+		if v == "" {
+			continue
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	if len(names) > cloudWatchMaxDimensions {
+		log.Log.Warnw(
+			"truncating cloudwatch dimensions",
+			zap.Int("dimensions", len(names)),
+			zap.Strings("dropped", names[cloudWatchMaxDimensions:]),
+		)
+		names = names[:cloudWatchMaxDimensions]
+	}
+
+	dims := make([]*cloudwatch.Dimension, 0, len(names))
+	for _, k := range names {
+		dims = append(dims, &cloudwatch.Dimension{
+			Name:  aws.String(k),
+			Value: aws.String(cd.Dimensions[k]),
+		})
+	}
+
+	d := &cloudwatch.MetricDatum{
+		MetricName: aws.String(string(cd.Kind)),
+		Dimensions: dims,
+		Value:      aws.Float64(float64(cd.Value)),
+		Unit:       aws.String(cloudwatch.StandardUnitNone),
+	}
+	if !cd.EndTime.IsZero() {
+		d.Timestamp = aws.Time(cd.EndTime)
+	}
+	return d
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/go-test/deep"
+)
+
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	mux    sync.Mutex
+	inputs []*cloudwatch.PutMetricDataInput
+}
+
+func (f *fakeCloudWatch) PutMetricDataWithContext(ctx aws.Context, in *cloudwatch.PutMetricDataInput, opts ...request.Option) (*cloudwatch.PutMetricDataOutput, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.inputs = append(f.inputs, in)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestCloudWatchExporterBatches(t *testing.T) {
+	fc := &fakeCloudWatch{}
+	ce := newCloudWatchCostExporter(context.Background(), fc, DefaultCloudWatchNamespace, 0)
+
+	for i := 0; i < 45; i++ {
+		ce.ExportCost(CostData{Kind: ResourceCostWeighted, Value: int64(i), Dimensions: map[string]string{"service": "foo"}})
+	}
+
+	if err := ce.Close(); err != nil {
+		t.Fatalf("unexpected error closing exporter: %v", err)
+	}
+
+	sizes := []int{}
+	for _, in := range fc.inputs {
+		if *in.Namespace != DefaultCloudWatchNamespace {
+			t.Fatalf("expected namespace %s, got %s", DefaultCloudWatchNamespace, *in.Namespace)
+		}
+		sizes = append(sizes, len(in.MetricData))
+	}
+
+	if diff := deep.Equal(sizes, []int{20, 20, 5}); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestCloudWatchDatum(t *testing.T) {
+	dims := map[string]string{"empty": ""}
+	for i := 0; i < 12; i++ {
+		dims[fmt.Sprintf("dim%02d", i)] = "value"
+	}
+
+	end := time.Unix(1542000000, 0)
+	d := cloudWatchDatum(CostData{Kind: ResourceCostCPU, Value: 42, Dimensions: dims, EndTime: end})
+
+	if *d.MetricName != string(ResourceCostCPU) {
+		t.Fatalf("expected metric name %s, got %s", ResourceCostCPU, *d.MetricName)
+	}
+	if *d.Value != 42 {
+		t.Fatalf("expected value 42, got %v", *d.Value)
+	}
+	if !d.Timestamp.Equal(end) {
+		t.Fatalf("expected timestamp %v, got %v", end, *d.Timestamp)
+	}
+
+	names := []string{}
+	for _, dim := range d.Dimensions {
+		names = append(names, *dim.Name)
+	}
+	expected := []string{"dim00", "dim01", "dim02", "dim03", "dim04", "dim05", "dim06", "dim07", "dim08", "dim09"}
+	if diff := deep.Equal(names, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
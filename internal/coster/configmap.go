@@ -0,0 +1,138 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+// ConfigMapRef identifies a key in a ConfigMap holding a configuration.
+type ConfigMapRef struct {
+	Namespace string
+	Name      string
+	Key       string
+}
+
+// ParseConfigMapRef parses a reference of the form namespace/name/key.
+func ParseConfigMapRef(ref string) (ConfigMapRef, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return ConfigMapRef{}, errors.Errorf("configmap reference must be of the form namespace/name/key, got %q", ref)
+	}
+	return ConfigMapRef{Namespace: parts[0], Name: parts[1], Key: parts[2]}, nil
+}
+
+func (r ConfigMapRef) String() string {
+	return r.Namespace + "/" + r.Name + "/" + r.Key
+}
+
+// NewConfigFromConfigMap fetches the referenced ConfigMap and constructs a
+// Config from the value of its key, decoding it as YAML if the key has a .yaml
+// or .yml extension and as JSON otherwise. The value is returned too, so that
+// WatchConfigMap may skip reloading the configuration already applied.
+func NewConfigFromConfigMap(client kubernetes.Interface, ref ConfigMapRef) (*Config, string, error) {
+	cm, err := client.CoreV1().ConfigMaps(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "could not get configmap %s/%s", ref.Namespace, ref.Name)
+	}
+	c, err := configFromConfigMap(cm, ref)
+	if err != nil {
+		return nil, "", err
+	}
+	return c, cm.Data[ref.Key], nil
+}
+
+func configFromConfigMap(cm *core_v1.ConfigMap, ref ConfigMapRef) (*Config, error) {
+	data, ok := cm.Data[ref.Key]
+	if !ok {
+		return nil, errors.Errorf("configmap %s/%s has no key %s", ref.Namespace, ref.Name, ref.Key)
+	}
+
+	c, err := NewConfigFromNamedReader(ref.Key, strings.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load configuration %s", ref)
+	}
+	return c, nil
+}
+
+// WatchConfigMap watches the referenced ConfigMap and invokes reload with the
+// newly parsed Config whenever the value of its key differs from the value
+// last applied, starting with the applied value provided. The ConfigMap being
+// created, e.g. after it was deleted or when it changed since it was last
+// fetched, counts as a change. Configurations that fail to load are logged
+// and ignored, leaving the last good configuration in place. It blocks until
+// the provided context is cancelled.
+func WatchConfigMap(ctx context.Context, client kubernetes.Interface, ref ConfigMapRef, applied string, reload func(*Config)) error {
+	// Periodic resyncs are unnecessary as unchanged data is never reloaded.
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		client,
+		0,
+		informers.WithNamespace(ref.Namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = fields.OneTermEqualSelector("metadata.name", ref.Name).String()
+		}),
+	)
+	informer := factory.Core().V1().ConfigMaps().Informer()
+
+	// Handlers are invoked serially, so the last applied value needs no lock.
+	apply := func(obj interface{}) {
+		cm, ok := obj.(*core_v1.ConfigMap)
+		if !ok || cm.Name != ref.Name {
+			return
+		}
+		data, ok := cm.Data[ref.Key]
+		if ok && data == applied {
+			return
+		}
+
+		cfg, err := configFromConfigMap(cm, ref)
+		if err != nil {
+			log.Log.Errorw("ignoring invalid configuration", zap.String("configmap", ref.String()), zap.Error(err))
+			return
+		}
+
+		log.Log.Infow("reloading configuration", zap.String("configmap", ref.String()))
+		applied = data
+		reload(cfg)
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    apply,
+		UpdateFunc: func(_, cur interface{}) { apply(cur) },
+	})
+
+	log.Log.Infow("watching configuration for changes", zap.String("configmap", ref.String()))
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return errors.Errorf("could not sync configmap %s/%s", ref.Namespace, ref.Name)
+	}
+
+	<-ctx.Done()
+	return nil
+}
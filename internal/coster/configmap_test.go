@@ -0,0 +1,150 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+var parseConfigMapRefCases = []struct {
+	name     string
+	ref      string
+	expected ConfigMapRef
+	err      bool
+}{
+	{
+		name:     "namespace, name and key",
+		ref:      "kube-system/kostanza/config.yaml",
+		expected: ConfigMapRef{Namespace: "kube-system", Name: "kostanza", Key: "config.yaml"},
+	},
+	{
+		name: "missing key",
+		ref:  "kube-system/kostanza",
+		err:  true,
+	},
+	{
+		name: "empty name",
+		ref:  "kube-system//config.json",
+		err:  true,
+	},
+}
+
+func TestParseConfigMapRef(t *testing.T) {
+	for _, tt := range parseConfigMapRefCases {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := ParseConfigMapRef(tt.ref)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error parsing %q", tt.ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ref != tt.expected {
+				t.Fatalf("expected %#v, got %#v", tt.expected, ref)
+			}
+		})
+	}
+}
+
+func testConfigMap(data string) *core_v1.ConfigMap {
+	return &core_v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kostanza"},
+		Data:       map[string]string{"config.json": data},
+	}
+}
+
+func TestNewConfigFromConfigMap(t *testing.T) {
+	client := testclient.NewSimpleClientset(testConfigMap(watchTestInitialConfig))
+
+	c, data, err := NewConfigFromConfigMap(client, ConfigMapRef{Namespace: "kube-system", Name: "kostanza", Key: "config.json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Pricing.Entries[0].HourlyMilliCPUCostMicroCents != 1 {
+		t.Fatalf("unexpected configuration: %#v", c)
+	}
+	if data != watchTestInitialConfig {
+		t.Fatalf("unexpected configuration data: %q", data)
+	}
+
+	if _, _, err := NewConfigFromConfigMap(client, ConfigMapRef{Namespace: "kube-system", Name: "kostanza", Key: "missing.json"}); err == nil {
+		t.Fatal("expected an error loading a missing key")
+	}
+}
+
+// expectReload waits for a reload of a configuration with the provided cpu
+// cost.
+func expectReload(t *testing.T, reloads <-chan *Config, cpu float64) {
+	t.Helper()
+	select {
+	case c := <-reloads:
+		if got := c.Pricing.Entries[0].HourlyMilliCPUCostMicroCents; got != cpu {
+			t.Fatalf("expected a reloaded cpu cost of %v, got %v", cpu, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for configuration reload")
+	}
+}
+
+func TestWatchConfigMap(t *testing.T) {
+	// The configmap changed since the initial configuration was loaded, as
+	// if it was updated before the informer synced.
+	client := testclient.NewSimpleClientset(testConfigMap(watchTestUpdatedConfig))
+	ref := ConfigMapRef{Namespace: "kube-system", Name: "kostanza", Key: "config.json"}
+	configMaps := client.CoreV1().ConfigMaps(ref.Namespace)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloads := make(chan *Config, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- WatchConfigMap(ctx, client, ref, watchTestInitialConfig, func(c *Config) { reloads <- c })
+	}()
+	expectReload(t, reloads, 2)
+
+	for _, data := range []string{watchTestInvalidConfig, watchTestInitialConfig} {
+		if _, err := configMaps.Update(testConfigMap(data)); err != nil {
+			t.Fatalf("could not update configmap: %v", err)
+		}
+	}
+	expectReload(t, reloads, 1)
+
+	// Recreating the configmap with the applied data does not reload it,
+	// while recreating it with new data does.
+	for _, data := range []string{watchTestInitialConfig, watchTestUpdatedConfig} {
+		if err := configMaps.Delete(ref.Name, &metav1.DeleteOptions{}); err != nil {
+			t.Fatalf("could not delete configmap: %v", err)
+		}
+		if _, err := configMaps.Create(testConfigMap(data)); err != nil {
+			t.Fatalf("could not create configmap: %v", err)
+		}
+	}
+	expectReload(t, reloads, 2)
+
+	cancel()
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected watch error: %v", err)
+	}
+}
@@ -15,13 +15,23 @@
 package coster
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/ghodss/yaml"
 	"github.com/pkg/errors"
 	"go.opencensus.io/exporter/prometheus"
 	"go.opencensus.io/stats"
@@ -31,6 +41,8 @@ import (
 	core_v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/jsonpath"
 
 	"github.com/planetlabs/kostanza/internal/lister"
 	"github.com/planetlabs/kostanza/internal/log"
@@ -51,10 +63,28 @@ var (
 	ResourceCostWeighted = ResourceCostKind("weighted")
 	// ResourceCostNode represents the overall cost of a node.
 	ResourceCostNode = ResourceCostKind("node")
+	// ResourceCostUnallocated represents the portion of a node's cost that is not attributed to pods.
+	ResourceCostUnallocated = ResourceCostKind("unallocated")
+	// ResourceCostEphemeralStorage is a cost metric derived from ephemeral-storage utilization.
+	ResourceCostEphemeralStorage = ResourceCostKind("ephemeral-storage")
+	// ResourceCostLimits is a cost metric derived from the cpu, memory, and gpu limits of a pod.
+	ResourceCostLimits = ResourceCostKind("limits")
+	// ResourceCostReserved represents the cost of node capacity reserved for the system rather than pods.
+	ResourceCostReserved = ResourceCostKind("reserved")
+	// ResourceCostStorage is a cost metric derived from the persistent volume claims mounted by a pod.
+	ResourceCostStorage = ResourceCostKind("storage")
+	// ResourceCostUsage is a cost metric derived from the cpu and memory a pod was observed to use.
+	ResourceCostUsage = ResourceCostKind("usage")
+	// ResourceCostNodePool represents the overall cost of the nodes in a node pool.
+	ResourceCostNodePool = ResourceCostKind("nodepool")
+	// ResourceCostLoadBalancer represents the cost of the cloud load balancer provisioned for a service.
+	ResourceCostLoadBalancer = ResourceCostKind("loadbalancer")
 	// TagStatus indicates the success or failure of an operation.
 	TagStatus, _       = tag.NewKey("status")
 	tagStatusSucceeded = "succeeded"
 	tagStatusFailed    = "failed"
+	// TagExporter identifies the exporter a measurement was recorded by.
+	TagExporter, _ = tag.NewKey("exporter")
 )
 
 var (
@@ -64,6 +94,13 @@ var (
 	// ErrSenselessInterval is returned if the difference since our last run time
 	// is less than 0. Obviously, this should never since time moves forward.
 	ErrSenselessInterval = errors.New("senseless interval since last calculation")
+	// ErrEmptyStrategy is returned by CalculateOnce when a strategy yielded no
+	// cost items, which usually signals a misconfigured cost table.
+	ErrEmptyStrategy = errors.New("strategy produced no cost items")
+	// ErrNoPodMetricsLister is returned by NewKubernetesCoster when the
+	// UsagePricingStrategy is selected without a lister for its usage data,
+	// see WithUsagePricing.
+	ErrNoPodMetricsLister = errors.New("the UsagePricingStrategy requires a pod metrics lister")
 )
 
 var (
@@ -73,12 +110,24 @@ var (
 	MeasureCycles = stats.Int64("kostanza/measures/cycles", "Iterations executed", stats.UnitDimensionless)
 	// MeasureLag is the discrepancy between the ideal interval and actual interval between calculations.
 	MeasureLag = stats.Float64("kostanza/measures/lag", "Lag time in calculation intervals", stats.UnitMilliseconds)
+	// MeasureLagSmoothed is an exponential moving average of MeasureLag, which
+	// is only recorded when lag smoothing is enabled via WithLagSmoothing.
+	MeasureLagSmoothed = stats.Float64("kostanza/measures/lag_smoothed", "Exponential moving average of lag time in calculation intervals", stats.UnitMilliseconds)
+	// MeasureOrphanedPods is the number of pods skipped by a calculation
+	// because the node they are scheduled to could not be found.
+	MeasureOrphanedPods = stats.Int64("kostanza/measures/orphaned_pods", "Pods skipped as their node could not be found", stats.UnitDimensionless)
+	// MeasureCalculationDuration is the time taken by each cost calculation.
+	MeasureCalculationDuration = stats.Float64("kostanza/measures/calculation_duration", "Time taken to calculate costs", stats.UnitMilliseconds)
+	// MeasureTotalClusterCost is the sum of every NodePricingStrategy cost
+	// item in a calculation, recorded once per cycle without dimensions.
+	MeasureTotalClusterCost = stats.Int64("kostanza/measures/total_cluster_cost", "Total cost of all nodes in millionths of a cent", "µ¢")
 )
 
 // Coster is used to calculate and emit metrics for services and components
 // running in a kubernetes cluster.
 type Coster interface {
 	CalculateAndEmit() error
+	CalculateOnce(ctx context.Context) ([]CostItem, error)
 	Run(ctx context.Context) error
 }
 
@@ -89,10 +138,265 @@ type Coster interface {
 type Config struct {
 	Mapper  Mapper
 	Pricing CostTable
+	// EnableLimitsStrategy adds the LimitsBasedPricingStrategy to the set of
+	// strategies used by the coster.
+	EnableLimitsStrategy bool
+	// Strategies names the pricing strategies, e.g. StrategyNameWeighted, used
+	// by the coster. All default strategies are used when it is empty.
+	Strategies []string
+	// PerContainerCosts prices the cpu and memory of each container in a pod
+	// separately, populating ContainerName, rather than pricing whole pods.
+	// This increases cardinality in proportion to the number of containers.
+	PerContainerCosts bool
+	// CPUWeight and MemoryWeight scale the cpu and memory components of the
+	// cost attributed to each pod by the WeightedPricingStrategy, biasing
+	// attribution towards pods heavy in one resource. They change how a
+	// node's cost is shared between its pods, not the node's total cost.
+	// Unset (zero) weights default to 1.
+	CPUWeight    float64
+	MemoryWeight float64
+	// StrictRequests prices containers by their resource requests alone. By
+	// default a container that limits but does not request a resource is
+	// priced by its limit, as Kubernetes defaults requests to limits.
+	StrictRequests bool
+	// NodePoolLabel is the node label the NodePoolPricingStrategy groups
+	// nodes into pools by. Defaults to DefaultNodePoolLabel.
+	NodePoolLabel string
+	// ProrateStartTime bills pods that started running during an interval
+	// for the fraction of the interval they were running, based on the start
+	// time of the pod and its containers. By default every pod is billed for
+	// the entire interval. This also bills a pod that was rescheduled during
+	// the interval, and so replaced by a pod on another node, only for its
+	// time on its current node.
+	ProrateStartTime bool
+	// SkipZeroCost drops cost items valued at zero, e.g. those of pods
+	// without resource requests, rather than exporting them.
+	SkipZeroCost bool
+	// Teams maps the namespace of each cost item to the team owning it,
+	// exported as DimensionTeam.
+	Teams TeamTable
+	// CostUnit is the unit in which exported CostData reports its UnitValue.
+	// Defaults to CostUnitMicroCents.
+	CostUnit CostUnit
+}
+
+// selectedStrategyNames returns the names of the strategies configured for
+// use, in the order they should be run.
+func (c *Config) selectedStrategyNames() []string {
+	names := append([]string{}, defaultStrategyNames...)
+	if len(c.Strategies) > 0 {
+		names = append([]string{}, c.Strategies...)
+	}
+
+	if c.EnableLimitsStrategy && !containsString(names, StrategyNameLimits) {
+		names = append(names, StrategyNameLimits)
+	}
+	return names
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Option configures optional behavior of a coster created by
+// NewKubernetesCoster.
+type Option func(c *coster)
+
+// WithPodFilters adds PodFilters that pods must satisfy, in addition to the
+// defaults, in order to be included in cost calculations.
+func WithPodFilters(filters ...PodFilter) Option {
+	return func(c *coster) {
+		c.podFilters = append(c.podFilters, filters...)
+	}
+}
+
+// WithScheduledPods includes every pod that has been scheduled to a node in
+// cost calculations, as per ScheduledPodFilter, rather than only running pods.
+func WithScheduledPods() Option {
+	return func(c *coster) {
+		c.phaseFilter = ScheduledPodFilter
+	}
+}
+
+const (
+	// DimensionCluster is the static dimension identifying the cluster cost
+	// data was collected from.
+	DimensionCluster = "cluster"
+	// DimensionEnvironment is the static dimension identifying the
+	// environment, e.g. production, cost data was collected from.
+	DimensionEnvironment = "environment"
+	// DimensionPriceEntry is the dimension identifying the CostTableEntry
+	// that priced a cost item, see CostTableEntry.ID.
+	DimensionPriceEntry = "price_entry"
+	// DimensionTeam is the dimension identifying the team owning the
+	// namespace of a cost item, as mapped by the TeamTable of a Config.
+	DimensionTeam = "team"
+	// DimensionNode is the dimension identifying the node a cost item was
+	// priced on, see WithNodeDimension.
+	DimensionNode = "node"
+)
+
+// WithStaticDimensions adds the provided dimensions, e.g. DimensionCluster,
+// to every CostData exported. Dimensions derived from the mapping take
+// precedence over static dimensions of the same name.
+func WithStaticDimensions(dims map[string]string) Option {
+	return func(c *coster) {
+		if c.staticDimensions == nil {
+			c.staticDimensions = map[string]string{}
+		}
+		for k, v := range dims {
+			if v != "" {
+				c.staticDimensions[k] = v
+			}
+		}
+	}
+}
+
+// WithLagSmoothing records MeasureLagSmoothed, an exponential moving average
+// of the lag of each calculation, alongside MeasureLag. The smoothing factor
+// alpha, in (0, 1], weighs the latest lag against the average; smaller
+// factors smooth over longer periods. A factor of zero disables smoothing.
+func WithLagSmoothing(alpha float64) Option {
+	return func(c *coster) {
+		c.lagSmoothing = alpha
+	}
+}
+
+// WithPriceEntryDimension adds DimensionPriceEntry to every CostData priced by
+// a node's CostTableEntry, unless the mapping already defines a dimension of
+// the same name. Storage costs are priced by storage class rather than node
+// and are not attributed to an entry.
+func WithPriceEntryDimension() Option {
+	return func(c *coster) {
+		c.priceEntryDimension = true
+	}
+}
+
+// WithClock replaces the clock the coster reads the time from and ticks
+// calculations with, e.g. with a FakeClock to drive calculations in tests.
+func WithClock(clock Clock) Option {
+	return func(c *coster) {
+		c.clock = clock
+	}
+}
+
+// WithNodeDimension adds DimensionNode, holding the node's name, to every
+// CostData of a cost item with a node, unless the mapping already defines a
+// dimension of the same name. Pod cost items carry the node their pod is
+// scheduled on.
+func WithNodeDimension() Option {
+	return func(c *coster) {
+		c.nodeDimension = true
+	}
+}
+
+// WithNodeLabelDimensions adds a dimension for each entry of labels, holding
+// the value of the node label it maps to, to every CostData of a cost item
+// with a node, e.g. "instance_type" to "node.kubernetes.io/instance-type".
+// Nodes without the label get an empty value. Dimensions the mapping already
+// defines are left as they are.
+func WithNodeLabelDimensions(labels map[string]string) Option {
+	return func(c *coster) {
+		if c.nodeLabelDimensions == nil {
+			c.nodeLabelDimensions = map[string]string{}
+		}
+		for d, l := range labels {
+			c.nodeLabelDimensions[d] = l
+		}
+	}
+}
+
+// WithWorkloadResolution resolves the OwnerKind and OwnerName of each pod by
+// looking up the ReplicaSets and Deployments controlling it, rather than by
+// inferring Deployments from the pod-template-hash label. This requires watch
+// access to ReplicaSets and Deployments.
+func WithWorkloadResolution() Option {
+	return func(c *coster) {
+		c.resolveWorkloads = true
+	}
+}
+
+// WithPprof serves the net/http/pprof profiling handlers under /debug/pprof/
+// on the coster's listen address.
+func WithPprof() Option {
+	return func(c *coster) {
+		c.pprof = true
+	}
+}
+
+// WithServerSecurity serves metrics and the other endpoints on the coster's
+// listen address with the provided TLS and authentication settings. Health
+// checks are served without authentication.
+func WithServerSecurity(ss ServerSecurity) Option {
+	return func(c *coster) {
+		c.security = ss
+	}
+}
+
+// WithCycleSummary logs a summary of each calculation at info level,
+// counting the pods, nodes and cost items it covered and totalling the value
+// of each kind of cost.
+func WithCycleSummary() Option {
+	return func(c *coster) {
+		c.summary = true
+	}
+}
+
+// WithMaxInterval caps the duration priced by a single calculation. When a
+// calculation runs more than max after the previous one, e.g. because the
+// process was starved of cpu, a warning is logged and the duration is clamped
+// to max. The cost of the remainder of the gap is not attributed, so that
+// each calculation reports cost for no more than max. A max of zero disables
+// the cap.
+func WithMaxInterval(max time.Duration) Option {
+	return func(c *coster) {
+		c.maxInterval = max
+	}
+}
+
+// WithIntervalJitter waits the interval plus or minus a random fraction of up
+// to jitter of it between calculations, rather than calculating on fixed
+// ticks, so that replicas started together do not publish in synchronized
+// bursts. A jitter of zero disables it.
+func WithIntervalJitter(jitter float64) Option {
+	return func(c *coster) {
+		c.intervalJitter = jitter
+		c.jitterRand = rand.New(rand.NewSource(time.Now().UnixNano())) // nolint: gosec
+	}
+}
+
+// WithResyncPeriods sets the intervals at which the pod and node informers
+// resync their caches, lister.DefaultResyncPeriod by default. A period of 0
+// disables periodic resyncs so that the informer only reacts to events.
+func WithResyncPeriods(pod, node time.Duration) Option {
+	return func(c *coster) {
+		c.podResync = pod
+		c.nodeResync = node
+	}
+}
+
+// WithUsagePricing adds the UsagePricingStrategy to the strategies in use,
+// listing pod usage via the provided lister on every calculation. Listing
+// errors, e.g. because metrics-server is not installed, are logged and the
+// calculation continues without usage costs.
+func WithUsagePricing(l lister.PodMetricsLister) Option {
+	return func(c *coster) {
+		c.podMetricsLister = l
+		if !containsString(c.strategyNames, StrategyNameUsage) {
+			c.strategyNames = append(c.strategyNames, StrategyNameUsage)
+			c.strategies = append(c.strategies, UsagePricingStrategy)
+		}
+	}
 }
 
 // NewKubernetesCoster returns a new coster that talks to a kubernetes cluster
-// via the provided client.
+// via the provided client. Selecting the UsagePricingStrategy in the config
+// requires the WithUsagePricing option.
 func NewKubernetesCoster(
 	interval time.Duration,
 	config *Config,
@@ -100,46 +404,195 @@ func NewKubernetesCoster(
 	prometheusExporter *prometheus.Exporter,
 	listenAddr string,
 	costExporters []CostExporter,
+	opts ...Option,
 ) (*coster, error) { // nolint: golint
 
-	podLister := lister.NewKubernetesPodLister(client)
-	nodeLister := lister.NewKubernetesNodeLister(client)
-
 	if config == nil {
 		return nil, errors.New("coster configuration is required")
 	}
 
-	return &coster{
+	names := config.selectedStrategyNames()
+
+	// Claims are only watched when they are priced, so that clusters that do
+	// not price storage need not grant access to them.
+	var pvcLister lister.PVCLister
+	if containsString(names, StrategyNameStorage) {
+		pvcLister = lister.NewKubernetesPVCLister(client)
+	}
+	var serviceLister lister.ServiceLister
+	if containsString(names, StrategyNameLoadBalancer) {
+		serviceLister = lister.NewKubernetesServiceLister(client)
+	}
+	strategies := []PricingStrategy{}
+	for _, n := range names {
+		if pcs, ok := perContainerStrategiesByName[n]; ok && config.PerContainerCosts {
+			strategies = append(strategies, pcs)
+			continue
+		}
+		strategies = append(strategies, strategiesByName[n])
+	}
+
+	c := &coster{
 		interval:           interval,
-		ticker:             time.NewTicker(interval),
-		podLister:          podLister,
-		nodeLister:         nodeLister,
+		pvcLister:          pvcLister,
+		serviceLister:      serviceLister,
 		config:             config,
 		prometheusExporter: prometheusExporter,
 		costExporters:      costExporters,
 		listenAddr:         listenAddr,
-		strategies:         []PricingStrategy{GPUPricingStrategy, CPUPricingStrategy, MemoryPricingStrategy, WeightedPricingStrategy, NodePricingStrategy},
-		podFilters:         PodFilters{RunningPodFilter},
-	}, nil
+		strategies:         strategies,
+		strategyNames:      names,
+		phaseFilter:        RunningPodFilter,
+		podResync:          lister.DefaultResyncPeriod,
+		nodeResync:         lister.DefaultResyncPeriod,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+	if containsString(c.strategyNames, StrategyNameUsage) && c.podMetricsLister == nil {
+		return nil, ErrNoPodMetricsLister
+	}
+
+	c.podLister = lister.NewKubernetesPodLister(client, c.podResync)
+	c.nodeLister = lister.NewKubernetesNodeLister(client, c.nodeResync)
+	if c.resolveWorkloads {
+		c.workloadResolver = lister.NewKubernetesWorkloadResolver(client, c.podResync)
+	}
+
+	return c, nil
 }
 
 type coster struct {
-	interval           time.Duration
-	ticker             *time.Ticker
-	podLister          lister.PodLister
-	nodeLister         lister.NodeLister
-	config             *Config
-	strategies         []PricingStrategy
-	listenAddr         string
-	prometheusExporter *prometheus.Exporter
-	costExporters      []CostExporter
-	podFilters         PodFilters
-	lastRun            time.Time
+	interval            time.Duration
+	maxInterval         time.Duration
+	intervalJitter      float64
+	jitterRand          *rand.Rand
+	podResync           time.Duration
+	pprof               bool
+	security            ServerSecurity
+	nodeResync          time.Duration
+	clock               Clock
+	podLister           lister.PodLister
+	nodeLister          lister.NodeLister
+	pvcLister           lister.PVCLister
+	serviceLister       lister.ServiceLister
+	podMetricsLister    lister.PodMetricsLister
+	resolveWorkloads    bool
+	priceEntryDimension bool
+	nodeDimension       bool
+	nodeLabelDimensions map[string]string
+	workloadResolver    lister.WorkloadResolver
+	config              *Config
+	configMux           sync.RWMutex
+	strategies          []PricingStrategy
+	strategyNames       []string
+	listenAddr          string
+	prometheusExporter  *prometheus.Exporter
+	costExporters       []CostExporter
+	phaseFilter         PodFilter
+	podFilters          PodFilters
+	staticDimensions    map[string]string
+	lastRun             time.Time
+	lagSmoothing        float64
+	smoothedLag         float64
+	lagSeeded           bool
+	statusMux           sync.RWMutex
+	lastCalculation     time.Time
+	lastError           error
+	lastTotalCost       int64
+	lastTotalStart      time.Time
+	lastTotalEnd        time.Time
+
+	// wait is the jittered interval waited before the current calculation,
+	// which lag is measured against when jitter is enabled.
+	wait time.Duration
+	// intervalStart and intervalEnd bound the interval priced by the most
+	// recent calculation.
+	intervalStart time.Time
+	intervalEnd   time.Time
+	// summary enables logging a cycleSummary of each calculation. The pod,
+	// node and orphaned pod counts of the most recent calculation are kept
+	// for it.
+	summary      bool
+	podCount     int
+	nodeCount    int
+	orphanedPods int
+}
+
+// Readiness reports whether the coster is producing cost data, as served by
+// the /readyz endpoint.
+type Readiness struct {
+	PodCacheSynced  bool       `json:"podCacheSynced"`
+	NodeCacheSynced bool       `json:"nodeCacheSynced"`
+	LastCalculation *time.Time `json:"lastCalculation"`
+	LastError       string     `json:"lastError,omitempty"`
+}
+
+// Ready is true once both caches have synced and a calculation succeeded.
+func (r Readiness) Ready() bool {
+	return r.PodCacheSynced && r.NodeCacheSynced && r.LastCalculation != nil
+}
+
+// readiness returns the current Readiness of the coster.
+func (c *coster) readiness() Readiness {
+	c.statusMux.RLock()
+	defer c.statusMux.RUnlock()
+
+	r := Readiness{
+		PodCacheSynced:  c.podLister.HasSynced(),
+		NodeCacheSynced: c.nodeLister.HasSynced(),
+	}
+	if !c.lastCalculation.IsZero() {
+		t := c.lastCalculation
+		r.LastCalculation = &t
+	}
+	if c.lastError != nil {
+		r.LastError = c.lastError.Error()
+	}
+	return r
+}
+
+// clockOrDefault returns the coster's Clock, or a RealClock if it is unset.
+func (c *coster) clockOrDefault() Clock {
+	if c.clock == nil {
+		return RealClock{}
+	}
+	return c.clock
+}
+
+// recordCalculation tracks the outcome of a calculate and emit cycle for
+// readiness reporting. Calculations that produced cost items despite
+// CalculationErrors still count as successful.
+func (c *coster) recordCalculation(err error) {
+	c.statusMux.Lock()
+	defer c.statusMux.Unlock()
+
+	c.lastError = err
+	if _, partial := err.(CalculationErrors); err == nil || partial {
+		c.lastCalculation = c.clockOrDefault().Now()
+	}
+}
+
+// readyzHandler serves the coster's Readiness as JSON, responding with a 503
+// until it is ready.
+func (c *coster) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close() // nolint: errcheck
+
+	rd := c.readiness()
+	w.Header().Set("Content-Type", "application/json")
+	if !rd.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(rd) // nolint: errcheck, gosec
 }
 
 func (c *coster) applyPodFilters(pods []*core_v1.Pod) []*core_v1.Pod {
 	ret := []*core_v1.Pod{}
 	for _, p := range pods {
+		if c.phaseFilter != nil && !c.phaseFilter(p) {
+			continue
+		}
 		if !c.podFilters.All(p) {
 			continue
 		}
@@ -148,21 +601,57 @@ func (c *coster) applyPodFilters(pods []*core_v1.Pod) []*core_v1.Pod {
 	return ret
 }
 
+// ReloadConfig applies the Pricing and Mapper sections of the provided
+// configuration to the coster. Other settings are fixed at construction time
+// and require a restart to change.
+func (c *coster) ReloadConfig(config *Config) {
+	c.configMux.Lock()
+	defer c.configMux.Unlock()
+
+	next := *c.config
+	next.Pricing = config.Pricing
+	next.Mapper = config.Mapper
+	c.config = &next
+}
+
+// currentConfig returns the configuration in use, which may be swapped out by
+// ReloadConfig at any time.
+func (c *coster) currentConfig() *Config {
+	c.configMux.RLock()
+	defer c.configMux.RUnlock()
+	return c.config
+}
+
+// smoothLag folds lag into the exponential moving average of lag, which is
+// seeded with the first lag recorded, and returns the updated average.
+func (c *coster) smoothLag(lag float64) float64 {
+	if !c.lagSeeded {
+		c.smoothedLag = lag
+		c.lagSeeded = true
+	} else {
+		c.smoothedLag = c.lagSmoothing*lag + (1-c.lagSmoothing)*c.smoothedLag
+	}
+	return c.smoothedLag
+}
+
 // Calculate returns a slice of podCostItem records that expose
-// pricing details for services.
+// pricing details for services. Failing to list pods or nodes returns a
+// ListError and no cost items, while nodes without a cost entry are reported
+// as CalculationErrors alongside the cost items that could be calculated.
 func (c *coster) calculate() ([]CostItem, error) {
 	log.Log.Debug("cost calculation loop triggered")
+	config := c.currentConfig()
 
 	pods, err := c.podLister.List(labels.Everything())
 	if err != nil {
-		return nil, err
+		return nil, &ListError{Resource: "pods", Err: err}
 	}
 
 	pods = c.applyPodFilters(pods)
 
 	nodes, err := c.nodeLister.List(labels.Everything())
 	if err != nil {
-		return nil, err
+		return nil, &ListError{Resource: "nodes", Err: err}
 	}
 
 	cis := []CostItem{}
@@ -171,59 +660,267 @@ func (c *coster) calculate() ([]CostItem, error) {
 	// actual interval since the last calculate() call. If this is signficant you
 	// may want to feed the program more cpu.
 	var interval time.Duration
+	now := c.clockOrDefault().Now()
 	if c.lastRun.IsZero() {
 		interval = c.interval
-		c.lastRun = time.Now()
+		c.lastRun = now
 	} else {
-		t := time.Now()
-		interval = t.Sub(c.lastRun)
+		interval = now.Sub(c.lastRun)
 		if interval <= 0 {
 			return nil, ErrSenselessInterval
 		}
 
-		c.lastRun = t
-		lag := float64((interval / time.Millisecond) - (c.interval / time.Millisecond))
+		c.lastRun = now
+		expected := c.interval
+		if c.wait > 0 {
+			expected = c.wait
+		}
+		lag := float64((interval / time.Millisecond) - (expected / time.Millisecond))
 		stats.Record(context.Background(), MeasureLag.M(lag))
+		if c.lagSmoothing > 0 {
+			stats.Record(context.Background(), MeasureLagSmoothed.M(c.smoothLag(lag)))
+		}
+
+		if c.maxInterval > 0 && interval > c.maxInterval {
+			log.Log.Warnw(
+				"clamping calculation interval",
+				zap.Duration("interval", interval),
+				zap.Duration("maxInterval", c.maxInterval),
+			)
+			interval = c.maxInterval
+		}
 	}
+	c.intervalEnd = c.lastRun
+	c.intervalStart = c.lastRun.Add(-interval)
+
+	cs := NewClusterState(pods, nodes)
+	cs.CPUWeight = config.CPUWeight
+	cs.MemoryWeight = config.MemoryWeight
+	cs.StrictRequests = config.StrictRequests
+	cs.NodePoolLabel = config.NodePoolLabel
+	if c.pvcLister != nil {
+		cs.Claims, err = c.pvcLister.List(labels.Everything())
+		if err != nil {
+			return nil, &ListError{Resource: "persistentvolumeclaims", Err: err}
+		}
+	}
+	if c.serviceLister != nil {
+		cs.Services, err = c.serviceLister.List(labels.Everything())
+		if err != nil {
+			return nil, &ListError{Resource: "services", Err: err}
+		}
+	}
+	if c.podMetricsLister != nil {
+		usage, uerr := c.podMetricsLister.List(labels.Everything())
+		if uerr != nil {
+			log.Log.Warnw("could not list pod metrics, skipping usage pricing", zap.Error(uerr))
+		}
+		cs.Usage = usage
+	}
+
+	c.podCount, c.nodeCount, c.orphanedPods = len(pods), len(nodes), cs.orphanedPods()
+	stats.Record(context.Background(), MeasureOrphanedPods.M(int64(c.orphanedPods)))
 
 	for _, s := range c.strategies {
-		cis = append(cis, s.Calculate(c.config.Pricing, interval, pods, nodes)...)
+		cis = append(cis, calculateStrategy(s, config.Pricing, interval, cs)...)
+	}
+
+	// The interval priced ends at the time of this calculation, lastRun.
+	if config.ProrateStartTime {
+		prorate(cis, c.lastRun, interval)
+	}
+
+	resolve := resolveOwner
+	if c.workloadResolver != nil {
+		resolve = c.workloadResolver.Resolve
+	}
+	resolveOwners(cis, resolve)
+
+	// Strategies skip nodes they cannot price, so report each such node once.
+	var errs CalculationErrors
+	for _, n := range nodes {
+		if _, err := config.Pricing.FindByNode(n); err != nil {
+			errs = append(errs, &MissingCostEntryError{NodeName: n.Name, Labels: n.Labels})
+		}
+	}
+	if len(errs) > 0 {
+		return cis, errs
 	}
 	return cis, nil
 }
 
 func (c *coster) CalculateAndEmit() error {
+	began := time.Now()
 	costs, err := c.calculate()
-	if err != nil {
+	stats.Record(context.Background(), MeasureCalculationDuration.M(float64(time.Since(began))/float64(time.Millisecond)))
+	c.recordCalculation(err)
+	recordCalculationErrors(err)
+	if _, partial := err.(CalculationErrors); err != nil && !partial {
 		log.Log.Error("failed to calculate pod costs")
 		ctx, _ := tag.New(context.Background(), tag.Upsert(TagStatus, tagStatusFailed)) // nolint: gosec
 		stats.Record(ctx, MeasureCycles.M(1))
 		return err
 	}
 
-	mapper := &c.config.Mapper
+	total := totalNodeCost(costs)
+	stats.Record(context.Background(), MeasureTotalClusterCost.M(total))
+	c.recordTotalCost(total, c.intervalStart, c.intervalEnd)
+
+	// The cost items cover the interval priced by the calculation, which
+	// ends when it listed the cluster and began at the previous calculation.
+	start, end := c.intervalStart, c.intervalEnd
+
+	cfg := c.currentConfig()
+	mapper := &cfg.Mapper
+	entries := priceEntries{}
 	for _, ci := range costs {
+		if cfg.SkipZeroCost && ci.Value == 0 {
+			continue
+		}
 		for _, exp := range c.costExporters {
-			dims, err := mapper.MapData(ci)
+			dims, err := mapper.MapCostItem(ci)
 			if err != nil {
 				log.Log.Error("could not map data", zap.Error(err))
 				continue
 			}
+			if _, ok := dims[DimensionPriceEntry]; c.priceEntryDimension && !ok {
+				if id := entries.id(cfg.Pricing, ci); id != "" {
+					dims[DimensionPriceEntry] = id
+				}
+			}
+			c.mapNode(ci, dims)
+			cfg.Teams.mapCostItem(ci, dims)
+			for k, v := range c.staticDimensions {
+				if _, ok := dims[k]; !ok {
+					dims[k] = v
+				}
+			}
 			ce := CostData{
-				Kind:       ci.Kind,
-				Strategy:   ci.Strategy,
-				Value:      ci.Value,
-				Dimensions: dims,
-				EndTime:    time.Now(),
+				Kind:          ci.Kind,
+				Strategy:      ci.Strategy,
+				Value:         ci.Value,
+				ContainerName: ci.ContainerName,
+				Dimensions:    dims,
+				StartTime:     start,
+				EndTime:       end,
 			}
+			ce.setUnit(cfg.CostUnit)
 			exp.ExportCost(ce)
 		}
 	}
 
+	if c.summary {
+		log.Log.Infow("calculated costs", zap.Object("summary", c.summarize(costs)))
+	}
+
 	ctx, _ := tag.New(context.Background(), tag.Upsert(TagStatus, tagStatusSucceeded)) // nolint: gosec
 	stats.Record(ctx, MeasureCycles.M(1))
 
-	return nil
+	return err
+}
+
+// mapNode adds the node dimensions configured by WithNodeDimension and
+// WithNodeLabelDimensions to dims, unless the mapping already defined them.
+func (c *coster) mapNode(ci CostItem, dims map[string]string) {
+	if ci.Node == nil {
+		return
+	}
+	if _, ok := dims[DimensionNode]; c.nodeDimension && !ok {
+		dims[DimensionNode] = ci.Node.Name
+	}
+	for d, l := range c.nodeLabelDimensions {
+		if _, ok := dims[d]; !ok {
+			dims[d] = ci.Node.Labels[l]
+		}
+	}
+}
+
+// priceEntries caches the ID of the CostTableEntry pricing each node by node
+// name for the duration of a calculation.
+type priceEntries map[string]string
+
+// id returns the ID of the CostTableEntry that priced the cost item, or an
+// empty string for items not priced by their node's entry.
+func (pe priceEntries) id(table CostTable, ci CostItem) string {
+	if ci.Node == nil || ci.Kind == ResourceCostStorage {
+		return ""
+	}
+
+	if id, ok := pe[ci.Node.Name]; ok {
+		return id
+	}
+
+	id := ""
+	if e, err := table.FindByNode(ci.Node); err == nil {
+		id = e.ID()
+	}
+	pe[ci.Node.Name] = id
+	return id
+}
+
+// totalNodeCost sums the value of every NodePricingStrategy cost item.
+func totalNodeCost(cis []CostItem) int64 {
+	var total int64
+	for _, ci := range cis {
+		if ci.Strategy == StrategyNameNode {
+			total += ci.Value
+		}
+	}
+	return total
+}
+
+// CalculateOnce waits for the pod and node caches to sync and then performs a
+// single cost calculation, returning the resulting CostItems without emitting
+// them. If any strategy produced no items the items are returned alongside an
+// error wrapping ErrEmptyStrategy, and otherwise alongside any
+// CalculationErrors.
+func (c *coster) CalculateOnce(ctx context.Context) ([]CostItem, error) {
+	ctx, done := context.WithCancel(ctx)
+	defer done()
+
+	go c.podLister.Run(ctx.Done())  // nolint: errcheck
+	go c.nodeLister.Run(ctx.Done()) // nolint: errcheck
+
+	synced := []cache.InformerSynced{c.podLister.HasSynced, c.nodeLister.HasSynced}
+	if c.pvcLister != nil {
+		go c.pvcLister.Run(ctx.Done()) // nolint: errcheck
+		synced = append(synced, c.pvcLister.HasSynced)
+	}
+	if c.serviceLister != nil {
+		go c.serviceLister.Run(ctx.Done()) // nolint: errcheck
+		synced = append(synced, c.serviceLister.HasSynced)
+	}
+	if c.workloadResolver != nil {
+		go c.workloadResolver.Run(ctx.Done()) // nolint: errcheck
+		synced = append(synced, c.workloadResolver.HasSynced)
+	}
+
+	log.Log.Debug("waiting for caches to sync")
+	if ok := cache.WaitForCacheSync(ctx.Done(), synced...); !ok {
+		return nil, lister.ErrCacheSyncFailed
+	}
+
+	cis, err := c.calculate()
+	if _, partial := err.(CalculationErrors); err != nil && !partial {
+		return nil, err
+	}
+
+	produced := map[string]bool{}
+	for _, ci := range cis {
+		produced[ci.Strategy] = true
+	}
+
+	empty := []string{}
+	for _, n := range c.strategyNames {
+		if !produced[n] {
+			empty = append(empty, n)
+		}
+	}
+
+	if len(empty) > 0 {
+		return cis, errors.Wrap(ErrEmptyStrategy, strings.Join(empty, ", "))
+	}
+	return cis, err
 }
 
 func (c *coster) Run(ctx context.Context) error {
@@ -240,36 +937,34 @@ func (c *coster) Run(ctx context.Context) error {
 		return c.nodeLister.Run(ctx.Done())
 	})
 
-	g.Go(func() error {
-		defer done()
-
-		mux := http.NewServeMux()
-		mux.Handle("/metrics", c.prometheusExporter)
-		mux.Handle("/healthz", http.HandlerFunc(
-			func(w http.ResponseWriter, r *http.Request) {
-				defer r.Body.Close() // nolint: errcheck
-				fmt.Fprintf(w, "ok") // nolint: errcheck
-			},
-		))
+	if c.pvcLister != nil {
+		g.Go(func() error {
+			defer done()
+			return c.pvcLister.Run(ctx.Done())
+		})
+	}
 
-		s := http.Server{
-			Addr:    c.listenAddr,
-			Handler: mux,
-		}
-		log.Log.Infof("starting server on %s", c.listenAddr)
+	if c.serviceLister != nil {
+		g.Go(func() error {
+			defer done()
+			return c.serviceLister.Run(ctx.Done())
+		})
+	}
 
-		go func() {
-			<-ctx.Done()
-			s.Shutdown(ctx) // nolint: gosec, errcheck
-		}()
+	if c.workloadResolver != nil {
+		g.Go(func() error {
+			defer done()
+			return c.workloadResolver.Run(ctx.Done())
+		})
+	}
 
-		err := s.ListenAndServe()
-		if err != nil {
-			log.Log.Errorw("error listening", zap.Error(err))
-			return err
-		}
-		return nil
-	})
+	// An empty listen address skips serving metrics and health checks, which
+	// suits short-lived runs that push their metrics elsewhere.
+	if c.listenAddr != "" {
+		g.Go(func() error {
+			return c.serve(ctx, done)
+		})
+	}
 
 	g.Go(func() error {
 		defer done()
@@ -277,9 +972,16 @@ func (c *coster) Run(ctx context.Context) error {
 		log.Log.Debug("starting cost calculation loop")
 		defer log.Log.Debug("exiting cost calculation loop")
 
+		if c.intervalJitter > 0 {
+			return c.runJittered(ctx)
+		}
+
+		ticker := c.clockOrDefault().NewTicker(c.interval)
+		defer ticker.Stop()
+
 		for {
 			select {
-			case <-c.ticker.C:
+			case <-ticker.C():
 				if err := c.CalculateAndEmit(); err != nil {
 					log.Log.Errorw("error during cost calculation cycle", zap.Error(err))
 				}
@@ -292,12 +994,418 @@ func (c *coster) Run(ctx context.Context) error {
 	return g.Wait()
 }
 
+// runJittered calculates and emits costs after waiting a jittered interval,
+// see nextWait, until the provided context is cancelled.
+func (c *coster) runJittered(ctx context.Context) error {
+	for {
+		wait := c.nextWait()
+		t := c.clockOrDefault().NewTicker(wait)
+		select {
+		case <-t.C():
+			t.Stop()
+			c.wait = wait
+			if err := c.CalculateAndEmit(); err != nil {
+				log.Log.Errorw("error during cost calculation cycle", zap.Error(err))
+			}
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		}
+	}
+}
+
+// nextWait returns the interval plus or minus a random fraction of up to the
+// configured jitter of it.
+func (c *coster) nextWait() time.Duration {
+	if c.intervalJitter <= 0 {
+		return c.interval
+	}
+	offset := (2*c.jitterRand.Float64() - 1) * c.intervalJitter
+	return time.Duration(float64(c.interval) * (1 + offset))
+}
+
+// serve exposes prometheus metrics, liveness and readiness checks on the coster's listen
+// address until the provided context is cancelled.
+func (c *coster) serve(ctx context.Context, done context.CancelFunc) error {
+	defer done()
+
+	s := http.Server{
+		Addr:    c.listenAddr,
+		Handler: c.handler(),
+	}
+	log.Log.Infof("starting server on %s", c.listenAddr)
+
+	go func() {
+		<-ctx.Done()
+		s.Shutdown(ctx) // nolint: gosec, errcheck
+	}()
+
+	err := c.security.ListenAndServe(&s)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	if err != nil {
+		log.Log.Errorw("error listening", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// handler returns the handler served on the coster's listen address, which
+// authenticates requests other than health checks if configured to.
+func (c *coster) handler() http.Handler {
+	return c.security.Handler(c.serveMux(), "/healthz", "/readyz")
+}
+
+// serveMux returns the handlers served on the coster's listen address.
+func (c *coster) serveMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.prometheusExporter)
+	mux.Handle("/healthz", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close() // nolint: errcheck
+			fmt.Fprintf(w, "ok") // nolint: errcheck
+		},
+	))
+	mux.Handle("/readyz", http.HandlerFunc(c.readyzHandler))
+	mux.Handle("/pricing", http.HandlerFunc(c.pricingHandler))
+	mux.Handle("/pricing/lookup", http.HandlerFunc(c.pricingLookupHandler))
+	mux.Handle("/forecast", http.HandlerFunc(c.forecastHandler))
+	if c.pprof {
+		RegisterPprofHandlers(mux)
+	}
+	return mux
+}
+
 // NewConfigFromReader constructs a Config from an io.Reader.
 func NewConfigFromReader(reader io.Reader) (*Config, error) {
+	c, err := decodeConfig(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// decodeConfig constructs a Config from an io.Reader containing JSON without
+// validating it, since it may be one part of a configuration to be merged.
+func decodeConfig(reader io.Reader) (*Config, error) {
 	var c Config
 	if err := json.NewDecoder(reader).Decode(&c); err != nil {
 		return nil, errors.Wrap(err, "could not unmarshal configuration")
 	}
 
+	if err := c.Pricing.Compile(); err != nil {
+		return nil, errors.Wrap(err, "could not prepare pricing table")
+	}
+
+	if err := c.Mapper.Compile(); err != nil {
+		return nil, errors.Wrap(err, "could not prepare mapping")
+	}
+
 	return &c, nil
 }
+
+// ConfigValidationError is returned by Config.Validate and describes every
+// problem found with a configuration.
+type ConfigValidationError struct {
+	Problems []string
+}
+
+func (e *ConfigValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(e.Problems, "; "))
+}
+
+// Validate checks that the configuration has at least one pricing entry and
+// at least one mapping, that its prices, factors and weights are in range,
+// that the strategies, units and modes it names are known, and that its
+// mappings and teams are well formed. It returns a ConfigValidationError
+// listing all problems found.
+func (c *Config) Validate() error {
+	problems := []string{}
+
+	if len(c.Pricing.Entries) == 0 {
+		problems = append(problems, "pricing table has no entries")
+	}
+
+	for i, e := range c.Pricing.Entries {
+		costs := []struct {
+			name  string
+			value float64
+		}{
+			{"HourlyMemoryByteCostMicroCents", e.HourlyMemoryByteCostMicroCents},
+			{"HourlyMilliCPUCostMicroCents", e.HourlyMilliCPUCostMicroCents},
+			{"HourlyGPUCostMicroCents", e.HourlyGPUCostMicroCents},
+			{"HourlyEphemeralStorageByteCostMicroCents", e.HourlyEphemeralStorageByteCostMicroCents},
+			{"HourlyStorageByteCostMicroCents", e.HourlyStorageByteCostMicroCents},
+			{"HourlyLoadBalancerCostMicroCents", e.HourlyLoadBalancerCostMicroCents},
+			{"Multiplier", e.Multiplier},
+			{"OvercommitFactor", e.OvercommitFactor},
+		}
+		for _, cost := range costs {
+			if cost.value < 0 {
+				problems = append(problems, fmt.Sprintf("pricing entry %d has negative %s %v", i, cost.name, cost.value))
+			}
+		}
+		// Factors below 1 would inflate costs wherever MaxScale caps scaling.
+		if e.OvercommitFactor > 0 && e.OvercommitFactor < 1 {
+			problems = append(problems, fmt.Sprintf("pricing entry %d has OvercommitFactor %v below 1", i, e.OvercommitFactor))
+		}
+
+		gpus := make([]string, 0, len(e.HourlyGPUResourceCostMicroCents))
+		for name := range e.HourlyGPUResourceCostMicroCents {
+			gpus = append(gpus, name)
+		}
+		sort.Strings(gpus)
+		for _, name := range gpus {
+			if v := e.HourlyGPUResourceCostMicroCents[name]; v < 0 {
+				problems = append(problems, fmt.Sprintf("pricing entry %d has negative HourlyGPUResourceCostMicroCents for %s %v", i, name, v))
+			}
+		}
+	}
+
+	if c.Pricing.MaxScale < 0 {
+		problems = append(problems, fmt.Sprintf("pricing table has negative MaxScale %v", c.Pricing.MaxScale))
+	}
+	if !c.Pricing.MatchMode.Valid() {
+		problems = append(problems, fmt.Sprintf("pricing table has unknown MatchMode %q", c.Pricing.MatchMode))
+	}
+
+	if c.CPUWeight < 0 {
+		problems = append(problems, fmt.Sprintf("negative CPUWeight %v", c.CPUWeight))
+	}
+	if c.MemoryWeight < 0 {
+		problems = append(problems, fmt.Sprintf("negative MemoryWeight %v", c.MemoryWeight))
+	}
+
+	for _, n := range c.Strategies {
+		if _, ok := strategiesByName[n]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown strategy %q", n))
+		}
+	}
+
+	if !c.CostUnit.Valid() {
+		problems = append(problems, fmt.Sprintf("unknown cost unit %q", c.CostUnit))
+	}
+
+	if len(c.Mapper.Entries) == 0 {
+		problems = append(problems, "mapping has no entries")
+	}
+
+	for i, m := range c.Mapper.Entries {
+		if err := jsonpath.New(m.Destination).Parse(m.Source); err != nil {
+			problems = append(problems, fmt.Sprintf("mapping entry %d (%s) has invalid source %q: %v", i, m.Destination, m.Source, err))
+		}
+		if m.SourceKind != "" && m.SourceKind != SourceKindPod && m.SourceKind != SourceKindNode && m.SourceKind != SourceKindService {
+			problems = append(problems, fmt.Sprintf("mapping entry %d (%s) has unknown source kind %q", i, m.Destination, m.SourceKind))
+		}
+		if m.SourceKey != "" && m.Source != "" {
+			problems = append(problems, fmt.Sprintf("mapping entry %d (%s) sets both a source and a source key", i, m.Destination))
+		}
+		if len(m.Sources) > 0 && (m.Source != "" || m.SourceKey != "") {
+			problems = append(problems, fmt.Sprintf("mapping entry %d (%s) sets sources alongside a source or source key", i, m.Destination))
+		}
+		for _, src := range m.Sources {
+			if err := jsonpath.New(m.Destination).Parse(src); err != nil {
+				problems = append(problems, fmt.Sprintf("mapping entry %d (%s) has invalid source %q: %v", i, m.Destination, src, err))
+			}
+		}
+		if m.SourceMap != "" && m.SourceMap != SourceMapLabels && m.SourceMap != SourceMapAnnotations {
+			problems = append(problems, fmt.Sprintf("mapping entry %d (%s) has unknown source map %q", i, m.Destination, m.SourceMap))
+		}
+		if m.Transform == "" {
+			continue
+		}
+		if _, err := parseTransform(m.Transform); err != nil {
+			problems = append(problems, fmt.Sprintf("mapping entry %d (%s) has invalid transform: %v", i, m.Destination, err))
+		}
+	}
+
+	problems = append(problems, c.Teams.problems()...)
+
+	if len(problems) > 0 {
+		return &ConfigValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// NewConfigFromFile constructs a Config from the file at the provided path.
+func NewConfigFromFile(path string) (*Config, error) {
+	return NewConfigFromFiles(path)
+}
+
+// NewConfigFromFiles constructs a Config by merging the configurations in the
+// files at the provided paths, in order, using MergeConfigs. Each file need
+// not be a valid configuration by itself, but the merged result must be.
+func NewConfigFromFiles(paths ...string) (*Config, error) {
+	cfgs := []*Config{}
+	for _, path := range paths {
+		c, err := decodeConfigFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not load configuration %s", path)
+		}
+		cfgs = append(cfgs, c)
+	}
+
+	return MergeConfigs(cfgs...)
+}
+
+func decodeConfigFile(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open configuration")
+	}
+	defer f.Close() // nolint: errcheck
+
+	return decodeNamedConfig(path, f)
+}
+
+// NewConfigFromYAMLReader constructs a Config from an io.Reader containing
+// YAML. The YAML is converted to JSON and decoded exactly as it would be by
+// NewConfigFromReader.
+func NewConfigFromYAMLReader(reader io.Reader) (*Config, error) {
+	c, err := decodeYAMLConfig(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func decodeYAMLConfig(reader io.Reader) (*Config, error) {
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read configuration")
+	}
+
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not convert yaml configuration")
+	}
+
+	return decodeConfig(bytes.NewReader(j))
+}
+
+// NewConfigFromNamedReader constructs a Config from an io.Reader, decoding it
+// as YAML if the provided name has a .yaml or .yml extension, as a cost table
+// per LoadCostTableFromCSV if it has a .csv extension, and as JSON otherwise.
+func NewConfigFromNamedReader(name string, reader io.Reader) (*Config, error) {
+	c, err := decodeNamedConfig(name, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func decodeNamedConfig(name string, reader io.Reader) (*Config, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return decodeYAMLConfig(reader)
+	case ".csv":
+		ct, err := LoadCostTableFromCSV(reader)
+		if err != nil {
+			return nil, err
+		}
+		return &Config{Pricing: *ct}, nil
+	default:
+		return decodeConfig(reader)
+	}
+}
+
+// MergeConfigs merges the provided configurations, in order, into a single
+// validated Config. Pricing entries are concatenated in order, so entries
+// from earlier configurations take precedence in FindByLabels. Mapper entries
+// are de-duplicated by Destination with later configurations winning; a
+// conflicting destination keeps its original position and logs a warning.
+// For all other settings the last configuration to set a non-zero value wins.
+func MergeConfigs(cfgs ...*Config) (*Config, error) {
+	if len(cfgs) == 0 {
+		return nil, errors.New("no configurations to merge")
+	}
+
+	merged := &Config{}
+	destinations := map[string]int{}
+	for _, c := range cfgs {
+		if c == nil {
+			return nil, errors.New("cannot merge a nil configuration")
+		}
+
+		merged.Pricing.Entries = append(merged.Pricing.Entries, c.Pricing.Entries...)
+		if c.Pricing.MatchMode != "" {
+			merged.Pricing.MatchMode = c.Pricing.MatchMode
+		}
+		if c.Pricing.MaxScale != 0 {
+			merged.Pricing.MaxScale = c.Pricing.MaxScale
+		}
+
+		for _, m := range c.Mapper.Entries {
+			i, ok := destinations[m.Destination]
+			if !ok {
+				destinations[m.Destination] = len(merged.Mapper.Entries)
+				merged.Mapper.Entries = append(merged.Mapper.Entries, m)
+				continue
+			}
+
+			if !reflect.DeepEqual(merged.Mapper.Entries[i], m) {
+				log.Log.Warnw("overriding conflicting mapping", zap.String("destination", m.Destination))
+			}
+			merged.Mapper.Entries[i] = m
+		}
+
+		if c.EnableLimitsStrategy {
+			merged.EnableLimitsStrategy = true
+		}
+		if c.PerContainerCosts {
+			merged.PerContainerCosts = true
+		}
+		if c.StrictRequests {
+			merged.StrictRequests = true
+		}
+		if c.ProrateStartTime {
+			merged.ProrateStartTime = true
+		}
+		if c.SkipZeroCost {
+			merged.SkipZeroCost = true
+		}
+		if len(c.Strategies) > 0 {
+			merged.Strategies = c.Strategies
+		}
+		if c.CostUnit != "" {
+			merged.CostUnit = c.CostUnit
+		}
+		if c.NodePoolLabel != "" {
+			merged.NodePoolLabel = c.NodePoolLabel
+		}
+		if c.Teams.Enabled() {
+			merged.Teams = c.Teams
+		}
+		if c.CPUWeight != 0 {
+			merged.CPUWeight = c.CPUWeight
+		}
+		if c.MemoryWeight != 0 {
+			merged.MemoryWeight = c.MemoryWeight
+		}
+	}
+
+	if err := merged.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := merged.Mapper.Compile(); err != nil {
+		return nil, errors.Wrap(err, "could not prepare mapping")
+	}
+	return merged, nil
+}
@@ -16,16 +16,26 @@ package coster
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-test/deep"
+	"github.com/pkg/errors"
 	"go.opencensus.io/exporter/prometheus"
+	"go.opencensus.io/stats/view"
 	core_v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	testclient "k8s.io/client-go/kubernetes/fake"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
 
 	"github.com/planetlabs/kostanza/internal/lister"
 )
@@ -44,8 +54,9 @@ var resourceTestPod = core_v1.Pod{
 			core_v1.Container{
 				Resources: core_v1.ResourceRequirements{
 					Requests: core_v1.ResourceList{
-						"memory": resource.MustParse("16Mi"),
-						"cpu":    resource.MustParse("500m"),
+						"memory":            resource.MustParse("16Mi"),
+						"cpu":               resource.MustParse("500m"),
+						"ephemeral-storage": resource.MustParse("1Gi"),
 					},
 				},
 			},
@@ -53,6 +64,31 @@ var resourceTestPod = core_v1.Pod{
 	},
 }
 
+// initContainerTestPod has an init container requesting more memory, but less
+// cpu, than the sum of its regular containers.
+var initContainerTestPod = core_v1.Pod{
+	Spec: core_v1.PodSpec{
+		InitContainers: []core_v1.Container{
+			core_v1.Container{
+				Resources: core_v1.ResourceRequirements{
+					Requests: core_v1.ResourceList{
+						"memory": resource.MustParse("128Mi"),
+						"cpu":    resource.MustParse("250m"),
+					},
+				},
+			},
+			core_v1.Container{
+				Resources: core_v1.ResourceRequirements{
+					Requests: core_v1.ResourceList{
+						"memory": resource.MustParse("64Mi"),
+					},
+				},
+			},
+		},
+		Containers: resourceTestPod.Spec.Containers,
+	},
+}
+
 var sumPodResourceCases = []struct {
 	name          string
 	kind          core_v1.ResourceName
@@ -71,6 +107,30 @@ var sumPodResourceCases = []struct {
 		pod:           resourceTestPod,
 		expectedValue: 1500,
 	},
+	{
+		name:          "sum by ephemeral storage",
+		kind:          core_v1.ResourceEphemeralStorage,
+		pod:           resourceTestPod,
+		expectedValue: 1073741824,
+	},
+	{
+		name:          "init container memory exceeds the sum of containers",
+		kind:          core_v1.ResourceMemory,
+		pod:           initContainerTestPod,
+		expectedValue: 134217728,
+	},
+	{
+		name:          "init container cpu is below the sum of containers",
+		kind:          core_v1.ResourceCPU,
+		pod:           initContainerTestPod,
+		expectedValue: 1500,
+	},
+	{
+		name:          "init containers without a resource do not affect it",
+		kind:          core_v1.ResourceEphemeralStorage,
+		pod:           initContainerTestPod,
+		expectedValue: 1073741824,
+	},
 }
 
 func TestSumPodResources(t *testing.T) {
@@ -84,6 +144,88 @@ func TestSumPodResources(t *testing.T) {
 	}
 }
 
+func cpuTestPod(requests, limits core_v1.ResourceList) *core_v1.Pod {
+	return &core_v1.Pod{
+		Spec: core_v1.PodSpec{
+			Containers: []core_v1.Container{
+				core_v1.Container{
+					Resources: core_v1.ResourceRequirements{Requests: requests, Limits: limits},
+				},
+			},
+		},
+	}
+}
+
+var effectiveRequestCases = []struct {
+	name           string
+	pod            *core_v1.Pod
+	expectedValue  int64
+	expectedStrict int64
+}{
+	{
+		name:           "limit only falls back to the limit",
+		pod:            cpuTestPod(nil, core_v1.ResourceList{"cpu": resource.MustParse("500m")}),
+		expectedValue:  500,
+		expectedStrict: 0,
+	},
+	{
+		name:           "request only uses the request",
+		pod:            cpuTestPod(core_v1.ResourceList{"cpu": resource.MustParse("250m")}, nil),
+		expectedValue:  250,
+		expectedStrict: 250,
+	},
+	{
+		name: "request and limit uses the request",
+		pod: cpuTestPod(
+			core_v1.ResourceList{"cpu": resource.MustParse("250m")},
+			core_v1.ResourceList{"cpu": resource.MustParse("1")},
+		),
+		expectedValue:  250,
+		expectedStrict: 250,
+	},
+	{
+		name: "limit of another resource does not affect it",
+		pod: cpuTestPod(
+			core_v1.ResourceList{"cpu": resource.MustParse("250m")},
+			core_v1.ResourceList{"memory": resource.MustParse("1Gi")},
+		),
+		expectedValue:  250,
+		expectedStrict: 250,
+	},
+}
+
+func TestSumPodResourcesEffectiveRequests(t *testing.T) {
+	for _, tt := range effectiveRequestCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sumPodResource(tt.pod, core_v1.ResourceCPU); got != tt.expectedValue {
+				t.Fatalf("expected effective cpu request of %d but got %d", tt.expectedValue, got)
+			}
+
+			cs := &ClusterState{StrictRequests: true}
+			if got := sumContainerResources(tt.pod, core_v1.ResourceCPU, cs.requests()); got != tt.expectedStrict {
+				t.Fatalf("expected strict cpu request of %d but got %d", tt.expectedStrict, got)
+			}
+		})
+	}
+}
+
+func TestEffectiveRequestsDoesNotModifyPod(t *testing.T) {
+	requests := core_v1.ResourceList{"memory": resource.MustParse("1Gi")}
+	c := core_v1.Container{
+		Resources: core_v1.ResourceRequirements{
+			Requests: requests,
+			Limits:   core_v1.ResourceList{"cpu": resource.MustParse("1")},
+		},
+	}
+
+	if rl := effectiveRequests(c); len(rl) != 2 {
+		t.Fatalf("expected the cpu limit to be added to the requests, got %v", rl)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("expected the container's requests to be unchanged, got %v", requests)
+	}
+}
+
 func TestNewKubernetesCoster(t *testing.T) {
 	dur := time.Hour
 	cfg := &Config{}
@@ -94,18 +236,950 @@ func TestNewKubernetesCoster(t *testing.T) {
 		t.Fatalf("could not get prometheus exporter %v", err)
 	}
 
-	c, err := NewKubernetesCoster(dur, cfg, cli, pro, lis, nil)
-	if err != nil {
-		t.Fatalf("error constructing coster: %v", err)
+	c, err := NewKubernetesCoster(dur, cfg, cli, pro, lis, nil)
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+	if c.podLister == nil {
+		t.Fatal("constructor should populate pod lister")
+	}
+
+	if c.nodeLister == nil {
+		t.Fatal("constructor should populate node lister")
+	}
+
+}
+
+func TestNewKubernetesCosterResyncPeriods(t *testing.T) {
+	cli := testclient.NewSimpleClientset()
+
+	def, err := NewKubernetesCoster(time.Hour, &Config{}, cli, nil, "", nil)
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+	if def.podResync != lister.DefaultResyncPeriod || def.nodeResync != lister.DefaultResyncPeriod {
+		t.Fatalf("expected default resync periods of %v, got %v and %v", lister.DefaultResyncPeriod, def.podResync, def.nodeResync)
+	}
+
+	c, err := NewKubernetesCoster(time.Hour, &Config{}, cli, nil, "", nil, WithResyncPeriods(0, time.Minute))
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+	if c.podResync != 0 || c.nodeResync != time.Minute {
+		t.Fatalf("expected resync periods of 0s and 1m0s, got %v and %v", c.podResync, c.nodeResync)
+	}
+	if c.podLister == nil || c.nodeLister == nil {
+		t.Fatal("constructor should populate pod and node listers")
+	}
+}
+
+func TestNewKubernetesCosterUsageRequiresMetrics(t *testing.T) {
+	cli := testclient.NewSimpleClientset()
+	cfg := &Config{Strategies: []string{StrategyNameCPU, StrategyNameUsage}}
+
+	if _, err := NewKubernetesCoster(time.Hour, cfg, cli, nil, "", nil); err != ErrNoPodMetricsLister {
+		t.Fatalf("expected %v, got %v", ErrNoPodMetricsLister, err)
+	}
+
+	c, err := NewKubernetesCoster(time.Hour, cfg, cli, nil, "", nil, WithUsagePricing(&lister.FakePodMetricsLister{}))
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+	if diff := deep.Equal(c.strategyNames, []string{StrategyNameCPU, StrategyNameUsage}); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestNewKubernetesCosterLimitsToggle(t *testing.T) {
+	cli := testclient.NewSimpleClientset()
+	pro, err := prometheus.NewExporter(prometheus.Options{})
+	if err != nil {
+		t.Fatalf("could not get prometheus exporter %v", err)
+	}
+
+	def, err := NewKubernetesCoster(time.Hour, &Config{}, cli, pro, ":5000", nil)
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+
+	lim, err := NewKubernetesCoster(time.Hour, &Config{EnableLimitsStrategy: true}, cli, pro, ":5000", nil)
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+
+	if len(lim.strategies) != len(def.strategies)+1 {
+		t.Fatalf("expected limits toggle to add a strategy, got %d and %d", len(def.strategies), len(lim.strategies))
+	}
+}
+
+func TestNewKubernetesCosterStrategies(t *testing.T) {
+	cli := testclient.NewSimpleClientset()
+	pro, err := prometheus.NewExporter(prometheus.Options{})
+	if err != nil {
+		t.Fatalf("could not get prometheus exporter %v", err)
+	}
+
+	cfg := &Config{
+		Pricing: CostTable{
+			Entries: []*CostTableEntry{
+				&CostTableEntry{
+					Labels:                         calculateTestNodeLabels,
+					HourlyMilliCPUCostMicroCents:   1000,
+					HourlyMemoryByteCostMicroCents: 1,
+				},
+			},
+		},
+		Strategies: []string{StrategyNameCPU, StrategyNameWeighted},
+	}
+
+	c, err := NewKubernetesCoster(time.Hour, cfg, cli, pro, ":5000", nil)
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+	c.nodeLister = &lister.FakeNodeLister{Nodes: []*core_v1.Node{testCalculationNode}}
+	pod := testCalculationPod.DeepCopy()
+	pod.Status.Phase = core_v1.PodRunning
+	c.podLister = &lister.FakePodLister{Pods: []*core_v1.Pod{pod}}
+
+	if diff := deep.Equal(c.strategyNames, cfg.Strategies); diff != nil {
+		t.Fatal(diff)
+	}
+
+	cis, err := c.calculate()
+	if err != nil {
+		t.Fatalf("unexpected error calculating costs: %v", err)
+	}
+
+	strategies := map[string]bool{}
+	for _, ci := range cis {
+		strategies[ci.Strategy] = true
+	}
+
+	expected := map[string]bool{StrategyNameCPU: true, StrategyNameWeighted: true}
+	if diff := deep.Equal(strategies, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestNewKubernetesCosterPerContainerCosts(t *testing.T) {
+	cli := testclient.NewSimpleClientset()
+	pro, err := prometheus.NewExporter(prometheus.Options{})
+	if err != nil {
+		t.Fatalf("could not get prometheus exporter %v", err)
+	}
+
+	cfg := &Config{
+		Pricing: CostTable{
+			Entries: []*CostTableEntry{
+				&CostTableEntry{
+					Labels:                         calculateTestNodeLabels,
+					HourlyMilliCPUCostMicroCents:   1000,
+					HourlyMemoryByteCostMicroCents: 1,
+				},
+			},
+		},
+		Strategies:        []string{StrategyNameCPU},
+		PerContainerCosts: true,
+	}
+
+	c, err := NewKubernetesCoster(time.Hour, cfg, cli, pro, ":5000", nil)
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+	c.nodeLister = &lister.FakeNodeLister{Nodes: []*core_v1.Node{testCalculationNode}}
+	pod := testCalculationPod.DeepCopy()
+	pod.Status.Phase = core_v1.PodRunning
+	pod.Spec.Containers[0].Name = "app"
+	c.podLister = &lister.FakePodLister{Pods: []*core_v1.Pod{pod}}
+
+	cis, err := c.calculate()
+	if err != nil {
+		t.Fatalf("unexpected error calculating costs: %v", err)
+	}
+
+	names := []string{}
+	for _, ci := range cis {
+		names = append(names, ci.Strategy+"/"+ci.ContainerName)
+	}
+
+	if diff := deep.Equal(names, []string{StrategyNameCPU + "/app"}); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestNewKubernetesCosterStorage(t *testing.T) {
+	cli := testclient.NewSimpleClientset()
+	cfg := &Config{
+		Pricing: CostTable{
+			Entries: []*CostTableEntry{
+				&CostTableEntry{
+					Labels:                          Labels{LabelStorageClass: "standard"},
+					HourlyStorageByteCostMicroCents: 1,
+				},
+			},
+		},
+		Strategies: []string{StrategyNameCPU},
+	}
+
+	c, err := NewKubernetesCoster(time.Hour, cfg, cli, nil, "", nil)
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+	if c.pvcLister != nil {
+		t.Fatal("expected claims not to be listed without the StoragePricingStrategy")
+	}
+
+	cfg.Strategies = []string{StrategyNameStorage}
+	c, err = NewKubernetesCoster(time.Hour, cfg, cli, nil, "", nil)
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+	if c.pvcLister == nil {
+		t.Fatal("expected claims to be listed with the StoragePricingStrategy")
+	}
+
+	class := "standard"
+	claim := &core_v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data"},
+		Spec:       core_v1.PersistentVolumeClaimSpec{StorageClassName: &class},
+		Status: core_v1.PersistentVolumeClaimStatus{
+			Phase:    core_v1.ClaimBound,
+			Capacity: core_v1.ResourceList{"storage": resource.MustParse("1Ki")},
+		},
+	}
+	pod := testCalculationPod.DeepCopy()
+	pod.Status.Phase = core_v1.PodRunning
+	pod.Spec.Volumes = []core_v1.Volume{
+		core_v1.Volume{
+			Name: "data",
+			VolumeSource: core_v1.VolumeSource{
+				PersistentVolumeClaim: &core_v1.PersistentVolumeClaimVolumeSource{ClaimName: "data"},
+			},
+		},
+	}
+	c.nodeLister = &lister.FakeNodeLister{Nodes: []*core_v1.Node{testCalculationNode}}
+	c.podLister = &lister.FakePodLister{Pods: []*core_v1.Pod{pod}}
+	c.pvcLister = &lister.FakePVCLister{Claims: []*core_v1.PersistentVolumeClaim{claim}}
+
+	cis, err := c.calculate()
+	if _, partial := err.(CalculationErrors); err != nil && !partial {
+		t.Fatalf("unexpected error calculating costs: %v", err)
+	}
+	if len(cis) != 1 || cis[0].Kind != ResourceCostStorage || cis[0].Value != 1024 {
+		t.Fatalf("expected a single storage cost item valued 1024, got %+v", cis)
+	}
+}
+
+func TestNewKubernetesCosterLoadBalancer(t *testing.T) {
+	cli := testclient.NewSimpleClientset()
+	cfg := &Config{
+		Pricing: CostTable{
+			Entries: []*CostTableEntry{
+				&CostTableEntry{
+					Labels:                           Labels{LabelServiceType: string(core_v1.ServiceTypeLoadBalancer)},
+					HourlyLoadBalancerCostMicroCents: 1000,
+				},
+			},
+		},
+		Strategies: []string{StrategyNameCPU},
+	}
+
+	c, err := NewKubernetesCoster(time.Hour, cfg, cli, nil, "", nil)
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+	if c.serviceLister != nil {
+		t.Fatal("expected services not to be listed without the LoadBalancerPricingStrategy")
+	}
+
+	cfg.Strategies = []string{StrategyNameLoadBalancer}
+	c, err = NewKubernetesCoster(time.Hour, cfg, cli, nil, "", nil)
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+	if c.serviceLister == nil {
+		t.Fatal("expected services to be listed with the LoadBalancerPricingStrategy")
+	}
+
+	services := []*core_v1.Service{
+		&core_v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "internal"},
+			Spec:       core_v1.ServiceSpec{Type: core_v1.ServiceTypeClusterIP},
+		},
+		&core_v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "frontend"},
+			Spec:       core_v1.ServiceSpec{Type: core_v1.ServiceTypeLoadBalancer},
+		},
+	}
+	c.nodeLister = &lister.FakeNodeLister{Nodes: []*core_v1.Node{testCalculationNode}}
+	c.podLister = &lister.FakePodLister{}
+	c.serviceLister = &lister.FakeServiceLister{Services: services}
+
+	cis, err := c.calculate()
+	if _, partial := err.(CalculationErrors); err != nil && !partial {
+		t.Fatalf("unexpected error calculating costs: %v", err)
+	}
+	if len(cis) != 1 || cis[0].Kind != ResourceCostLoadBalancer || cis[0].Service != services[1] || cis[0].Value != 1000 {
+		t.Fatalf("expected a single load balancer cost item valued 1000, got %+v", cis)
+	}
+}
+
+func TestCalculateResolvesWorkloads(t *testing.T) {
+	tt := calculateCases[0]
+	cli := testclient.NewSimpleClientset()
+
+	c, err := NewKubernetesCoster(time.Hour, tt.config, cli, nil, "", nil)
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+	if c.workloadResolver != nil {
+		t.Fatal("expected workloads not to be resolved by default")
+	}
+
+	c, err = NewKubernetesCoster(time.Hour, tt.config, cli, nil, "", nil, WithWorkloadResolution())
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+	if c.workloadResolver == nil {
+		t.Fatal("expected workloads to be resolved with WithWorkloadResolution")
+	}
+
+	pod := testCalculationPod.DeepCopy()
+	pod.Name = "db-0"
+	pod.Status.Phase = core_v1.PodRunning
+	c.nodeLister = &lister.FakeNodeLister{Nodes: tt.nodes}
+	c.podLister = &lister.FakePodLister{Pods: []*core_v1.Pod{pod}}
+	c.workloadResolver = &lister.FakeWorkloadResolver{Workloads: map[string]lister.FakeWorkload{
+		"db-0": lister.FakeWorkload{Kind: "StatefulSet", Name: "db"},
+	}}
+
+	cis, err := c.calculate()
+	if _, partial := err.(CalculationErrors); err != nil && !partial {
+		t.Fatalf("unexpected error calculating costs: %v", err)
+	}
+	resolved := 0
+	for _, ci := range cis {
+		if ci.Pod == nil {
+			continue
+		}
+		resolved++
+		if ci.OwnerKind != "StatefulSet" || ci.OwnerName != "db" {
+			t.Errorf("expected StatefulSet/db, got %s/%s", ci.OwnerKind, ci.OwnerName)
+		}
+	}
+	if resolved == 0 {
+		t.Fatal("expected pod cost items")
+	}
+}
+
+func TestCalculateAndEmitRecordsDuration(t *testing.T) {
+	v := &view.View{
+		Name:        "test_calculation_duration",
+		Measure:     MeasureCalculationDuration,
+		Aggregation: view.Distribution(1, 10, 100),
+	}
+	if err := view.Register(v); err != nil {
+		t.Fatalf("could not register view: %v", err)
+	}
+	defer view.Unregister(v)
+
+	tt := calculateCases[0]
+	c := &coster{
+		interval:   time.Hour,
+		nodeLister: &lister.FakeNodeLister{Nodes: tt.nodes},
+		podLister:  &lister.FakePodLister{Pods: tt.pods},
+		config:     tt.config,
+		strategies: []PricingStrategy{CPUPricingStrategy},
+	}
+
+	for i := int64(1); i <= 3; i++ {
+		if err := c.CalculateAndEmit(); err != nil {
+			t.Fatalf("unexpected calculation error: %v", err)
+		}
+
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			t.Fatalf("could not retrieve calculation durations: %v", err)
+		}
+		if len(rows) != 1 {
+			t.Fatalf("expected a single row, got %#v", rows)
+		}
+		if count := rows[0].Data.(*view.DistributionData).Count; count != i {
+			t.Fatalf("expected %d recorded calculation durations, got %d", i, count)
+		}
+	}
+}
+
+func TestCalculateAndEmitRecordsTotalClusterCost(t *testing.T) {
+	v := &view.View{
+		Name:        "test_total_cluster_cost",
+		Measure:     MeasureTotalClusterCost,
+		Aggregation: view.LastValue(),
+	}
+	if err := view.Register(v); err != nil {
+		t.Fatalf("could not register view: %v", err)
+	}
+	defer view.Unregister(v)
+
+	tt := calculateCases[0]
+	first := testCalculationNode.DeepCopy()
+	first.Status.Capacity = core_v1.ResourceList{"cpu": resource.MustParse("2"), "memory": resource.MustParse("0")}
+	second := first.DeepCopy()
+	second.Name = "second"
+	second.Status.Capacity["cpu"] = resource.MustParse("4")
+
+	re := &recordingExporter{}
+	c := &coster{
+		interval:      time.Hour,
+		nodeLister:    &lister.FakeNodeLister{Nodes: []*core_v1.Node{first, second}},
+		podLister:     &lister.FakePodLister{Pods: tt.pods},
+		config:        tt.config,
+		strategies:    []PricingStrategy{CPUPricingStrategy, NodePricingStrategy},
+		costExporters: []CostExporter{re},
+	}
+	if err := c.CalculateAndEmit(); err != nil {
+		t.Fatalf("unexpected calculation error: %v", err)
+	}
+
+	var expected int64
+	for _, cd := range re.data {
+		if cd.Strategy == StrategyNameNode {
+			expected += cd.Value
+		}
+	}
+	// Each node costs 1000µ¢ per millicpu hour, i.e. 2000000 and 4000000.
+	if expected != 6000000 {
+		t.Fatalf("expected node cost items summing to 6000000, got %d", expected)
+	}
+
+	rows, err := view.RetrieveData(v.Name)
+	if err != nil {
+		t.Fatalf("could not retrieve total cluster cost: %v", err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("expected a single row, got %#v", rows)
+	}
+	if total := rows[0].Data.(*view.LastValueData).Value; total != float64(expected) {
+		t.Fatalf("expected total cluster cost %d, got %v", expected, total)
+	}
+}
+
+func TestCalculateAndEmitNodePoolDimension(t *testing.T) {
+	tt := calculateCases[0]
+	cfg := *tt.config
+	cfg.Mapper = Mapper{Entries: []Mapping{
+		Mapping{Destination: "node_pool", Source: `{.ObjectMeta.Labels.cloud\.google\.com/gke-nodepool}`, SourceKind: SourceKindNode, Default: "none"},
+	}}
+
+	node := testCalculationNode.DeepCopy()
+	node.Labels["cloud.google.com/gke-nodepool"] = "highmem-pool"
+
+	re := &recordingExporter{}
+	c := &coster{
+		interval:      time.Hour,
+		nodeLister:    &lister.FakeNodeLister{Nodes: []*core_v1.Node{node}},
+		podLister:     &lister.FakePodLister{Pods: tt.pods},
+		config:        &cfg,
+		strategies:    []PricingStrategy{CPUPricingStrategy},
+		costExporters: []CostExporter{re},
+	}
+
+	if err := c.CalculateAndEmit(); err != nil {
+		t.Fatalf("unexpected calculation error: %v", err)
+	}
+	if len(re.data) != 1 {
+		t.Fatalf("expected a single exported cost datum, got %d", len(re.data))
+	}
+	if diff := deep.Equal(re.data[0].Dimensions, map[string]string{"node_pool": "highmem-pool"}); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestCalculateAndEmitPriceEntryDimension(t *testing.T) {
+	tt := calculateCases[0]
+	spot := &CostTableEntry{
+		Name:                         "spot",
+		Labels:                       Labels{"spot": "true"},
+		HourlyMilliCPUCostMicroCents: 300,
+	}
+	onDemand := &CostTableEntry{HourlyMilliCPUCostMicroCents: 1000}
+	cfg := *tt.config
+	cfg.Pricing = CostTable{Entries: []*CostTableEntry{spot, onDemand}}
+
+	spotNode := testCalculationNode.DeepCopy()
+	spotNode.Name = "spot-node"
+	spotNode.Labels = map[string]string{"spot": "true"}
+	spotPod := testCalculationPod.DeepCopy()
+	spotPod.Name = "spot-pod"
+	spotPod.Spec.NodeName = spotNode.Name
+
+	re := &recordingExporter{}
+	c := &coster{
+		interval:            time.Hour,
+		nodeLister:          &lister.FakeNodeLister{Nodes: []*core_v1.Node{testCalculationNode, spotNode}},
+		podLister:           &lister.FakePodLister{Pods: []*core_v1.Pod{testCalculationPod, spotPod}},
+		config:              &cfg,
+		strategies:          []PricingStrategy{CPUPricingStrategy},
+		costExporters:       []CostExporter{re},
+		priceEntryDimension: true,
+	}
+
+	if err := c.CalculateAndEmit(); err != nil {
+		t.Fatalf("unexpected calculation error: %v", err)
+	}
+	if len(re.data) != 2 {
+		t.Fatalf("expected two exported cost data, got %d", len(re.data))
+	}
+
+	expected := map[int64]string{300000: "spot", 1000000: onDemand.ID()}
+	for _, cd := range re.data {
+		if id := cd.Dimensions[DimensionPriceEntry]; id != expected[cd.Value] {
+			t.Errorf("expected cost %d to be priced by %q, got %q", cd.Value, expected[cd.Value], id)
+		}
+	}
+}
+
+func TestNextWaitJitter(t *testing.T) {
+	c := &coster{interval: time.Minute}
+	if w := c.nextWait(); w != time.Minute {
+		t.Fatalf("expected the interval without jitter, got %v", w)
+	}
+
+	WithIntervalJitter(0.1)(c)
+	waits := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		w := c.nextWait()
+		if w < 54*time.Second || w > 66*time.Second {
+			t.Fatalf("expected a wait within 10%% of the interval, got %v", w)
+		}
+		waits[w] = true
+	}
+	if len(waits) < 2 {
+		t.Fatalf("expected successive waits to vary, got %v", waits)
+	}
+}
+
+func TestCalculateUsagePricing(t *testing.T) {
+	tt := calculateCases[0]
+	cli := testclient.NewSimpleClientset()
+
+	pod := testCalculationPod.DeepCopy()
+	pod.Status.Phase = core_v1.PodRunning
+	pm := &metricsv1beta1.PodMetrics{
+		ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name},
+		Containers: []metricsv1beta1.ContainerMetrics{
+			{Usage: core_v1.ResourceList{core_v1.ResourceCPU: resource.MustParse("1")}},
+		},
+	}
+
+	pml := &lister.FakePodMetricsLister{Metrics: []*metricsv1beta1.PodMetrics{pm}}
+	c, err := NewKubernetesCoster(time.Hour, tt.config, cli, nil, "", nil, WithUsagePricing(pml))
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+	c.nodeLister = &lister.FakeNodeLister{Nodes: []*core_v1.Node{testCalculationNode}}
+	c.podLister = &lister.FakePodLister{Pods: []*core_v1.Pod{pod}}
+
+	usage := func() []CostItem {
+		cis, err := c.calculate()
+		if _, partial := err.(CalculationErrors); err != nil && !partial {
+			t.Fatalf("unexpected error calculating costs: %v", err)
+		}
+		found := []CostItem{}
+		for _, ci := range cis {
+			if ci.Strategy == StrategyNameUsage {
+				found = append(found, ci)
+			}
+		}
+		return found
+	}
+
+	if cis := usage(); len(cis) != 1 || cis[0].Value != 1000000 {
+		t.Fatalf("expected a single usage cost item valued 1000000, got %+v", cis)
+	}
+
+	pml.Err = errors.New("the server could not find the requested resource")
+	if cis := usage(); len(cis) != 0 {
+		t.Fatalf("expected no usage cost items when metrics are unavailable, got %+v", cis)
+	}
+}
+
+func TestCalculateAndEmitIntervalTimes(t *testing.T) {
+	tt := calculateCases[0]
+	re := &recordingExporter{}
+	prev := time.Now().Add(-90 * time.Minute)
+	c := &coster{
+		interval:      time.Hour,
+		nodeLister:    &lister.FakeNodeLister{Nodes: tt.nodes},
+		podLister:     &lister.FakePodLister{Pods: tt.pods},
+		config:        tt.config,
+		strategies:    []PricingStrategy{CPUPricingStrategy},
+		costExporters: []CostExporter{re},
+		lastRun:       prev,
+	}
+
+	for i := 0; i < 2; i++ {
+		re.data = nil
+		if err := c.CalculateAndEmit(); err != nil {
+			t.Fatalf("unexpected calculation error: %v", err)
+		}
+		if len(re.data) != 1 {
+			t.Fatalf("expected a single cost data, got %+v", re.data)
+		}
+
+		// Each interval begins where the previous calculation left off and
+		// spans the time measured between the two.
+		cd := re.data[0]
+		if !cd.StartTime.Equal(prev) {
+			t.Fatalf("expected start time %v, got %v", prev, cd.StartTime)
+		}
+		if !cd.EndTime.Equal(c.lastRun) {
+			t.Fatalf("expected end time %v, got %v", c.lastRun, cd.EndTime)
+		}
+		if got, measured := cd.EndTime.Sub(cd.StartTime), c.lastRun.Sub(prev); got != measured {
+			t.Fatalf("expected interval %v, got %v", measured, got)
+		}
+		prev = cd.EndTime
+	}
+}
+
+// channelExporter sends all of the cost data exported to it on the channel.
+type channelExporter chan CostData
+
+func (ce channelExporter) ExportCost(cd CostData) {
+	ce <- cd
+}
+
+func TestRunFakeClockIntervals(t *testing.T) {
+	v := &view.View{
+		Name:        "test_run_lag",
+		Measure:     MeasureLag,
+		Aggregation: view.LastValue(),
+	}
+	if err := view.Register(v); err != nil {
+		t.Fatalf("could not register view: %v", err)
+	}
+	defer view.Unregister(v)
+
+	tt := calculateCases[0]
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start)
+	ce := make(channelExporter, 1)
+	c := &coster{
+		interval:      time.Hour,
+		clock:         fc,
+		nodeLister:    &lister.FakeNodeLister{Nodes: tt.nodes},
+		podLister:     &lister.FakePodLister{Pods: tt.pods},
+		config:        tt.config,
+		strategies:    []PricingStrategy{CPUPricingStrategy},
+		costExporters: []CostExporter{ce},
+	}
+
+	ctx, done := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		if err := c.Run(ctx); err != nil {
+			errs <- err
+		}
+	}()
+	fc.BlockUntil(1)
+
+	// A late tick is followed by an early one, as the fake ticker keeps to
+	// its period regardless of when the clock is advanced past it.
+	steps := []struct {
+		advance time.Duration
+		start   time.Time
+		end     time.Time
+		lag     float64
+	}{
+		{time.Hour, start, start.Add(time.Hour), 0},
+		{time.Hour + 5*time.Second, start.Add(time.Hour), start.Add(2*time.Hour + 5*time.Second), 5000},
+		{59*time.Minute + 55*time.Second, start.Add(2*time.Hour + 5*time.Second), start.Add(3 * time.Hour), -5000},
+	}
+	for i, s := range steps {
+		fc.Advance(s.advance)
+		cd := <-ce
+		if !cd.StartTime.Equal(s.start) {
+			t.Fatalf("tick %d: expected start time %v, got %v", i, s.start, cd.StartTime)
+		}
+		if !cd.EndTime.Equal(s.end) {
+			t.Fatalf("tick %d: expected end time %v, got %v", i, s.end, cd.EndTime)
+		}
+		if i == 0 {
+			continue
+		}
+
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			t.Fatalf("could not retrieve lag: %v", err)
+		}
+		if len(rows) != 1 {
+			t.Fatalf("expected a single lag row, got %+v", rows)
+		}
+		if lag := rows[0].Data.(*view.LastValueData).Value; lag != s.lag {
+			t.Fatalf("tick %d: expected lag %v, got %v", i, s.lag, lag)
+		}
+	}
+
+	done()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCalculateRecordsOrphanedPods(t *testing.T) {
+	v := &view.View{
+		Name:        "test_orphaned_pods",
+		Measure:     MeasureOrphanedPods,
+		Aggregation: view.Sum(),
+	}
+	if err := view.Register(v); err != nil {
+		t.Fatalf("could not register view: %v", err)
+	}
+	defer view.Unregister(v)
+
+	orphan := testCalculationPod.DeepCopy()
+	orphan.Spec.NodeName = "deleted"
+
+	tt := calculateCases[0]
+	c := &coster{
+		interval:   time.Hour,
+		nodeLister: &lister.FakeNodeLister{Nodes: tt.nodes},
+		podLister:  &lister.FakePodLister{Pods: []*core_v1.Pod{testCalculationPod, orphan}},
+		config:     tt.config,
+		strategies: []PricingStrategy{CPUPricingStrategy},
+	}
+
+	for i := 1; i <= 2; i++ {
+		if err := c.CalculateAndEmit(); err != nil {
+			t.Fatalf("unexpected calculation error: %v", err)
+		}
+
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			t.Fatalf("could not retrieve orphaned pods: %v", err)
+		}
+		if len(rows) != 1 {
+			t.Fatalf("expected a single row, got %#v", rows)
+		}
+		if sum := rows[0].Data.(*view.SumData).Value; sum != float64(i) {
+			t.Fatalf("expected %d orphaned pods after %d calculations, got %v", i, i, sum)
+		}
+	}
+}
+
+func TestCalculateProratesStartTime(t *testing.T) {
+	tt := calculateCases[0]
+	cfg := *tt.config
+	cfg.ProrateStartTime = true
+
+	pod := testCalculationPod.DeepCopy()
+	pod.Status.StartTime = &metav1.Time{Time: time.Now().Add(-30 * time.Minute)}
+
+	c := &coster{
+		interval:   time.Hour,
+		nodeLister: &lister.FakeNodeLister{Nodes: tt.nodes},
+		podLister:  &lister.FakePodLister{Pods: []*core_v1.Pod{pod}},
+		config:     &cfg,
+		strategies: []PricingStrategy{CPUPricingStrategy},
+	}
+
+	cis, err := c.calculate()
+	if err != nil {
+		t.Fatalf("unexpected calculation error: %v", err)
+	}
+	if len(cis) != 1 {
+		t.Fatalf("expected a single cost item, got %d", len(cis))
+	}
+
+	// The pod started halfway through the hour, give or take the time taken
+	// to run the calculation.
+	full := tt.expectedCostItems[0].Value
+	if v := cis[0].Value; v < full/2 || v > full/2+full/100 {
+		t.Fatalf("expected roughly half of %d, got %d", full, v)
+	}
+}
+
+func TestCalculateProratesRescheduledPod(t *testing.T) {
+	pricey := &core_v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   "pricey-node",
+		Labels: map[string]string{"pool": "pricey"},
+	}}
+	cfg := Config{
+		ProrateStartTime: true,
+		Pricing: CostTable{
+			Entries: []*CostTableEntry{
+				&CostTableEntry{Labels: calculateTestNodeLabels, HourlyMilliCPUCostMicroCents: 1000},
+				&CostTableEntry{Labels: pricey.Labels, HourlyMilliCPUCostMicroCents: 4000},
+			},
+		},
+	}
+
+	original := testCalculationPod.DeepCopy()
+	original.Status.StartTime = &metav1.Time{Time: time.Now().Add(-24 * time.Hour)}
+	pl := &lister.FakePodLister{Pods: []*core_v1.Pod{original}}
+
+	c := &coster{
+		interval:   time.Hour,
+		nodeLister: &lister.FakeNodeLister{Nodes: []*core_v1.Node{testCalculationNode, pricey}},
+		podLister:  pl,
+		config:     &cfg,
+		strategies: []PricingStrategy{CPUPricingStrategy},
+	}
+	if _, err := c.calculate(); err != nil {
+		t.Fatalf("unexpected calculation error: %v", err)
+	}
+
+	// An hour later the pod has been rescheduled, replacing it with a pod of
+	// the same name on the pricier node that has only run for the last
+	// quarter of the interval.
+	c.lastRun = c.lastRun.Add(-time.Hour)
+	rescheduled := original.DeepCopy()
+	rescheduled.UID = "rescheduled"
+	rescheduled.Spec.NodeName = pricey.Name
+	rescheduled.Status.StartTime = &metav1.Time{Time: time.Now().Add(-15 * time.Minute)}
+	pl.Pods = []*core_v1.Pod{rescheduled}
+
+	cis, err := c.calculate()
+	if err != nil {
+		t.Fatalf("unexpected calculation error: %v", err)
+	}
+	if len(cis) != 1 || cis[0].Node != pricey {
+		t.Fatalf("expected a single cost item on the pricier node, got %#v", cis)
+	}
+
+	// A quarter of an hour at the pricier node's rate, give or take the time
+	// taken to run the calculations, rather than the whole hour.
+	full := int64(4000000)
+	if v := cis[0].Value; v < full/4-full/100 || v > full/4+full/100 {
+		t.Fatalf("expected roughly a quarter of %d, got %d", full, v)
+	}
+}
+
+func TestCalculateAndEmitSkipZeroCost(t *testing.T) {
+	tt := calculateCases[0]
+	requestless := testCalculationPod.DeepCopy()
+	requestless.Name = "requestless"
+	requestless.Spec.Containers[0].Resources = core_v1.ResourceRequirements{}
+
+	for _, skip := range []bool{false, true} {
+		cfg := *tt.config
+		cfg.SkipZeroCost = skip
+
+		re := &recordingExporter{}
+		c := &coster{
+			interval:      time.Hour,
+			nodeLister:    &lister.FakeNodeLister{Nodes: tt.nodes},
+			podLister:     &lister.FakePodLister{Pods: []*core_v1.Pod{testCalculationPod, requestless}},
+			config:        &cfg,
+			strategies:    []PricingStrategy{CPUPricingStrategy},
+			costExporters: []CostExporter{re},
+		}
+
+		if err := c.CalculateAndEmit(); err != nil {
+			t.Fatalf("unexpected calculation error: %v", err)
+		}
+
+		values := []int64{}
+		for _, cd := range re.data {
+			values = append(values, cd.Value)
+		}
+		expected := []int64{1000000, 0}
+		if skip {
+			expected = []int64{1000000}
+		}
+		if diff := deep.Equal(values, expected); diff != nil {
+			t.Fatalf("SkipZeroCost %v: %v", skip, diff)
+		}
+	}
+}
+
+func TestCalculateAndEmitStaticDimensions(t *testing.T) {
+	tt := calculateCases[0]
+	cfg := *tt.config
+	cfg.Mapper = Mapper{Entries: []Mapping{
+		Mapping{Destination: "kind", Source: "{.Kind}"},
+		Mapping{Destination: DimensionEnvironment, Source: "{.Strategy}"},
+	}}
+
+	re := &recordingExporter{}
+	c := &coster{
+		interval:      time.Hour,
+		nodeLister:    &lister.FakeNodeLister{Nodes: tt.nodes},
+		podLister:     &lister.FakePodLister{Pods: tt.pods},
+		config:        &cfg,
+		strategies:    []PricingStrategy{CPUPricingStrategy},
+		costExporters: []CostExporter{re},
+	}
+	WithStaticDimensions(map[string]string{
+		DimensionCluster:     "us-central1-a",
+		DimensionEnvironment: "production",
+		"unset":              "",
+	})(c)
+
+	if err := c.CalculateAndEmit(); err != nil {
+		t.Fatalf("unexpected calculation error: %v", err)
+	}
+
+	if len(re.data) != 1 {
+		t.Fatalf("expected a single exported cost datum, got %d", len(re.data))
+	}
+
+	expected := map[string]string{
+		"kind":               string(ResourceCostCPU),
+		DimensionCluster:     "us-central1-a",
+		DimensionEnvironment: StrategyNameCPU,
+	}
+	if diff := deep.Equal(re.data[0].Dimensions, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestCalculateAndEmitNodeDimensions(t *testing.T) {
+	tt := calculateCases[0]
+	cfg := *tt.config
+	cfg.Mapper = Mapper{Entries: []Mapping{
+		Mapping{Destination: "kind", Source: "{.Kind}"},
+		Mapping{Destination: "mapped", Source: "{.Strategy}"},
+	}}
+
+	re := &recordingExporter{}
+	c := &coster{
+		interval:      time.Hour,
+		nodeLister:    &lister.FakeNodeLister{Nodes: tt.nodes},
+		podLister:     &lister.FakePodLister{Pods: tt.pods},
+		config:        &cfg,
+		strategies:    []PricingStrategy{CPUPricingStrategy, NodePricingStrategy},
+		costExporters: []CostExporter{re},
 	}
-	if c.podLister == nil {
-		t.Fatal("constructor should populate pod lister")
+	WithNodeDimension()(c)
+	WithNodeLabelDimensions(map[string]string{
+		"test_label": "test",
+		"missing":    "example.com/missing",
+		"mapped":     "test",
+	})(c)
+
+	if err := c.CalculateAndEmit(); err != nil {
+		t.Fatalf("unexpected calculation error: %v", err)
 	}
 
-	if c.nodeLister == nil {
-		t.Fatal("constructor should populate node lister")
+	if len(re.data) != 2 {
+		t.Fatalf("expected pod and node cost data, got %d", len(re.data))
 	}
 
+	for _, cd := range re.data {
+		expected := map[string]string{
+			"kind":        string(cd.Kind),
+			"mapped":      cd.Strategy,
+			DimensionNode: calculateTestNodeName,
+			"test_label":  "test",
+			"missing":     "",
+		}
+		if diff := deep.Equal(cd.Dimensions, expected); diff != nil {
+			t.Errorf("%s: %v", cd.Strategy, diff)
+		}
+	}
 }
 
 const calculateTestNodeName = "woot"
@@ -182,7 +1256,6 @@ func TestCalculate(t *testing.T) {
 
 			c := &coster{
 				interval:           time.Hour,
-				ticker:             time.NewTicker(time.Hour),
 				prometheusExporter: pro,
 				listenAddr:         ":5000",
 				nodeLister:         &nodl,
@@ -203,6 +1276,203 @@ func TestCalculate(t *testing.T) {
 	}
 }
 
+func TestCalculateMaxInterval(t *testing.T) {
+	tt := calculateCases[0]
+	c := &coster{
+		interval:    time.Hour,
+		maxInterval: 2 * time.Hour,
+		nodeLister:  &lister.FakeNodeLister{Nodes: tt.nodes},
+		podLister:   &lister.FakePodLister{Pods: tt.pods},
+		config:      tt.config,
+		strategies:  []PricingStrategy{CPUPricingStrategy},
+		lastRun:     time.Now().Add(-10 * time.Hour),
+	}
+
+	ci, err := c.calculate()
+	if err != nil {
+		t.Fatalf("unexpected error calculating costs: %v", err)
+	}
+
+	// Ten hours have passed but only two hours' worth of cost is priced.
+	expected := tt.expectedCostItems[0].Value * 2
+	if len(ci) != 1 || ci[0].Value != expected {
+		t.Fatalf("expected a single cost item valued %d, got %+v", expected, ci)
+	}
+}
+
+func TestSmoothLagConverges(t *testing.T) {
+	c := &coster{}
+	WithLagSmoothing(0.5)(c)
+
+	// A transient pause is followed by calculations consistently 100ms late.
+	lags := []float64{5000}
+	for i := 0; i < 20; i++ {
+		lags = append(lags, 100)
+	}
+
+	var smoothed float64
+	for i, lag := range lags {
+		prev := smoothed
+		smoothed = c.smoothLag(lag)
+		if i == 0 && smoothed != lag {
+			t.Fatalf("expected the average to be seeded with the first lag %v, got %v", lag, smoothed)
+		}
+		if i > 0 && smoothed >= prev {
+			t.Fatalf("expected the average to fall towards 100ms, got %v after %v", smoothed, prev)
+		}
+	}
+
+	if math.Abs(smoothed-100) > 0.01 {
+		t.Fatalf("expected the average to converge on 100ms, got %v", smoothed)
+	}
+}
+
+func TestCalculateOnce(t *testing.T) {
+	tt := calculateCases[0]
+	c := &coster{
+		interval:      time.Hour,
+		nodeLister:    &lister.FakeNodeLister{Nodes: tt.nodes},
+		podLister:     &lister.FakePodLister{Pods: tt.pods},
+		config:        tt.config,
+		strategies:    []PricingStrategy{CPUPricingStrategy, GPUPricingStrategy},
+		strategyNames: []string{StrategyNameCPU, StrategyNameGPU},
+	}
+
+	ci, err := c.CalculateOnce(context.Background())
+	if errors.Cause(err) != ErrEmptyStrategy {
+		t.Fatalf("expected the gpu strategy to be reported empty, got %v", err)
+	}
+	if !strings.Contains(err.Error(), StrategyNameGPU) || strings.Contains(err.Error(), StrategyNameCPU) {
+		t.Fatalf("expected error to name only the empty strategy, got %v", err)
+	}
+
+	if diff := deep.Equal(ci, tt.expectedCostItems); diff != nil {
+		t.Fatal(diff)
+	}
+
+	c.strategies = []PricingStrategy{CPUPricingStrategy}
+	c.strategyNames = []string{StrategyNameCPU}
+	if _, err := c.CalculateOnce(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestNewKubernetesCosterWithPodFilters(t *testing.T) {
+	cli := testclient.NewSimpleClientset()
+	pro, err := prometheus.NewExporter(prometheus.Options{})
+	if err != nil {
+		t.Fatalf("could not get prometheus exporter %v", err)
+	}
+
+	c, err := NewKubernetesCoster(time.Hour, &Config{}, cli, pro, ":5000", nil, WithPodFilters(NamespaceExcludeFilter("kube-system")))
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+
+	pods := []*core_v1.Pod{
+		&core_v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}, Status: core_v1.PodStatus{Phase: core_v1.PodRunning}},
+		&core_v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system"}, Status: core_v1.PodStatus{Phase: core_v1.PodRunning}},
+		&core_v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}, Status: core_v1.PodStatus{Phase: core_v1.PodPending}},
+	}
+
+	if diff := deep.Equal(c.applyPodFilters(pods), pods[:1]); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestNewKubernetesCosterWithScheduledPods(t *testing.T) {
+	cli := testclient.NewSimpleClientset()
+	pro, err := prometheus.NewExporter(prometheus.Options{})
+	if err != nil {
+		t.Fatalf("could not get prometheus exporter %v", err)
+	}
+
+	c, err := NewKubernetesCoster(time.Hour, &Config{}, cli, pro, ":5000", nil, WithScheduledPods())
+	if err != nil {
+		t.Fatalf("error constructing coster: %v", err)
+	}
+
+	pods := []*core_v1.Pod{
+		&core_v1.Pod{Spec: core_v1.PodSpec{NodeName: "node"}, Status: core_v1.PodStatus{Phase: core_v1.PodRunning}},
+		&core_v1.Pod{Spec: core_v1.PodSpec{NodeName: "node"}, Status: core_v1.PodStatus{Phase: core_v1.PodPending}},
+		&core_v1.Pod{Status: core_v1.PodStatus{Phase: core_v1.PodPending}},
+	}
+
+	if diff := deep.Equal(c.applyPodFilters(pods), pods[:2]); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	c := &coster{
+		config: &Config{
+			EnableLimitsStrategy: true,
+			Pricing:              CostTable{Entries: []*CostTableEntry{&CostTableEntry{HourlyMilliCPUCostMicroCents: 1}}},
+		},
+	}
+
+	reloaded := &Config{
+		Pricing: CostTable{Entries: []*CostTableEntry{&CostTableEntry{HourlyMilliCPUCostMicroCents: 2}}},
+		Mapper:  Mapper{Entries: []Mapping{Mapping{Destination: "service", Source: "{.Pod.ObjectMeta.Labels.service}"}}},
+	}
+	c.ReloadConfig(reloaded)
+
+	expected := &Config{
+		EnableLimitsStrategy: true,
+		Pricing:              reloaded.Pricing,
+		Mapper:               reloaded.Mapper,
+	}
+	if diff := deep.Equal(c.currentConfig(), expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	c := &coster{
+		interval:   time.Hour,
+		nodeLister: &lister.FakeNodeLister{},
+		podLister:  &lister.FakePodLister{},
+		config:     &Config{},
+		strategies: []PricingStrategy{},
+	}
+
+	get := func() (int, Readiness) {
+		rec := httptest.NewRecorder()
+		c.readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		var r Readiness
+		if err := json.NewDecoder(rec.Body).Decode(&r); err != nil {
+			t.Fatalf("could not decode readiness: %v", err)
+		}
+		return rec.Code, r
+	}
+
+	code, r := get()
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before any calculation, got %d", code)
+	}
+	if !r.PodCacheSynced || !r.NodeCacheSynced || r.LastCalculation != nil {
+		t.Fatalf("unexpected readiness before any calculation: %#v", r)
+	}
+
+	c.recordCalculation(ErrSenselessInterval)
+	code, r = get()
+	if code != http.StatusServiceUnavailable || r.LastError != ErrSenselessInterval.Error() {
+		t.Fatalf("expected 503 with the last error after a failure, got %d %#v", code, r)
+	}
+
+	if err := c.CalculateAndEmit(); err != nil {
+		t.Fatalf("unexpected calculation error: %v", err)
+	}
+	code, r = get()
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 after a successful calculation, got %d", code)
+	}
+	if r.LastCalculation == nil || r.LastError != "" {
+		t.Fatalf("unexpected readiness after a successful calculation: %#v", r)
+	}
+}
+
 func TestRun(t *testing.T) {
 	pro, err := prometheus.NewExporter(prometheus.Options{})
 	if err != nil {
@@ -214,7 +1484,6 @@ func TestRun(t *testing.T) {
 
 	c := &coster{
 		interval:           time.Hour,
-		ticker:             time.NewTicker(time.Hour),
 		prometheusExporter: pro,
 		listenAddr:         ":5000",
 		nodeLister:         &nodl,
@@ -280,7 +1549,6 @@ func BenchmarkCalculate(b *testing.B) {
 
 			c := &coster{
 				interval:           time.Hour,
-				ticker:             time.NewTicker(time.Hour),
 				prometheusExporter: pro,
 				listenAddr:         ":5000",
 				nodeLister:         &nodl,
@@ -297,3 +1565,435 @@ func BenchmarkCalculate(b *testing.B) {
 		})
 	}
 }
+
+var validTestMapper = Mapper{Entries: []Mapping{Mapping{Destination: "service", Source: "{.Pod.ObjectMeta.Labels.service}"}}}
+
+var validTestPricing = CostTable{Entries: []*CostTableEntry{&CostTableEntry{HourlyMilliCPUCostMicroCents: 1}}}
+
+var validateConfigCases = []struct {
+	name             string
+	config           Config
+	expectedProblems []string
+}{
+	{
+		name:   "valid configuration",
+		config: Config{Mapper: validTestMapper, Pricing: validTestPricing},
+	},
+	{
+		name:             "no pricing entries",
+		config:           Config{Mapper: validTestMapper},
+		expectedProblems: []string{"pricing table has no entries"},
+	},
+	{
+		name: "negative costs",
+		config: Config{
+			Mapper: validTestMapper,
+			Pricing: CostTable{Entries: []*CostTableEntry{
+				&CostTableEntry{HourlyMilliCPUCostMicroCents: 1},
+				&CostTableEntry{HourlyMemoryByteCostMicroCents: -1, HourlyGPUCostMicroCents: -2},
+			}},
+		},
+		expectedProblems: []string{
+			"pricing entry 1 has negative HourlyMemoryByteCostMicroCents -1",
+			"pricing entry 1 has negative HourlyGPUCostMicroCents -2",
+		},
+	},
+	{
+		name: "negative gpu resource costs",
+		config: Config{
+			Mapper: validTestMapper,
+			Pricing: CostTable{Entries: []*CostTableEntry{
+				&CostTableEntry{HourlyGPUResourceCostMicroCents: map[string]float64{"nvidia.com/mig-1g.5gb": -1}},
+			}},
+		},
+		expectedProblems: []string{
+			"pricing entry 0 has negative HourlyGPUResourceCostMicroCents for nvidia.com/mig-1g.5gb -1",
+		},
+	},
+	{
+		name: "negative storage and load balancer costs",
+		config: Config{
+			Mapper: validTestMapper,
+			Pricing: CostTable{Entries: []*CostTableEntry{
+				&CostTableEntry{HourlyStorageByteCostMicroCents: -1, HourlyLoadBalancerCostMicroCents: -2},
+			}},
+		},
+		expectedProblems: []string{
+			"pricing entry 0 has negative HourlyStorageByteCostMicroCents -1",
+			"pricing entry 0 has negative HourlyLoadBalancerCostMicroCents -2",
+		},
+	},
+	{
+		name:   "negative weights",
+		config: Config{Mapper: validTestMapper, Pricing: validTestPricing, CPUWeight: -1, MemoryWeight: -0.5},
+		expectedProblems: []string{
+			"negative CPUWeight -1",
+			"negative MemoryWeight -0.5",
+		},
+	},
+	{
+		name: "unknown source kind",
+		config: Config{
+			Pricing: validTestPricing,
+			Mapper:  Mapper{Entries: []Mapping{Mapping{Destination: "service", Source: "{.ObjectMeta.Labels.app}", SourceKind: "container"}}},
+		},
+		expectedProblems: []string{`mapping entry 0 (service) has unknown source kind "container"`},
+	},
+	{
+		name: "source and source key",
+		config: Config{
+			Pricing: validTestPricing,
+			Mapper:  Mapper{Entries: []Mapping{Mapping{Destination: "service", Source: "{.ObjectMeta.Labels.app}", SourceKey: "app"}}},
+		},
+		expectedProblems: []string{"mapping entry 0 (service) sets both a source and a source key"},
+	},
+	{
+		name: "sources alongside a source",
+		config: Config{
+			Pricing: validTestPricing,
+			Mapper:  Mapper{Entries: []Mapping{Mapping{Destination: "service", Source: "{.ObjectMeta.Labels.app}", Sources: []string{"{.ObjectMeta.Labels.service}"}}}},
+		},
+		expectedProblems: []string{"mapping entry 0 (service) sets sources alongside a source or source key"},
+	},
+	{
+		name: "invalid sources",
+		config: Config{
+			Pricing: validTestPricing,
+			Mapper:  Mapper{Entries: []Mapping{Mapping{Destination: "service", Sources: []string{"{.ObjectMeta.Labels.app}", "{.ObjectMeta.Labels.app"}}}},
+		},
+		expectedProblems: []string{`mapping entry 0 (service) has invalid source "{.ObjectMeta.Labels.app": unclosed action`},
+	},
+	{
+		name: "unknown source map",
+		config: Config{
+			Pricing: validTestPricing,
+			Mapper:  Mapper{Entries: []Mapping{Mapping{Destination: "service", SourceKey: "app", SourceMap: "taints"}}},
+		},
+		expectedProblems: []string{`mapping entry 0 (service) has unknown source map "taints"`},
+	},
+	{
+		name:             "unknown strategy",
+		config:           Config{Mapper: validTestMapper, Pricing: validTestPricing, Strategies: []string{StrategyNameCPU, "CheapPricingStrategy"}},
+		expectedProblems: []string{`unknown strategy "CheapPricingStrategy"`},
+	},
+	{
+		name:             "unknown match mode",
+		config:           Config{Mapper: validTestMapper, Pricing: CostTable{Entries: validTestPricing.Entries, MatchMode: "most_specific"}},
+		expectedProblems: []string{`pricing table has unknown MatchMode "most_specific"`},
+	},
+	{
+		name:             "unknown cost unit",
+		config:           Config{Mapper: validTestMapper, Pricing: validTestPricing, CostUnit: "euros"},
+		expectedProblems: []string{`unknown cost unit "euros"`},
+	},
+	{
+		name:             "no mapper entries",
+		config:           Config{Pricing: validTestPricing},
+		expectedProblems: []string{"mapping has no entries"},
+	},
+	{
+		name: "invalid jsonpath source",
+		config: Config{
+			Pricing: validTestPricing,
+			Mapper:  Mapper{Entries: []Mapping{Mapping{Destination: "service", Source: "{.Pod.ObjectMeta.Labels.service"}}},
+		},
+		expectedProblems: []string{`mapping entry 0 (service) has invalid source "{.Pod.ObjectMeta.Labels.service": unclosed action`},
+	},
+	{
+		name: "invalid transform",
+		config: Config{
+			Pricing: validTestPricing,
+			Mapper:  Mapper{Entries: []Mapping{Mapping{Destination: "service", Source: "{.Pod.ObjectMeta.Labels.service}", Transform: "reverse"}}},
+		},
+		expectedProblems: []string{`mapping entry 0 (service) has invalid transform: unknown transform "reverse"`},
+	},
+	{
+		name: "negative overcommit factor",
+		config: Config{
+			Mapper:  validTestMapper,
+			Pricing: CostTable{Entries: []*CostTableEntry{&CostTableEntry{HourlyMilliCPUCostMicroCents: 1, OvercommitFactor: -1.5}}},
+		},
+		expectedProblems: []string{"pricing entry 0 has negative OvercommitFactor -1.5"},
+	},
+	{
+		name: "undercommit factor",
+		config: Config{
+			Mapper:  validTestMapper,
+			Pricing: CostTable{Entries: []*CostTableEntry{&CostTableEntry{HourlyMilliCPUCostMicroCents: 1, OvercommitFactor: 0.5}}},
+		},
+		expectedProblems: []string{"pricing entry 0 has OvercommitFactor 0.5 below 1"},
+	},
+	{
+		name: "invalid team entries",
+		config: Config{
+			Mapper:  validTestMapper,
+			Pricing: validTestPricing,
+			Teams: TeamTable{Entries: []TeamTableEntry{
+				TeamTableEntry{Namespace: "payments-[", Team: "billing"},
+				TeamTableEntry{Namespace: "data-*"},
+			}},
+		},
+		expectedProblems: []string{
+			`team entry 0 has invalid namespace pattern "payments-[": syntax error in pattern`,
+			"team entry 1 (data-*) has no team",
+		},
+	},
+	{
+		name:   "reports every problem",
+		config: Config{},
+		expectedProblems: []string{
+			"pricing table has no entries",
+			"mapping has no entries",
+		},
+	},
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, tt := range validateConfigCases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.expectedProblems == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			verr, ok := err.(*ConfigValidationError)
+			if !ok {
+				t.Fatalf("expected a ConfigValidationError, got %#v", err)
+			}
+			if diff := deep.Equal(verr.Problems, tt.expectedProblems); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestNewConfigFromReaderValidates(t *testing.T) {
+	if _, err := NewConfigFromReader(strings.NewReader(`{"Pricing": {"Entries": [{}]}}`)); err == nil {
+		t.Fatal("expected configuration without mappings to be rejected")
+	}
+}
+
+const testJSONConfig = `{
+  "Pricing": {
+    "MatchMode": "most-specific",
+    "Entries": [
+      {
+        "Labels": {
+          "beta.kubernetes.io/instance-type": "n1-standard-16",
+          "cloud.google.com/gke-preemptible": "true"
+        },
+        "HourlyMemoryByteCostMicroCents": 0.00043406151235103607,
+        "HourlyMilliCPUCostMicroCents": 3477.21,
+        "Multiplier": 0.3
+      },
+      {
+        "Labels": {
+          "beta.kubernetes.io/instance-type": "glob:n1-standard-*"
+        },
+        "HourlyMemoryByteCostMicroCents": 0.0002,
+        "HourlyMilliCPUCostMicroCents": 2000
+      }
+    ]
+  },
+  "Mapper": {
+    "Entries": [
+      {
+        "Destination": "service",
+        "Source": "{.Pod.ObjectMeta.Labels.service}",
+        "Default": "unknown"
+      },
+      {
+        "Destination": "node_instance_type",
+        "Source": "{.Node.ObjectMeta.Labels['beta.kubernetes.io/instance-type']}",
+        "Default": "unknown"
+      }
+    ]
+  }
+}`
+
+const testYAMLConfig = `
+Pricing:
+  MatchMode: most-specific
+  Entries:
+  - Labels:
+      beta.kubernetes.io/instance-type: n1-standard-16
+      cloud.google.com/gke-preemptible: "true"
+    HourlyMemoryByteCostMicroCents: 0.00043406151235103607
+    HourlyMilliCPUCostMicroCents: 3477.21
+    Multiplier: 0.3
+  - Labels:
+      beta.kubernetes.io/instance-type: "glob:n1-standard-*"
+    HourlyMemoryByteCostMicroCents: 0.0002
+    HourlyMilliCPUCostMicroCents: 2000
+Mapper:
+  Entries:
+  - Destination: service
+    Source: "{.Pod.ObjectMeta.Labels.service}"
+    Default: unknown
+  - Destination: node_instance_type
+    Source: "{.Node.ObjectMeta.Labels['beta.kubernetes.io/instance-type']}"
+    Default: unknown
+`
+
+func TestYAMLConfigMatchesJSON(t *testing.T) {
+	j, err := NewConfigFromNamedReader("config.json", strings.NewReader(testJSONConfig))
+	if err != nil {
+		t.Fatalf("could not load json configuration: %v", err)
+	}
+
+	y, err := NewConfigFromNamedReader("config.yaml", strings.NewReader(testYAMLConfig))
+	if err != nil {
+		t.Fatalf("could not load yaml configuration: %v", err)
+	}
+
+	if diff := deep.Equal(y, j); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+var mergeTestGPUConfig = &Config{
+	Pricing: CostTable{
+		Entries: []*CostTableEntry{
+			&CostTableEntry{Labels: Labels{"accelerator": "glob:*"}, HourlyGPUCostMicroCents: 3},
+			&CostTableEntry{Labels: Labels{"size": "glob:*"}, HourlyMilliCPUCostMicroCents: 2},
+		},
+	},
+	Mapper: Mapper{Entries: []Mapping{
+		Mapping{Destination: "service", Source: "{.Pod.ObjectMeta.Labels.service}"},
+		Mapping{Destination: "accelerator", Source: "{.Node.ObjectMeta.Labels.accelerator}"},
+	}},
+}
+
+var mergeTestComputeConfig = &Config{
+	Pricing: CostTable{
+		Entries: []*CostTableEntry{
+			&CostTableEntry{Labels: Labels{"size": "glob:*"}, HourlyMilliCPUCostMicroCents: 1},
+		},
+		MaxScale: 4,
+	},
+	Mapper: Mapper{Entries: []Mapping{
+		Mapping{Destination: "service", Source: "{.Pod.ObjectMeta.Labels.app}", Default: "unknown"},
+		Mapping{Destination: "component", Source: "{.Pod.ObjectMeta.Labels.component}"},
+	}},
+}
+
+func TestMergeConfigs(t *testing.T) {
+	merged, err := MergeConfigs(mergeTestGPUConfig, mergeTestComputeConfig)
+	if err != nil {
+		t.Fatalf("unexpected error merging configurations: %v", err)
+	}
+
+	expected := &Config{
+		Pricing: CostTable{
+			Entries: []*CostTableEntry{
+				mergeTestGPUConfig.Pricing.Entries[0],
+				mergeTestGPUConfig.Pricing.Entries[1],
+				mergeTestComputeConfig.Pricing.Entries[0],
+			},
+			MaxScale: 4,
+		},
+		Mapper: Mapper{Entries: []Mapping{
+			mergeTestComputeConfig.Mapper.Entries[0],
+			mergeTestGPUConfig.Mapper.Entries[1],
+			mergeTestComputeConfig.Mapper.Entries[1],
+		}},
+	}
+	if diff := deep.Equal(merged, expected); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// Entries from earlier configurations take precedence when matching.
+	e, err := merged.Pricing.FindByLabels(Labels{"size": "large"})
+	if err != nil {
+		t.Fatalf("unexpected error finding entry: %v", err)
+	}
+	if e != mergeTestGPUConfig.Pricing.Entries[1] {
+		t.Fatalf("expected the first matching entry to win, got %#v", e)
+	}
+
+	reversed, err := MergeConfigs(mergeTestComputeConfig, mergeTestGPUConfig)
+	if err != nil {
+		t.Fatalf("unexpected error merging configurations: %v", err)
+	}
+	e, err = reversed.Pricing.FindByLabels(Labels{"size": "large"})
+	if err != nil {
+		t.Fatalf("unexpected error finding entry: %v", err)
+	}
+	if e != mergeTestComputeConfig.Pricing.Entries[0] {
+		t.Fatalf("expected the first matching entry to win, got %#v", e)
+	}
+}
+
+func TestMergeConfigsWeights(t *testing.T) {
+	weights := &Config{CPUWeight: 0.3, MemoryWeight: 0.7}
+	merged, err := MergeConfigs(mergeTestComputeConfig, weights, &Config{CPUWeight: 0.4})
+	if err != nil {
+		t.Fatalf("unexpected error merging configurations: %v", err)
+	}
+
+	if merged.CPUWeight != 0.4 || merged.MemoryWeight != 0.7 {
+		t.Fatalf("expected later weights to override earlier ones, got cpu %v and memory %v", merged.CPUWeight, merged.MemoryWeight)
+	}
+}
+
+func TestMergeConfigsProrateStartTime(t *testing.T) {
+	merged, err := MergeConfigs(mergeTestComputeConfig, &Config{ProrateStartTime: true}, &Config{})
+	if err != nil {
+		t.Fatalf("unexpected error merging configurations: %v", err)
+	}
+	if !merged.ProrateStartTime {
+		t.Fatal("expected proration enabled by any configuration to be merged")
+	}
+}
+
+func TestMergeConfigsSkipZeroCost(t *testing.T) {
+	merged, err := MergeConfigs(mergeTestComputeConfig, &Config{SkipZeroCost: true}, &Config{})
+	if err != nil {
+		t.Fatalf("unexpected error merging configurations: %v", err)
+	}
+	if !merged.SkipZeroCost {
+		t.Fatal("expected skipping zero costs enabled by any configuration to be merged")
+	}
+}
+
+func TestMergeConfigsValidates(t *testing.T) {
+	if _, err := MergeConfigs(); err == nil {
+		t.Fatal("expected merging no configurations to fail")
+	}
+
+	if _, err := MergeConfigs(&Config{Pricing: mergeTestComputeConfig.Pricing}); err == nil {
+		t.Fatal("expected merged configuration without mappings to be rejected")
+	}
+}
+
+func TestNewConfigFromFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kostanza-config")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	pricing := filepath.Join(dir, "pricing.json")
+	if err := ioutil.WriteFile(pricing, []byte(`{"Pricing": {"Entries": [{"HourlyMilliCPUCostMicroCents": 1}]}}`), 0644); err != nil {
+		t.Fatalf("could not write configuration: %v", err)
+	}
+	mapper := filepath.Join(dir, "mapper.yaml")
+	if err := ioutil.WriteFile(mapper, []byte("Mapper:\n  Entries:\n  - Destination: service\n    Source: \"{.Pod.ObjectMeta.Labels.service}\"\n"), 0644); err != nil {
+		t.Fatalf("could not write configuration: %v", err)
+	}
+
+	if _, err := NewConfigFromFile(pricing); err == nil {
+		t.Fatal("expected partial configuration to be rejected by itself")
+	}
+
+	c, err := NewConfigFromFiles(pricing, mapper)
+	if err != nil {
+		t.Fatalf("unexpected error loading configurations: %v", err)
+	}
+	if len(c.Pricing.Entries) != 1 || len(c.Mapper.Entries) != 1 {
+		t.Fatalf("unexpected merged configuration: %#v", c)
+	}
+}
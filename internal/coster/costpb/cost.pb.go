@@ -0,0 +1,297 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: cost.proto
+
+package costpb
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+import timestamp "github.com/golang/protobuf/ptypes/timestamp"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+// CostData is a single cost datum, as exported by kostanza.
+type CostData struct {
+	Kind                 string               `protobuf:"bytes,1,opt,name=kind,proto3" json:"kind,omitempty"`
+	Strategy             string               `protobuf:"bytes,2,opt,name=strategy,proto3" json:"strategy,omitempty"`
+	Value                int64                `protobuf:"varint,3,opt,name=value,proto3" json:"value,omitempty"`
+	Unit                 string               `protobuf:"bytes,4,opt,name=unit,proto3" json:"unit,omitempty"`
+	UnitValue            float64              `protobuf:"fixed64,5,opt,name=unit_value,json=unitValue,proto3" json:"unit_value,omitempty"`
+	ContainerName        string               `protobuf:"bytes,6,opt,name=container_name,json=containerName,proto3" json:"container_name,omitempty"`
+	Dimensions           map[string]string    `protobuf:"bytes,7,rep,name=dimensions,proto3" json:"dimensions,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	StartTime            *timestamp.Timestamp `protobuf:"bytes,8,opt,name=start_time,json=startTime,proto3" json:"start_time,omitempty"`
+	EndTime              *timestamp.Timestamp `protobuf:"bytes,9,opt,name=end_time,json=endTime,proto3" json:"end_time,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}             `json:"-"`
+	XXX_unrecognized     []byte               `json:"-"`
+	XXX_sizecache        int32                `json:"-"`
+}
+
+func (m *CostData) Reset()         { *m = CostData{} }
+func (m *CostData) String() string { return proto.CompactTextString(m) }
+func (*CostData) ProtoMessage()    {}
+func (*CostData) Descriptor() ([]byte, []int) {
+	return fileDescriptor_cost_7f964288c3170654, []int{0}
+}
+func (m *CostData) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CostData.Unmarshal(m, b)
+}
+func (m *CostData) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CostData.Marshal(b, m, deterministic)
+}
+func (dst *CostData) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CostData.Merge(dst, src)
+}
+func (m *CostData) XXX_Size() int {
+	return xxx_messageInfo_CostData.Size(m)
+}
+func (m *CostData) XXX_DiscardUnknown() {
+	xxx_messageInfo_CostData.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CostData proto.InternalMessageInfo
+
+func (m *CostData) GetKind() string {
+	if m != nil {
+		return m.Kind
+	}
+	return ""
+}
+
+func (m *CostData) GetStrategy() string {
+	if m != nil {
+		return m.Strategy
+	}
+	return ""
+}
+
+func (m *CostData) GetValue() int64 {
+	if m != nil {
+		return m.Value
+	}
+	return 0
+}
+
+func (m *CostData) GetUnit() string {
+	if m != nil {
+		return m.Unit
+	}
+	return ""
+}
+
+func (m *CostData) GetUnitValue() float64 {
+	if m != nil {
+		return m.UnitValue
+	}
+	return 0
+}
+
+func (m *CostData) GetContainerName() string {
+	if m != nil {
+		return m.ContainerName
+	}
+	return ""
+}
+
+func (m *CostData) GetDimensions() map[string]string {
+	if m != nil {
+		return m.Dimensions
+	}
+	return nil
+}
+
+func (m *CostData) GetStartTime() *timestamp.Timestamp {
+	if m != nil {
+		return m.StartTime
+	}
+	return nil
+}
+
+func (m *CostData) GetEndTime() *timestamp.Timestamp {
+	if m != nil {
+		return m.EndTime
+	}
+	return nil
+}
+
+// SubscribeRequest subscribes to the cost data exported by kostanza.
+type SubscribeRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SubscribeRequest) Reset()         { *m = SubscribeRequest{} }
+func (m *SubscribeRequest) String() string { return proto.CompactTextString(m) }
+func (*SubscribeRequest) ProtoMessage()    {}
+func (*SubscribeRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_cost_7f964288c3170654, []int{1}
+}
+func (m *SubscribeRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SubscribeRequest.Unmarshal(m, b)
+}
+func (m *SubscribeRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SubscribeRequest.Marshal(b, m, deterministic)
+}
+func (dst *SubscribeRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SubscribeRequest.Merge(dst, src)
+}
+func (m *SubscribeRequest) XXX_Size() int {
+	return xxx_messageInfo_SubscribeRequest.Size(m)
+}
+func (m *SubscribeRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SubscribeRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SubscribeRequest proto.InternalMessageInfo
+
+func init() {
+	proto.RegisterType((*CostData)(nil), "kostanza.v1.CostData")
+	proto.RegisterMapType((map[string]string)(nil), "kostanza.v1.CostData.DimensionsEntry")
+	proto.RegisterType((*SubscribeRequest)(nil), "kostanza.v1.SubscribeRequest")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// CostServiceClient is the client API for CostService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type CostServiceClient interface {
+	// Subscribe streams cost data as it is exported until the client
+	// disconnects.
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (CostService_SubscribeClient, error)
+}
+
+type costServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewCostServiceClient(cc *grpc.ClientConn) CostServiceClient {
+	return &costServiceClient{cc}
+}
+
+func (c *costServiceClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (CostService_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_CostService_serviceDesc.Streams[0], "/kostanza.v1.CostService/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &costServiceSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type CostService_SubscribeClient interface {
+	Recv() (*CostData, error)
+	grpc.ClientStream
+}
+
+type costServiceSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *costServiceSubscribeClient) Recv() (*CostData, error) {
+	m := new(CostData)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CostServiceServer is the server API for CostService service.
+type CostServiceServer interface {
+	// Subscribe streams cost data as it is exported until the client
+	// disconnects.
+	Subscribe(*SubscribeRequest, CostService_SubscribeServer) error
+}
+
+func RegisterCostServiceServer(s *grpc.Server, srv CostServiceServer) {
+	s.RegisterService(&_CostService_serviceDesc, srv)
+}
+
+func _CostService_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CostServiceServer).Subscribe(m, &costServiceSubscribeServer{stream})
+}
+
+type CostService_SubscribeServer interface {
+	Send(*CostData) error
+	grpc.ServerStream
+}
+
+type costServiceSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *costServiceSubscribeServer) Send(m *CostData) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _CostService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "kostanza.v1.CostService",
+	HandlerType: (*CostServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _CostService_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "cost.proto",
+}
+
+func init() { proto.RegisterFile("cost.proto", fileDescriptor_cost_7f964288c3170654) }
+
+var fileDescriptor_cost_7f964288c3170654 = []byte{
+	// 362 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x92, 0x4f, 0x8b, 0xdb, 0x30,
+	0x10, 0xc5, 0x51, 0x9c, 0x3f, 0xf6, 0x98, 0xb6, 0x41, 0xb4, 0x60, 0x0c, 0xa1, 0x26, 0x10, 0xf0,
+	0x49, 0x69, 0x53, 0x0a, 0x6d, 0xa1, 0x97, 0x26, 0xb9, 0xf6, 0xe0, 0x94, 0x1e, 0x7a, 0x09, 0xb2,
+	0x3d, 0x0d, 0x22, 0xb1, 0x94, 0x5a, 0x72, 0x20, 0xfd, 0x38, 0xfb, 0x49, 0x17, 0x59, 0x1b, 0x6f,
+	0x36, 0x2c, 0xec, 0xc9, 0xf3, 0xc6, 0xef, 0x0d, 0x7e, 0x3f, 0x0c, 0x50, 0x28, 0x6d, 0xd8, 0xb1,
+	0x56, 0x46, 0xd1, 0x70, 0xaf, 0xb4, 0xe1, 0xf2, 0x3f, 0x67, 0xa7, 0x8f, 0xf1, 0xfb, 0x9d, 0x52,
+	0xbb, 0x03, 0xce, 0xdb, 0x57, 0x79, 0xf3, 0x77, 0x6e, 0x44, 0x85, 0xda, 0xf0, 0xea, 0xe8, 0xdc,
+	0xd3, 0x3b, 0x0f, 0xfc, 0xa5, 0xd2, 0x66, 0xc5, 0x0d, 0xa7, 0x14, 0xfa, 0x7b, 0x21, 0xcb, 0x88,
+	0x24, 0x24, 0x0d, 0xb2, 0x76, 0xa6, 0x31, 0xf8, 0xda, 0xd4, 0xdc, 0xe0, 0xee, 0x1c, 0xf5, 0xda,
+	0x7d, 0xa7, 0xe9, 0x5b, 0x18, 0x9c, 0xf8, 0xa1, 0xc1, 0xc8, 0x4b, 0x48, 0xea, 0x65, 0x4e, 0xd8,
+	0x2b, 0x8d, 0x14, 0x26, 0xea, 0xbb, 0x2b, 0x76, 0xa6, 0x13, 0x00, 0xfb, 0xdc, 0x3a, 0xfb, 0x20,
+	0x21, 0x29, 0xc9, 0x02, 0xbb, 0xf9, 0xdd, 0x46, 0x66, 0xf0, 0xba, 0x50, 0xd2, 0x70, 0x21, 0xb1,
+	0xde, 0x4a, 0x5e, 0x61, 0x34, 0x6c, 0xc3, 0xaf, 0xba, 0xed, 0x4f, 0x5e, 0x21, 0x5d, 0x03, 0x94,
+	0xa2, 0x42, 0xa9, 0x85, 0x92, 0x3a, 0x1a, 0x25, 0x5e, 0x1a, 0x2e, 0x66, 0xec, 0xaa, 0x2f, 0xbb,
+	0x54, 0x61, 0xab, 0xce, 0xb7, 0x96, 0xa6, 0x3e, 0x67, 0x57, 0x41, 0xfa, 0x15, 0x40, 0x1b, 0x5e,
+	0x9b, 0xad, 0x85, 0x11, 0xf9, 0x09, 0x49, 0xc3, 0x45, 0xcc, 0x1c, 0x29, 0x76, 0x21, 0xc5, 0x7e,
+	0x5d, 0x48, 0x65, 0x41, 0xeb, 0xb6, 0x9a, 0x7e, 0x06, 0x1f, 0x65, 0xe9, 0x82, 0xc1, 0x8b, 0xc1,
+	0x11, 0xca, 0xd2, 0xaa, 0xf8, 0x3b, 0xbc, 0xb9, 0xf9, 0x20, 0x3a, 0x06, 0x6f, 0x8f, 0xe7, 0x07,
+	0xd4, 0x76, 0x7c, 0xa4, 0xe9, 0x30, 0x3b, 0xf1, 0xad, 0xf7, 0x85, 0x4c, 0x29, 0x8c, 0x37, 0x4d,
+	0xae, 0x8b, 0x5a, 0xe4, 0x98, 0xe1, 0xbf, 0x06, 0xb5, 0x59, 0x64, 0x10, 0xda, 0xb2, 0x1b, 0xac,
+	0x4f, 0xa2, 0x40, 0xba, 0x84, 0xa0, 0xb3, 0xd0, 0xc9, 0x13, 0x26, 0xb7, 0xd1, 0xf8, 0xdd, 0xb3,
+	0xc8, 0x3e, 0x90, 0x1f, 0xfe, 0x9f, 0xa1, 0xfd, 0x91, 0x8e, 0x79, 0x3e, 0x6c, 0xdb, 0x7c, 0xba,
+	0x1f, 0x00, 0x1c, 0xe6, 0xd3, 0xcf, 0x59, 0x02, 0x00, 0x00,
+}
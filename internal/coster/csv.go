@@ -0,0 +1,140 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// CSVLabelColumnPrefix prefixes the header of a cost table CSV column
+	// holding the value of a label, e.g. "label:kostanza.io/region".
+	CSVLabelColumnPrefix = "label:"
+	// CSVNameColumn is the header of the optional cost table CSV column
+	// holding the Name of each entry.
+	CSVNameColumn = "Name"
+)
+
+// csvCostColumns maps the headers of the numeric cost table CSV columns, in
+// lower case, to the CostTableEntry field they set.
+var csvCostColumns = map[string]func(e *CostTableEntry, v float64){
+	"hourlymillicpucostmicrocents":             func(e *CostTableEntry, v float64) { e.HourlyMilliCPUCostMicroCents = v },
+	"hourlymemorybytecostmicrocents":           func(e *CostTableEntry, v float64) { e.HourlyMemoryByteCostMicroCents = v },
+	"hourlygpucostmicrocents":                  func(e *CostTableEntry, v float64) { e.HourlyGPUCostMicroCents = v },
+	"hourlyephemeralstoragebytecostmicrocents": func(e *CostTableEntry, v float64) { e.HourlyEphemeralStorageByteCostMicroCents = v },
+	"hourlystoragebytecostmicrocents":          func(e *CostTableEntry, v float64) { e.HourlyStorageByteCostMicroCents = v },
+	"hourlyloadbalancercostmicrocents":         func(e *CostTableEntry, v float64) { e.HourlyLoadBalancerCostMicroCents = v },
+	"multiplier":                               func(e *CostTableEntry, v float64) { e.Multiplier = v },
+	"overcommitfactor":                         func(e *CostTableEntry, v float64) { e.OvercommitFactor = v },
+}
+
+// LoadCostTableFromCSV reads a CostTable from CSV, e.g. as exported from a
+// spreadsheet. The first row is a header naming each column: CSVNameColumn,
+// a label prefixed by CSVLabelColumnPrefix, or a numeric CostTableEntry field
+// such as HourlyMilliCPUCostMicroCents or Multiplier, ignoring case. Each
+// subsequent row is an entry, in order. Empty cells leave the label or field
+// unset, so a row without labels matches any node. Lines starting with # are
+// ignored.
+func LoadCostTableFromCSV(r io.Reader) (*CostTable, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("cost table csv has no header")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read cost table csv header")
+	}
+
+	seen := map[string]bool{}
+	for i, h := range header {
+		h = strings.TrimSpace(h)
+		header[i] = h
+
+		key := strings.ToLower(h)
+		if strings.HasPrefix(key, CSVLabelColumnPrefix) {
+			if h[len(CSVLabelColumnPrefix):] == "" {
+				return nil, errors.Errorf("cost table csv column %d has an empty label", i+1)
+			}
+			key = CSVLabelColumnPrefix + h[len(CSVLabelColumnPrefix):]
+		} else if _, ok := csvCostColumns[key]; !ok && key != strings.ToLower(CSVNameColumn) {
+			return nil, errors.Errorf("cost table csv column %d has unknown header %q", i+1, h)
+		}
+
+		if seen[key] {
+			return nil, errors.Errorf("cost table csv column %q is repeated", h)
+		}
+		seen[key] = true
+	}
+
+	ct := &CostTable{}
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read cost table csv")
+		}
+
+		e, err := csvCostTableEntry(header, record)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid cost table csv row %d", row)
+		}
+		ct.Entries = append(ct.Entries, e)
+	}
+
+	if err := ct.Compile(); err != nil {
+		return nil, err
+	}
+	return ct, nil
+}
+
+// csvCostTableEntry returns the CostTableEntry described by a record of a
+// cost table CSV with the provided header.
+func csvCostTableEntry(header, record []string) (*CostTableEntry, error) {
+	e := &CostTableEntry{}
+	for i, h := range header {
+		v := strings.TrimSpace(record[i])
+		if v == "" {
+			continue
+		}
+
+		key := strings.ToLower(h)
+		switch {
+		case key == strings.ToLower(CSVNameColumn):
+			e.Name = v
+		case strings.HasPrefix(key, CSVLabelColumnPrefix):
+			if e.Labels == nil {
+				e.Labels = Labels{}
+			}
+			e.Labels[h[len(CSVLabelColumnPrefix):]] = v
+		default:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, errors.Errorf("%s %q is not a number", h, v)
+			}
+			csvCostColumns[key](e, f)
+		}
+	}
+	return e, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+const testCostTableCSV = `# Maintained by finance, prices in millionths of a cent.
+Name,label:kostanza.io/instance-type,label:kostanza.io/region,HourlyMilliCPUCostMicroCents,HourlyMemoryByteCostMicroCents,HourlyGPUCostMicroCents,Multiplier
+n1-us-central1,n1-standard-4,us-central1,3000,0.0004,,
+n1-standard-4,n1-standard-4,,3500,0.0005,,0.3
+gpu,,europe-west4,3200,0.00045,250000000,
+fallback,,,4000,0.0006,, 
+`
+
+func TestLoadCostTableFromCSV(t *testing.T) {
+	ct, err := LoadCostTableFromCSV(strings.NewReader(testCostTableCSV))
+	if err != nil {
+		t.Fatalf("unexpected error loading cost table: %v", err)
+	}
+
+	expected := []*CostTableEntry{
+		&CostTableEntry{
+			Name:                           "n1-us-central1",
+			Labels:                         Labels{LabelInstanceType: "n1-standard-4", LabelRegion: "us-central1"},
+			HourlyMilliCPUCostMicroCents:   3000,
+			HourlyMemoryByteCostMicroCents: 0.0004,
+		},
+		&CostTableEntry{
+			Name:                           "n1-standard-4",
+			Labels:                         Labels{LabelInstanceType: "n1-standard-4"},
+			HourlyMilliCPUCostMicroCents:   3500,
+			HourlyMemoryByteCostMicroCents: 0.0005,
+			Multiplier:                     0.3,
+		},
+		&CostTableEntry{
+			Name:                           "gpu",
+			Labels:                         Labels{LabelRegion: "europe-west4"},
+			HourlyMilliCPUCostMicroCents:   3200,
+			HourlyMemoryByteCostMicroCents: 0.00045,
+			HourlyGPUCostMicroCents:        250000000,
+		},
+		&CostTableEntry{
+			Name:                           "fallback",
+			HourlyMilliCPUCostMicroCents:   4000,
+			HourlyMemoryByteCostMicroCents: 0.0006,
+		},
+	}
+	if diff := deep.Equal(ct.Entries, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+var loadCostTableFromCSVLookupCases = []struct {
+	name     string
+	labels   Labels
+	expected string
+}{
+	{
+		name:     "region specific row",
+		labels:   Labels{"node.kubernetes.io/instance-type": "n1-standard-4", "topology.kubernetes.io/region": "us-central1"},
+		expected: "n1-us-central1",
+	},
+	{
+		name:     "instance type row in another region",
+		labels:   Labels{"node.kubernetes.io/instance-type": "n1-standard-4", "topology.kubernetes.io/region": "us-east1"},
+		expected: "n1-standard-4",
+	},
+	{
+		name:     "region row",
+		labels:   Labels{"node.kubernetes.io/instance-type": "a2-highgpu-1g", "topology.kubernetes.io/region": "europe-west4"},
+		expected: "gpu",
+	},
+	{
+		name:     "fallback row without labels",
+		labels:   Labels{"node.kubernetes.io/instance-type": "e2-small", "topology.kubernetes.io/region": "asia-east1"},
+		expected: "fallback",
+	},
+}
+
+func TestLoadCostTableFromCSVLookups(t *testing.T) {
+	ct, err := LoadCostTableFromCSV(strings.NewReader(testCostTableCSV))
+	if err != nil {
+		t.Fatalf("unexpected error loading cost table: %v", err)
+	}
+
+	for _, tt := range loadCostTableFromCSVLookupCases {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := ct.FindByLabels(tt.labels)
+			if err != nil {
+				t.Fatalf("unexpected error finding %v: %v", tt.labels, err)
+			}
+			if e.Name != tt.expected {
+				t.Fatalf("expected entry %q, got %q", tt.expected, e.Name)
+			}
+		})
+	}
+}
+
+var loadCostTableFromCSVErrorCases = []struct {
+	name string
+	csv  string
+	err  string
+}{
+	{
+		name: "empty",
+		csv:  "",
+		err:  "no header",
+	},
+	{
+		name: "unknown column",
+		csv:  "label:region,HourlyCPUCost\nus,1\n",
+		err:  `unknown header "HourlyCPUCost"`,
+	},
+	{
+		name: "repeated column",
+		csv:  "Multiplier,multiplier\n1,2\n",
+		err:  "repeated",
+	},
+	{
+		name: "empty label",
+		csv:  "label:,Multiplier\nus,1\n",
+		err:  "empty label",
+	},
+	{
+		name: "invalid number",
+		csv:  "label:region,HourlyMilliCPUCostMicroCents\nus,1\neu,cheap\n",
+		err:  `row 3: HourlyMilliCPUCostMicroCents "cheap" is not a number`,
+	},
+	{
+		name: "missing cells",
+		csv:  "label:region,HourlyMilliCPUCostMicroCents\nus\n",
+		err:  "wrong number of fields",
+	},
+	{
+		name: "invalid label pattern",
+		csv:  "label:region,HourlyMilliCPUCostMicroCents\nregex:(us,1\n",
+		err:  "invalid regular expression",
+	},
+}
+
+func TestLoadCostTableFromCSVErrors(t *testing.T) {
+	for _, tt := range loadCostTableFromCSVErrorCases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadCostTableFromCSV(strings.NewReader(tt.csv))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestNewConfigFromFilesCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kostanza-csv")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	pricing := filepath.Join(dir, "pricing.csv")
+	if err := ioutil.WriteFile(pricing, []byte(testCostTableCSV), 0644); err != nil {
+		t.Fatalf("could not write cost table: %v", err)
+	}
+	mapper := filepath.Join(dir, "mapper.json")
+	if err := ioutil.WriteFile(mapper, []byte(`{"Mapper": {"Entries": [{"Destination": "service", "Source": "{.Pod.ObjectMeta.Labels.service}"}]}}`), 0644); err != nil {
+		t.Fatalf("could not write configuration: %v", err)
+	}
+
+	c, err := NewConfigFromFiles(pricing, mapper)
+	if err != nil {
+		t.Fatalf("unexpected error loading configurations: %v", err)
+	}
+	if len(c.Pricing.Entries) != 4 || c.Pricing.Entries[3].Name != "fallback" || len(c.Mapper.Entries) != 1 {
+		t.Fatalf("unexpected merged configuration: %#v", c)
+	}
+}
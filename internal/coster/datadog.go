@@ -0,0 +1,147 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+const (
+	// DatadogMetricName is the name of the metric cost data is sent as.
+	DatadogMetricName = "kostanza.cost"
+
+	// DatadogMetricCount sends cost data as DogStatsD counts, which Datadog
+	// sums into the cost accrued over each flush interval.
+	DatadogMetricCount = "count"
+	// DatadogMetricGauge sends cost data as DogStatsD gauges, which Datadog
+	// reports as the most recent cost of each interval.
+	DatadogMetricGauge = "gauge"
+
+	// datadogMaxTagLength is the maximum length of a Datadog tag. Longer tags
+	// are truncated by Datadog, so they are truncated before being sent.
+	datadogMaxTagLength = 200
+)
+
+// dogstatsdClient is the subset of the statsd.Client API used by the
+// DatadogCostExporter.
+type dogstatsdClient interface {
+	Count(name string, value int64, tags []string, rate float64) error
+	Gauge(name string, value float64, tags []string, rate float64) error
+	Close() error
+}
+
+// DatadogCostExporter sends cost data to a DogStatsD agent as the
+// DatadogMetricName metric, tagged with its kind, strategy and dimensions.
+type DatadogCostExporter struct {
+	client     dogstatsdClient
+	metricType string
+}
+
+// NewDatadogCostExporter returns a DatadogCostExporter sending to the
+// DogStatsD agent at addr, e.g. localhost:8125, as metrics of metricType.
+func NewDatadogCostExporter(addr string, metricType string) (*DatadogCostExporter, error) {
+	if metricType != DatadogMetricCount && metricType != DatadogMetricGauge {
+		return nil, errors.Errorf("unknown datadog metric type %q", metricType)
+	}
+
+	client, err := statsd.New(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create dogstatsd client")
+	}
+
+	return newDatadogCostExporter(client, metricType), nil
+}
+
+func newDatadogCostExporter(client dogstatsdClient, metricType string) *DatadogCostExporter {
+	return &DatadogCostExporter{
+		client:     client,
+		metricType: metricType,
+	}
+}
+
+// ExportCost sends the CostData provided to the DogStatsD agent.
+func (de *DatadogCostExporter) ExportCost(cd CostData) {
+	tags := datadogTags(cd)
+
+	var err error
+	if de.metricType == DatadogMetricGauge {
+		err = de.client.Gauge(DatadogMetricName, float64(cd.Value), tags, 1)
+	} else {
+		err = de.client.Count(DatadogMetricName, cd.Value, tags, 1)
+	}
+	if err != nil {
+		log.Log.Errorw("could not send cost data to dogstatsd", zap.Error(err))
+	}
+}
+
+// Close flushes any buffered metrics and closes the DogStatsD client.
+func (de *DatadogCostExporter) Close() error {
+	return de.client.Close()
+}
+
+// datadogTags returns the sorted Datadog tags for cost data, formed from its
+// kind, strategy, container and dimensions. Dimensions with empty values are
+// omitted.
+func datadogTags(cd CostData) []string {
+	tags := []string{
+		datadogTag("kind", string(cd.Kind)),
+		datadogTag("strategy", cd.Strategy),
+	}
+	if cd.ContainerName != "" {
+		tags = append(tags, datadogTag("container", cd.ContainerName))
+	}
+	for k, v := range cd.Dimensions {
+		if v == "" {
+			continue
+		}
+		tags = append(tags, datadogTag(k, v))
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// datadogTag returns a key:value tag, replacing characters Datadog does not
+// permit with underscores and truncating it to the maximum tag length. Keys
+// may not contain colons, which separate them from values.
+func datadogTag(key, value string) string {
+	tag := sanitizeDatadogTag(key, false) + ":" + sanitizeDatadogTag(value, true)
+	if len(tag) > datadogMaxTagLength {
+		tag = tag[:datadogMaxTagLength]
+	}
+	return tag
+}
+
+func sanitizeDatadogTag(s string, allowColon bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		case r == '_', r == '-', r == '.', r == '/':
+			return r
+		case r == ':' && allowColon:
+			return r
+		}
+		return '_'
+	}, s)
+}
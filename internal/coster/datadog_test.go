@@ -0,0 +1,130 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+type fakeDogstatsdMetric struct {
+	MetricType string
+	Name       string
+	Value      float64
+	Tags       []string
+}
+
+type fakeDogstatsdClient struct {
+	metrics []fakeDogstatsdMetric
+	closed  bool
+}
+
+func (f *fakeDogstatsdClient) Count(name string, value int64, tags []string, rate float64) error {
+	f.metrics = append(f.metrics, fakeDogstatsdMetric{DatadogMetricCount, name, float64(value), tags})
+	return nil
+}
+
+func (f *fakeDogstatsdClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	f.metrics = append(f.metrics, fakeDogstatsdMetric{DatadogMetricGauge, name, value, tags})
+	return nil
+}
+
+func (f *fakeDogstatsdClient) Close() error {
+	f.closed = true
+	return nil
+}
+
+var datadogExporterCases = []struct {
+	name       string
+	metricType string
+	data       CostData
+	expected   fakeDogstatsdMetric
+}{
+	{
+		name:       "costs are sent as counts tagged with their dimensions",
+		metricType: DatadogMetricCount,
+		data: CostData{
+			Kind:       ResourceCostWeighted,
+			Strategy:   StrategyNameWeighted,
+			Value:      42,
+			Dimensions: map[string]string{"service": "foo", "team": ""},
+		},
+		expected: fakeDogstatsdMetric{
+			MetricType: DatadogMetricCount,
+			Name:       DatadogMetricName,
+			Value:      42,
+			Tags:       []string{"kind:weighted", "service:foo", "strategy:weightedpricingstrategy"},
+		},
+	},
+	{
+		name:       "costs are sent as gauges with sanitized tags",
+		metricType: DatadogMetricGauge,
+		data: CostData{
+			Kind:          ResourceCostCPU,
+			Strategy:      StrategyNameCPU,
+			Value:         7,
+			ContainerName: "app",
+			Dimensions:    map[string]string{"Service Name": "Foo Bar", "image": "gcr.io/foo:v1"},
+		},
+		expected: fakeDogstatsdMetric{
+			MetricType: DatadogMetricGauge,
+			Name:       DatadogMetricName,
+			Value:      7,
+			Tags: []string{
+				"container:app",
+				"image:gcr.io/foo:v1",
+				"kind:cpu",
+				"service_name:foo_bar",
+				"strategy:cpupricingstrategy",
+			},
+		},
+	},
+}
+
+func TestDatadogCostExporter(t *testing.T) {
+	for _, tt := range datadogExporterCases {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeDogstatsdClient{}
+			de := newDatadogCostExporter(client, tt.metricType)
+			de.ExportCost(tt.data)
+
+			if diff := deep.Equal(client.metrics, []fakeDogstatsdMetric{tt.expected}); diff != nil {
+				t.Fatal(diff)
+			}
+
+			if err := de.Close(); err != nil {
+				t.Fatalf("unexpected error closing exporter: %v", err)
+			}
+			if !client.closed {
+				t.Fatal("expected client to be closed")
+			}
+		})
+	}
+}
+
+func TestDatadogTagTruncated(t *testing.T) {
+	tag := datadogTag("service", strings.Repeat("a", 300))
+	if len(tag) != datadogMaxTagLength {
+		t.Fatalf("expected tag to be truncated to %d characters, got %d", datadogMaxTagLength, len(tag))
+	}
+}
+
+func TestNewDatadogCostExporterRejectsUnknownMetricType(t *testing.T) {
+	if _, err := NewDatadogCostExporter("localhost:8125", "histogram"); err == nil {
+		t.Fatal("expected an unknown metric type to be rejected")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	core_v1 "k8s.io/api/core/v1"
+)
+
+const (
+	errorKindMissingCostEntry = "missing_cost_entry"
+	errorKindList             = "list"
+	errorKindOther            = "other"
+)
+
+var (
+	// MeasureCalculationErrors is the number of errors encountered while
+	// calculating costs, tagged by TagErrorKind.
+	MeasureCalculationErrors = stats.Int64("kostanza/measures/calculation_errors", "Errors encountered calculating costs", stats.UnitDimensionless)
+	// TagErrorKind identifies the kind of error a measurement was recorded for.
+	TagErrorKind, _ = tag.NewKey("kind")
+
+	// MeasureCostEntryMissByLabels is the number of times a strategy could not
+	// find a CostTableEntry matching a node's labels, tagged by TagStrategy and,
+	// if the node has one, TagInstanceType. Misses are recorded per lookup, so
+	// strategies pricing each pod record one per pod on an unmatched node.
+	MeasureCostEntryMissByLabels = stats.Int64("kostanza/measures/cost_entry_misses", "Node pricing entry lookups that matched no entry", stats.UnitDimensionless)
+	// TagStrategy identifies the strategy a measurement was recorded for.
+	TagStrategy, _ = tag.NewKey("strategy")
+	// TagInstanceType identifies the instance type of the node a measurement
+	// was recorded for, as per LabelInstanceType.
+	TagInstanceType, _ = tag.NewKey("instance_type")
+)
+
+// MissingCostEntryError is returned when no CostTableEntry matches a node's
+// labels. It unwraps to ErrNoCostEntry.
+type MissingCostEntryError struct {
+	NodeName string
+	Labels   map[string]string
+}
+
+func (e *MissingCostEntryError) Error() string {
+	return fmt.Sprintf("%s for node %s", ErrNoCostEntry, e.NodeName)
+}
+
+// Unwrap returns ErrNoCostEntry.
+func (e *MissingCostEntryError) Unwrap() error {
+	return ErrNoCostEntry
+}
+
+// ListError is returned when pods or nodes could not be listed.
+type ListError struct {
+	// Resource is the kind of object that could not be listed, e.g. pods.
+	Resource string
+	Err      error
+}
+
+func (e *ListError) Error() string {
+	return fmt.Sprintf("could not list %s: %v", e.Resource, e.Err)
+}
+
+// Unwrap returns the underlying lister error.
+func (e *ListError) Unwrap() error {
+	return e.Err
+}
+
+// CalculationErrors aggregates the errors encountered by a calculation that
+// nonetheless produced cost items, e.g. one MissingCostEntryError per node
+// that could not be priced.
+type CalculationErrors []error
+
+func (e CalculationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// errorKind returns the TagErrorKind value err is recorded with.
+func errorKind(err error) string {
+	switch err.(type) {
+	case *MissingCostEntryError:
+		return errorKindMissingCostEntry
+	case *ListError:
+		return errorKindList
+	default:
+		return errorKindOther
+	}
+}
+
+// recordCalculationErrors records err, or each error it aggregates, against
+// MeasureCalculationErrors.
+func recordCalculationErrors(err error) {
+	if err == nil {
+		return
+	}
+
+	errs, ok := err.(CalculationErrors)
+	if !ok {
+		errs = CalculationErrors{err}
+	}
+
+	for _, err := range errs {
+		ctx, _ := tag.New(context.Background(), tag.Upsert(TagErrorKind, errorKind(err))) // nolint: gosec
+		stats.Record(ctx, MeasureCalculationErrors.M(1))
+	}
+}
+
+// recordCostEntryMiss records a MeasureCostEntryMissByLabels for a node the
+// named strategy could not price.
+func recordCostEntryMiss(strategy string, n *core_v1.Node) {
+	mutators := []tag.Mutator{tag.Upsert(TagStrategy, strategy)}
+	if it := Labels(n.Labels).Canonical()[LabelInstanceType]; it != "" {
+		mutators = append(mutators, tag.Upsert(TagInstanceType, it))
+	}
+	ctx, _ := tag.New(context.Background(), mutators...) // nolint: gosec
+	stats.Record(ctx, MeasureCostEntryMissByLabels.M(1))
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/planetlabs/kostanza/internal/lister"
+)
+
+var testUnpricedNode = &core_v1.Node{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:   "unpriced",
+		Labels: map[string]string{"test": "unpriced"},
+	},
+}
+
+func TestCalculateMissingCostEntry(t *testing.T) {
+	tt := calculateCases[0]
+	c := &coster{
+		interval:   time.Hour,
+		nodeLister: &lister.FakeNodeLister{Nodes: []*core_v1.Node{testCalculationNode, testUnpricedNode}},
+		podLister:  &lister.FakePodLister{Pods: tt.pods},
+		config:     tt.config,
+		strategies: []PricingStrategy{CPUPricingStrategy},
+	}
+
+	cis, err := c.calculate()
+	if len(cis) != 1 {
+		t.Fatalf("expected the priced node's cost item, got %+v", cis)
+	}
+
+	errs, ok := err.(CalculationErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("expected a single calculation error, got %v", err)
+	}
+
+	var mce *MissingCostEntryError
+	if !errors.As(errs[0], &mce) {
+		t.Fatalf("expected a MissingCostEntryError, got %v", errs[0])
+	}
+	if mce.NodeName != testUnpricedNode.Name {
+		t.Fatalf("expected node %s, got %s", testUnpricedNode.Name, mce.NodeName)
+	}
+	if !errors.Is(errs[0], ErrNoCostEntry) {
+		t.Fatalf("expected %v to be ErrNoCostEntry", errs[0])
+	}
+}
+
+func TestCalculateRecordsCostEntryMisses(t *testing.T) {
+	v := &view.View{
+		Name:        "test_cost_entry_misses",
+		Measure:     MeasureCostEntryMissByLabels,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{TagStrategy, TagInstanceType},
+	}
+	if err := view.Register(v); err != nil {
+		t.Fatalf("could not register view: %v", err)
+	}
+	defer view.Unregister(v)
+
+	unpriced := testUnpricedNode.DeepCopy()
+	unpriced.Labels["node.kubernetes.io/instance-type"] = "n2-standard-4"
+	pod := testCalculationPod.DeepCopy()
+	pod.Name = "unpriced"
+	pod.Spec.NodeName = unpriced.Name
+
+	tt := calculateCases[0]
+	c := &coster{
+		interval:   time.Hour,
+		nodeLister: &lister.FakeNodeLister{Nodes: []*core_v1.Node{testCalculationNode, unpriced}},
+		podLister:  &lister.FakePodLister{Pods: append([]*core_v1.Pod{pod}, tt.pods...)},
+		config:     tt.config,
+		strategies: []PricingStrategy{CPUPricingStrategy, MemoryPricingStrategy, NodePricingStrategy, StoragePricingStrategy},
+	}
+	c.calculate() // nolint: errcheck, gosec
+
+	rows, err := view.RetrieveData(v.Name)
+	if err != nil {
+		t.Fatalf("could not retrieve cost entry misses: %v", err)
+	}
+
+	misses := map[string]float64{}
+	for _, row := range rows {
+		tags := map[string]string{}
+		for _, tg := range row.Tags {
+			tags[tg.Key.Name()] = tg.Value
+		}
+		if tags[TagInstanceType.Name()] != "n2-standard-4" {
+			t.Errorf("expected misses to be tagged with the node's instance type, got %v", tags)
+		}
+		misses[tags[TagStrategy.Name()]] = row.Data.(*view.SumData).Value
+	}
+
+	// The storage strategy does not price nodes, so records no misses.
+	expected := map[string]float64{StrategyNameCPU: 1, StrategyNameMemory: 1, StrategyNameNode: 1}
+	if diff := deep.Equal(misses, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestCalculateListError(t *testing.T) {
+	tt := calculateCases[0]
+	lerr := errors.New("boom")
+	c := &coster{
+		interval:   time.Hour,
+		nodeLister: &lister.FakeNodeLister{Nodes: tt.nodes},
+		podLister:  &lister.FakePodLister{Err: lerr},
+		config:     tt.config,
+		strategies: []PricingStrategy{CPUPricingStrategy},
+	}
+
+	cis, err := c.calculate()
+	if cis != nil {
+		t.Fatalf("expected no cost items, got %+v", cis)
+	}
+
+	var le *ListError
+	if !errors.As(err, &le) || le.Resource != "pods" {
+		t.Fatalf("expected a ListError for pods, got %v", err)
+	}
+	if !errors.Is(err, lerr) {
+		t.Fatalf("expected %v to unwrap to the lister error", err)
+	}
+}
+
+var errorKindCases = []struct {
+	name     string
+	err      error
+	expected string
+}{
+	{
+		name:     "missing cost entry",
+		err:      &MissingCostEntryError{NodeName: "woot"},
+		expected: errorKindMissingCostEntry,
+	},
+	{
+		name:     "list",
+		err:      &ListError{Resource: "nodes", Err: errors.New("boom")},
+		expected: errorKindList,
+	},
+	{
+		name:     "other",
+		err:      ErrSenselessInterval,
+		expected: errorKindOther,
+	},
+}
+
+func TestErrorKind(t *testing.T) {
+	for _, tt := range errorKindCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if k := errorKind(tt.err); k != tt.expected {
+				t.Fatalf("expected kind %s, got %s", tt.expected, k)
+			}
+		})
+	}
+}
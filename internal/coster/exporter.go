@@ -18,12 +18,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math/rand"
+	"os"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
 	"go.uber.org/zap"
@@ -35,6 +39,8 @@ import (
 var (
 	// MeasurePubsubPublishErrors tracks publishing errors in the PubsubCostExporter.
 	MeasurePubsubPublishErrors = stats.Int64("kostanza/measures/pubsub_errors", "Number of pubsub publish error", stats.UnitDimensionless)
+	// MeasureBufferDepth tracks the number of distinct cost data buffered by a BufferingCostExporter.
+	MeasureBufferDepth = stats.Int64("kostanza/measures/buffer_depth", "Number of buffered cost data", stats.UnitDimensionless)
 )
 
 // CostExporter emits CostItems - for example, as a metric or
@@ -46,28 +52,65 @@ type CostExporter interface {
 // StatsCostExporter emits metrics to a stats system.
 type StatsCostExporter struct {
 	mapper *Mapper
+	// AllowedDimensions restricts the dimensions recorded as tags to those
+	// listed, bounding the cardinality of the resulting metrics. Other
+	// exporters are unaffected. All dimensions are recorded when it is empty.
+	AllowedDimensions []string
+	// SampleRate records cost data at random with a probability of 1 in
+	// SampleRate, scaling the value recorded by SampleRate so that totals
+	// remain approximately correct, to bound the load recording places on
+	// the stats system. Every cost datum is recorded when it is 1 or less.
+	SampleRate int
+
+	mux sync.Mutex
+	rnd *rand.Rand
 }
 
 // NewStatsCostExporter returns a new StatsCostExporter.
 func NewStatsCostExporter(mapper *Mapper) *StatsCostExporter {
 	return &StatsCostExporter{
 		mapper: mapper,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())), // nolint: gosec
 	}
 }
 
 // ExportCost emits cost data to the stats system.
 func (sce *StatsCostExporter) ExportCost(cd CostData) {
+	value, ok := sce.sample(cd.Value)
+	if !ok {
+		return
+	}
+
 	ctx, err := sce.mapTags(cd)
 	if err != nil {
 		log.Log.Errorw("could not update tag context from pod metadata", zap.Error(err))
 	}
-	stats.Record(ctx, MeasureCost.M(cd.Value))
+	stats.Record(ctx, MeasureCost.M(value))
+}
+
+// sample reports whether a cost datum of the provided value should be
+// recorded per SampleRate, and the scaled value to record if so.
+func (sce *StatsCostExporter) sample(value int64) (int64, bool) {
+	if sce.SampleRate <= 1 {
+		return value, true
+	}
+
+	sce.mux.Lock()
+	defer sce.mux.Unlock()
+	if sce.rnd.Intn(sce.SampleRate) != 0 {
+		return 0, false
+	}
+	return value * int64(sce.SampleRate), true
 }
 
 func (sce *StatsCostExporter) mapTags(cd CostData) (context.Context, error) {
 	ctx := context.Background()
 	tags := []tag.Mutator{}
 	for k, v := range cd.Dimensions {
+		if !sce.allowed(k) {
+			continue
+		}
+
 		t, err := tag.NewKey(k)
 		if err != nil {
 			return nil, err
@@ -79,11 +122,131 @@ func (sce *StatsCostExporter) mapTags(cd CostData) (context.Context, error) {
 	return tag.New(ctx, tags...)
 }
 
+func (sce *StatsCostExporter) allowed(dimension string) bool {
+	if len(sce.AllowedDimensions) == 0 {
+		return true
+	}
+	for _, d := range sce.AllowedDimensions {
+		if d == dimension {
+			return true
+		}
+	}
+	return false
+}
+
+// StdoutCostExporter writes cost data as JSON lines to an io.Writer, which is
+// generally stdout. It is primarily intended for local debugging.
+type StdoutCostExporter struct {
+	writer io.Writer
+	pretty bool
+	mux    sync.Mutex
+}
+
+// NewStdoutCostExporter returns a StdoutCostExporter that writes to the
+// provided writer, defaulting to os.Stdout when writer is nil. When pretty is
+// set each CostData is indented for readability.
+func NewStdoutCostExporter(writer io.Writer, pretty bool) *StdoutCostExporter {
+	if writer == nil {
+		writer = os.Stdout
+	}
+
+	return &StdoutCostExporter{
+		writer: writer,
+		pretty: pretty,
+	}
+}
+
+// ExportCost writes the CostData provided as JSON to the exporter's writer.
+func (se *StdoutCostExporter) ExportCost(cd CostData) {
+	var msg []byte
+	var err error
+	if se.pretty {
+		msg, err = json.MarshalIndent(cd, "", "  ")
+	} else {
+		msg, err = json.Marshal(cd)
+	}
+	if err != nil {
+		log.Log.Errorw("could not marshal cost", zap.Error(err))
+		return
+	}
+
+	se.mux.Lock()
+	defer se.mux.Unlock()
+	if _, err := fmt.Fprintf(se.writer, "%s\n", msg); err != nil {
+		log.Log.Errorw("could not write cost", zap.Error(err))
+	}
+}
+
+// LogCostExporter logs each CostData at info level and does nothing else. It
+// is intended for dry runs, e.g. validating a mapping against real cluster
+// state without writing to any metrics backend.
+type LogCostExporter struct {
+	logger *zap.SugaredLogger
+}
+
+// NewLogCostExporter returns a LogCostExporter that logs to the provided
+// logger, defaulting to the global logger when logger is nil.
+func NewLogCostExporter(logger *zap.SugaredLogger) *LogCostExporter {
+	if logger == nil {
+		logger = log.Log
+	}
+
+	return &LogCostExporter{
+		logger: logger,
+	}
+}
+
+// ExportCost logs the CostData provided.
+func (le *LogCostExporter) ExportCost(cd CostData) {
+	le.logger.Infow("exporting cost data", zap.Object("data", &cd))
+}
+
+const (
+	// DefaultPubsubMaxAttempts is the default number of times the
+	// PubsubCostExporter attempts to publish each message.
+	DefaultPubsubMaxAttempts = 5
+	// DefaultPubsubRetryDelay is the default delay before the first retry of a
+	// failed publish. Subsequent retries back off exponentially.
+	DefaultPubsubRetryDelay = time.Second
+)
+
 // PubsubCostExporter emits data to pubsub.
 type PubsubCostExporter struct {
-	client *pubsub.Client
-	topic  *pubsub.Topic
-	ctx    context.Context
+	client      *pubsub.Client
+	topic       *pubsub.Topic
+	ctx         context.Context
+	publish     func(ctx context.Context, msg *pubsub.Message) error
+	maxAttempts int
+	retryDelay  time.Duration
+	// eventSource wraps messages in CloudEvents from this source when set.
+	eventSource string
+	// wg tracks publishes that are still in flight.
+	wg sync.WaitGroup
+	// mux guards closed, so that no publish is added to wg once Close has
+	// begun waiting on it.
+	mux    sync.Mutex
+	closed bool
+}
+
+// PubsubOption configures optional behavior of a PubsubCostExporter.
+type PubsubOption func(pe *PubsubCostExporter)
+
+// WithPublishRetry configures the PubsubCostExporter to attempt each publish
+// up to maxAttempts times, waiting retryDelay before the first retry and
+// doubling the delay for each subsequent retry.
+func WithPublishRetry(maxAttempts int, retryDelay time.Duration) PubsubOption {
+	return func(pe *PubsubCostExporter) {
+		pe.maxAttempts = maxAttempts
+		pe.retryDelay = retryDelay
+	}
+}
+
+// WithCloudEvents configures the PubsubCostExporter to wrap each CostData in a
+// CloudEvents envelope from the provided source, see MarshalCostData.
+func WithCloudEvents(source string) PubsubOption {
+	return func(pe *PubsubCostExporter) {
+		pe.eventSource = source
+	}
 }
 
 // CostData models pubsub-exported cost metadata.
@@ -94,12 +257,29 @@ type CostData struct {
 	Strategy string
 	// The value in microcents that it costs.
 	Value int64
+	// The unit in which UnitValue is expressed.
+	Unit CostUnit `json:",omitempty"`
+	// The value converted to Unit, for the convenience of consumers. Omitted
+	// when zero.
+	UnitValue float64 `json:",omitempty"`
+	// The container priced, when per-container costs are enabled.
+	ContainerName string `json:",omitempty"`
 	// Additional dimensions associated with the cost.
 	Dimensions map[string]string
-	// The interval for which this metric was created.
+	// The start of the interval for which this metric was created, i.e. the
+	// time of the previous calculation.
+	StartTime time.Time
+	// The end of the interval for which this metric was created, i.e. the
+	// time of the calculation that created it.
 	EndTime time.Time
 }
 
+// setUnit sets the unit of the cost data, converting its value to the unit.
+func (c *CostData) setUnit(u CostUnit) {
+	c.Unit = u.orDefault()
+	c.UnitValue = c.Unit.Convert(c.Value)
+}
+
 // CostDataKey groups related cost data. Note: this isn't very space efficient
 // at the moment given the duplication between it and the CostDataRow. We could,
 // for example use a hashing function instead but this ought to be friendly
@@ -109,6 +289,8 @@ type CostDataKey struct {
 	Kind ResourceCostKind
 	// The strategy the yielded this CostItem.
 	Strategy string
+	// The container priced, if any.
+	ContainerName string
 	// Additional dimensions associated with the cost.
 	Dimensions string
 }
@@ -117,24 +299,43 @@ type CostDataKey struct {
 func (c *CostData) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	enc.AddString("Kind", string(c.Kind))
 	enc.AddString("Strategy", c.Strategy)
+	enc.AddTime("StartTime", c.StartTime)
 	enc.AddTime("EndTime", c.EndTime)
 	enc.AddInt64("Value", c.Value)
-	for k, v := range c.Dimensions {
-		enc.AddString("Dimensions."+k, v)
+	if c.ContainerName != "" {
+		enc.AddString("ContainerName", c.ContainerName)
+	}
+	if c.Unit != "" {
+		enc.AddString("Unit", string(c.Unit))
+		enc.AddFloat64("UnitValue", c.UnitValue)
+	}
+	for _, k := range c.DimensionNames() {
+		enc.AddString("Dimensions."+k, c.Dimensions[k])
 	}
 	return nil
 }
 
+// DimensionNames returns the names of the CostData's dimensions in sorted
+// order, so that output derived from them is deterministic.
+func (c *CostData) DimensionNames() []string {
+	names := make([]string, 0, len(c.Dimensions))
+	for k := range c.Dimensions {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (c *CostData) key() CostDataKey {
-	dims := sort.StringSlice([]string{})
-	for k, v := range c.Dimensions {
-		dims = append(dims, fmt.Sprintf("%s:%s", k, v))
+	dims := []string{}
+	for _, k := range c.DimensionNames() {
+		dims = append(dims, fmt.Sprintf("%s:%s", k, c.Dimensions[k]))
 	}
-	dims.Sort()
 	return CostDataKey{
-		Kind:       c.Kind,
-		Strategy:   c.Strategy,
-		Dimensions: strings.Join(dims, ","),
+		Kind:          c.Kind,
+		Strategy:      c.Strategy,
+		ContainerName: c.ContainerName,
+		Dimensions:    strings.Join(dims, ","),
 	}
 }
 
@@ -166,26 +367,32 @@ func createTopicIfNotExists(ctx context.Context, client *pubsub.Client, topic st
 // dimensioned data on the client before emitting to other exporters.
 type BufferingCostExporter struct {
 	ctx      context.Context
+	name     string
 	buffer   map[CostDataKey]CostData
 	interval time.Duration
 	mux      sync.Mutex
 	next     CostExporter
+	stopped  chan struct{}
 }
 
 // NewBufferingCostExporter returns a BufferingCostExporter that flushes on the
 // provided interval. The backgrounded flush procedure can be cancelled by
 // cancelling the provided context. On every interval we emit aggregated cost
-// metrics to the provided `next` CostExporter.
-func NewBufferingCostExporter(ctx context.Context, interval time.Duration, next CostExporter) (*BufferingCostExporter, error) {
+// metrics to the provided `next` CostExporter. The name distinguishes the
+// exporter's buffer depth measurements from those of other exporters.
+func NewBufferingCostExporter(ctx context.Context, name string, interval time.Duration, next CostExporter) (*BufferingCostExporter, error) {
 	bce := &BufferingCostExporter{
 		ctx:      ctx,
+		name:     name,
 		mux:      sync.Mutex{},
 		buffer:   map[CostDataKey]CostData{},
 		interval: interval,
 		next:     next,
+		stopped:  make(chan struct{}),
 	}
 
 	go func() {
+		defer close(bce.stopped)
 		log.Log.Debug("starting background flush loop")
 		bce.startFlusher()
 		log.Log.Debug("background flush loop completed")
@@ -196,16 +403,48 @@ func NewBufferingCostExporter(ctx context.Context, interval time.Duration, next
 
 // ExportCost enqueues the CostData provided for subsequent emission to the next
 // cost exporter. This serves to debounce repeated cost events and reduce load
-// on the system.
+// on the system. Merged entries span the window from the earliest StartTime to
+// the latest EndTime of the CostData they were built from.
 func (bce *BufferingCostExporter) ExportCost(cd CostData) {
 	bce.mux.Lock()
 	defer bce.mux.Unlock()
 	k := cd.key()
-	v := bce.buffer[k].Value
-	cd.Value += v
+	if prev, ok := bce.buffer[k]; ok {
+		cd.Value += prev.Value
+		if !prev.StartTime.IsZero() && (cd.StartTime.IsZero() || prev.StartTime.Before(cd.StartTime)) {
+			cd.StartTime = prev.StartTime
+		}
+		if prev.EndTime.After(cd.EndTime) {
+			cd.EndTime = prev.EndTime
+		}
+		if cd.Unit != "" {
+			cd.setUnit(cd.Unit)
+		}
+	}
 	bce.buffer[k] = cd
+	bce.recordDepth()
+}
+
+// recordDepth records the size of the buffer. Callers must hold bce.mux.
+func (bce *BufferingCostExporter) recordDepth() {
+	ctx, err := tag.New(bce.ctx, tag.Upsert(TagExporter, bce.name))
+	if err != nil {
+		log.Log.Errorw("could not tag buffer depth", zap.Error(err))
+		return
+	}
+	stats.Record(ctx, MeasureBufferDepth.M(int64(len(bce.buffer))))
+}
+
+// Stopped returns a channel that is closed once the exporter's context has
+// been cancelled and any remaining buffered data has been flushed to the next
+// CostExporter.
+func (bce *BufferingCostExporter) Stopped() <-chan struct{} {
+	return bce.stopped
 }
 
+// startFlusher flushes the buffer on every interval until the exporter's
+// context is cancelled, flushing once more before returning so that data
+// buffered since the last interval is not lost on shutdown.
 func (bce *BufferingCostExporter) startFlusher() {
 	ticker := time.NewTicker(bce.interval)
 	defer ticker.Stop()
@@ -214,6 +453,7 @@ func (bce *BufferingCostExporter) startFlusher() {
 	for {
 		select {
 		case <-done:
+			bce.flush()
 			return
 		case <-ticker.C:
 			bce.flush()
@@ -229,44 +469,114 @@ func (bce *BufferingCostExporter) flush() {
 		bce.next.ExportCost(v)
 	}
 	bce.buffer = map[CostDataKey]CostData{}
+	bce.recordDepth()
 }
 
 // NewPubsubCostExporter creates a new PubsubCostExporter, instantiating an
-// internal client against google cloud APIs.
-func NewPubsubCostExporter(ctx context.Context, topic string, project string) (*PubsubCostExporter, error) {
+// internal client against google cloud APIs. Provisioning the topic must
+// complete within startupTimeout, while ctx bounds publishing for the life of
+// the exporter.
+func NewPubsubCostExporter(ctx context.Context, startupTimeout time.Duration, topic string, project string, opts ...PubsubOption) (*PubsubCostExporter, error) {
+	// The client retains the context it is created with for refreshing
+	// credentials, so only the setup calls below are bounded by the timeout.
 	client, err := pubsub.NewClient(ctx, project)
 	if err != nil {
 		return nil, err
 	}
 
-	t, err := createTopicIfNotExists(ctx, client, topic)
+	sctx, cancel := StartupContext(ctx, startupTimeout)
+	defer cancel()
+
+	t, err := createTopicIfNotExists(sctx, client, topic)
 	if err != nil {
-		return nil, err
+		return nil, StartupError(sctx, err, startupTimeout)
 	}
 
-	return &PubsubCostExporter{
+	pe := &PubsubCostExporter{
 		client: client,
 		topic:  t,
 		ctx:    ctx,
-	}, nil
+		publish: func(ctx context.Context, msg *pubsub.Message) error {
+			_, err := t.Publish(ctx, msg).Get(ctx)
+			return err
+		},
+		maxAttempts: DefaultPubsubMaxAttempts,
+		retryDelay:  DefaultPubsubRetryDelay,
+	}
+
+	for _, opt := range opts {
+		opt(pe)
+	}
+
+	return pe, nil
 }
 
-// ExportCost emits the CostItem to the PubsubCostExporter's configured pubsub topic.
+// ExportCost emits the CostItem to the PubsubCostExporter's configured pubsub
+// topic. Cost data exported after Close is dropped.
 func (pe *PubsubCostExporter) ExportCost(cd CostData) {
-	msg, err := json.Marshal(cd)
+	msg, err := MarshalCostData(cd, pe.eventSource)
 	if err != nil {
 		log.Log.Errorw("could not marshal cost", zap.Error(err))
 		return
 	}
 
+	pe.mux.Lock()
+	defer pe.mux.Unlock()
+	if pe.closed {
+		log.Log.Warnw("dropping cost data exported after pubsub exporter closed", zap.Object("data", &cd))
+		return
+	}
+
 	log.Log.Debugw("exporting cost data to pubsub", zap.Object("data", &cd))
-	res := pe.topic.Publish(pe.ctx, &pubsub.Message{Data: msg})
-	go func(res *pubsub.PublishResult) {
-		_, err := res.Get(pe.ctx)
-		if err != nil {
-			log.Log.Errorw("Failed to publish", zap.Error(err))
+	pe.wg.Add(1)
+	go func() {
+		defer pe.wg.Done()
+		pe.publishWithRetry(msg)
+	}()
+}
+
+// Close waits for in-flight publishes, including their retries, to complete
+// and then stops the topic and closes the underlying pubsub client.
+func (pe *PubsubCostExporter) Close() error {
+	pe.mux.Lock()
+	pe.closed = true
+	pe.mux.Unlock()
+
+	pe.wg.Wait()
+	if pe.topic != nil {
+		pe.topic.Stop()
+	}
+	if pe.client != nil {
+		return errors.Wrap(pe.client.Close(), "could not close pubsub client")
+	}
+	return nil
+}
+
+// publishWithRetry publishes the provided message data, retrying failures
+// with exponential backoff until the configured number of attempts is
+// exhausted or the exporter's context is cancelled.
+func (pe *PubsubCostExporter) publishWithRetry(data []byte) {
+	delay := pe.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := pe.publish(pe.ctx, &pubsub.Message{Data: data})
+		if err == nil {
+			return
+		}
+
+		if attempt >= pe.maxAttempts {
+			log.Log.Errorw("Failed to publish", zap.Error(err), zap.Int("attempts", attempt))
 			stats.Record(pe.ctx, MeasurePubsubPublishErrors.M(1))
 			return
 		}
-	}(res)
+
+		log.Log.Warnw("Failed to publish, retrying", zap.Error(err), zap.Int("attempt", attempt), zap.Duration("delay", delay))
+		select {
+		case <-pe.ctx.Done():
+			log.Log.Errorw("Failed to publish before shutdown", zap.Error(err), zap.Int("attempts", attempt))
+			stats.Record(pe.ctx, MeasurePubsubPublishErrors.M(1))
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
 }
@@ -15,12 +15,22 @@
 package coster
 
 import (
+	"bytes"
 	"context"
+	"math"
+	"math/rand"
 	"sync"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/pubsub"
 	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 var testBufferingExporterCases = []struct {
@@ -39,7 +49,8 @@ var testBufferingExporterCases = []struct {
 					"service":   "foo",
 					"component": "bar",
 				},
-				EndTime: time.Unix(1542000000, 0),
+				StartTime: time.Unix(1541999995, 0),
+				EndTime:   time.Unix(1542000000, 0),
 			},
 			CostData{
 				Kind:     ResourceCostWeighted,
@@ -49,7 +60,8 @@ var testBufferingExporterCases = []struct {
 					"service":   "foo",
 					"component": "bar",
 				},
-				EndTime: time.Unix(1542000005, 0),
+				StartTime: time.Unix(1542000000, 0),
+				EndTime:   time.Unix(1542000005, 0),
 			},
 		},
 		expectedBuffer: map[CostDataKey]CostData{
@@ -64,8 +76,9 @@ var testBufferingExporterCases = []struct {
 					"service":   "foo",
 					"component": "bar",
 				},
-				Value:   8,                        // The combined sum.
-				EndTime: time.Unix(1542000005, 0), // The last exported timestamp.
+				Value:     8,                        // The combined sum.
+				StartTime: time.Unix(1541999995, 0), // The first exported start timestamp.
+				EndTime:   time.Unix(1542000005, 0), // The last exported timestamp.
 			},
 		},
 	},
@@ -126,6 +139,218 @@ var testBufferingExporterCases = []struct {
 	},
 }
 
+func TestBufferingExporterOutOfOrder(t *testing.T) {
+	ce := &BufferingCostExporter{
+		ctx:      context.Background(),
+		buffer:   map[CostDataKey]CostData{},
+		interval: time.Second, // Irrelevant in tests.
+		mux:      sync.Mutex{},
+	}
+
+	// Data arriving out of order should still produce the widest window.
+	ce.ExportCost(CostData{Kind: ResourceCostNode, Value: 1, StartTime: time.Unix(1542000005, 0), EndTime: time.Unix(1542000010, 0)})
+	ce.ExportCost(CostData{Kind: ResourceCostNode, Value: 1, StartTime: time.Unix(1542000000, 0), EndTime: time.Unix(1542000005, 0)})
+	ce.ExportCost(CostData{Kind: ResourceCostNode, Value: 1, EndTime: time.Unix(1542000001, 0)})
+
+	expected := map[CostDataKey]CostData{
+		CostDataKey{Kind: ResourceCostNode}: CostData{
+			Kind:      ResourceCostNode,
+			Value:     3,
+			StartTime: time.Unix(1542000000, 0),
+			EndTime:   time.Unix(1542000010, 0),
+		},
+	}
+
+	if diff := deep.Equal(ce.buffer, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestBufferingExporterDepth(t *testing.T) {
+	v := &view.View{
+		Name:        "test_buffer_depth",
+		Measure:     MeasureBufferDepth,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{TagExporter},
+	}
+	if err := view.Register(v); err != nil {
+		t.Fatalf("could not register view: %v", err)
+	}
+	defer view.Unregister(v)
+
+	ce := &BufferingCostExporter{
+		ctx:      context.Background(),
+		name:     "test",
+		buffer:   map[CostDataKey]CostData{},
+		interval: time.Second, // Irrelevant in tests.
+		mux:      sync.Mutex{},
+		next:     NewStdoutCostExporter(&bytes.Buffer{}, false),
+	}
+
+	depth := func() float64 {
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			t.Fatalf("could not retrieve buffer depth: %v", err)
+		}
+		if len(rows) != 1 || rows[0].Tags[0].Value != "test" {
+			t.Fatalf("expected a single row tagged with the exporter name, got %#v", rows)
+		}
+		return rows[0].Data.(*view.LastValueData).Value
+	}
+
+	ce.ExportCost(CostData{Kind: ResourceCostNode, Value: 1})
+	ce.ExportCost(CostData{Kind: ResourceCostNode, Value: 1})
+	ce.ExportCost(CostData{Kind: ResourceCostCPU, Value: 1})
+	if d := depth(); d != 2 {
+		t.Fatalf("expected a buffer depth of 2, got %v", d)
+	}
+
+	ce.flush()
+	if d := depth(); d != 0 {
+		t.Fatalf("expected a buffer depth of 0 after flushing, got %v", d)
+	}
+}
+
+// recordingExporter records all of the cost data exported to it.
+type recordingExporter struct {
+	mux  sync.Mutex
+	data []CostData
+}
+
+func (re *recordingExporter) ExportCost(cd CostData) {
+	re.mux.Lock()
+	defer re.mux.Unlock()
+	re.data = append(re.data, cd)
+}
+
+func TestStatsExporterAllowedDimensions(t *testing.T) {
+	service, _ := tag.NewKey("service")
+	pod, _ := tag.NewKey("pod")
+	v := &view.View{
+		Name:        "test_allowed_dimensions",
+		Measure:     MeasureCost,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{service, pod},
+	}
+	if err := view.Register(v); err != nil {
+		t.Fatalf("could not register view: %v", err)
+	}
+	defer view.Unregister(v)
+
+	sce := NewStatsCostExporter(&Mapper{})
+	sce.AllowedDimensions = []string{"service"}
+	re := &recordingExporter{}
+
+	cd := CostData{Kind: ResourceCostCPU, Value: 1, Dimensions: map[string]string{"service": "api", "pod": "api-7d9f"}}
+	for _, exp := range []CostExporter{sce, re} {
+		exp.ExportCost(cd)
+	}
+
+	rows, err := view.RetrieveData(v.Name)
+	if err != nil {
+		t.Fatalf("could not retrieve costs: %v", err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("expected a single row, got %#v", rows)
+	}
+	if diff := deep.Equal(rows[0].Tags, []tag.Tag{{Key: service, Value: "api"}}); diff != nil {
+		t.Fatal(diff)
+	}
+
+	if len(re.data) != 1 || re.data[0].Dimensions["pod"] != "api-7d9f" {
+		t.Fatalf("expected other exporters to receive every dimension, got %#v", re.data)
+	}
+}
+
+func TestStatsExporterSampling(t *testing.T) {
+	service, _ := tag.NewKey("service")
+	sum := &view.View{
+		Name:        "test_sampled_costs",
+		Measure:     MeasureCost,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{service},
+	}
+	count := &view.View{
+		Name:        "test_sampled_records",
+		Measure:     MeasureCost,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{service},
+	}
+	if err := view.Register(sum, count); err != nil {
+		t.Fatalf("could not register views: %v", err)
+	}
+	defer view.Unregister(sum, count)
+
+	sce := NewStatsCostExporter(&Mapper{})
+	sce.SampleRate = 10
+	sce.rnd = rand.New(rand.NewSource(1))
+
+	const exports = 10000
+	cd := CostData{Kind: ResourceCostCPU, Value: 3, Dimensions: map[string]string{"service": "sampled"}}
+	for i := 0; i < exports; i++ {
+		sce.ExportCost(cd)
+	}
+
+	rows, err := view.RetrieveData(count.Name)
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("could not retrieve record count: %v %#v", err, rows)
+	}
+	records := rows[0].Data.(*view.CountData).Value
+	if records >= exports/2 {
+		t.Fatalf("expected roughly 1 in 10 cost data to be recorded, got %d of %d", records, exports)
+	}
+
+	rows, err = view.RetrieveData(sum.Name)
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("could not retrieve recorded costs: %v %#v", err, rows)
+	}
+	total := rows[0].Data.(*view.SumData).Value
+	if total != float64(records*30) {
+		t.Fatalf("expected each of %d records to be scaled to 30, got a total of %v", records, total)
+	}
+	if expected := float64(exports * 3); math.Abs(total-expected) > expected*0.1 {
+		t.Fatalf("expected a sampled total of approximately %v, got %v", expected, total)
+	}
+}
+
+func TestStatsExporterNoSampling(t *testing.T) {
+	for _, rate := range []int{0, 1} {
+		sce := NewStatsCostExporter(&Mapper{})
+		sce.SampleRate = rate
+		for i := 0; i < 100; i++ {
+			if v, ok := sce.sample(7); !ok || v != 7 {
+				t.Fatalf("expected sample rate %d to record every value unscaled, got %d, %v", rate, v, ok)
+			}
+		}
+	}
+}
+
+func TestBufferingExporterFlushesOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	next := &recordingExporter{}
+	ce, err := NewBufferingCostExporter(ctx, "test", time.Hour, next)
+	if err != nil {
+		t.Fatalf("unexpected error creating exporter: %v", err)
+	}
+
+	cd := CostData{Kind: ResourceCostNode, Value: 1}
+	ce.ExportCost(cd)
+	cancel()
+
+	select {
+	case <-ce.Stopped():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the exporter to stop")
+	}
+
+	if diff := deep.Equal(next.data, []CostData{cd}); diff != nil {
+		t.Fatal(diff)
+	}
+	if len(ce.buffer) != 0 {
+		t.Fatalf("expected the buffer to be drained, got %#v", ce.buffer)
+	}
+}
+
 func TestBufferingExporter(t *testing.T) {
 	for _, tt := range testBufferingExporterCases {
 		t.Run(tt.name, func(t *testing.T) {
@@ -146,3 +371,322 @@ func TestBufferingExporter(t *testing.T) {
 		})
 	}
 }
+
+var testStdoutExporterCases = []struct {
+	name     string
+	pretty   bool
+	datum    []CostData
+	expected string
+}{
+	{
+		name: "Writes a json line per cost datum",
+		datum: []CostData{
+			CostData{
+				Kind:     ResourceCostCPU,
+				Strategy: StrategyNameCPU,
+				Value:    5,
+				Dimensions: map[string]string{
+					"service": "foo",
+				},
+				EndTime: time.Unix(1542000000, 0).UTC(),
+			},
+			CostData{
+				Kind:     ResourceCostNode,
+				Strategy: StrategyNameNode,
+				Value:    3,
+				EndTime:  time.Unix(1542000005, 0).UTC(),
+			},
+		},
+		expected: `{"Kind":"cpu","Strategy":"CPUPricingStrategy","Value":5,"Dimensions":{"service":"foo"},"StartTime":"0001-01-01T00:00:00Z","EndTime":"2018-11-12T05:20:00Z"}
+{"Kind":"node","Strategy":"NodePricingStrategy","Value":3,"Dimensions":null,"StartTime":"0001-01-01T00:00:00Z","EndTime":"2018-11-12T05:20:05Z"}
+`,
+	},
+	{
+		name:   "Pretty prints when requested",
+		pretty: true,
+		datum: []CostData{
+			CostData{
+				Kind:     ResourceCostCPU,
+				Strategy: StrategyNameCPU,
+				Value:    5,
+				Dimensions: map[string]string{
+					"service": "foo",
+				},
+				EndTime: time.Unix(1542000000, 0).UTC(),
+			},
+		},
+		expected: `{
+  "Kind": "cpu",
+  "Strategy": "CPUPricingStrategy",
+  "Value": 5,
+  "Dimensions": {
+    "service": "foo"
+  },
+  "StartTime": "0001-01-01T00:00:00Z",
+  "EndTime": "2018-11-12T05:20:00Z"
+}
+`,
+	},
+}
+
+func TestStdoutExporter(t *testing.T) {
+	for _, tt := range testStdoutExporterCases {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			ce := NewStdoutCostExporter(buf, tt.pretty)
+
+			for _, cd := range tt.datum {
+				ce.ExportCost(cd)
+			}
+
+			if diff := deep.Equal(buf.String(), tt.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestLogExporter(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ce := NewLogCostExporter(zap.New(core).Sugar())
+
+	ce.ExportCost(CostData{
+		Kind:       ResourceCostWeighted,
+		Strategy:   StrategyNameWeighted,
+		Value:      5,
+		Dimensions: map[string]string{"service": "foo"},
+	})
+
+	entries := logs.AllUntimed()
+	if len(entries) != 1 {
+		t.Fatalf("expected a single log entry, got %d", len(entries))
+	}
+	if entries[0].Level != zapcore.InfoLevel {
+		t.Fatalf("expected cost data to be logged at info level, got %v", entries[0].Level)
+	}
+
+	fields := entries[0].ContextMap()["data"].(map[string]interface{})
+	if fields["Dimensions.service"] != "foo" || fields["Value"] != int64(5) {
+		t.Fatalf("unexpected logged cost data: %#v", fields)
+	}
+}
+
+func TestLogExporterDeterministic(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg", EncodeTime: zapcore.ISO8601TimeEncoder})
+	ce := NewLogCostExporter(zap.New(zapcore.NewCore(enc, zapcore.AddSync(buf), zapcore.DebugLevel)).Sugar())
+
+	// Each CostData gets its own dimensions map, so that the two are equal
+	// but iterated in independently random order.
+	data := func() CostData {
+		dims := map[string]string{}
+		for _, k := range []string{"team", "service", "namespace", "app", "cluster", "environment", "component", "zone"} {
+			dims[k] = k + "-value"
+		}
+		return CostData{
+			Kind:       ResourceCostWeighted,
+			Strategy:   StrategyNameWeighted,
+			Value:      5,
+			EndTime:    time.Unix(1500000000, 0).UTC(),
+			Dimensions: dims,
+		}
+	}
+	ce.ExportCost(data())
+	ce.ExportCost(data())
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d", len(lines))
+	}
+	if !bytes.Equal(lines[0], lines[1]) {
+		t.Fatalf("expected identical cost data to be logged identically, got:\n%s\n%s", lines[0], lines[1])
+	}
+	if a, z := bytes.Index(lines[0], []byte("Dimensions.app")), bytes.Index(lines[0], []byte("Dimensions.zone")); a < 0 || a > z {
+		t.Fatalf("expected dimensions to be logged in sorted order, got %s", lines[0])
+	}
+}
+
+func TestCostDataDimensionNames(t *testing.T) {
+	cd := CostData{Dimensions: map[string]string{"b": "2", "c": "3", "a": "1"}}
+	if diff := deep.Equal(cd.DimensionNames(), []string{"a", "b", "c"}); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+// failingPublisher fails the first `failures` publishes and then succeeds,
+// signalling completion on done.
+type failingPublisher struct {
+	mux      sync.Mutex
+	failures int
+	attempts int
+	done     chan struct{}
+}
+
+func (fp *failingPublisher) publish(ctx context.Context, msg *pubsub.Message) error {
+	fp.mux.Lock()
+	defer fp.mux.Unlock()
+	fp.attempts++
+	if fp.attempts <= fp.failures {
+		return errTestPublish
+	}
+	close(fp.done)
+	return nil
+}
+
+var errTestPublish = errors.New("transient publish failure")
+
+func TestPubsubExporterRetries(t *testing.T) {
+	fp := &failingPublisher{failures: 3, done: make(chan struct{})}
+	pe := &PubsubCostExporter{
+		ctx:         context.Background(),
+		publish:     fp.publish,
+		maxAttempts: 5,
+		retryDelay:  time.Millisecond,
+	}
+
+	pe.ExportCost(CostData{Kind: ResourceCostCPU, Value: 1})
+
+	select {
+	case <-fp.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a successful publish")
+	}
+
+	fp.mux.Lock()
+	defer fp.mux.Unlock()
+	if fp.attempts != 4 {
+		t.Fatalf("expected 4 attempts, got %d", fp.attempts)
+	}
+}
+
+func TestPubsubExporterGivesUp(t *testing.T) {
+	fp := &failingPublisher{failures: 10, done: make(chan struct{})}
+	pe := &PubsubCostExporter{
+		ctx:         context.Background(),
+		publish:     fp.publish,
+		maxAttempts: 3,
+		retryDelay:  time.Millisecond,
+	}
+
+	pe.publishWithRetry([]byte("{}"))
+
+	fp.mux.Lock()
+	defer fp.mux.Unlock()
+	if fp.attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", fp.attempts)
+	}
+}
+
+func TestPubsubExporterRetryRespectsCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fp := &failingPublisher{failures: 10, done: make(chan struct{})}
+	pe := &PubsubCostExporter{
+		ctx:         ctx,
+		publish:     fp.publish,
+		maxAttempts: 5,
+		retryDelay:  time.Hour,
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		pe.publishWithRetry([]byte("{}"))
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry did not stop after the context was cancelled")
+	}
+}
+
+// blockingPublisher holds every publish until release is closed, counting
+// those that complete.
+type blockingPublisher struct {
+	mux       sync.Mutex
+	release   chan struct{}
+	published int
+}
+
+func (bp *blockingPublisher) publish(ctx context.Context, msg *pubsub.Message) error {
+	<-bp.release
+	bp.mux.Lock()
+	defer bp.mux.Unlock()
+	bp.published++
+	return nil
+}
+
+func TestPubsubExporterCloseWaitsForPublishes(t *testing.T) {
+	bp := &blockingPublisher{release: make(chan struct{})}
+	pe := &PubsubCostExporter{
+		ctx:         context.Background(),
+		publish:     bp.publish,
+		maxAttempts: 1,
+	}
+
+	for i := 0; i < 3; i++ {
+		pe.ExportCost(CostData{Kind: ResourceCostCPU, Value: int64(i)})
+	}
+
+	closed := make(chan error)
+	go func() { closed <- pe.Close() }()
+
+	select {
+	case <-closed:
+		t.Fatal("close returned before in-flight publishes completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(bp.release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("unexpected close error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for close")
+	}
+
+	bp.mux.Lock()
+	defer bp.mux.Unlock()
+	if bp.published != 3 {
+		t.Fatalf("expected 3 completed publishes, got %d", bp.published)
+	}
+}
+
+func TestPubsubExporterExportDuringClose(t *testing.T) {
+	bp := &blockingPublisher{release: make(chan struct{})}
+	pe := &PubsubCostExporter{
+		ctx:         context.Background(),
+		publish:     bp.publish,
+		maxAttempts: 1,
+	}
+
+	pe.ExportCost(CostData{Kind: ResourceCostCPU, Value: 1})
+
+	closed := make(chan error)
+	go func() { closed <- pe.Close() }()
+	time.Sleep(50 * time.Millisecond)
+
+	// Exports racing Close, as from a BufferingCostExporter abandoned by a
+	// timed out shutdown, are dropped rather than published to a stopped topic.
+	pe.ExportCost(CostData{Kind: ResourceCostCPU, Value: 2})
+	close(bp.release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("unexpected close error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for close")
+	}
+	pe.ExportCost(CostData{Kind: ResourceCostCPU, Value: 3})
+
+	bp.mux.Lock()
+	defer bp.mux.Unlock()
+	if bp.published != 1 {
+		t.Fatalf("expected only the export before close to be published, got %d", bp.published)
+	}
+}
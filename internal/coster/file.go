@@ -0,0 +1,54 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"github.com/pkg/errors"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// FileCostExporter appends cost data as JSON lines to a file, rotating it
+// once it reaches a maximum size. It is intended for clusters where an
+// external agent ships the file onward.
+type FileCostExporter struct {
+	*StdoutCostExporter
+	file *lumberjack.Logger
+}
+
+// NewFileCostExporter returns a FileCostExporter that appends to the provided
+// path, rotating it once it grows beyond maxSizeMB megabytes and keeping at
+// most maxBackups rotated files. A maxBackups of zero retains every rotated
+// file.
+func NewFileCostExporter(path string, maxSizeMB, maxBackups int) (*FileCostExporter, error) {
+	if path == "" {
+		return nil, errors.New("an output file path is required")
+	}
+
+	file := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    maxSizeMB,
+		MaxBackups: maxBackups,
+	}
+
+	return &FileCostExporter{
+		StdoutCostExporter: NewStdoutCostExporter(file, false),
+		file:               file,
+	}, nil
+}
+
+// Close closes the current file.
+func (fe *FileCostExporter) Close() error {
+	return errors.Wrap(fe.file.Close(), "could not close output file")
+}
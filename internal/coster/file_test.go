@@ -0,0 +1,79 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFileCostExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kostanza-file")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	path := filepath.Join(dir, "costs.json")
+	fe, err := NewFileCostExporter(path, 1, 1)
+	if err != nil {
+		t.Fatalf("could not create file cost exporter: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fe.ExportCost(CostData{Kind: ResourceCostCPU, Value: int64(i)})
+		}(i)
+	}
+	wg.Wait()
+
+	if err := fe.Close(); err != nil {
+		t.Fatalf("could not close file cost exporter: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("could not open output file: %v", err)
+	}
+	defer f.Close() // nolint: errcheck
+
+	lines := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var cd CostData
+		if err := json.Unmarshal(s.Bytes(), &cd); err != nil {
+			t.Fatalf("could not decode line %q: %v", s.Text(), err)
+		}
+		lines++
+	}
+
+	if lines != 100 {
+		t.Fatalf("expected 100 lines, got %d", lines)
+	}
+}
+
+func TestFileCostExporterRequiresPath(t *testing.T) {
+	if _, err := NewFileCostExporter("", 1, 1); err == nil {
+		t.Fatal("expected an error without an output file path")
+	}
+}
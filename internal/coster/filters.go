@@ -14,7 +14,10 @@
 
 package coster
 
-import core_v1 "k8s.io/api/core/v1"
+import (
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
 
 // PodFilter returns true if Pod should be included in filtered results.
 type PodFilter func(p *core_v1.Pod) bool
@@ -37,3 +40,54 @@ func (pf PodFilters) All(p *core_v1.Pod) bool {
 func RunningPodFilter(p *core_v1.Pod) bool {
 	return p.Status.Phase == core_v1.PodRunning
 }
+
+// ScheduledPodFilter returns true if the Pod has been scheduled to a node and
+// has not yet terminated. Unlike RunningPodFilter it includes pending pods,
+// e.g. those pulling images, which already hold a reservation on their node.
+// Pods that have succeeded or failed no longer hold one and are excluded.
+func ScheduledPodFilter(p *core_v1.Pod) bool {
+	if p.Spec.NodeName == "" {
+		return false
+	}
+	return p.Status.Phase != core_v1.PodSucceeded && p.Status.Phase != core_v1.PodFailed
+}
+
+// NamespaceIncludeFilter returns a PodFilter that only includes pods within one
+// of the provided namespaces. An empty list of namespaces includes all pods.
+func NamespaceIncludeFilter(namespaces ...string) PodFilter {
+	ns := namespaceSet(namespaces)
+	return func(p *core_v1.Pod) bool {
+		if len(ns) == 0 {
+			return true
+		}
+		_, ok := ns[p.ObjectMeta.Namespace]
+		return ok
+	}
+}
+
+// NamespaceExcludeFilter returns a PodFilter that excludes pods within any of
+// the provided namespaces. An empty list of namespaces excludes no pods.
+func NamespaceExcludeFilter(namespaces ...string) PodFilter {
+	ns := namespaceSet(namespaces)
+	return func(p *core_v1.Pod) bool {
+		_, ok := ns[p.ObjectMeta.Namespace]
+		return !ok
+	}
+}
+
+// SelectorPodFilter returns a PodFilter that only includes pods whose labels
+// match the provided selector, e.g. one parsed from "cost-exempt!=true". An
+// empty selector includes all pods.
+func SelectorPodFilter(selector labels.Selector) PodFilter {
+	return func(p *core_v1.Pod) bool {
+		return selector.Matches(labels.Set(p.ObjectMeta.Labels))
+	}
+}
+
+func namespaceSet(namespaces []string) map[string]struct{} {
+	ns := map[string]struct{}{}
+	for _, n := range namespaces {
+		ns[n] = struct{}{}
+	}
+	return ns
+}
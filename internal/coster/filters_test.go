@@ -0,0 +1,198 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"testing"
+
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func namespacedPod(namespace string) *core_v1.Pod {
+	return &core_v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace}}
+}
+
+var namespaceFilterCases = []struct {
+	name     string
+	filters  PodFilters
+	pod      *core_v1.Pod
+	expected bool
+}{
+	{
+		name:     "empty include list includes everything",
+		filters:  PodFilters{NamespaceIncludeFilter()},
+		pod:      namespacedPod("default"),
+		expected: true,
+	},
+	{
+		name:     "empty exclude list excludes nothing",
+		filters:  PodFilters{NamespaceExcludeFilter()},
+		pod:      namespacedPod("kube-system"),
+		expected: true,
+	},
+	{
+		name:     "include list includes listed namespaces",
+		filters:  PodFilters{NamespaceIncludeFilter("default", "monitoring")},
+		pod:      namespacedPod("monitoring"),
+		expected: true,
+	},
+	{
+		name:     "include list excludes unlisted namespaces",
+		filters:  PodFilters{NamespaceIncludeFilter("default", "monitoring")},
+		pod:      namespacedPod("kube-system"),
+		expected: false,
+	},
+	{
+		name:     "exclude list excludes listed namespaces",
+		filters:  PodFilters{NamespaceExcludeFilter("kube-system")},
+		pod:      namespacedPod("kube-system"),
+		expected: false,
+	},
+	{
+		name:     "exclude list includes unlisted namespaces",
+		filters:  PodFilters{NamespaceExcludeFilter("kube-system")},
+		pod:      namespacedPod("default"),
+		expected: true,
+	},
+	{
+		name:     "exclusion wins when a namespace is both included and excluded",
+		filters:  PodFilters{NamespaceIncludeFilter("default", "kube-system"), NamespaceExcludeFilter("kube-system")},
+		pod:      namespacedPod("kube-system"),
+		expected: false,
+	},
+	{
+		name:     "overlapping filters still include namespaces that are only included",
+		filters:  PodFilters{NamespaceIncludeFilter("default", "kube-system"), NamespaceExcludeFilter("kube-system")},
+		pod:      namespacedPod("default"),
+		expected: true,
+	},
+}
+
+func TestNamespaceFilters(t *testing.T) {
+	for _, tt := range namespaceFilterCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filters.All(tt.pod); got != tt.expected {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func phasedPod(node string, phase core_v1.PodPhase) *core_v1.Pod {
+	return &core_v1.Pod{Spec: core_v1.PodSpec{NodeName: node}, Status: core_v1.PodStatus{Phase: phase}}
+}
+
+var phaseFilterCases = []struct {
+	name      string
+	pod       *core_v1.Pod
+	running   bool
+	scheduled bool
+}{
+	{
+		name:      "running pods are included by both filters",
+		pod:       phasedPod("node", core_v1.PodRunning),
+		running:   true,
+		scheduled: true,
+	},
+	{
+		name:      "scheduled pending pods are only included when scheduled",
+		pod:       phasedPod("node", core_v1.PodPending),
+		running:   false,
+		scheduled: true,
+	},
+	{
+		name:      "unscheduled pending pods are excluded by both filters",
+		pod:       phasedPod("", core_v1.PodPending),
+		running:   false,
+		scheduled: false,
+	},
+	{
+		name:      "terminated pods are excluded by both filters",
+		pod:       phasedPod("node", core_v1.PodSucceeded),
+		running:   false,
+		scheduled: false,
+	},
+}
+
+func TestPhaseFilters(t *testing.T) {
+	for _, tt := range phaseFilterCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RunningPodFilter(tt.pod); got != tt.running {
+				t.Fatalf("expected RunningPodFilter to return %v, got %v", tt.running, got)
+			}
+			if got := ScheduledPodFilter(tt.pod); got != tt.scheduled {
+				t.Fatalf("expected ScheduledPodFilter to return %v, got %v", tt.scheduled, got)
+			}
+		})
+	}
+}
+
+func labelledPod(l map[string]string) *core_v1.Pod {
+	return &core_v1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: l}}
+}
+
+var selectorFilterCases = []struct {
+	name     string
+	selector string
+	pod      *core_v1.Pod
+	expected bool
+}{
+	{
+		name:     "matching pods are included",
+		selector: "team=data",
+		pod:      labelledPod(map[string]string{"team": "data"}),
+		expected: true,
+	},
+	{
+		name:     "non-matching pods are excluded",
+		selector: "team=data",
+		pod:      labelledPod(map[string]string{"team": "web"}),
+		expected: false,
+	},
+	{
+		name:     "exempt pods are excluded",
+		selector: "cost-exempt!=true",
+		pod:      labelledPod(map[string]string{"cost-exempt": "true"}),
+		expected: false,
+	},
+	{
+		name:     "pods without the exemption label are included",
+		selector: "cost-exempt!=true",
+		pod:      labelledPod(nil),
+		expected: true,
+	},
+	{
+		name:     "the empty selector matches everything",
+		selector: "",
+		pod:      labelledPod(map[string]string{"team": "web"}),
+		expected: true,
+	},
+}
+
+func TestSelectorPodFilter(t *testing.T) {
+	for _, tt := range selectorFilterCases {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := labels.Parse(tt.selector)
+			if err != nil {
+				t.Fatalf("could not parse selector: %v", err)
+			}
+			if got := SelectorPodFilter(selector)(tt.pod); got != tt.expected {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
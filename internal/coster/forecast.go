@@ -0,0 +1,101 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+// ForecastPeriod is the period the /forecast endpoint projects cost over.
+const ForecastPeriod = 30 * 24 * time.Hour
+
+// Forecast projects the total node cost of the most recent calculation over
+// ForecastPeriod, as served by the /forecast endpoint.
+type Forecast struct {
+	// Total is the cost in microcents of every node over the basis interval.
+	Total int64 `json:"total"`
+	// StartTime and EndTime bound the basis interval.
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	// Interval is the duration of the basis interval, e.g. "1m0s".
+	Interval string `json:"interval"`
+	// Monthly is the cost in microcents of ForecastPeriod at the same rate.
+	Monthly int64 `json:"monthly"`
+	// Unit is the configured CostUnit, and MonthlyUnitValue is Monthly
+	// converted to it.
+	Unit             CostUnit `json:"unit"`
+	MonthlyUnitValue float64  `json:"monthlyUnitValue"`
+}
+
+// newForecast linearly projects the total cost of the interval from start to
+// end over ForecastPeriod.
+func newForecast(total int64, start, end time.Time, unit CostUnit) Forecast {
+	interval := end.Sub(start)
+	monthly := int64(math.Round(float64(total) * float64(ForecastPeriod) / float64(interval)))
+	return Forecast{
+		Total:            total,
+		StartTime:        start,
+		EndTime:          end,
+		Interval:         interval.String(),
+		Monthly:          monthly,
+		Unit:             unit.orDefault(),
+		MonthlyUnitValue: unit.Convert(monthly),
+	}
+}
+
+// recordTotalCost tracks the total node cost of the latest calculation, and
+// the interval it was priced over, for forecasting.
+func (c *coster) recordTotalCost(total int64, start, end time.Time) {
+	c.statusMux.Lock()
+	defer c.statusMux.Unlock()
+
+	c.lastTotalCost = total
+	c.lastTotalStart = start
+	c.lastTotalEnd = end
+}
+
+// forecast returns the Forecast of the latest calculation. The boolean return
+// value is false if no calculation has completed.
+func (c *coster) forecast() (Forecast, bool) {
+	unit := c.currentConfig().CostUnit
+
+	c.statusMux.RLock()
+	defer c.statusMux.RUnlock()
+
+	if !c.lastTotalEnd.After(c.lastTotalStart) {
+		return Forecast{}, false
+	}
+	return newForecast(c.lastTotalCost, c.lastTotalStart, c.lastTotalEnd, unit), true
+}
+
+// forecastHandler serves the Forecast of the latest calculation as JSON,
+// responding with a 503 until a calculation has completed.
+func (c *coster) forecastHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close() // nolint: errcheck
+
+	if r.Method != http.MethodGet {
+		writePricingJSON(w, http.StatusMethodNotAllowed, pricingError{Error: "only GET is supported"})
+		return
+	}
+
+	f, ok := c.forecast()
+	if !ok {
+		writePricingJSON(w, http.StatusServiceUnavailable, pricingError{Error: "no calculation has completed yet"})
+		return
+	}
+	writePricingJSON(w, http.StatusOK, f)
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/planetlabs/kostanza/internal/lister"
+)
+
+func TestForecastHandler(t *testing.T) {
+	tt := calculateCases[0]
+	node := testCalculationNode.DeepCopy()
+	node.Status.Capacity = core_v1.ResourceList{"cpu": resource.MustParse("2"), "memory": resource.MustParse("0")}
+
+	cfg := *tt.config
+	cfg.CostUnit = CostUnitDollars
+	c := &coster{
+		interval:   time.Hour,
+		nodeLister: &lister.FakeNodeLister{Nodes: []*core_v1.Node{node}},
+		podLister:  &lister.FakePodLister{Pods: tt.pods},
+		config:     &cfg,
+		strategies: []PricingStrategy{NodePricingStrategy},
+	}
+
+	rec := httptest.NewRecorder()
+	c.forecastHandler(rec, httptest.NewRequest(http.MethodGet, "/forecast", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 before the first calculation, got %d", rec.Code)
+	}
+
+	if err := c.CalculateAndEmit(); err != nil {
+		t.Fatalf("unexpected calculation error: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	c.forecastHandler(rec, httptest.NewRequest(http.MethodGet, "/forecast", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	var f Forecast
+	if err := json.NewDecoder(rec.Body).Decode(&f); err != nil {
+		t.Fatalf("could not decode forecast: %v", err)
+	}
+
+	// The node costs 1000µ¢ per millicpu hour, i.e. 2000000µ¢ over the first
+	// hour long interval and 720 times as much over 30 days.
+	if f.Total != 2000000 {
+		t.Fatalf("expected a total of 2000000, got %d", f.Total)
+	}
+	if f.Interval != "1h0m0s" {
+		t.Fatalf("expected a 1h0m0s basis interval, got %s", f.Interval)
+	}
+	if f.Monthly != 1440000000 {
+		t.Fatalf("expected a monthly projection of 1440000000, got %d", f.Monthly)
+	}
+	if f.Unit != CostUnitDollars || f.MonthlyUnitValue != 14.4 {
+		t.Fatalf("expected a monthly projection of 14.4 dollars, got %v %s", f.MonthlyUnitValue, f.Unit)
+	}
+}
+
+func TestNewForecast(t *testing.T) {
+	end := time.Unix(1542000000, 0)
+	f := newForecast(100, end.Add(-90*time.Second), end, "")
+
+	// 30 days is 28800 intervals of 90 seconds.
+	if f.Monthly != 2880000 {
+		t.Fatalf("expected a monthly projection of 2880000, got %d", f.Monthly)
+	}
+	if f.Unit != CostUnitMicroCents || f.MonthlyUnitValue != 2880000 {
+		t.Fatalf("expected a monthly projection of 2880000 microcents, got %v %s", f.MonthlyUnitValue, f.Unit)
+	}
+}
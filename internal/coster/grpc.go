@@ -0,0 +1,223 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+//go:generate protoc -I costpb --go_out=plugins=grpc:costpb costpb/cost.proto
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"go.opencensus.io/stats"
+	"google.golang.org/grpc"
+
+	"github.com/planetlabs/kostanza/internal/coster/costpb"
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+const (
+	// GRPCBackpressureDropOldest discards the oldest cost data buffered for a
+	// subscriber that is not keeping up.
+	GRPCBackpressureDropOldest = "drop-oldest"
+	// GRPCBackpressureBlock waits up to a timeout for a subscriber that is
+	// not keeping up, discarding the cost data if it times out.
+	GRPCBackpressureBlock = "block"
+
+	// DefaultGRPCSubscriberBuffer is the number of cost data buffered for
+	// each subscriber.
+	DefaultGRPCSubscriberBuffer = 1000
+)
+
+var (
+	// MeasureGRPCDropped tracks cost data discarded by the GRPCCostExporter
+	// because a subscriber was not keeping up.
+	MeasureGRPCDropped = stats.Int64("kostanza/measures/grpc_dropped", "Cost data dropped for slow grpc subscribers", stats.UnitDimensionless)
+)
+
+var _ costpb.CostServiceServer = (*GRPCCostExporter)(nil)
+
+// GRPCCostExporter serves the cost data it exports to subscribers of the
+// costpb.CostService. Cost data is buffered separately for each subscriber,
+// so that a slow subscriber does not hold up the others.
+type GRPCCostExporter struct {
+	server       *grpc.Server
+	buffer       int
+	backpressure string
+	timeout      time.Duration
+	mux          sync.Mutex
+	subscribers  map[chan *costpb.CostData]struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewGRPCCostExporter returns a GRPCCostExporter that buffers up to buffer
+// cost data for each subscriber. A subscriber whose buffer is full is handled
+// per backpressure, either GRPCBackpressureDropOldest or
+// GRPCBackpressureBlock, in which case ExportCost waits up to timeout.
+func NewGRPCCostExporter(buffer int, backpressure string, timeout time.Duration) *GRPCCostExporter {
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	ge := &GRPCCostExporter{
+		server:       grpc.NewServer(),
+		buffer:       buffer,
+		backpressure: backpressure,
+		timeout:      timeout,
+		subscribers:  map[chan *costpb.CostData]struct{}{},
+		done:         make(chan struct{}),
+	}
+	costpb.RegisterCostServiceServer(ge.server, ge)
+	return ge
+}
+
+// Serve accepts subscribers on the provided listener until Close is called.
+func (ge *GRPCCostExporter) Serve(lis net.Listener) error {
+	log.Log.Infof("starting grpc server on %s", lis.Addr())
+	return ge.server.Serve(lis)
+}
+
+// Close ends all subscriptions and stops serving.
+func (ge *GRPCCostExporter) Close() error {
+	ge.closeOnce.Do(func() {
+		close(ge.done)
+		ge.server.GracefulStop()
+	})
+	return nil
+}
+
+// ExportCost sends the CostData provided to every subscriber.
+func (ge *GRPCCostExporter) ExportCost(cd CostData) {
+	msg := costDataProto(cd)
+
+	ge.mux.Lock()
+	subs := make([]chan *costpb.CostData, 0, len(ge.subscribers))
+	for s := range ge.subscribers {
+		subs = append(subs, s)
+	}
+	ge.mux.Unlock()
+
+	for _, s := range subs {
+		if !ge.send(s, msg) {
+			stats.Record(context.Background(), MeasureGRPCDropped.M(1))
+		}
+	}
+}
+
+// send buffers msg for a subscriber, applying backpressure if its buffer is
+// full. It reports whether msg was buffered without dropping any cost data.
+func (ge *GRPCCostExporter) send(s chan *costpb.CostData, msg *costpb.CostData) bool {
+	select {
+	case s <- msg:
+		return true
+	default:
+	}
+
+	if ge.backpressure == GRPCBackpressureBlock {
+		t := time.NewTimer(ge.timeout)
+		defer t.Stop()
+		select {
+		case s <- msg:
+			return true
+		case <-t.C:
+			log.Log.Debug("timed out sending cost data to grpc subscriber")
+			return false
+		}
+	}
+
+	// Concurrent senders may refill the buffer, so keep dropping the oldest
+	// message until there is room.
+	for {
+		select {
+		case <-s:
+		default:
+		}
+		select {
+		case s <- msg:
+			return false
+		default:
+		}
+	}
+}
+
+// Subscribe streams exported cost data to the subscriber until it
+// disconnects or the exporter is closed.
+func (ge *GRPCCostExporter) Subscribe(req *costpb.SubscribeRequest, stream costpb.CostService_SubscribeServer) error {
+	s := make(chan *costpb.CostData, ge.buffer)
+
+	ge.mux.Lock()
+	ge.subscribers[s] = struct{}{}
+	ge.mux.Unlock()
+	log.Log.Debug("grpc subscriber connected")
+
+	defer func() {
+		ge.mux.Lock()
+		delete(ge.subscribers, s)
+		ge.mux.Unlock()
+		log.Log.Debug("grpc subscriber disconnected")
+	}()
+
+	for {
+		select {
+		case msg := <-s:
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-ge.done:
+			return nil
+		}
+	}
+}
+
+// subscriberCount returns the number of connected subscribers.
+func (ge *GRPCCostExporter) subscriberCount() int {
+	ge.mux.Lock()
+	defer ge.mux.Unlock()
+	return len(ge.subscribers)
+}
+
+// costDataProto converts CostData into its costpb representation.
+func costDataProto(cd CostData) *costpb.CostData {
+	return &costpb.CostData{
+		Kind:          string(cd.Kind),
+		Strategy:      cd.Strategy,
+		Value:         cd.Value,
+		Unit:          string(cd.Unit),
+		UnitValue:     cd.UnitValue,
+		ContainerName: cd.ContainerName,
+		Dimensions:    cd.Dimensions,
+		StartTime:     timestampProto(cd.StartTime),
+		EndTime:       timestampProto(cd.EndTime),
+	}
+}
+
+// timestampProto converts t into a protobuf timestamp, leaving zero times
+// unset.
+func timestampProto(t time.Time) *timestamp.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	ts, err := ptypes.TimestampProto(t)
+	if err != nil {
+		return nil
+	}
+	return ts
+}
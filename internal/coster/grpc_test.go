@@ -0,0 +1,135 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/planetlabs/kostanza/internal/coster/costpb"
+)
+
+func TestGRPCCostExporterStreams(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	ge := NewGRPCCostExporter(DefaultGRPCSubscriberBuffer, GRPCBackpressureDropOldest, time.Second)
+	go ge.Serve(lis) // nolint: errcheck
+	defer ge.Close() // nolint: errcheck
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, "bufconn",
+		grpc.WithInsecure(),
+		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) { return lis.Dial() }),
+	)
+	if err != nil {
+		t.Fatalf("could not dial exporter: %v", err)
+	}
+	defer conn.Close() // nolint: errcheck
+
+	stream, err := costpb.NewCostServiceClient(conn).Subscribe(ctx, &costpb.SubscribeRequest{})
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	if err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return ge.subscriberCount() == 1, nil
+	}); err != nil {
+		t.Fatalf("subscriber did not connect: %v", err)
+	}
+
+	end := time.Date(2018, 11, 1, 12, 0, 0, 0, time.UTC)
+	for i := int64(1); i <= 3; i++ {
+		ge.ExportCost(CostData{
+			Kind:       ResourceCostCPU,
+			Strategy:   StrategyNameCPU,
+			Value:      i,
+			Dimensions: map[string]string{"service": "web"},
+			EndTime:    end,
+		})
+	}
+
+	for i := int64(1); i <= 3; i++ {
+		got, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("could not receive cost data %d: %v", i, err)
+		}
+		expected := &costpb.CostData{
+			Kind:       string(ResourceCostCPU),
+			Strategy:   StrategyNameCPU,
+			Value:      i,
+			Dimensions: map[string]string{"service": "web"},
+			EndTime:    timestampProto(end),
+		}
+		if diff := deep.Equal(got, expected); diff != nil {
+			t.Fatal(diff)
+		}
+	}
+}
+
+func TestGRPCCostExporterDropOldest(t *testing.T) {
+	ge := NewGRPCCostExporter(2, GRPCBackpressureDropOldest, time.Second)
+	s := make(chan *costpb.CostData, 2)
+	ge.subscribers[s] = struct{}{}
+
+	for i := int64(1); i <= 3; i++ {
+		ge.ExportCost(CostData{Value: i})
+	}
+
+	if first, second := <-s, <-s; first.Value != 2 || second.Value != 3 {
+		t.Fatalf("expected the newest cost data to be kept, got %d and %d", first.Value, second.Value)
+	}
+}
+
+func TestGRPCCostExporterBlock(t *testing.T) {
+	ge := NewGRPCCostExporter(1, GRPCBackpressureBlock, 10*time.Millisecond)
+	s := make(chan *costpb.CostData, 1)
+	ge.subscribers[s] = struct{}{}
+
+	ge.ExportCost(CostData{Value: 1})
+	ge.ExportCost(CostData{Value: 2})
+
+	if got := <-s; got.Value != 1 {
+		t.Fatalf("expected cost data to be dropped once the timeout passed, got %d", got.Value)
+	}
+
+	// A subscriber that catches up within the timeout receives the data.
+	ge.timeout = time.Minute
+	s <- &costpb.CostData{Value: 3}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-s
+	}()
+	if !ge.send(s, &costpb.CostData{Value: 4}) {
+		t.Fatal("expected the send to wait for the subscriber")
+	}
+	if got := <-s; got.Value != 4 {
+		t.Fatalf("expected the blocked cost data to be received, got %d", got.Value)
+	}
+}
+
+func TestCostDataProtoOmitsZeroTimes(t *testing.T) {
+	got := costDataProto(CostData{Kind: ResourceCostNode, Value: 1})
+	if got.StartTime != nil || got.EndTime != nil {
+		t.Fatalf("expected zero times to be unset, got %v and %v", got.StartTime, got.EndTime)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+	"go.opencensus.io/stats"
+	"go.uber.org/zap"
+
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+var (
+	// MeasureKafkaWriteErrors tracks write errors in the KafkaCostExporter.
+	MeasureKafkaWriteErrors = stats.Int64("kostanza/measures/kafka_errors", "Number of kafka write errors", stats.UnitDimensionless)
+)
+
+const (
+	// kafkaQueueSize is the number of messages queued for the writer before
+	// ExportCost blocks.
+	kafkaQueueSize = 1000
+	// kafkaMaxBatch is the maximum number of queued messages written in a
+	// single WriteMessages call.
+	kafkaMaxBatch = 100
+)
+
+// kafkaWriter is the subset of the kafka.Writer API used by the
+// KafkaCostExporter.
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaCostExporter emits data to a kafka topic. Messages share the payload
+// of the PubsubCostExporter so that they may be consumed the same way. A
+// single goroutine writes messages in the order they were exported, so that
+// messages sharing a key are ordered within their partition.
+type KafkaCostExporter struct {
+	ctx    context.Context
+	writer kafkaWriter
+	keyDim string
+	msgs   chan kafka.Message
+	done   chan struct{}
+	// mux guards closed, so that ExportCost never sends on msgs once Close
+	// has closed it.
+	mux    sync.RWMutex
+	closed bool
+	// eventSource wraps messages in CloudEvents from this source when set.
+	eventSource string
+}
+
+// KafkaOption configures optional behavior of a KafkaCostExporter.
+type KafkaOption func(ke *KafkaCostExporter)
+
+// WithKafkaCloudEvents configures the KafkaCostExporter to wrap each CostData
+// in a CloudEvents envelope from the provided source, see MarshalCostData.
+func WithKafkaCloudEvents(source string) KafkaOption {
+	return func(ke *KafkaCostExporter) {
+		ke.eventSource = source
+	}
+}
+
+// NewKafkaCostExporter creates a new KafkaCostExporter producing to the topic
+// on the provided brokers. When keyDimension is set, messages are keyed and
+// partitioned by the value of that Mapper dimension so that the cost data for
+// each value is ordered. Otherwise messages are distributed round-robin.
+func NewKafkaCostExporter(ctx context.Context, brokers []string, topic string, keyDimension string, opts ...KafkaOption) (*KafkaCostExporter, error) {
+	if len(brokers) == 0 {
+		return nil, errors.New("at least one kafka broker is required")
+	}
+	if topic == "" {
+		return nil, errors.New("a kafka topic is required")
+	}
+
+	cfg := kafka.WriterConfig{
+		Brokers: brokers,
+		Topic:   topic,
+	}
+	if keyDimension != "" {
+		cfg.Balancer = &kafka.Hash{}
+	}
+
+	return newKafkaCostExporter(ctx, kafka.NewWriter(cfg), keyDimension, opts...), nil
+}
+
+func newKafkaCostExporter(ctx context.Context, writer kafkaWriter, keyDimension string, opts ...KafkaOption) *KafkaCostExporter {
+	ke := &KafkaCostExporter{
+		ctx:    ctx,
+		writer: writer,
+		keyDim: keyDimension,
+		msgs:   make(chan kafka.Message, kafkaQueueSize),
+		done:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(ke)
+	}
+	go ke.write()
+	return ke
+}
+
+// ExportCost emits the CostData to the KafkaCostExporter's configured topic.
+// Cost data exported after Close is dropped.
+func (ke *KafkaCostExporter) ExportCost(cd CostData) {
+	msg, err := ke.message(cd)
+	if err != nil {
+		log.Log.Errorw("could not marshal cost", zap.Error(err))
+		return
+	}
+
+	ke.mux.RLock()
+	defer ke.mux.RUnlock()
+	if ke.closed {
+		log.Log.Warnw("dropping cost data exported after kafka exporter closed", zap.Object("data", &cd))
+		return
+	}
+
+	log.Log.Debugw("exporting cost data to kafka", zap.Object("data", &cd))
+	ke.msgs <- msg
+}
+
+// write writes queued messages until the queue is closed, batching those
+// already queued into a single synchronous write.
+func (ke *KafkaCostExporter) write() {
+	defer close(ke.done)
+	for msg := range ke.msgs {
+		batch := []kafka.Message{msg}
+	drain:
+		for len(batch) < kafkaMaxBatch {
+			select {
+			case m, ok := <-ke.msgs:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, m)
+			default:
+				break drain
+			}
+		}
+
+		if err := ke.writer.WriteMessages(ke.ctx, batch...); err != nil {
+			log.Log.Errorw("Failed to write to kafka", zap.Error(err), zap.Int("messages", len(batch)))
+			stats.Record(ke.ctx, MeasureKafkaWriteErrors.M(1))
+		}
+	}
+}
+
+func (ke *KafkaCostExporter) message(cd CostData) (kafka.Message, error) {
+	value, err := MarshalCostData(cd, ke.eventSource)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	msg := kafka.Message{Value: value}
+	if ke.keyDim != "" {
+		msg.Key = []byte(cd.Dimensions[ke.keyDim])
+	}
+	return msg, nil
+}
+
+// Close waits for queued messages to be written and closes the underlying
+// kafka writer, flushing any messages it has buffered.
+func (ke *KafkaCostExporter) Close() error {
+	ke.mux.Lock()
+	if !ke.closed {
+		ke.closed = true
+		close(ke.msgs)
+	}
+	ke.mux.Unlock()
+	<-ke.done
+	return ke.writer.Close()
+}
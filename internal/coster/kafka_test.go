@@ -0,0 +1,207 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"encoding/json"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/go-test/deep"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+type fakeKafkaWriter struct {
+	mux    sync.Mutex
+	msgs   []kafka.Message
+	writes int
+	closed bool
+	// blocked, when set, is waited on before each write.
+	blocked chan struct{}
+}
+
+func (f *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if f.blocked != nil {
+		<-f.blocked
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.msgs = append(f.msgs, msgs...)
+	f.writes++
+	return nil
+}
+
+func (f *fakeKafkaWriter) Close() error {
+	f.closed = true
+	return nil
+}
+
+var kafkaExporterCases = []struct {
+	name        string
+	keyDim      string
+	expectedKey []byte
+}{
+	{
+		name:        "messages are keyed by the configured dimension",
+		keyDim:      "service",
+		expectedKey: []byte("foo"),
+	},
+	{
+		name:        "messages are unkeyed without a dimension",
+		keyDim:      "",
+		expectedKey: nil,
+	},
+}
+
+func TestKafkaExporter(t *testing.T) {
+	cd := CostData{
+		Kind:       ResourceCostWeighted,
+		Strategy:   StrategyNameWeighted,
+		Value:      5,
+		Dimensions: map[string]string{"service": "foo"},
+	}
+
+	for _, tt := range kafkaExporterCases {
+		t.Run(tt.name, func(t *testing.T) {
+			fw := &fakeKafkaWriter{}
+			ke := newKafkaCostExporter(context.Background(), fw, tt.keyDim)
+
+			ke.ExportCost(cd)
+			if err := ke.Close(); err != nil {
+				t.Fatalf("unexpected error closing exporter: %v", err)
+			}
+
+			if !fw.closed {
+				t.Fatal("expected the writer to be closed")
+			}
+			if len(fw.msgs) != 1 {
+				t.Fatalf("expected a single message, got %d", len(fw.msgs))
+			}
+			if diff := deep.Equal(fw.msgs[0].Key, tt.expectedKey); diff != nil {
+				t.Fatal(diff)
+			}
+
+			// The payload matches that of the PubsubCostExporter.
+			expected, err := json.Marshal(cd)
+			if err != nil {
+				t.Fatalf("could not marshal cost data: %v", err)
+			}
+			if diff := deep.Equal(fw.msgs[0].Value, expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestKafkaExporterCloudEvents(t *testing.T) {
+	fw := &fakeKafkaWriter{}
+	ke := newKafkaCostExporter(context.Background(), fw, "", WithKafkaCloudEvents("//kostanza/test-cluster"))
+
+	ke.ExportCost(cloudEventsTestCostData)
+	if err := ke.Close(); err != nil {
+		t.Fatalf("unexpected error closing exporter: %v", err)
+	}
+	if len(fw.msgs) != 1 {
+		t.Fatalf("expected a single message, got %d", len(fw.msgs))
+	}
+
+	var ev CloudEvent
+	if err := json.Unmarshal(fw.msgs[0].Value, &ev); err != nil {
+		t.Fatalf("could not unmarshal cloudevent: %v", err)
+	}
+	if ev.Type != CloudEventType || ev.Source != "//kostanza/test-cluster" {
+		t.Fatalf("unexpected cloudevent %#v", ev)
+	}
+	if diff := deep.Equal(ev.Data, cloudEventsTestCostData); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestKafkaExporterOrdering(t *testing.T) {
+	fw := &fakeKafkaWriter{}
+	ke := newKafkaCostExporter(context.Background(), fw, "service")
+
+	n := kafkaMaxBatch * 3
+	for i := 0; i < n; i++ {
+		ke.ExportCost(CostData{
+			Kind:       ResourceCostWeighted,
+			Strategy:   StrategyNameWeighted,
+			Value:      int64(i),
+			Dimensions: map[string]string{"service": "foo"},
+		})
+	}
+	if err := ke.Close(); err != nil {
+		t.Fatalf("unexpected error closing exporter: %v", err)
+	}
+
+	if len(fw.msgs) != n {
+		t.Fatalf("expected %d messages, got %d", n, len(fw.msgs))
+	}
+	if fw.writes < n/kafkaMaxBatch || fw.writes > n {
+		t.Fatalf("expected between %d and %d writes, got %d", n/kafkaMaxBatch, n, fw.writes)
+	}
+	for i, msg := range fw.msgs {
+		var cd CostData
+		if err := json.Unmarshal(msg.Value, &cd); err != nil {
+			t.Fatalf("could not unmarshal cost data: %v", err)
+		}
+		if cd.Value != int64(i) {
+			t.Fatalf("expected message %d to have value %d, got %d", i, i, cd.Value)
+		}
+	}
+}
+
+func TestKafkaExporterExportDuringClose(t *testing.T) {
+	fw := &fakeKafkaWriter{blocked: make(chan struct{})}
+	ke := newKafkaCostExporter(context.Background(), fw, "")
+	cd := CostData{Kind: ResourceCostWeighted, Strategy: StrategyNameWeighted, Value: 1}
+
+	// Export continuously, as a BufferingCostExporter abandoned by a timed out
+	// shutdown may, so that an export is blocked on the full queue when Close
+	// is called and exports continue after it returns.
+	stop := make(chan struct{})
+	exported := make(chan struct{})
+	go func() {
+		defer close(exported)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				ke.ExportCost(cd)
+			}
+		}
+	}()
+	for len(ke.msgs) < kafkaQueueSize {
+		runtime.Gosched()
+	}
+
+	closed := make(chan error)
+	go func() { closed <- ke.Close() }()
+	close(fw.blocked)
+
+	if err := <-closed; err != nil {
+		t.Fatalf("unexpected error closing exporter: %v", err)
+	}
+	close(stop)
+	<-exported
+	ke.ExportCost(cd)
+
+	if len(fw.msgs) < kafkaQueueSize {
+		t.Fatalf("expected at least the %d queued messages to be written, got %d", kafkaQueueSize, len(fw.msgs))
+	}
+}
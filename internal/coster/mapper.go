@@ -16,23 +16,161 @@ package coster
 
 import (
 	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
 
+	"github.com/pkg/errors"
 	"go.opencensus.io/tag"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/client-go/util/jsonpath"
 )
 
+const (
+	// TransformLowercase lowercases the extracted value.
+	TransformLowercase = "lowercase"
+	// TransformUppercase uppercases the extracted value.
+	TransformUppercase = "uppercase"
+	// TransformTrimPrefix removes the prefix following it from the extracted
+	// value, e.g. "trimPrefix:team-".
+	TransformTrimPrefix = "trimPrefix:"
+	// TransformTruncate keeps at most the number of characters following it,
+	// e.g. "truncate:8".
+	TransformTruncate = "truncate:"
+	// TransformRegexReplace replaces matches of the regular expression
+	// following it with the replacement after the final slash, e.g.
+	// "regexReplace:-[a-z0-9]+$/". The replacement may refer to submatches as
+	// per regexp.Regexp.ReplaceAllString.
+	TransformRegexReplace = "regexReplace:"
+)
+
+const (
+	// SourceKindPod evaluates a mapping's source against the pod of a cost
+	// item, e.g. "{.ObjectMeta.Labels.app}".
+	SourceKindPod = "pod"
+	// SourceKindNode evaluates a mapping's source against the node of a cost
+	// item, e.g. "{.ObjectMeta.Name}".
+	SourceKindNode = "node"
+	// SourceKindService evaluates a mapping's source against the service of
+	// a cost item, e.g. "{.ObjectMeta.Namespace}".
+	SourceKindService = "service"
+)
+
+const (
+	// SourceMapLabels indexes the labels of a mapping's object by its
+	// SourceKey.
+	SourceMapLabels = "labels"
+	// SourceMapAnnotations indexes the annotations of a mapping's object by
+	// its SourceKey.
+	SourceMapAnnotations = "annotations"
+)
+
 // Mapping models how to map a destination field from a source field within
 // a  kubernetes resource. The source is typically a jsonPath expression.
 type Mapping struct {
 	Default     string
 	Destination string
 	Source      string
+	// Transform optionally names a transform, e.g. TransformLowercase, that is
+	// applied to the value extracted from the source before Default handling.
+	Transform string
+	// SourceKind optionally evaluates the source against the pod, node or
+	// service of a cost item rather than the cost item itself, per
+	// SourceKindPod, SourceKindNode and SourceKindService. Node level cost
+	// items, e.g. those of the NodePricingStrategy, have no pod, so pod
+	// sourced mappings use their Default for them. Node sourced mappings read
+	// the node a pod is scheduled on for pod items. Only the items of the
+	// LoadBalancerPricingStrategy have a service.
+	SourceKind string
+	// SourceKey optionally replaces Source with the exact key of a label or
+	// annotation, e.g. "app.kubernetes.io/name", avoiding jsonpath escaping of
+	// dotted keys. The key indexes the SourceMap of the pod or node per
+	// SourceKind, or of the pod of a cost item if SourceKind is unset.
+	SourceKey string
+	// SourceMap is the map SourceKey indexes, SourceMapLabels by default or
+	// SourceMapAnnotations.
+	SourceMap string
+	// Sources optionally replaces Source with jsonPath expressions that are
+	// evaluated in order, using the first non-empty value, e.g. to read an
+	// annotation that only some pods set and fall back to a label.
+	Sources []string
 }
 
 // Mapper is a used to manage a set of mappings from source fields in
 // a generic interface{} to a destination.
 type Mapper struct {
 	Entries []Mapping
+
+	// transforms caches parsed transforms by their definition.
+	transforms map[string]transform
+}
+
+// transform modifies a value extracted by a Mapping.
+type transform func(string) string
+
+// parseTransform returns the transform described by def.
+func parseTransform(def string) (transform, error) {
+	switch {
+	case def == TransformLowercase:
+		return strings.ToLower, nil
+	case def == TransformUppercase:
+		return strings.ToUpper, nil
+	case strings.HasPrefix(def, TransformTrimPrefix):
+		prefix := strings.TrimPrefix(def, TransformTrimPrefix)
+		return func(v string) string { return strings.TrimPrefix(v, prefix) }, nil
+	case strings.HasPrefix(def, TransformTruncate):
+		n, err := strconv.Atoi(strings.TrimPrefix(def, TransformTruncate))
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid truncate length in transform %q", def)
+		}
+		return func(v string) string {
+			if r := []rune(v); len(r) > n {
+				return string(r[:n])
+			}
+			return v
+		}, nil
+	case strings.HasPrefix(def, TransformRegexReplace):
+		expr := strings.TrimPrefix(def, TransformRegexReplace)
+		i := strings.LastIndex(expr, "/")
+		if i < 0 {
+			return nil, errors.Errorf("missing replacement in transform %q", def)
+		}
+		re, err := regexp.Compile(expr[:i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid regular expression in transform %q", def)
+		}
+		repl := expr[i+1:]
+		return func(v string) string { return re.ReplaceAllString(v, repl) }, nil
+	}
+	return nil, errors.Errorf("unknown transform %q", def)
+}
+
+// Compile parses the transforms of every mapping so that they need not be
+// parsed, nor their regular expressions compiled, on every call to MapData.
+func (m *Mapper) Compile() error {
+	transforms := map[string]transform{}
+	for _, mp := range m.Entries {
+		if mp.Transform == "" {
+			continue
+		}
+
+		t, err := parseTransform(mp.Transform)
+		if err != nil {
+			return errors.Wrapf(err, "could not prepare mapping %s", mp.Destination)
+		}
+		transforms[mp.Transform] = t
+	}
+	m.transforms = transforms
+	return nil
+}
+
+// transform returns the transform for the provided definition, parsing it if
+// the mapper has not been compiled.
+func (m *Mapper) transform(def string) (transform, error) {
+	if t, ok := m.transforms[def]; ok {
+		return t, nil
+	}
+	return parseTransform(def)
 }
 
 // TagKeys returns a slice of tag.Key structs, useful when preparing your
@@ -55,23 +193,139 @@ func (m *Mapper) TagKeys() ([]tag.Key, error) {
 func (m *Mapper) MapData(obj interface{}) (map[string]string, error) {
 	res := map[string]string{}
 	for _, mp := range m.Entries {
-		buf := new(bytes.Buffer)
-
-		j := jsonpath.New(mp.Destination)
-		j.AllowMissingKeys(true)
-
-		if err := j.Parse(mp.Source); err != nil {
+		v, err := m.mapValue(mp, obj)
+		if err != nil {
 			return nil, err
 		}
+		res[mp.Destination] = v
+	}
+	return res, nil
+}
 
-		if err := j.Execute(buf, obj); err != nil {
-			return nil, err
+// MapCostItem returns a string map by applying the mappers rules to a cost
+// item. Mappings without a SourceKind are evaluated against the cost item, as
+// with MapData, while the rest are evaluated against its pod, node or
+// service. Pod
+// level cost items carry the node their pod is scheduled on, so node sourced
+// mappings apply to them as well as to node level cost items.
+func (m *Mapper) MapCostItem(ci CostItem) (map[string]string, error) {
+	res := map[string]string{}
+	for _, mp := range m.Entries {
+		var obj interface{}
+		switch mp.SourceKind {
+		case "":
+			obj = ci
+		case SourceKindPod:
+			if ci.Pod != nil {
+				obj = ci.Pod
+			}
+		case SourceKindNode:
+			if ci.Node != nil {
+				obj = ci.Node
+			}
+		case SourceKindService:
+			if ci.Service != nil {
+				obj = ci.Service
+			}
 		}
 
-		res[mp.Destination] = buf.String()
-		if res[mp.Destination] == "" {
+		if obj == nil {
 			res[mp.Destination] = mp.Default
+			continue
+		}
+
+		v, err := m.mapValue(mp, obj)
+		if err != nil {
+			return nil, err
 		}
+		res[mp.Destination] = v
 	}
 	return res, nil
 }
+
+// mapValue evaluates the source of a mapping against obj, applying its
+// transform and default.
+func (m *Mapper) mapValue(mp Mapping, obj interface{}) (string, error) {
+	v, err := sourceValue(mp, obj)
+	if err != nil {
+		return "", err
+	}
+
+	if mp.Transform != "" {
+		t, err := m.transform(mp.Transform)
+		if err != nil {
+			return "", err
+		}
+		v = t(v)
+	}
+
+	if v == "" {
+		v = mp.Default
+	}
+	return v, nil
+}
+
+// sourceValue extracts the value of a mapping's SourceKey, Sources or Source
+// from obj.
+func sourceValue(mp Mapping, obj interface{}) (string, error) {
+	if mp.SourceKey != "" {
+		sm, err := sourceMap(mp.SourceMap, obj)
+		if err != nil {
+			return "", err
+		}
+		return sm[mp.SourceKey], nil
+	}
+
+	if len(mp.Sources) > 0 {
+		for _, src := range mp.Sources {
+			v, err := jsonpathValue(mp.Destination, src, obj)
+			if err != nil || v != "" {
+				return v, err
+			}
+		}
+		return "", nil
+	}
+
+	return jsonpathValue(mp.Destination, mp.Source, obj)
+}
+
+// jsonpathValue evaluates the jsonPath expression src against obj.
+func jsonpathValue(name, src string, obj interface{}) (string, error) {
+	buf := new(bytes.Buffer)
+
+	j := jsonpath.New(name)
+	j.AllowMissingKeys(true)
+
+	if err := j.Parse(src); err != nil {
+		return "", err
+	}
+
+	if err := j.Execute(buf, obj); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// sourceMap returns the labels or annotations of obj, per name. Cost items
+// yield those of their pod, if any.
+func sourceMap(name string, obj interface{}) (map[string]string, error) {
+	if ci, ok := obj.(CostItem); ok {
+		if ci.Pod == nil {
+			return nil, nil
+		}
+		obj = ci.Pod
+	}
+
+	o, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot index %T by key", obj)
+	}
+
+	switch name {
+	case "", SourceMapLabels:
+		return o.GetLabels(), nil
+	case SourceMapAnnotations:
+		return o.GetAnnotations(), nil
+	}
+	return nil, errors.Errorf("unknown source map %q", name)
+}
@@ -17,6 +17,9 @@ package coster
 import (
 	"reflect"
 	"testing"
+
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type mapperTestMetadata struct {
@@ -32,6 +35,7 @@ var testStruct = mapperTestStruct{
 	Metadata: mapperTestMetadata{
 		Labels: map[string]string{
 			"service": "svc-via-label",
+			"upper":   "SVC-VIA-LABEL",
 		},
 		Annotations: map[string]string{
 			"service": "svc-via-annotation",
@@ -76,6 +80,120 @@ var mapperTestCases = []struct {
 			"service": "fresh-default",
 		},
 	},
+	{
+		name: "lowercase transform",
+		obj:  testStruct,
+		mapper: Mapper{
+			Entries: []Mapping{
+				Mapping{
+					Source:      "{.Metadata.Labels.upper}",
+					Destination: "service",
+					Transform:   "lowercase",
+				},
+			},
+		},
+		expected: map[string]string{
+			"service": "svc-via-label",
+		},
+	},
+	{
+		name: "uppercase transform",
+		obj:  testStruct,
+		mapper: Mapper{
+			Entries: []Mapping{
+				Mapping{
+					Source:      "{.Metadata.Labels.service}",
+					Destination: "service",
+					Transform:   "uppercase",
+				},
+			},
+		},
+		expected: map[string]string{
+			"service": "SVC-VIA-LABEL",
+		},
+	},
+	{
+		name: "trimPrefix transform",
+		obj:  testStruct,
+		mapper: Mapper{
+			Entries: []Mapping{
+				Mapping{
+					Source:      "{.Metadata.Labels.service}",
+					Destination: "service",
+					Transform:   "trimPrefix:svc-",
+				},
+			},
+		},
+		expected: map[string]string{
+			"service": "via-label",
+		},
+	},
+	{
+		name: "truncate transform",
+		obj:  testStruct,
+		mapper: Mapper{
+			Entries: []Mapping{
+				Mapping{
+					Source:      "{.Metadata.Labels.service}",
+					Destination: "service",
+					Transform:   "truncate:3",
+				},
+			},
+		},
+		expected: map[string]string{
+			"service": "svc",
+		},
+	},
+	{
+		name: "regexReplace transform",
+		obj:  testStruct,
+		mapper: Mapper{
+			Entries: []Mapping{
+				Mapping{
+					Source:      "{.Metadata.Labels.service}",
+					Destination: "service",
+					Transform:   "regexReplace:-via-(.*)$/.$1",
+				},
+			},
+		},
+		expected: map[string]string{
+			"service": "svc.label",
+		},
+	},
+	{
+		name: "transform applied before default",
+		obj:  testStruct,
+		mapper: Mapper{
+			Entries: []Mapping{
+				Mapping{
+					Source:      "{.Metadata.Labels.service}",
+					Default:     "fresh-default",
+					Destination: "service",
+					Transform:   "trimPrefix:svc-via-label",
+				},
+			},
+		},
+		expected: map[string]string{
+			"service": "fresh-default",
+		},
+	},
+	{
+		name: "default is not transformed",
+		obj:  testStruct,
+		mapper: Mapper{
+			Entries: []Mapping{
+				Mapping{
+					Source:      "{.Metadata.Annotations.nonexistent}",
+					Default:     "fresh-default",
+					Destination: "service",
+					Transform:   "uppercase",
+				},
+			},
+		},
+		expected: map[string]string{
+			"service": "fresh-default",
+		},
+	},
 }
 
 func TestMapperMapping(t *testing.T) {
@@ -91,3 +209,290 @@ func TestMapperMapping(t *testing.T) {
 		})
 	}
 }
+
+var mapperSourcesCases = []struct {
+	name     string
+	mapping  Mapping
+	expected string
+}{
+	{
+		name: "falls back to the second source when the first is empty",
+		mapping: Mapping{
+			Destination: "service",
+			Sources:     []string{"{.Metadata.Annotations.team}", "{.Metadata.Labels.service}"},
+			Default:     "unknown",
+		},
+		expected: "svc-via-label",
+	},
+	{
+		name: "uses the first non-empty source",
+		mapping: Mapping{
+			Destination: "service",
+			Sources:     []string{"{.Metadata.Annotations.service}", "{.Metadata.Labels.service}"},
+		},
+		expected: "svc-via-annotation",
+	},
+	{
+		name: "uses the default when every source is empty",
+		mapping: Mapping{
+			Destination: "service",
+			Sources:     []string{"{.Metadata.Annotations.team}", "{.Metadata.Labels.team}"},
+			Default:     "unknown",
+		},
+		expected: "unknown",
+	},
+	{
+		name: "transforms the first non-empty source",
+		mapping: Mapping{
+			Destination: "service",
+			Sources:     []string{"{.Metadata.Annotations.team}", "{.Metadata.Labels.upper}"},
+			Transform:   TransformLowercase,
+		},
+		expected: "svc-via-label",
+	},
+}
+
+func TestMapperSources(t *testing.T) {
+	for _, tt := range mapperSourcesCases {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Mapper{Entries: []Mapping{tt.mapping}}
+			got, err := m.MapData(testStruct)
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			if got["service"] != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, got["service"])
+			}
+		})
+	}
+}
+
+var transformErrorCases = []struct {
+	name      string
+	transform string
+}{
+	{name: "unknown transform", transform: "reverse"},
+	{name: "invalid truncate length", transform: "truncate:many"},
+	{name: "missing regexReplace replacement", transform: "regexReplace:abc"},
+	{name: "invalid regexReplace expression", transform: "regexReplace:(/x"},
+}
+
+func TestMapperCompileInvalidTransforms(t *testing.T) {
+	for _, tt := range transformErrorCases {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Mapper{Entries: []Mapping{Mapping{Source: "{.Metadata.Labels.service}", Destination: "service", Transform: tt.transform}}}
+			if err := m.Compile(); err == nil {
+				t.Fatalf("expected an error compiling transform %q", tt.transform)
+			}
+			if _, err := m.MapData(testStruct); err == nil {
+				t.Fatalf("expected an error mapping with transform %q", tt.transform)
+			}
+		})
+	}
+}
+
+func TestMapperCompileCachesTransforms(t *testing.T) {
+	m := Mapper{Entries: []Mapping{Mapping{Source: "{.Metadata.Labels.service}", Destination: "service", Transform: "regexReplace:^svc/service"}}}
+	if err := m.Compile(); err != nil {
+		t.Fatalf("unexpected error compiling mapper: %v", err)
+	}
+	if _, ok := m.transforms["regexReplace:^svc/service"]; !ok {
+		t.Fatal("expected the transform to be cached")
+	}
+
+	got, err := m.MapData(testStruct)
+	if err != nil {
+		t.Fatalf("unexpected error mapping: %v", err)
+	}
+	if got["service"] != "service-via-label" {
+		t.Fatalf("expected service-via-label, got %s", got["service"])
+	}
+}
+
+var sourceKindTestPod = &core_v1.Pod{
+	ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+}
+
+var sourceKindTestNode = &core_v1.Node{
+	ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{
+		"beta.kubernetes.io/instance-type": "n1-standard-4",
+		"cloud.google.com/gke-nodepool":    "default-pool",
+		"eks.amazonaws.com/nodegroup":      "workers",
+	}},
+}
+
+var sourceKindTestMapper = Mapper{
+	Entries: []Mapping{
+		Mapping{Destination: "service", Source: "{.ObjectMeta.Labels.app}", SourceKind: SourceKindPod, Default: "unknown"},
+		Mapping{Destination: "instance_type", Source: `{.ObjectMeta.Labels.beta\.kubernetes\.io/instance-type}`, SourceKind: SourceKindNode, Default: "none"},
+		Mapping{Destination: "strategy", Source: "{.Strategy}"},
+		Mapping{Destination: "node_pool", Source: `{.ObjectMeta.Labels.cloud\.google\.com/gke-nodepool}`, SourceKind: SourceKindNode, Default: "none"},
+	},
+}
+
+var mapCostItemCases = []struct {
+	name     string
+	item     CostItem
+	expected map[string]string
+}{
+	{
+		name: "pod items map pod sourced mappings",
+		item: CostItem{Strategy: StrategyNameWeighted, Pod: sourceKindTestPod, Node: sourceKindTestNode},
+		expected: map[string]string{
+			"service":       "web",
+			"instance_type": "n1-standard-4",
+			"strategy":      StrategyNameWeighted,
+			"node_pool":     "default-pool",
+		},
+	},
+	{
+		name: "pod items without a node use node sourced defaults",
+		item: CostItem{Strategy: StrategyNameWeighted, Pod: sourceKindTestPod},
+		expected: map[string]string{
+			"service":       "web",
+			"instance_type": "none",
+			"strategy":      StrategyNameWeighted,
+			"node_pool":     "none",
+		},
+	},
+	{
+		name: "node items map node sourced mappings",
+		item: CostItem{Strategy: StrategyNameNode, Node: sourceKindTestNode},
+		expected: map[string]string{
+			"service":       "unknown",
+			"instance_type": "n1-standard-4",
+			"strategy":      StrategyNameNode,
+			"node_pool":     "default-pool",
+		},
+	},
+}
+
+func TestMapCostItem(t *testing.T) {
+	for _, tt := range mapCostItemCases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sourceKindTestMapper.MapCostItem(tt.item)
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected %#v, got %#v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMapCostItemService(t *testing.T) {
+	m := Mapper{
+		Entries: []Mapping{
+			Mapping{Destination: "namespace", Source: "{.ObjectMeta.Namespace}", SourceKind: SourceKindService, Default: "none"},
+			Mapping{Destination: "service", Source: "{.ObjectMeta.Name}", SourceKind: SourceKindService, Default: "none"},
+			Mapping{Destination: "app", Source: "{.ObjectMeta.Labels.app}", SourceKind: SourceKindPod, Default: "unknown"},
+		},
+	}
+
+	svc := &core_v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "frontend"}}
+	got, err := m.MapCostItem(CostItem{Strategy: StrategyNameLoadBalancer, Service: svc})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	expected := map[string]string{"namespace": "web", "service": "frontend", "app": "unknown"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, got)
+	}
+
+	got, err = m.MapCostItem(CostItem{Strategy: StrategyNameWeighted, Pod: sourceKindTestPod})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	expected = map[string]string{"namespace": "none", "service": "none", "app": "web"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, got)
+	}
+}
+
+var sourceKeyTestPod = &core_v1.Pod{
+	ObjectMeta: metav1.ObjectMeta{
+		Labels: map[string]string{
+			"app.kubernetes.io/name": "web",
+			"app":                    "naive",
+		},
+		Annotations: map[string]string{
+			"cost.example.com/team.name": "payments",
+		},
+	},
+}
+
+var sourceKeyTestMapper = Mapper{
+	Entries: []Mapping{
+		Mapping{Destination: "service", SourceKey: "app.kubernetes.io/name", Default: "unknown"},
+		Mapping{Destination: "team", SourceKey: "cost.example.com/team.name", SourceMap: SourceMapAnnotations, SourceKind: SourceKindPod, Default: "unknown"},
+		Mapping{Destination: "node_pool", SourceKey: "cloud.google.com/gke-nodepool", SourceKind: SourceKindNode, Default: "none"},
+		Mapping{Destination: "instance_type", SourceKey: "beta.kubernetes.io/instance-type", SourceKind: SourceKindNode, Transform: "trimPrefix:n1-"},
+	},
+}
+
+var sourceKeyCases = []struct {
+	name     string
+	item     CostItem
+	expected map[string]string
+}{
+	{
+		name: "pod items index labels and annotations by exact key",
+		item: CostItem{Pod: sourceKeyTestPod, Node: sourceKindTestNode},
+		expected: map[string]string{
+			"service":       "web",
+			"team":          "payments",
+			"node_pool":     "default-pool",
+			"instance_type": "standard-4",
+		},
+	},
+	{
+		name: "node items use the defaults of pod keyed mappings",
+		item: CostItem{Node: sourceKindTestNode},
+		expected: map[string]string{
+			"service":       "unknown",
+			"team":          "unknown",
+			"node_pool":     "default-pool",
+			"instance_type": "standard-4",
+		},
+	},
+	{
+		name: "missing keys use the default",
+		item: CostItem{Pod: sourceKindTestPod, Node: &core_v1.Node{}},
+		expected: map[string]string{
+			"service":       "unknown",
+			"team":          "unknown",
+			"node_pool":     "none",
+			"instance_type": "",
+		},
+	},
+}
+
+func TestMapCostItemSourceKey(t *testing.T) {
+	for _, tt := range sourceKeyCases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sourceKeyTestMapper.MapCostItem(tt.item)
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected %#v, got %#v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMapDataSourceKey(t *testing.T) {
+	m := Mapper{Entries: []Mapping{Mapping{Destination: "service", SourceKey: "app.kubernetes.io/name"}}}
+	got, err := m.MapData(sourceKeyTestPod)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if got["service"] != "web" {
+		t.Fatalf("expected web, got %s", got["service"])
+	}
+
+	if _, err := m.MapData(testStruct); err == nil {
+		t.Fatal("expected an error indexing an object without metadata by key")
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"strings"
+
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	ownerKindReplicaSet = "ReplicaSet"
+	ownerKindDeployment = "Deployment"
+	// podTemplateHashLabel is added to pods and ReplicaSets by the Deployment
+	// controller. ReplicaSets it creates are named <deployment>-<hash>.
+	podTemplateHashLabel = "pod-template-hash"
+)
+
+// resolveOwner returns the kind and name of the workload controlling the
+// provided pod, or empty strings if it has no controller. Pods controlled by
+// a ReplicaSet created by a Deployment resolve to the Deployment, which is
+// inferred from the pod-template-hash label rather than by looking up the
+// ReplicaSet.
+func resolveOwner(p *core_v1.Pod) (string, string) {
+	ref := metav1.GetControllerOf(p)
+	if ref == nil {
+		return "", ""
+	}
+
+	if ref.Kind == ownerKindReplicaSet {
+		if hash, ok := p.Labels[podTemplateHashLabel]; ok && strings.HasSuffix(ref.Name, "-"+hash) {
+			return ownerKindDeployment, strings.TrimSuffix(ref.Name, "-"+hash)
+		}
+	}
+
+	return ref.Kind, ref.Name
+}
+
+// resolveOwners populates the OwnerKind and OwnerName of every CostItem
+// associated with a pod using the provided resolve function, e.g.
+// resolveOwner.
+func resolveOwners(cis []CostItem, resolve func(*core_v1.Pod) (string, string)) {
+	for i := range cis {
+		if cis[i].Pod == nil {
+			continue
+		}
+		cis[i].OwnerKind, cis[i].OwnerName = resolve(cis[i].Pod)
+	}
+}
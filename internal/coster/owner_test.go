@@ -0,0 +1,117 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func ownedPod(kind, name string, controller bool, labels map[string]string) *core_v1.Pod {
+	return &core_v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: labels,
+			OwnerReferences: []metav1.OwnerReference{
+				metav1.OwnerReference{Kind: kind, Name: name, Controller: &controller},
+			},
+		},
+	}
+}
+
+var resolveOwnerCases = []struct {
+	name         string
+	pod          *core_v1.Pod
+	expectedKind string
+	expectedName string
+}{
+	{
+		name:         "deployment pods resolve through their replicaset",
+		pod:          ownedPod("ReplicaSet", "web-5d8f7c9b4", true, map[string]string{"pod-template-hash": "5d8f7c9b4"}),
+		expectedKind: "Deployment",
+		expectedName: "web",
+	},
+	{
+		name:         "bare replicasets are reported as is",
+		pod:          ownedPod("ReplicaSet", "web", true, nil),
+		expectedKind: "ReplicaSet",
+		expectedName: "web",
+	},
+	{
+		name:         "daemonset pods",
+		pod:          ownedPod("DaemonSet", "fluentd", true, nil),
+		expectedKind: "DaemonSet",
+		expectedName: "fluentd",
+	},
+	{
+		name:         "job pods",
+		pod:          ownedPod("Job", "migrate-1541999995", true, nil),
+		expectedKind: "Job",
+		expectedName: "migrate-1541999995",
+	},
+	{
+		name:         "non-controller owners are ignored",
+		pod:          ownedPod("DaemonSet", "fluentd", false, nil),
+		expectedKind: "",
+		expectedName: "",
+	},
+	{
+		name:         "unowned pods",
+		pod:          &core_v1.Pod{},
+		expectedKind: "",
+		expectedName: "",
+	},
+}
+
+func TestResolveOwner(t *testing.T) {
+	for _, tt := range resolveOwnerCases {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, name := resolveOwner(tt.pod)
+			if kind != tt.expectedKind || name != tt.expectedName {
+				t.Fatalf("expected %s/%s, got %s/%s", tt.expectedKind, tt.expectedName, kind, name)
+			}
+		})
+	}
+}
+
+func TestOwnerDimensionsMapping(t *testing.T) {
+	cis := []CostItem{
+		CostItem{Pod: ownedPod("ReplicaSet", "web-5d8f7c9b4", true, map[string]string{"pod-template-hash": "5d8f7c9b4"})},
+		CostItem{Node: &core_v1.Node{}},
+	}
+	resolveOwners(cis, resolveOwner)
+
+	m := Mapper{Entries: []Mapping{
+		Mapping{Destination: "owner_kind", Source: "{.OwnerKind}", Default: "none"},
+		Mapping{Destination: "owner_name", Source: "{.OwnerName}", Default: "none"},
+	}}
+
+	expected := []map[string]string{
+		map[string]string{"owner_kind": "Deployment", "owner_name": "web"},
+		map[string]string{"owner_kind": "none", "owner_name": "none"},
+	}
+
+	for i, ci := range cis {
+		got, err := m.MapData(ci)
+		if err != nil {
+			t.Fatalf("unexpected error mapping data: %v", err)
+		}
+		if diff := deep.Equal(got, expected[i]); diff != nil {
+			t.Fatal(diff)
+		}
+	}
+}
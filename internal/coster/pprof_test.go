@@ -0,0 +1,50 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestServeMuxPprof(t *testing.T) {
+	cli := testclient.NewSimpleClientset()
+	for _, enabled := range []bool{false, true} {
+		opts := []Option{}
+		if enabled {
+			opts = append(opts, WithPprof())
+		}
+
+		c, err := NewKubernetesCoster(time.Hour, &Config{}, cli, nil, "", nil, opts...)
+		if err != nil {
+			t.Fatalf("error constructing coster: %v", err)
+		}
+
+		rec := httptest.NewRecorder()
+		c.serveMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+
+		expected := http.StatusNotFound
+		if enabled {
+			expected = http.StatusOK
+		}
+		if rec.Code != expected {
+			t.Errorf("expected status %d with pprof enabled %v, got %d", expected, enabled, rec.Code)
+		}
+	}
+}
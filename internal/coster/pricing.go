@@ -0,0 +1,74 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// pricingError is the JSON body returned by the pricing handlers on failure.
+type pricingError struct {
+	Error string
+}
+
+func writePricingJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v) // nolint: errcheck, gosec
+}
+
+// pricingHandler serves the pricing table of the current configuration, so
+// that it reflects any hot reloads.
+func (c *coster) pricingHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close() // nolint: errcheck
+
+	if r.Method != http.MethodGet {
+		writePricingJSON(w, http.StatusMethodNotAllowed, pricingError{Error: "only GET is supported"})
+		return
+	}
+	writePricingJSON(w, http.StatusOK, c.currentConfig().Pricing)
+}
+
+// pricingLookupHandler serves the pricing table entry matching the labels
+// supplied as repeated label=key=value query parameters, exactly as a node
+// with those labels would be matched.
+func (c *coster) pricingLookupHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close() // nolint: errcheck
+
+	if r.Method != http.MethodGet {
+		writePricingJSON(w, http.StatusMethodNotAllowed, pricingError{Error: "only GET is supported"})
+		return
+	}
+
+	labels := Labels{}
+	for _, l := range r.URL.Query()["label"] {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			writePricingJSON(w, http.StatusBadRequest, pricingError{Error: "labels must be of the form key=value, got " + l})
+			return
+		}
+		labels[kv[0]] = kv[1]
+	}
+
+	pricing := c.currentConfig().Pricing
+	e, err := pricing.FindByLabels(labels)
+	if err != nil {
+		writePricingJSON(w, http.StatusNotFound, pricingError{Error: err.Error()})
+		return
+	}
+	writePricingJSON(w, http.StatusOK, e)
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+var testPricingConfig = &Config{
+	Pricing: CostTable{
+		Entries: []*CostTableEntry{
+			&CostTableEntry{
+				Labels:                       Labels{"size": "large", "region": "usa"},
+				HourlyMilliCPUCostMicroCents: 2,
+			},
+			&CostTableEntry{
+				Labels:                       Labels{"size": "glob:*"},
+				HourlyMilliCPUCostMicroCents: 1,
+			},
+		},
+	},
+}
+
+var pricingLookupCases = []struct {
+	name          string
+	query         string
+	expectedCode  int
+	expectedEntry *CostTableEntry
+	expectedError string
+}{
+	{
+		name:          "exact match",
+		query:         "label=size=large&label=region=usa",
+		expectedCode:  http.StatusOK,
+		expectedEntry: testPricingConfig.Pricing.Entries[0],
+	},
+	{
+		name:          "glob match",
+		query:         "label=size=small",
+		expectedCode:  http.StatusOK,
+		expectedEntry: testPricingConfig.Pricing.Entries[1],
+	},
+	{
+		name:          "label values may contain equals signs",
+		query:         "label=size=a=b",
+		expectedCode:  http.StatusOK,
+		expectedEntry: testPricingConfig.Pricing.Entries[1],
+	},
+	{
+		name:          "no match",
+		query:         "label=region=usa",
+		expectedCode:  http.StatusNotFound,
+		expectedError: ErrNoCostEntry.Error(),
+	},
+	{
+		name:          "malformed label",
+		query:         "label=size",
+		expectedCode:  http.StatusBadRequest,
+		expectedError: "labels must be of the form key=value, got size",
+	},
+}
+
+func TestPricingLookupHandler(t *testing.T) {
+	c := &coster{config: testPricingConfig}
+
+	for _, tt := range pricingLookupCases {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c.pricingLookupHandler(rec, httptest.NewRequest(http.MethodGet, "/pricing/lookup?"+tt.query, nil))
+
+			if rec.Code != tt.expectedCode {
+				t.Fatalf("expected status %d, got %d", tt.expectedCode, rec.Code)
+			}
+
+			if tt.expectedEntry != nil {
+				var e CostTableEntry
+				if err := json.NewDecoder(rec.Body).Decode(&e); err != nil {
+					t.Fatalf("could not decode entry: %v", err)
+				}
+				if diff := deep.Equal(&e, tt.expectedEntry); diff != nil {
+					t.Fatal(diff)
+				}
+				return
+			}
+
+			var pe pricingError
+			if err := json.NewDecoder(rec.Body).Decode(&pe); err != nil {
+				t.Fatalf("could not decode error: %v", err)
+			}
+			if pe.Error != tt.expectedError {
+				t.Fatalf("expected error %q, got %q", tt.expectedError, pe.Error)
+			}
+		})
+	}
+}
+
+func TestPricingHandlerReflectsReload(t *testing.T) {
+	c := &coster{config: testPricingConfig}
+	reloaded := &Config{Pricing: CostTable{Entries: []*CostTableEntry{&CostTableEntry{HourlyGPUCostMicroCents: 3}}}}
+	c.ReloadConfig(reloaded)
+
+	rec := httptest.NewRecorder()
+	c.pricingHandler(rec, httptest.NewRequest(http.MethodGet, "/pricing", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	var ct CostTable
+	if err := json.NewDecoder(rec.Body).Decode(&ct); err != nil {
+		t.Fatalf("could not decode pricing table: %v", err)
+	}
+	if diff := deep.Equal(&ct, &reloaded.Pricing); diff != nil {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+)
+
+// runningSince returns when the provided pod started running, or false if its
+// start time is unknown. This is the pod's start time or, if later, the time
+// its first container started, which excludes e.g. time spent pulling images.
+func runningSince(p *core_v1.Pod) (time.Time, bool) {
+	if p.Status.StartTime == nil {
+		return time.Time{}, false
+	}
+	since := p.Status.StartTime.Time
+
+	var first time.Time
+	for _, cs := range p.Status.ContainerStatuses {
+		for _, s := range []core_v1.ContainerState{cs.State, cs.LastTerminationState} {
+			var started time.Time
+			switch {
+			case s.Running != nil:
+				started = s.Running.StartedAt.Time
+			case s.Terminated != nil:
+				started = s.Terminated.StartedAt.Time
+			}
+			if !started.IsZero() && (first.IsZero() || started.Before(first)) {
+				first = started
+			}
+		}
+	}
+
+	if first.After(since) {
+		since = first
+	}
+	return since, true
+}
+
+// runningFraction returns the fraction of the interval ending at end that
+// the provided pod spent running. Pods whose start time is unknown are
+// considered to have run for the entire interval.
+func runningFraction(p *core_v1.Pod, end time.Time, interval time.Duration) float64 {
+	since, ok := runningSince(p)
+	if !ok || interval <= 0 {
+		return 1
+	}
+
+	running := end.Sub(since)
+	switch {
+	case running <= 0:
+		return 0
+	case running >= interval:
+		return 1
+	}
+	return float64(running) / float64(interval)
+}
+
+// prorate scales the Value of every CostItem associated with a pod by the
+// fraction of the interval ending at end that the pod spent running.
+func prorate(cis []CostItem, end time.Time, interval time.Duration) {
+	for i := range cis {
+		if cis[i].Pod == nil {
+			continue
+		}
+		if f := runningFraction(cis[i].Pod, end, interval); f < 1 {
+			cis[i].Value = int64(float64(cis[i].Value) * f)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"testing"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var prorationEnd = time.Date(2018, 11, 1, 12, 0, 0, 0, time.UTC)
+
+// startedPod returns a pod that started at start, with containers started at
+// each of containers.
+func startedPod(start time.Time, containers ...time.Time) *core_v1.Pod {
+	p := &core_v1.Pod{Status: core_v1.PodStatus{StartTime: &metav1.Time{Time: start}}}
+	for _, c := range containers {
+		p.Status.ContainerStatuses = append(p.Status.ContainerStatuses, core_v1.ContainerStatus{
+			State: core_v1.ContainerState{Running: &core_v1.ContainerStateRunning{StartedAt: metav1.Time{Time: c}}},
+		})
+	}
+	return p
+}
+
+var runningFractionCases = []struct {
+	name     string
+	pod      *core_v1.Pod
+	expected float64
+}{
+	{
+		name:     "pod without a start time",
+		pod:      &core_v1.Pod{},
+		expected: 1,
+	},
+	{
+		name:     "pod started before the interval",
+		pod:      startedPod(prorationEnd.Add(-time.Hour)),
+		expected: 1,
+	},
+	{
+		name:     "pod started halfway through the interval",
+		pod:      startedPod(prorationEnd.Add(-5 * time.Second)),
+		expected: 0.5,
+	},
+	{
+		name:     "pod whose container started after the pod",
+		pod:      startedPod(prorationEnd.Add(-5*time.Second), prorationEnd.Add(-2*time.Second)),
+		expected: 0.2,
+	},
+	{
+		name:     "pod whose first container started after the pod",
+		pod:      startedPod(prorationEnd.Add(-8*time.Second), prorationEnd.Add(-2*time.Second), prorationEnd.Add(-5*time.Second)),
+		expected: 0.5,
+	},
+	{
+		name: "restarted containers count from their first start",
+		pod: &core_v1.Pod{Status: core_v1.PodStatus{
+			StartTime: &metav1.Time{Time: prorationEnd.Add(-time.Hour)},
+			ContainerStatuses: []core_v1.ContainerStatus{core_v1.ContainerStatus{
+				State:                core_v1.ContainerState{Running: &core_v1.ContainerStateRunning{StartedAt: metav1.Time{Time: prorationEnd.Add(-time.Second)}}},
+				LastTerminationState: core_v1.ContainerState{Terminated: &core_v1.ContainerStateTerminated{StartedAt: metav1.Time{Time: prorationEnd.Add(-time.Hour)}}},
+			}},
+		}},
+		expected: 1,
+	},
+	{
+		name:     "pod started after the interval",
+		pod:      startedPod(prorationEnd.Add(time.Second)),
+		expected: 0,
+	},
+}
+
+func TestRunningFraction(t *testing.T) {
+	for _, tt := range runningFractionCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runningFraction(tt.pod, prorationEnd, 10*time.Second); got != tt.expected {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestProrate(t *testing.T) {
+	halfway := startedPod(prorationEnd.Add(-5 * time.Second))
+	cis := []CostItem{
+		CostItem{Kind: ResourceCostCPU, Value: 1000, Pod: halfway},
+		CostItem{Kind: ResourceCostCPU, Value: 1000, Pod: startedPod(prorationEnd.Add(-time.Hour))},
+		CostItem{Kind: ResourceCostNode, Value: 1000, Node: &core_v1.Node{}},
+	}
+
+	prorate(cis, prorationEnd, 10*time.Second)
+
+	for i, expected := range []int64{500, 1000, 1000} {
+		if cis[i].Value != expected {
+			t.Errorf("expected item %d to be valued %d, got %d", i, expected, cis[i].Value)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"go.uber.org/zap"
+
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+// PushgatewayMetricName is the name of the gauge pushed by the
+// PushgatewayCostExporter.
+const PushgatewayMetricName = "kostanza_cost"
+
+// PushgatewayCostExporter aggregates cost data by its mapped dimensions and
+// periodically pushes the totals to a Prometheus Pushgateway. It suits
+// short-lived collect runs, such as CronJobs, that cannot be scraped.
+type PushgatewayCostExporter struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	url      string
+	job      string
+	labels   []string
+	interval time.Duration
+	mux      sync.Mutex
+	buffer   map[CostDataKey]CostData
+}
+
+// NewPushgatewayCostExporter returns a PushgatewayCostExporter that pushes to
+// the Pushgateway at url under the provided job name every interval. Metrics
+// are labelled with the destinations of the provided mapper. An interval of 0
+// disables periodic pushes, in which case data is only pushed by Flush and
+// Close.
+func NewPushgatewayCostExporter(ctx context.Context, url, job string, interval time.Duration, mapper *Mapper) (*PushgatewayCostExporter, error) {
+	if url == "" {
+		return nil, errors.New("pushgateway url is required")
+	}
+	if job == "" {
+		return nil, errors.New("pushgateway job is required")
+	}
+
+	labels := []string{}
+	for _, e := range mapper.Entries {
+		labels = append(labels, e.Destination)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	pe := &PushgatewayCostExporter{
+		ctx:      ctx,
+		cancel:   cancel,
+		url:      url,
+		job:      job,
+		labels:   labels,
+		interval: interval,
+		buffer:   map[CostDataKey]CostData{},
+	}
+
+	if interval > 0 {
+		go func() {
+			log.Log.Debug("starting background pushgateway loop")
+			pe.startPusher()
+			log.Log.Debug("background pushgateway loop completed")
+		}()
+	}
+
+	return pe, nil
+}
+
+// ExportCost enqueues the CostData provided for the next push.
+func (pe *PushgatewayCostExporter) ExportCost(cd CostData) {
+	pe.mux.Lock()
+	defer pe.mux.Unlock()
+	k := cd.key()
+	if prev, ok := pe.buffer[k]; ok {
+		cd.Value += prev.Value
+	}
+	pe.buffer[k] = cd
+}
+
+func (pe *PushgatewayCostExporter) startPusher() {
+	ticker := time.NewTicker(pe.interval)
+	defer ticker.Stop()
+	done := pe.ctx.Done()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := pe.Flush(); err != nil {
+				log.Log.Errorw("could not push to pushgateway", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Flush pushes all cost data accumulated since the previous push, replacing
+// any metrics previously pushed for the exporter's job. Data is discarded
+// whether or not the push succeeds, so that a failing Pushgateway does not
+// cause unbounded growth.
+func (pe *PushgatewayCostExporter) Flush() error {
+	pe.mux.Lock()
+	buffer := pe.buffer
+	pe.buffer = map[CostDataKey]CostData{}
+	pe.mux.Unlock()
+
+	gauge := prom.NewGaugeVec(prom.GaugeOpts{
+		Name: PushgatewayMetricName,
+		Help: "Cost in millionths of a cent accumulated since the last push.",
+	}, pe.labels)
+
+	for _, cd := range buffer {
+		values := make([]string, len(pe.labels))
+		for i, l := range pe.labels {
+			values[i] = cd.Dimensions[l]
+		}
+
+		g, err := gauge.GetMetricWithLabelValues(values...)
+		if err != nil {
+			return errors.Wrap(err, "could not prepare pushgateway metric")
+		}
+		g.Add(float64(cd.Value))
+	}
+
+	registry := prom.NewRegistry()
+	if err := registry.Register(gauge); err != nil {
+		return errors.Wrap(err, "could not register pushgateway metric")
+	}
+
+	log.Log.Debugw("pushing cost data to pushgateway", zap.String("url", pe.url), zap.Int("series", len(buffer)))
+	return errors.Wrap(push.FromGatherer(pe.job, nil, pe.url, registry), "could not push to pushgateway")
+}
+
+// Close stops periodic pushes and pushes any remaining cost data.
+func (pe *PushgatewayCostExporter) Close() error {
+	pe.cancel()
+	return pe.Flush()
+}
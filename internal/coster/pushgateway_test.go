@@ -0,0 +1,82 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type pushRequest struct {
+	method string
+	path   string
+	body   string
+}
+
+func TestPushgatewayExporter(t *testing.T) {
+	reqs := make(chan pushRequest, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body) // nolint: errcheck
+		reqs <- pushRequest{method: r.Method, path: r.URL.Path, body: string(body)}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer s.Close()
+
+	mapper := &Mapper{Entries: []Mapping{{Destination: "service"}, {Destination: "component"}}}
+	pe, err := NewPushgatewayCostExporter(context.Background(), s.URL, "kostanza", 0, mapper)
+	if err != nil {
+		t.Fatalf("unexpected error creating exporter: %v", err)
+	}
+
+	dims := map[string]string{"service": "foo", "component": "bar"}
+	pe.ExportCost(CostData{Kind: ResourceCostWeighted, Strategy: StrategyNameWeighted, Value: 5, Dimensions: dims})
+	pe.ExportCost(CostData{Kind: ResourceCostWeighted, Strategy: StrategyNameWeighted, Value: 3, Dimensions: dims})
+	pe.ExportCost(CostData{Kind: ResourceCostCPU, Strategy: StrategyNameCPU, Value: 2, Dimensions: dims})
+
+	if err := pe.Close(); err != nil {
+		t.Fatalf("unexpected error closing exporter: %v", err)
+	}
+
+	req := <-reqs
+	if req.method != http.MethodPut {
+		t.Fatalf("expected a PUT, got %s", req.method)
+	}
+	if req.path != "/metrics/job/kostanza" {
+		t.Fatalf("expected job path, got %s", req.path)
+	}
+
+	// The body is protobuf delimited, so just check the pushed pieces are present.
+	for _, want := range []string{PushgatewayMetricName, "service", "foo", "component", "bar"} {
+		if !strings.Contains(req.body, want) {
+			t.Fatalf("expected pushed body to contain %q", want)
+		}
+	}
+
+	pe.mux.Lock()
+	defer pe.mux.Unlock()
+	if len(pe.buffer) != 0 {
+		t.Fatalf("expected buffer to be emptied after push, got %d entries", len(pe.buffer))
+	}
+}
+
+func TestPushgatewayExporterRequiresURL(t *testing.T) {
+	if _, err := NewPushgatewayCostExporter(context.Background(), "", "kostanza", 0, &Mapper{}); err == nil {
+		t.Fatal("expected an error without a pushgateway url")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	core_v1 "k8s.io/api/core/v1"
+)
+
+// podResources holds the sums of the resources a pod is priced by, as per
+// sumContainerResources, so that strategies sharing a ClusterState need not
+// each convert the pod's resource quantities.
+type podResources struct {
+	cpu              int64
+	memory           int64
+	ephemeralStorage int64
+	// gpus holds the units of each gpu resource, keyed by resource name.
+	gpus map[core_v1.ResourceName]int64
+}
+
+func newPodResources(p *core_v1.Pod, list func(c core_v1.Container) core_v1.ResourceList) podResources {
+	return podResources{
+		cpu:              sumContainerResources(p, core_v1.ResourceCPU, list),
+		memory:           sumContainerResources(p, core_v1.ResourceMemory, list),
+		ephemeralStorage: sumContainerResources(p, core_v1.ResourceEphemeralStorage, list),
+		gpus:             podGPUs(p, list),
+	}
+}
+
+// gpuTotal returns the total number of units of every gpu resource.
+func (r podResources) gpuTotal() int64 {
+	total := int64(0)
+	for _, v := range r.gpus {
+		total += v
+	}
+	return total
+}
+
+// podResourceMap holds the podResources of every pod in a ClusterState. It is
+// keyed by pod rather than UID, as every pod in a ClusterState is distinct
+// but pods built outside of the API server, e.g. in tests, may lack a UID.
+type podResourceMap map[*core_v1.Pod]podResources
+
+func buildPodResourceMap(pods []*core_v1.Pod, list func(c core_v1.Container) core_v1.ResourceList) podResourceMap {
+	prm := make(podResourceMap, len(pods))
+	for _, p := range pods {
+		prm[p] = newPodResources(p, list)
+	}
+	return prm
+}
+
+// podGPUs returns the units of each gpu resource in the ResourceLists returned
+// by list for a pod, per sumContainerResources, or nil if it uses no gpus.
+func podGPUs(p *core_v1.Pod, list func(c core_v1.Container) core_v1.ResourceList) map[core_v1.ResourceName]int64 {
+	var gpus map[core_v1.ResourceName]int64
+	for _, name := range podGPUResourceNames(p, list) {
+		if gpus == nil {
+			gpus = map[core_v1.ResourceName]int64{}
+		}
+		gpus[name] = sumContainerResources(p, name, list)
+	}
+	return gpus
+}
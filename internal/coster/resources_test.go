@@ -0,0 +1,106 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"testing"
+
+	core_v1 "k8s.io/api/core/v1"
+)
+
+var podResourcesCases = []*core_v1.Pod{
+	testStrategyPodA,
+	testStrategyPodNoResources,
+	testStrategyPodGPU,
+	testStrategyPodLimits,
+	testStrategyPodEphemeralStorage,
+	testStrategyPodMultiContainer,
+	testStrategyPodMIG,
+}
+
+func TestPodResourcesMatchSums(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		cs := NewClusterState(podResourcesCases, nil)
+		cs.StrictRequests = strict
+		requests := cs.requests()
+
+		for _, p := range podResourcesCases {
+			r := cs.resourcesOf(p)
+			for kind, got := range map[core_v1.ResourceName]int64{
+				core_v1.ResourceCPU:              r.cpu,
+				core_v1.ResourceMemory:           r.memory,
+				core_v1.ResourceEphemeralStorage: r.ephemeralStorage,
+			} {
+				if expected := sumContainerResources(p, kind, requests); got != expected {
+					t.Errorf("pod %s, strict %v: expected %s of %d, got %d", p.Name, strict, kind, expected, got)
+				}
+			}
+
+			for _, name := range podGPUResourceNames(p, requests) {
+				if expected := sumContainerResources(p, name, requests); r.gpus[name] != expected {
+					t.Errorf("pod %s, strict %v: expected %s of %d, got %d", p.Name, strict, name, expected, r.gpus[name])
+				}
+			}
+		}
+	}
+}
+
+func TestResourcesOfFollowsStrictRequests(t *testing.T) {
+	cs := NewClusterState([]*core_v1.Pod{testStrategyPodLimits}, nil)
+	lenient := cs.resourcesOf(testStrategyPodLimits)
+
+	cs.StrictRequests = true
+	strict := cs.resourcesOf(testStrategyPodLimits)
+
+	if lenient.cpu != sumContainerResources(testStrategyPodLimits, core_v1.ResourceCPU, effectiveRequests) {
+		t.Fatalf("unexpected effective cpu request %d", lenient.cpu)
+	}
+	if strict.cpu != sumContainerResources(testStrategyPodLimits, core_v1.ResourceCPU, containerRequests) {
+		t.Fatalf("unexpected strict cpu request %d", strict.cpu)
+	}
+}
+
+// BenchmarkPodResources compares summing pod resources in every strategy, as
+// the request based strategies and the normalized node resource map once did,
+// against summing them once per ClusterState.
+func BenchmarkPodResources(b *testing.B) {
+	pods, _ := buildSyntheticCluster(300, 10)
+	// The cpu, memory, ephemeral storage, gpu and weighted strategies, along
+	// with the normalized node resource map, each read a pod's resources.
+	const readers = 6
+
+	b.Run("per-call", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			for i := 0; i < readers; i++ {
+				for _, p := range pods {
+					newPodResources(p, effectiveRequests)
+				}
+			}
+		}
+	})
+
+	b.Run("precomputed", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			cs := NewClusterState(pods, nil)
+			for i := 0; i < readers; i++ {
+				for _, p := range pods {
+					cs.resourcesOf(p)
+				}
+			}
+		}
+	})
+}
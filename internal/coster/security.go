@@ -0,0 +1,115 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ServerSecurity configures TLS and authentication of the HTTP server exposing
+// metrics and health checks. The zero value serves plaintext HTTP without
+// authentication.
+type ServerSecurity struct {
+	// TLSCertFile and TLSKeyFile are the paths of a PEM encoded certificate
+	// and key. The server uses TLS when both are set.
+	TLSCertFile string
+	TLSKeyFile  string
+	// BasicAuthUsername and BasicAuthPassword are the credentials accepted
+	// via HTTP basic authentication, if set.
+	BasicAuthUsername string
+	BasicAuthPassword string
+	// BearerToken is the token accepted via an `Authorization: Bearer`
+	// header, if set.
+	BearerToken string
+}
+
+// Validate returns an error if the settings are incomplete.
+func (ss ServerSecurity) Validate() error {
+	if (ss.TLSCertFile == "") != (ss.TLSKeyFile == "") {
+		return errors.New("a tls certificate and key must be set together")
+	}
+	if (ss.BasicAuthUsername == "") != (ss.BasicAuthPassword == "") {
+		return errors.New("a basic auth username and password must be set together")
+	}
+	return nil
+}
+
+// TLS reports whether the server should use TLS.
+func (ss ServerSecurity) TLS() bool {
+	return ss.TLSCertFile != "" && ss.TLSKeyFile != ""
+}
+
+// authenticates reports whether requests must be authenticated.
+func (ss ServerSecurity) authenticates() bool {
+	return ss.BasicAuthUsername != "" || ss.BearerToken != ""
+}
+
+// Handler wraps h so that requests must present either the basic auth
+// credentials or the bearer token, if any are configured. Requests for the
+// public paths, e.g. health checks probed by the kubelet, are always served.
+func (ss ServerSecurity) Handler(h http.Handler, public ...string) http.Handler {
+	if !ss.authenticates() {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if containsString(public, r.URL.Path) || ss.authorized(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if ss.BasicAuthUsername != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kostanza"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// authorized reports whether r presents valid credentials.
+func (ss ServerSecurity) authorized(r *http.Request) bool {
+	if ss.BasicAuthUsername != "" {
+		if u, p, ok := r.BasicAuth(); ok && secureEqual(u, ss.BasicAuthUsername) && secureEqual(p, ss.BasicAuthPassword) {
+			return true
+		}
+	}
+
+	if ss.BearerToken != "" {
+		const prefix = "Bearer "
+		if a := r.Header.Get("Authorization"); strings.HasPrefix(a, prefix) && secureEqual(strings.TrimPrefix(a, prefix), ss.BearerToken) {
+			return true
+		}
+	}
+	return false
+}
+
+// secureEqual compares credentials in constant time.
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// ListenAndServe serves s over TLS if it is configured, and plaintext HTTP
+// otherwise.
+func (ss ServerSecurity) ListenAndServe(s *http.Server) error {
+	if ss.TLS() {
+		return s.ListenAndServeTLS(ss.TLSCertFile, ss.TLSKeyFile)
+	}
+	return s.ListenAndServe()
+}
@@ -0,0 +1,238 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.opencensus.io/exporter/prometheus"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+var testServerSecurity = ServerSecurity{
+	BasicAuthUsername: "finance",
+	BasicAuthPassword: "hunter2",
+	BearerToken:       "s3cr3t",
+}
+
+var serverSecurityCases = []struct {
+	name     string
+	security ServerSecurity
+	path     string
+	auth     func(r *http.Request)
+	expected int
+}{
+	{
+		name:     "no authentication by default",
+		path:     "/metrics",
+		expected: http.StatusOK,
+	},
+	{
+		name:     "missing credentials",
+		security: testServerSecurity,
+		path:     "/metrics",
+		expected: http.StatusUnauthorized,
+	},
+	{
+		name:     "valid basic auth",
+		security: testServerSecurity,
+		path:     "/metrics",
+		auth:     func(r *http.Request) { r.SetBasicAuth("finance", "hunter2") },
+		expected: http.StatusOK,
+	},
+	{
+		name:     "invalid basic auth password",
+		security: testServerSecurity,
+		path:     "/metrics",
+		auth:     func(r *http.Request) { r.SetBasicAuth("finance", "hunter3") },
+		expected: http.StatusUnauthorized,
+	},
+	{
+		name:     "valid bearer token",
+		security: testServerSecurity,
+		path:     "/metrics",
+		auth:     func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cr3t") },
+		expected: http.StatusOK,
+	},
+	{
+		name:     "invalid bearer token",
+		security: testServerSecurity,
+		path:     "/metrics",
+		auth:     func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") },
+		expected: http.StatusUnauthorized,
+	},
+	{
+		name:     "bearer token sent as basic auth password",
+		security: ServerSecurity{BearerToken: "s3cr3t"},
+		path:     "/metrics",
+		auth:     func(r *http.Request) { r.SetBasicAuth("finance", "s3cr3t") },
+		expected: http.StatusUnauthorized,
+	},
+	{
+		name:     "health checks are public",
+		security: testServerSecurity,
+		path:     "/healthz",
+		expected: http.StatusOK,
+	},
+}
+
+func TestServerSecurityHandler(t *testing.T) {
+	pro, err := prometheus.NewExporter(prometheus.Options{})
+	if err != nil {
+		t.Fatalf("could not create prometheus exporter: %v", err)
+	}
+
+	for _, tt := range serverSecurityCases {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewKubernetesCoster(time.Hour, &Config{}, testclient.NewSimpleClientset(), pro, "", nil, WithServerSecurity(tt.security))
+			if err != nil {
+				t.Fatalf("error constructing coster: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.auth != nil {
+				tt.auth(req)
+			}
+			rec := httptest.NewRecorder()
+			c.handler().ServeHTTP(rec, req)
+
+			if rec.Code != tt.expected {
+				t.Fatalf("expected status %d, got %d", tt.expected, rec.Code)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("expected unauthorized responses to set WWW-Authenticate")
+			}
+		})
+	}
+}
+
+var serverSecurityValidateCases = []struct {
+	name     string
+	security ServerSecurity
+	valid    bool
+}{
+	{name: "plaintext", valid: true},
+	{name: "tls", security: ServerSecurity{TLSCertFile: "tls.crt", TLSKeyFile: "tls.key"}, valid: true},
+	{name: "certificate without key", security: ServerSecurity{TLSCertFile: "tls.crt"}},
+	{name: "username without password", security: ServerSecurity{BasicAuthUsername: "finance"}},
+	{name: "bearer token", security: ServerSecurity{BearerToken: "s3cr3t"}, valid: true},
+}
+
+func TestServerSecurityValidate(t *testing.T) {
+	for _, tt := range serverSecurityValidateCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.security.Validate(); (err == nil) != tt.valid {
+				t.Fatalf("expected valid %v, got error %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key to dir, returning their paths.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kostanza"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestServerSecurityListenAndServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kostanza-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close() // nolint: errcheck, gosec
+
+	ss := ServerSecurity{TLSCertFile: certFile, TLSKeyFile: keyFile, BearerToken: "s3cr3t"}
+	s := &http.Server{
+		Addr: addr,
+		Handler: ss.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})),
+	}
+	go ss.ListenAndServe(s) // nolint: errcheck
+	defer s.Close()         // nolint: errcheck
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // nolint: gosec
+	}}
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+addr+"/metrics", nil)
+		req.Header.Set("Authorization", "Bearer s3cr3t")
+		if resp, err = client.Do(req); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("could not reach tls server: %v", err)
+	}
+	resp.Body.Close() // nolint: errcheck, gosec
+
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Fatalf("expected an authenticated tls response, got status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3"
+	gax "github.com/googleapis/gax-go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+const (
+	// StackdriverMetricType is the Cloud Monitoring custom metric cost data is
+	// written to.
+	StackdriverMetricType = "custom.googleapis.com/kostanza/cost"
+
+	// stackdriverMaxTimeSeries is the maximum number of time series Cloud
+	// Monitoring accepts in a single CreateTimeSeries call.
+	stackdriverMaxTimeSeries = 200
+	// stackdriverMaxLabels is the maximum number of labels Cloud Monitoring
+	// accepts for a custom metric, including the kind label.
+	stackdriverMaxLabels = 10
+	// stackdriverKindLabel is the label holding the cost data Kind.
+	stackdriverKindLabel = "kind"
+)
+
+// stackdriverClient is the subset of the monitoring MetricClient used by the
+// StackdriverCostExporter.
+type stackdriverClient interface {
+	CreateTimeSeries(ctx context.Context, req *monitoringpb.CreateTimeSeriesRequest, opts ...gax.CallOption) error
+	Close() error
+}
+
+// stackdriverSeries is the running total of the cost of a time series.
+type stackdriverSeries struct {
+	labels map[string]string
+	total  int64
+}
+
+// StackdriverCostExporter writes cost data to Google Cloud Monitoring as the
+// cumulative StackdriverMetricType metric, with the cost Kind and mapped
+// dimensions as metric labels. Costs are summed per set of labels, and the
+// totals are written every interval, much as a prometheus counter is scraped.
+type StackdriverCostExporter struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	client   stackdriverClient
+	project  string
+	interval time.Duration
+	start    time.Time
+	mux      sync.Mutex
+	series   map[string]*stackdriverSeries
+	dropped  map[string]bool
+}
+
+// NewStackdriverCostExporter returns a StackdriverCostExporter that writes to
+// the provided project every interval.
+func NewStackdriverCostExporter(ctx context.Context, project string, interval time.Duration) (*StackdriverCostExporter, error) {
+	client, err := monitoring.NewMetricClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create cloud monitoring client")
+	}
+
+	return newStackdriverCostExporter(ctx, client, project, interval), nil
+}
+
+func newStackdriverCostExporter(ctx context.Context, client stackdriverClient, project string, interval time.Duration) *StackdriverCostExporter {
+	ctx, cancel := context.WithCancel(ctx)
+	se := &StackdriverCostExporter{
+		ctx:      ctx,
+		cancel:   cancel,
+		client:   client,
+		project:  project,
+		interval: interval,
+		start:    time.Now(),
+		series:   map[string]*stackdriverSeries{},
+		dropped:  map[string]bool{},
+	}
+
+	if interval > 0 {
+		go func() {
+			log.Log.Debug("starting background stackdriver flush loop")
+			se.startFlusher()
+			log.Log.Debug("background stackdriver flush loop completed")
+		}()
+	}
+
+	return se
+}
+
+// ExportCost adds the CostData provided to the total of its time series.
+func (se *StackdriverCostExporter) ExportCost(cd CostData) {
+	labels := se.labels(cd)
+	key := stackdriverSeriesKey(labels)
+
+	se.mux.Lock()
+	defer se.mux.Unlock()
+	s, ok := se.series[key]
+	if !ok {
+		s = &stackdriverSeries{labels: labels}
+		se.series[key] = s
+	}
+	s.total += cd.Value
+}
+
+// labels returns the metric labels of the CostData: its kind, and its
+// dimensions sorted by name and truncated to the Cloud Monitoring limit.
+// Dimensions whose names are not valid label keys are dropped too. Each
+// distinct set of dropped dimensions is logged once.
+func (se *StackdriverCostExporter) labels(cd CostData) map[string]string {
+	names := make([]string, 0, len(cd.Dimensions))
+	dropped := []string{}
+	for k := range cd.Dimensions {
+		if k == stackdriverKindLabel || !validStackdriverLabel(k) {
+			dropped = append(dropped, k)
+			continue
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	if len(names) > stackdriverMaxLabels-1 {
+		dropped = append(dropped, names[stackdriverMaxLabels-1:]...)
+		names = names[:stackdriverMaxLabels-1]
+	}
+
+	if len(dropped) > 0 {
+		sort.Strings(dropped)
+		se.warnDropped(dropped)
+	}
+
+	labels := map[string]string{stackdriverKindLabel: string(cd.Kind)}
+	for _, k := range names {
+		labels[k] = cd.Dimensions[k]
+	}
+	return labels
+}
+
+func (se *StackdriverCostExporter) warnDropped(dropped []string) {
+	key := strings.Join(dropped, ",")
+
+	se.mux.Lock()
+	defer se.mux.Unlock()
+	if se.dropped[key] {
+		return
+	}
+	se.dropped[key] = true
+	log.Log.Warnw("dropping stackdriver metric labels", zap.Strings("dropped", dropped))
+}
+
+// validStackdriverLabel returns true if the name is a valid Cloud Monitoring
+// label key: a lowercase letter followed by lowercase letters, digits and
+// underscores, of at most 100 characters.
+func validStackdriverLabel(name string) bool {
+	if name == "" || len(name) > 100 || name[0] < 'a' || name[0] > 'z' {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func stackdriverSeriesKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, k := range names {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func (se *StackdriverCostExporter) startFlusher() {
+	ticker := time.NewTicker(se.interval)
+	defer ticker.Stop()
+	done := se.ctx.Done()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := se.Flush(); err != nil {
+				log.Log.Errorw("could not write to stackdriver", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Flush writes the total of every time series in batches of at most 200.
+// Batches that fail to write are retried with the next flush, as the totals
+// are cumulative, and the first error is returned.
+func (se *StackdriverCostExporter) Flush() error {
+	se.mux.Lock()
+	end := timestampProto(time.Now())
+	start := timestampProto(se.start)
+	ts := make([]*monitoringpb.TimeSeries, 0, len(se.series))
+	for _, s := range se.series {
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric: &metricpb.Metric{
+				Type:   StackdriverMetricType,
+				Labels: s.labels,
+			},
+			Resource: &monitoredrespb.MonitoredResource{
+				Type:   "global",
+				Labels: map[string]string{"project_id": se.project},
+			},
+			MetricKind: metricpb.MetricDescriptor_CUMULATIVE,
+			ValueType:  metricpb.MetricDescriptor_INT64,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{StartTime: start, EndTime: end},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: s.total}},
+			}},
+		})
+	}
+	se.mux.Unlock()
+
+	var ferr error
+	for len(ts) > 0 {
+		n := len(ts)
+		if n > stackdriverMaxTimeSeries {
+			n = stackdriverMaxTimeSeries
+		}
+
+		// Writing uses a background context so that Close can flush after
+		// the exporter's context is cancelled.
+		err := se.client.CreateTimeSeries(context.Background(), &monitoringpb.CreateTimeSeriesRequest{
+			Name:       "projects/" + se.project,
+			TimeSeries: ts[:n],
+		})
+		if err != nil && ferr == nil {
+			ferr = errors.Wrap(err, "could not create stackdriver time series")
+		}
+		ts = ts[n:]
+	}
+	return ferr
+}
+
+// Close stops periodic flushes, writes the final totals and closes the
+// underlying client.
+func (se *StackdriverCostExporter) Close() error {
+	se.cancel()
+	err := se.Flush()
+	if cerr := se.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/go-test/deep"
+	gax "github.com/googleapis/gax-go"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+type fakeStackdriver struct {
+	mux      sync.Mutex
+	requests []*monitoringpb.CreateTimeSeriesRequest
+	closed   bool
+}
+
+func (f *fakeStackdriver) CreateTimeSeries(ctx context.Context, req *monitoringpb.CreateTimeSeriesRequest, opts ...gax.CallOption) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.requests = append(f.requests, req)
+	return nil
+}
+
+func (f *fakeStackdriver) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestStackdriverExporterSumsSeries(t *testing.T) {
+	fs := &fakeStackdriver{}
+	se := newStackdriverCostExporter(context.Background(), fs, "example", 0)
+
+	se.ExportCost(CostData{Kind: ResourceCostCPU, Value: 1, Dimensions: map[string]string{"service": "foo"}})
+	se.ExportCost(CostData{Kind: ResourceCostCPU, Value: 2, Dimensions: map[string]string{"service": "foo"}})
+	se.ExportCost(CostData{Kind: ResourceCostMemory, Value: 4, Dimensions: map[string]string{"service": "foo"}})
+
+	if err := se.Close(); err != nil {
+		t.Fatalf("unexpected error closing exporter: %v", err)
+	}
+	if !fs.closed {
+		t.Fatal("expected client to be closed")
+	}
+	if len(fs.requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(fs.requests))
+	}
+	if fs.requests[0].Name != "projects/example" {
+		t.Fatalf("expected name projects/example, got %s", fs.requests[0].Name)
+	}
+
+	totals := map[string]int64{}
+	for _, ts := range fs.requests[0].TimeSeries {
+		if ts.Metric.Type != StackdriverMetricType {
+			t.Fatalf("expected metric type %s, got %s", StackdriverMetricType, ts.Metric.Type)
+		}
+		if ts.Resource.Labels["project_id"] != "example" {
+			t.Fatalf("expected project_id example, got %s", ts.Resource.Labels["project_id"])
+		}
+		totals[ts.Metric.Labels["kind"]+"/"+ts.Metric.Labels["service"]] = ts.Points[0].GetValue().GetInt64Value()
+	}
+
+	expected := map[string]int64{
+		string(ResourceCostCPU) + "/foo":    3,
+		string(ResourceCostMemory) + "/foo": 4,
+	}
+	if diff := deep.Equal(totals, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestStackdriverExporterBatches(t *testing.T) {
+	fs := &fakeStackdriver{}
+	se := newStackdriverCostExporter(context.Background(), fs, "example", 0)
+
+	for i := 0; i < 450; i++ {
+		se.ExportCost(CostData{Kind: ResourceCostWeighted, Value: int64(i), Dimensions: map[string]string{"service": fmt.Sprintf("svc%d", i)}})
+	}
+
+	if err := se.Flush(); err != nil {
+		t.Fatalf("unexpected error flushing exporter: %v", err)
+	}
+
+	sizes := []int{}
+	for _, req := range fs.requests {
+		sizes = append(sizes, len(req.TimeSeries))
+	}
+
+	if diff := deep.Equal(sizes, []int{200, 200, 50}); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestStackdriverLabels(t *testing.T) {
+	dims := map[string]string{"Invalid": "value", "kind": "value"}
+	for i := 0; i < 12; i++ {
+		dims[fmt.Sprintf("dim%02d", i)] = "value"
+	}
+
+	se := newStackdriverCostExporter(context.Background(), &fakeStackdriver{}, "example", 0)
+	labels := se.labels(CostData{Kind: ResourceCostCPU, Dimensions: dims})
+
+	expected := map[string]string{"kind": string(ResourceCostCPU)}
+	for i := 0; i < 9; i++ {
+		expected[fmt.Sprintf("dim%02d", i)] = "value"
+	}
+	if diff := deep.Equal(labels, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultStartupTimeout is the default time allowed for cloud clients to
+// finish their setup calls before startup is abandoned.
+const DefaultStartupTimeout = 30 * time.Second
+
+// StartupContext returns a context derived from ctx that expires after
+// timeout, for bounding the calls made while setting up an exporter or
+// consumer. A non-positive timeout only adds cancellation. The returned
+// context must not be retained for long-lived work.
+func StartupContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// StartupError annotates err with the startup timeout when it was caused by
+// the StartupContext ctx expiring, so that a hanging environment is reported
+// as such rather than as an opaque deadline error.
+func StartupError(ctx context.Context, err error, timeout time.Duration) error {
+	if err == nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	return errors.Wrapf(err, "setup did not complete within the %s startup timeout", timeout)
+}
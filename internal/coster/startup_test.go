@@ -0,0 +1,51 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestStartupContext(t *testing.T) {
+	ctx, cancel := StartupContext(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+
+	err := StartupError(ctx, ctx.Err(), time.Millisecond)
+	if !strings.Contains(err.Error(), "1ms startup timeout") {
+		t.Errorf("expected startup timeout in error, got %q", err)
+	}
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("expected cause to be context.DeadlineExceeded, got %v", errors.Cause(err))
+	}
+}
+
+func TestStartupContextWithoutTimeout(t *testing.T) {
+	ctx, cancel := StartupContext(context.Background(), 0)
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expected no deadline for a zero timeout")
+	}
+
+	cancel()
+	err := errors.New("boom")
+	if got := StartupError(ctx, err, 0); got != err {
+		t.Errorf("expected error to be returned unchanged, got %v", got)
+	}
+}
@@ -15,12 +15,14 @@
 package coster
 
 import (
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/planetlabs/kostanza/internal/log"
 	"go.uber.org/zap"
 	core_v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
 )
 
 const (
@@ -34,8 +36,31 @@ const (
 	StrategyNameWeighted = "WeightedPricingStrategy"
 	// StrategyNameGPU is used whenever we derive a cost metric using the GPUPricingStrategy.
 	StrategyNameGPU = "GPUPricingStrategy"
+	// StrategyNameLimits is used whenever we derive a cost metric using the LimitsBasedPricingStrategy.
+	StrategyNameLimits = "LimitsBasedPricingStrategy"
+	// StrategyNameUnallocated is used whenever we derive a cost metric using the UnallocatedPricingStrategy.
+	StrategyNameUnallocated = "UnallocatedPricingStrategy"
+	// StrategyNameEphemeralStorage is used whenever we derive a cost metric using the EphemeralStoragePricingStrategy.
+	StrategyNameEphemeralStorage = "EphemeralStoragePricingStrategy"
+	// StrategyNameReserved is used whenever we derive a cost metric using the ReservedPricingStrategy.
+	StrategyNameReserved = "ReservedPricingStrategy"
+	// StrategyNameStorage is used whenever we derive a cost metric using the StoragePricingStrategy.
+	StrategyNameStorage = "StoragePricingStrategy"
+	// StrategyNameUsage is used whenever we derive a cost metric using the UsagePricingStrategy.
+	StrategyNameUsage = "UsagePricingStrategy"
+	// StrategyNameNodePool is used whenever we derive a cost metric using the NodePoolPricingStrategy.
+	StrategyNameNodePool = "NodePoolPricingStrategy"
+	// StrategyNameLoadBalancer is used whenever we derive a cost metric using the LoadBalancerPricingStrategy.
+	StrategyNameLoadBalancer = "LoadBalancerPricingStrategy"
+	// DefaultNodePoolLabel is the node label the NodePoolPricingStrategy groups
+	// nodes by unless otherwise configured.
+	DefaultNodePoolLabel = "cloud.google.com/gke-nodepool"
 	// ResourceGPU is used for gpu resources, coinciding with modern versions of the nvidia-device-plugin.
 	ResourceGPU = core_v1.ResourceName("nvidia.com/gpu")
+	// ResourceGPUPrefix prefixes every gpu resource advertised by the
+	// nvidia-device-plugin, including MIG profiles such as nvidia.com/mig-1g.5gb
+	// and shared gpus.
+	ResourceGPUPrefix = "nvidia.com/"
 )
 
 // CostItem models the metadata associated with a pod and/or node cost.
@@ -52,6 +77,22 @@ type CostItem struct {
 	Pod *core_v1.Pod
 	// Kubernetes pod metadata associated with the node which we're pricing out.
 	Node *core_v1.Node
+	// The kind of workload controlling the pod, e.g. Deployment or DaemonSet.
+	// Populated by the coster prior to mapping.
+	OwnerKind string
+	// The name of the workload controlling the pod. Populated by the coster
+	// prior to mapping.
+	OwnerName string
+	// The name of the container priced, for strategies that price containers
+	// individually when per-container costs are enabled. Empty otherwise.
+	ContainerName string
+	// The node pool priced, for the NodePoolPricingStrategy, which aggregates
+	// the nodes of each pool into a single CostItem without a Node. Empty
+	// otherwise.
+	NodePool string
+	// The service priced, for the LoadBalancerPricingStrategy, which prices
+	// services rather than pods or nodes. Nil otherwise.
+	Service *core_v1.Service
 }
 
 // PricingStrategyFunc is an interface wrapper to convert a function into valid
@@ -69,6 +110,155 @@ type PricingStrategy interface {
 	Calculate(t CostTable, duration time.Duration, pods []*core_v1.Pod, nodes []*core_v1.Node) []CostItem
 }
 
+// ClusterState holds the pods and nodes running in a cluster along with the
+// lookups strategies derive from them, so that a calculation builds each
+// lookup once and shares it between strategies.
+type ClusterState struct {
+	Pods  []*core_v1.Pod
+	Nodes []*core_v1.Node
+	// Claims are the persistent volume claims in the cluster. They are only
+	// listed when the StoragePricingStrategy is in use.
+	Claims []*core_v1.PersistentVolumeClaim
+	// Services are the services in the cluster. They are only listed when
+	// the LoadBalancerPricingStrategy is in use.
+	Services []*core_v1.Service
+	// Usage holds the resource usage of pods reported by metrics-server. It
+	// is only listed when the UsagePricingStrategy is in use, and is nil if
+	// metrics-server was unavailable.
+	Usage []*metricsv1beta1.PodMetrics
+	// CPUWeight and MemoryWeight scale the cpu and memory components of the
+	// cost attributed by the WeightedPricingStrategy. Unset (zero) weights are
+	// treated as 1.
+	CPUWeight    float64
+	MemoryWeight float64
+	// StrictRequests prices containers by their requests alone. By default a
+	// container without a request for a resource is priced by its limit, as
+	// Kubernetes defaults requests to limits.
+	StrictRequests bool
+	// NodePoolLabel is the node label the NodePoolPricingStrategy groups
+	// nodes by. Defaults to DefaultNodePoolLabel.
+	NodePoolLabel string
+
+	nodeMap    nodeMap
+	normalized nodeResourceMap
+	maxScale   float64
+	resources  podResourceMap
+	// resourcesStrict records the StrictRequests setting resources were
+	// summed with.
+	resourcesStrict bool
+}
+
+// NewClusterState returns a ClusterState for the provided pods and nodes.
+func NewClusterState(pods []*core_v1.Pod, nodes []*core_v1.Node) *ClusterState {
+	return &ClusterState{
+		Pods:    pods,
+		Nodes:   nodes,
+		nodeMap: buildNodeMap(nodes),
+	}
+}
+
+// normalizedNodeResourceMap returns the normalized resources allocated on
+// each node, building them on first use for a given maxScale.
+func (cs *ClusterState) normalizedNodeResourceMap(maxScale float64) nodeResourceMap {
+	if cs.normalized == nil || cs.maxScale != maxScale {
+		cs.normalized = buildNormalizedNodeResourceMap(cs.Pods, cs.Nodes, maxScale, cs.resourcesOf)
+		cs.maxScale = maxScale
+	}
+	return cs.normalized
+}
+
+// resourcesOf returns the sums of the resources the pod is priced by, summing
+// them for every pod in the cluster state on first use.
+func (cs *ClusterState) resourcesOf(p *core_v1.Pod) podResources {
+	if cs.resources == nil || cs.resourcesStrict != cs.StrictRequests {
+		cs.resources = buildPodResourceMap(cs.Pods, cs.requests())
+		cs.resourcesStrict = cs.StrictRequests
+	}
+
+	if r, ok := cs.resources[p]; ok {
+		return r
+	}
+	return newPodResources(p, cs.requests())
+}
+
+// orphanedPods returns the number of pods scheduled to nodes that are absent
+// from the cluster state, e.g. because the node was deleted mid-cycle.
+// Strategies skip such pods, so their cost is not reported.
+func (cs *ClusterState) orphanedPods() int {
+	n := 0
+	for _, p := range cs.Pods {
+		if _, ok := cs.nodeMap[p.Spec.NodeName]; p.Spec.NodeName != "" && !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// requests returns the function resolving the requests a container is priced
+// by, per StrictRequests.
+func (cs *ClusterState) requests() func(c core_v1.Container) core_v1.ResourceList {
+	if cs.StrictRequests {
+		return containerRequests
+	}
+	return effectiveRequests
+}
+
+// resourceWeights returns the cpu and memory weights, defaulting unset
+// weights to 1.
+func (cs *ClusterState) resourceWeights() (float64, float64) {
+	return defaultWeight(cs.CPUWeight), defaultWeight(cs.MemoryWeight)
+}
+
+func defaultWeight(w float64) float64 {
+	if w == 0 {
+		return 1
+	}
+	return w
+}
+
+// ClusterStatePricingStrategy is a PricingStrategy that can calculate
+// CostItems from a ClusterState shared with other strategies.
+type ClusterStatePricingStrategy interface {
+	PricingStrategy
+	CalculateClusterState(t CostTable, duration time.Duration, cs *ClusterState) []CostItem
+}
+
+// ClusterStatePricingStrategyFunc is an interface wrapper to convert a function
+// into a valid ClusterStatePricingStrategy.
+type ClusterStatePricingStrategyFunc func(table CostTable, duration time.Duration, cs *ClusterState) []CostItem
+
+// Calculate returns CostItems given a pricing table of node costs, the duration
+// we're costing out, and the pods as well as nodes running in a cluster.
+func (f ClusterStatePricingStrategyFunc) Calculate(table CostTable, duration time.Duration, pods []*core_v1.Pod, nodes []*core_v1.Node) []CostItem {
+	return f(table, duration, NewClusterState(pods, nodes))
+}
+
+// CalculateClusterState returns CostItems given a pricing table of node costs,
+// the duration we're costing out, and the state of the cluster.
+func (f ClusterStatePricingStrategyFunc) CalculateClusterState(table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+	return f(table, duration, cs)
+}
+
+// calculateStrategy calculates CostItems using s, sharing cs with it if it is
+// a ClusterStatePricingStrategy.
+func calculateStrategy(s PricingStrategy, table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+	if css, ok := s.(ClusterStatePricingStrategy); ok {
+		return css.CalculateClusterState(table, duration, cs)
+	}
+	return s.Calculate(table, duration, cs.Pods, cs.Nodes)
+}
+
+// findNodeEntry returns the CostTableEntry matching a node, as per
+// CostTable.FindByNode, recording a MeasureCostEntryMissByLabels for the named
+// strategy if no entry matches.
+func findNodeEntry(table CostTable, n *core_v1.Node, strategy string) (*CostTableEntry, error) {
+	te, err := table.FindByNode(n)
+	if err == ErrNoCostEntry {
+		recordCostEntryMiss(strategy, n)
+	}
+	return te, err
+}
+
 // allocatedNodeResources tracks the allocated resources for a given node, generally determined by
 // taking the sum of individual resource requests from pods.
 type allocatedNodeResources struct {
@@ -78,55 +268,180 @@ type allocatedNodeResources struct {
 	cpuAvailable    int64
 	gpuAvailable    int64
 	memoryAvailable int64
+	maxScale        float64
 	node            *core_v1.Node
 }
 
+// capScale limits a scale factor to the configured maximum. A node with very
+// low utilization yields a very large scale factor, attributing the node's
+// full cost to the few pods running on it. A maximum scale bounds how much
+// more than its requests a pod may be billed for, leaving the remainder
+// unattributed. An unset (zero) maximum applies no cap, fully attributing
+// node cost as before.
+func (nr allocatedNodeResources) capScale(scale float64) float64 {
+	if nr.maxScale > 0 && scale > nr.maxScale {
+		return nr.maxScale
+	}
+	return scale
+}
+
+// CPUScale returns the factor by which pod cpu requests are scaled so that
+// the pods on a node are attributed its entire cpu cost, i.e. the inverse of
+// the fraction of cpu allocated. See capScale for limits on this factor.
 func (nr allocatedNodeResources) CPUScale() float64 {
 	if nr.cpuUsed == 0 {
 		return 0
 	}
-	return float64(nr.cpuAvailable) / float64(nr.cpuUsed)
+	return nr.capScale(float64(nr.cpuAvailable) / float64(nr.cpuUsed))
 }
 
+// MemoryScale returns the factor by which pod memory requests are scaled so that
+// the pods on a node are attributed its entire memory cost, i.e. the inverse of
+// the fraction of memory allocated. See capScale for limits on this factor.
 func (nr allocatedNodeResources) MemoryScale() float64 {
 	if nr.memoryUsed == 0 {
 		return 0
 	}
-	return float64(nr.memoryAvailable) / float64(nr.memoryUsed)
+	return nr.capScale(float64(nr.memoryAvailable) / float64(nr.memoryUsed))
 }
 
+// GPUScale returns the factor by which pod gpu requests are scaled so that
+// the pods on a node are attributed its entire gpu cost, i.e. the inverse of
+// the fraction of gpu allocated. See capScale for limits on this factor.
 func (nr allocatedNodeResources) GPUScale() float64 {
 	if nr.gpuUsed == 0 {
 		return 0
 	}
-	return float64(nr.gpuAvailable) / float64(nr.gpuUsed)
+	return nr.capScale(float64(nr.gpuAvailable) / float64(nr.gpuUsed))
 }
 
-// gpuCapacity mirrors the definitions of ResourceList.Memory and
-// ResourceList.CPU in k8s client-go and provides equivalent functionality for
-// GPU capacity.
-func gpuCapacity(self *core_v1.ResourceList) *resource.Quantity {
-	if val, ok := (*self)[ResourceGPU]; ok {
-		return &val
+// overcommitted returns the resources of a node whose cpu and memory are
+// deliberately overcommitted by the provided factor, as though its capacity
+// were that much larger. Pod costs scaled by the result must be divided by
+// the factor, each unit of overcommitted capacity costing that much less.
+func (nr allocatedNodeResources) overcommitted(factor float64) allocatedNodeResources {
+	if factor == 1 {
+		return nr
+	}
+	nr.cpuAvailable = int64(float64(nr.cpuAvailable) * factor)
+	nr.memoryAvailable = int64(float64(nr.memoryAvailable) * factor)
+	return nr
+}
+
+// IsGPUResource reports whether the named resource is a gpu resource, i.e.
+// whether it has the ResourceGPUPrefix.
+func IsGPUResource(name core_v1.ResourceName) bool {
+	return strings.HasPrefix(string(name), ResourceGPUPrefix)
+}
+
+// gpuResourceNames returns the sorted names of the gpu resources present in
+// any of the provided ResourceLists.
+func gpuResourceNames(lists ...core_v1.ResourceList) []core_v1.ResourceName {
+	seen := map[core_v1.ResourceName]bool{}
+	names := []core_v1.ResourceName{}
+	for _, rl := range lists {
+		for name := range rl {
+			if IsGPUResource(name) && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
 	}
-	return &resource.Quantity{Format: resource.DecimalSI}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// podGPUResourceNames returns the names of the gpu resources in the
+// ResourceLists returned by list for each of a pod's containers.
+func podGPUResourceNames(p *core_v1.Pod, list func(c core_v1.Container) core_v1.ResourceList) []core_v1.ResourceName {
+	lists := []core_v1.ResourceList{}
+	for _, c := range p.Spec.InitContainers {
+		lists = append(lists, list(c))
+	}
+	for _, c := range p.Spec.Containers {
+		lists = append(lists, list(c))
+	}
+	return gpuResourceNames(lists...)
+}
+
+// gpuCapacity returns the total number of units of every gpu resource in the
+// provided ResourceList, regardless of model or profile.
+func gpuCapacity(rl core_v1.ResourceList) int64 {
+	total := int64(0)
+	for _, name := range gpuResourceNames(rl) {
+		total += containerResource(rl, name)
+	}
+	return total
+}
+
+// podGPUCost returns the cost of every gpu resource in the ResourceLists
+// returned by list for a pod, with each resource's units multiplied by scale.
+func podGPUCost(te *CostTableEntry, p *core_v1.Pod, list func(c core_v1.Container) core_v1.ResourceList, scale float64, duration time.Duration) int64 {
+	return gpuCost(te, podGPUs(p, list), scale, duration)
+}
+
+// gpuCost returns the cost of the units of each gpu resource provided, with
+// each resource's units multiplied by scale.
+func gpuCost(te *CostTableEntry, gpus map[core_v1.ResourceName]int64, scale float64, duration time.Duration) int64 {
+	cost := int64(0)
+	for name, units := range gpus {
+		cost += te.GPUResourceCostMicroCents(string(name), float64(units)*scale, duration)
+	}
+	return cost
+}
+
+// containerRequests returns the resource requests of a container, for use
+// with sumContainerResources.
+func containerRequests(c core_v1.Container) core_v1.ResourceList {
+	return c.Resources.Requests
+}
+
+// effectiveRequests returns the resource requests of a container, falling
+// back to its limit for any resource that is limited but not requested, as
+// Kubernetes does when defaulting requests. It is for use with
+// sumContainerResources.
+func effectiveRequests(c core_v1.Container) core_v1.ResourceList {
+	var rl core_v1.ResourceList
+	for name, q := range c.Resources.Limits {
+		if _, ok := c.Resources.Requests[name]; ok {
+			continue
+		}
+		if rl == nil {
+			rl = core_v1.ResourceList{}
+			for k, v := range c.Resources.Requests {
+				rl[k] = v
+			}
+		}
+		rl[name] = q
+	}
+
+	if rl == nil {
+		return c.Resources.Requests
+	}
+	return rl
+}
+
+// containerLimits returns the resource limits of a container, for use with
+// sumContainerResources.
+func containerLimits(c core_v1.Container) core_v1.ResourceList {
+	return c.Resources.Limits
 }
 
 // CPUPricingStrategy calculates the cost of a pod based strictly on it's share
 // of CPU requests as a fraction of all CPU available on the node onto which it
 // is allocated.
-var CPUPricingStrategy = PricingStrategyFunc(func(table CostTable, duration time.Duration, pods []*core_v1.Pod, nodes []*core_v1.Node) []CostItem {
-	nm := buildNodeMap(nodes)
+var CPUPricingStrategy = ClusterStatePricingStrategyFunc(func(table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+	nm := cs.nodeMap
 	cis := []CostItem{}
-	for _, p := range pods {
-		cpu := sumPodResource(p, core_v1.ResourceCPU)
+	for _, p := range cs.Pods {
+		cpu := cs.resourcesOf(p).cpu
 		node, ok := nm[p.Spec.NodeName]
 		if !ok {
 			log.Log.Warnw("could not find nodeResourceMap for node", zap.String("nodeName", p.Spec.NodeName))
 			continue
 		}
 
-		te, err := table.FindByLabels(node.Labels)
+		te, err := findNodeEntry(table, node, StrategyNameCPU)
 		if err != nil {
 			log.Log.Warnw("could not find pricing entry for node", zap.String("nodeName", node.ObjectMeta.Name))
 			continue
@@ -153,18 +468,18 @@ var CPUPricingStrategy = PricingStrategyFunc(func(table CostTable, duration time
 // MemoryPricingStrategy calculates the cost of a pod based strictly on it's
 // share of memory requests as a fraction of all memory on the node onto which
 // it was scheduled.
-var MemoryPricingStrategy = PricingStrategyFunc(func(table CostTable, duration time.Duration, pods []*core_v1.Pod, nodes []*core_v1.Node) []CostItem {
-	nm := buildNodeMap(nodes)
+var MemoryPricingStrategy = ClusterStatePricingStrategyFunc(func(table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+	nm := cs.nodeMap
 	cis := []CostItem{}
-	for _, p := range pods {
-		mem := sumPodResource(p, core_v1.ResourceMemory)
+	for _, p := range cs.Pods {
+		mem := cs.resourcesOf(p).memory
 		node, ok := nm[p.Spec.NodeName]
 		if !ok {
 			log.Log.Warnw("could not find nodeResourceMap for node", zap.String("nodeName", p.Spec.NodeName))
 			continue
 		}
 
-		te, err := table.FindByLabels(node.Labels)
+		te, err := findNodeEntry(table, node, StrategyNameMemory)
 		if err != nil {
 			log.Log.Warnw("could not find pricing entry for node", zap.String("nodeName", node.ObjectMeta.Name))
 			continue
@@ -188,12 +503,51 @@ var MemoryPricingStrategy = PricingStrategyFunc(func(table CostTable, duration t
 	return cis
 })
 
+// EphemeralStoragePricingStrategy calculates the cost of a pod based strictly
+// on its ephemeral-storage requests, priced by the node onto which it was
+// scheduled.
+var EphemeralStoragePricingStrategy = ClusterStatePricingStrategyFunc(func(table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+	nm := cs.nodeMap
+	cis := []CostItem{}
+	for _, p := range cs.Pods {
+		storage := cs.resourcesOf(p).ephemeralStorage
+		node, ok := nm[p.Spec.NodeName]
+		if !ok {
+			log.Log.Warnw("could not find nodeResourceMap for node", zap.String("nodeName", p.Spec.NodeName))
+			continue
+		}
+
+		te, err := findNodeEntry(table, node, StrategyNameEphemeralStorage)
+		if err != nil {
+			log.Log.Warnw("could not find pricing entry for node", zap.String("nodeName", node.ObjectMeta.Name))
+			continue
+		}
+
+		ci := CostItem{
+			Kind:     ResourceCostEphemeralStorage,
+			Value:    te.EphemeralStorageCostMicroCents(float64(storage), duration),
+			Pod:      p,
+			Node:     node,
+			Strategy: StrategyNameEphemeralStorage,
+		}
+		log.Log.Debugw(
+			"generated cost item",
+			zap.String("pod", ci.Pod.ObjectMeta.Name),
+			zap.String("strategy", ci.Strategy),
+			zap.Int64("value", ci.Value),
+		)
+		cis = append(cis, ci)
+	}
+	return cis
+})
+
 // GPUPricingStrategy generates cost metrics that account for the cost of GPUs consumed by pods.
-var GPUPricingStrategy = PricingStrategyFunc(func(table CostTable, duration time.Duration, pods []*core_v1.Pod, nodes []*core_v1.Node) []CostItem {
-	nm := buildNodeMap(nodes)
+var GPUPricingStrategy = ClusterStatePricingStrategyFunc(func(table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+	nm := cs.nodeMap
 	cis := []CostItem{}
-	for _, p := range pods {
-		gpu := sumPodResource(p, ResourceGPU)
+	for _, p := range cs.Pods {
+		r := cs.resourcesOf(p)
+		gpu := r.gpuTotal()
 		node, ok := nm[p.Spec.NodeName]
 
 		if gpu == 0 {
@@ -206,7 +560,7 @@ var GPUPricingStrategy = PricingStrategyFunc(func(table CostTable, duration time
 			continue
 		}
 
-		te, err := table.FindByLabels(node.Labels)
+		te, err := findNodeEntry(table, node, StrategyNameGPU)
 		if err != nil {
 			log.Log.Warnw("could not find pricing entry for node", zap.String("nodeName", node.ObjectMeta.Name))
 			continue
@@ -214,7 +568,7 @@ var GPUPricingStrategy = PricingStrategyFunc(func(table CostTable, duration time
 
 		ci := CostItem{
 			Kind:     ResourceCostGPU,
-			Value:    te.GPUCostMicroCents(float64(gpu), duration),
+			Value:    gpuCost(te, r.gpus, 1, duration),
 			Pod:      p,
 			Node:     node,
 			Strategy: StrategyNameGPU,
@@ -235,35 +589,26 @@ var GPUPricingStrategy = PricingStrategyFunc(func(table CostTable, duration time
 // which it has been allocated. This strategy ensures that unallocated resources do not
 // go unattributed and has a tendency to punish pods that may occupy oddly shaped resources
 // or those that frequently churn.
-var WeightedPricingStrategy = PricingStrategyFunc(func(table CostTable, duration time.Duration, pods []*core_v1.Pod, nodes []*core_v1.Node) []CostItem {
-	nrm := buildNormalizedNodeResourceMap(pods, nodes)
+var WeightedPricingStrategy = ClusterStatePricingStrategyFunc(func(table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+	nrm := cs.normalizedNodeResourceMap(table.MaxScale)
+	cpuWeight, memoryWeight := cs.resourceWeights()
 	cis := []CostItem{}
-	for _, p := range pods {
-		cpu := sumPodResource(p, core_v1.ResourceCPU)
-		mem := sumPodResource(p, core_v1.ResourceMemory)
-		gpu := sumPodResource(p, ResourceGPU)
-
+	for _, p := range cs.Pods {
 		nr, ok := nrm[p.Spec.NodeName]
 		if !ok {
 			log.Log.Warnw("could not find nodeResourceMap for node", zap.String("nodeName", p.Spec.NodeName))
 			continue
 		}
 
-		te, err := table.FindByLabels(nr.node.Labels)
+		te, err := findNodeEntry(table, nr.node, StrategyNameWeighted)
 		if err != nil {
 			log.Log.Warnw("could not find pricing entry for node", zap.String("nodeName", nr.node.ObjectMeta.Name))
 			continue
 		}
 
-		// We "normalize" cpu, memory, and gpu utilization by scaling the utilized resources
-		// of pods by the global utilization of the respective resource on the node.
-		cpucost := te.CPUCostMicroCents(float64(cpu)*nr.CPUScale(), duration)
-		memcost := te.MemoryCostMicroCents(float64(mem)*nr.MemoryScale(), duration)
-		gpucost := te.GPUCostMicroCents(float64(gpu)*nr.GPUScale(), duration)
-
 		ci := CostItem{
 			Kind:     ResourceCostWeighted,
-			Value:    cpucost + memcost + gpucost,
+			Value:    weightedPodCost(te, nr, cs.resourcesOf(p), duration, cpuWeight, memoryWeight),
 			Pod:      p,
 			Node:     nr.node,
 			Strategy: StrategyNameWeighted,
@@ -279,43 +624,219 @@ var WeightedPricingStrategy = PricingStrategyFunc(func(table CostTable, duration
 	return cis
 })
 
+// LimitsBasedPricingStrategy calculates the cost of a pod based on the cpu,
+// memory, and gpu limits of its containers rather than their requests. This
+// attributes cost according to the ceiling a pod is permitted to consume on the
+// node onto which it was scheduled. Containers without limits contribute
+// nothing, as with the request based strategies.
+var LimitsBasedPricingStrategy = ClusterStatePricingStrategyFunc(func(table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+	nm := cs.nodeMap
+	cis := []CostItem{}
+	for _, p := range cs.Pods {
+		cpu := sumPodLimit(p, core_v1.ResourceCPU)
+		mem := sumPodLimit(p, core_v1.ResourceMemory)
+
+		node, ok := nm[p.Spec.NodeName]
+		if !ok {
+			log.Log.Warnw("could not find nodeResourceMap for node", zap.String("nodeName", p.Spec.NodeName))
+			continue
+		}
+
+		te, err := findNodeEntry(table, node, StrategyNameLimits)
+		if err != nil {
+			log.Log.Warnw("could not find pricing entry for node", zap.String("nodeName", node.ObjectMeta.Name))
+			continue
+		}
+
+		cpucost := te.CPUCostMicroCents(float64(cpu), duration)
+		memcost := te.MemoryCostMicroCents(float64(mem), duration)
+		gpucost := podGPUCost(te, p, containerLimits, 1, duration)
+
+		ci := CostItem{
+			Kind:     ResourceCostLimits,
+			Value:    cpucost + memcost + gpucost,
+			Pod:      p,
+			Node:     node,
+			Strategy: StrategyNameLimits,
+		}
+		log.Log.Debugw(
+			"generated cost item",
+			zap.String("pod", ci.Pod.ObjectMeta.Name),
+			zap.String("strategy", ci.Strategy),
+			zap.Int64("value", ci.Value),
+		)
+		cis = append(cis, ci)
+	}
+	return cis
+})
+
 // NodePricingStrategy generates cost metrics that represent the cost of an
 // active node, regardless of pod. This is generally used to provide an overall
 // cost metric that can be compared to per-pod costs.
 var NodePricingStrategy = PricingStrategyFunc(func(table CostTable, duration time.Duration, pods []*core_v1.Pod, nodes []*core_v1.Node) []CostItem {
 	cis := []CostItem{}
 	for _, n := range nodes {
-		te, err := table.FindByLabels(n.Labels)
+		te, err := findNodeEntry(table, n, StrategyNameNode)
 		if err != nil {
 			log.Log.Warnw("could not find pricing entry for node", zap.String("nodeName", n.ObjectMeta.Name))
 			continue
 		}
 
-		c := n.Status.Capacity.Cpu()
-		if c == nil {
-			log.Log.Warnw("could not get node cpu capacity, skipping", zap.String("nodeName", n.ObjectMeta.Name))
+		value, ok := nodeCost(te, n, duration)
+		if !ok {
 			continue
 		}
 
-		m := n.Status.Capacity.Memory()
-		if m == nil {
-			log.Log.Warnw("could not get node memory capacity, skipping", zap.String("nodeName", n.ObjectMeta.Name))
+		ci := CostItem{
+			Kind:     ResourceCostNode,
+			Value:    value,
+			Node:     n,
+			Strategy: StrategyNameNode,
+		}
+		log.Log.Debugw(
+			"generated cost item",
+			zap.String("node", ci.Node.ObjectMeta.Name),
+			zap.String("strategy", ci.Strategy),
+			zap.Int64("value", ci.Value),
+		)
+		cis = append(cis, ci)
+	}
+	return cis
+})
+
+// NodePoolPricingStrategy generates a cost metric per node pool representing
+// the summed cost of its nodes, as priced by the NodePricingStrategy. Nodes are
+// grouped by the value of the NodePoolLabel, and nodes without it form a pool
+// with an empty name. This trades the per-node view for lower cardinality.
+var NodePoolPricingStrategy = ClusterStatePricingStrategyFunc(func(table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+	label := cs.NodePoolLabel
+	if label == "" {
+		label = DefaultNodePoolLabel
+	}
+
+	totals := map[string]int64{}
+	for _, n := range cs.Nodes {
+		te, err := findNodeEntry(table, n, StrategyNameNodePool)
+		if err != nil {
+			log.Log.Warnw("could not find pricing entry for node", zap.String("nodeName", n.ObjectMeta.Name))
 			continue
 		}
 
-		memcost := te.MemoryCostMicroCents(float64(m.MilliValue())/1000, duration)
-		cpucost := te.CPUCostMicroCents(float64(c.MilliValue()), duration)
+		value, ok := nodeCost(te, n, duration)
+		if !ok {
+			continue
+		}
+		totals[n.ObjectMeta.Labels[label]] += value
+	}
+
+	pools := make([]string, 0, len(totals))
+	for pool := range totals {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
 
-		gpucost := int64(0)
-		if g := gpuCapacity(&n.Status.Capacity); g != nil {
-			gpucost = te.GPUCostMicroCents(float64(g.Value()), duration)
+	cis := make([]CostItem, 0, len(pools))
+	for _, pool := range pools {
+		ci := CostItem{
+			Kind:     ResourceCostNodePool,
+			Value:    totals[pool],
+			NodePool: pool,
+			Strategy: StrategyNameNodePool,
+		}
+		log.Log.Debugw(
+			"generated cost item",
+			zap.String("nodePool", ci.NodePool),
+			zap.String("strategy", ci.Strategy),
+			zap.Int64("value", ci.Value),
+		)
+		cis = append(cis, ci)
+	}
+	return cis
+})
+
+// UnallocatedPricingStrategy generates a cost metric per node representing the
+// portion of the node's cost that is not attributed to pods by the
+// WeightedPricingStrategy, i.e. the cost of idle or otherwise unrequested
+// resources. Values are floored at zero.
+var UnallocatedPricingStrategy = ClusterStatePricingStrategyFunc(func(table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+	nrm := cs.normalizedNodeResourceMap(table.MaxScale)
+	cpuWeight, memoryWeight := cs.resourceWeights()
+	allocated := map[string]int64{}
+	for _, p := range cs.Pods {
+		nr, ok := nrm[p.Spec.NodeName]
+		if !ok {
+			continue
+		}
+
+		te, err := table.FindByNode(nr.node)
+		if err != nil {
+			continue
+		}
+
+		allocated[p.Spec.NodeName] += weightedPodCost(te, nr, cs.resourcesOf(p), duration, cpuWeight, memoryWeight)
+	}
+
+	cis := []CostItem{}
+	for _, n := range cs.Nodes {
+		te, err := findNodeEntry(table, n, StrategyNameUnallocated)
+		if err != nil {
+			log.Log.Warnw("could not find pricing entry for node", zap.String("nodeName", n.ObjectMeta.Name))
+			continue
+		}
+
+		total, ok := nodeCost(te, n, duration)
+		if !ok {
+			continue
+		}
+
+		value := total - allocated[n.ObjectMeta.Name]
+		if value < 0 {
+			log.Log.Warnw(
+				"attributed pod cost exceeds node cost, flooring unallocated cost at zero",
+				zap.String("nodeName", n.ObjectMeta.Name),
+				zap.Int64("nodeCost", total),
+				zap.Int64("allocatedCost", allocated[n.ObjectMeta.Name]),
+			)
+			value = 0
 		}
 
 		ci := CostItem{
-			Kind:     ResourceCostNode,
-			Value:    memcost + cpucost + gpucost,
+			Kind:     ResourceCostUnallocated,
+			Value:    value,
 			Node:     n,
-			Strategy: StrategyNameNode,
+			Strategy: StrategyNameUnallocated,
+		}
+		log.Log.Debugw(
+			"generated cost item",
+			zap.String("node", ci.Node.ObjectMeta.Name),
+			zap.String("strategy", ci.Strategy),
+			zap.Int64("value", ci.Value),
+		)
+		cis = append(cis, ci)
+	}
+	return cis
+})
+
+// ReservedPricingStrategy generates a cost metric per node representing the
+// cost of the cpu, memory, and gpu capacity reserved for the system and
+// kubelet, i.e. the difference between the node's capacity and the resources
+// allocatable to pods. Pod strategies attribute cost against requests, so this
+// overhead is otherwise never attributed to pods. Note that it overlaps with
+// the UnallocatedPricingStrategy, which includes reserved capacity.
+var ReservedPricingStrategy = PricingStrategyFunc(func(table CostTable, duration time.Duration, pods []*core_v1.Pod, nodes []*core_v1.Node) []CostItem {
+	cis := []CostItem{}
+	for _, n := range nodes {
+		te, err := findNodeEntry(table, n, StrategyNameReserved)
+		if err != nil {
+			log.Log.Warnw("could not find pricing entry for node", zap.String("nodeName", n.ObjectMeta.Name))
+			continue
+		}
+
+		ci := CostItem{
+			Kind:     ResourceCostReserved,
+			Value:    reservedCost(te, n, duration),
+			Node:     n,
+			Strategy: StrategyNameReserved,
 		}
 		log.Log.Debugw(
 			"generated cost item",
@@ -328,32 +849,485 @@ var NodePricingStrategy = PricingStrategyFunc(func(table CostTable, duration tim
 	return cis
 })
 
-// sumPodResource calculates the total resource requests of `kind` for all
-// containers within a given Pod. The meaning of the value returned depends on
-// the kind chosen:
+// reservedCost returns the cost of the difference between a node's capacity
+// and its allocatable resources over the provided duration. Nodes that do not
+// report allocatable resources are assumed to reserve nothing.
+func reservedCost(te *CostTableEntry, n *core_v1.Node, duration time.Duration) int64 {
+	reserved := func(kind core_v1.ResourceName) int64 {
+		c, ok := n.Status.Capacity[kind]
+		if !ok {
+			return 0
+		}
+		a, ok := n.Status.Allocatable[kind]
+		if !ok {
+			return 0
+		}
+
+		r := containerResource(core_v1.ResourceList{kind: c}, kind) - containerResource(core_v1.ResourceList{kind: a}, kind)
+		if r < 0 {
+			return 0
+		}
+		return r
+	}
+
+	cpucost := te.CPUCostMicroCents(float64(reserved(core_v1.ResourceCPU)), duration)
+	memcost := te.MemoryCostMicroCents(float64(reserved(core_v1.ResourceMemory)), duration)
+	gpucost := int64(0)
+	for _, name := range gpuResourceNames(n.Status.Capacity) {
+		gpucost += te.GPUResourceCostMicroCents(string(name), float64(reserved(name)), duration)
+	}
+
+	return cpucost + memcost + gpucost
+}
+
+// StoragePricingStrategy attributes the cost of bound persistent volume claims
+// to the pods that mount them. The cost of a claim mounted by several pods,
+// e.g. a ReadWriteMany claim, is split evenly between them, while claims that
+// no pod mounts are not attributed. Claims are priced by the entry matching
+// the LabelStorageClass label set to their storage class; entries without
+// that label are never considered.
+var StoragePricingStrategy = ClusterStatePricingStrategyFunc(func(table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+	claims := map[string]*core_v1.PersistentVolumeClaim{}
+	for _, c := range cs.Claims {
+		if c.Status.Phase != core_v1.ClaimBound {
+			continue
+		}
+		claims[c.ObjectMeta.Namespace+"/"+c.ObjectMeta.Name] = c
+	}
+
+	mounts := map[string]int{}
+	for _, p := range cs.Pods {
+		for _, k := range podClaimKeys(p) {
+			mounts[k]++
+		}
+	}
+
+	storage := table.withLabel(LabelStorageClass)
+	cis := []CostItem{}
+	for _, p := range cs.Pods {
+		value := int64(0)
+		priced := false
+		for _, k := range podClaimKeys(p) {
+			c, ok := claims[k]
+			if !ok {
+				continue
+			}
+
+			te, err := storage.FindByLabels(Labels{LabelStorageClass: claimStorageClass(c)})
+			if err != nil {
+				log.Log.Warnw("could not find pricing entry for claim", zap.String("claim", k))
+				continue
+			}
+
+			value += te.StorageCostMicroCents(float64(claimBytes(c))/float64(mounts[k]), duration)
+			priced = true
+		}
+
+		if !priced {
+			continue
+		}
+
+		node, ok := cs.nodeMap[p.Spec.NodeName]
+		if !ok {
+			log.Log.Warnw("could not find nodeResourceMap for node", zap.String("nodeName", p.Spec.NodeName))
+			continue
+		}
+
+		ci := CostItem{
+			Kind:     ResourceCostStorage,
+			Value:    value,
+			Pod:      p,
+			Node:     node,
+			Strategy: StrategyNameStorage,
+		}
+		log.Log.Debugw(
+			"generated cost item",
+			zap.String("pod", ci.Pod.ObjectMeta.Name),
+			zap.String("strategy", ci.Strategy),
+			zap.Int64("value", ci.Value),
+		)
+		cis = append(cis, ci)
+	}
+	return cis
+})
+
+// podClaimKeys returns the namespace/name keys of the persistent volume claims
+// mounted by a pod, without duplicates.
+func podClaimKeys(p *core_v1.Pod) []string {
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, v := range p.Spec.Volumes {
+		if v.PersistentVolumeClaim == nil {
+			continue
+		}
+
+		k := p.ObjectMeta.Namespace + "/" + v.PersistentVolumeClaim.ClaimName
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// claimStorageClass returns the name of a claim's storage class, falling back
+// to the deprecated beta annotation.
+func claimStorageClass(c *core_v1.PersistentVolumeClaim) string {
+	if c.Spec.StorageClassName != nil {
+		return *c.Spec.StorageClassName
+	}
+	return c.ObjectMeta.Annotations[core_v1.BetaStorageClassAnnotation]
+}
+
+// claimBytes returns the capacity of a bound claim in bytes, or its requested
+// storage if it reports no capacity.
+func claimBytes(c *core_v1.PersistentVolumeClaim) int64 {
+	if q, ok := c.Status.Capacity[core_v1.ResourceStorage]; ok {
+		return q.Value()
+	}
+	if q, ok := c.Spec.Resources.Requests[core_v1.ResourceStorage]; ok {
+		return q.Value()
+	}
+	return 0
+}
+
+// LoadBalancerPricingStrategy charges a flat hourly cost for each service of
+// type LoadBalancer, as cloud load balancers are billed regardless of the pods
+// behind them. Services are priced by the entry matching the LabelServiceType
+// label set to their type; entries without that label are never considered.
+// Their cost items have neither a pod nor a node.
+var LoadBalancerPricingStrategy = ClusterStatePricingStrategyFunc(func(table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+	lbs := table.withLabel(LabelServiceType)
+	cis := []CostItem{}
+	for _, s := range cs.Services {
+		if s.Spec.Type != core_v1.ServiceTypeLoadBalancer {
+			continue
+		}
+
+		te, err := lbs.FindByLabels(Labels{LabelServiceType: string(s.Spec.Type)})
+		if err != nil {
+			log.Log.Warnw(
+				"could not find pricing entry for service",
+				zap.String("service", s.ObjectMeta.Namespace+"/"+s.ObjectMeta.Name),
+			)
+			continue
+		}
+
+		ci := CostItem{
+			Kind:     ResourceCostLoadBalancer,
+			Value:    te.LoadBalancerCostMicroCents(duration),
+			Service:  s,
+			Strategy: StrategyNameLoadBalancer,
+		}
+		log.Log.Debugw(
+			"generated cost item",
+			zap.String("service", ci.Service.ObjectMeta.Name),
+			zap.String("strategy", ci.Strategy),
+			zap.Int64("value", ci.Value),
+		)
+		cis = append(cis, ci)
+	}
+	return cis
+})
+
+// UsagePricingStrategy prices pods by the cpu and memory they were observed to
+// use, as reported by metrics-server, rather than by their requests. This
+// attributes cost by consumption, e.g. for showback, so that pods requesting
+// generously but using little are not billed for the difference. Pods without
+// metrics are not priced, and nothing is priced if metrics-server was
+// unavailable.
+var UsagePricingStrategy = ClusterStatePricingStrategyFunc(func(table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+	cis := []CostItem{}
+	if cs.Usage == nil {
+		log.Log.Warn("no pod metrics available, skipping usage pricing")
+		return cis
+	}
+
+	usage := map[string]*metricsv1beta1.PodMetrics{}
+	for _, pm := range cs.Usage {
+		usage[pm.ObjectMeta.Namespace+"/"+pm.ObjectMeta.Name] = pm
+	}
+
+	for _, p := range cs.Pods {
+		pm, ok := usage[p.ObjectMeta.Namespace+"/"+p.ObjectMeta.Name]
+		if !ok {
+			log.Log.Debugw("could not find metrics for pod", zap.String("pod", p.ObjectMeta.Name))
+			continue
+		}
+
+		node, ok := cs.nodeMap[p.Spec.NodeName]
+		if !ok {
+			log.Log.Warnw("could not find nodeResourceMap for node", zap.String("nodeName", p.Spec.NodeName))
+			continue
+		}
+
+		te, err := findNodeEntry(table, node, StrategyNameUsage)
+		if err != nil {
+			log.Log.Warnw("could not find pricing entry for node", zap.String("nodeName", node.ObjectMeta.Name))
+			continue
+		}
+
+		cpu, mem := int64(0), int64(0)
+		for _, c := range pm.Containers {
+			cpu += containerResource(c.Usage, core_v1.ResourceCPU)
+			mem += containerResource(c.Usage, core_v1.ResourceMemory)
+		}
+
+		ci := CostItem{
+			Kind:     ResourceCostUsage,
+			Value:    te.CPUCostMicroCents(float64(cpu), duration) + te.MemoryCostMicroCents(float64(mem), duration),
+			Pod:      p,
+			Node:     node,
+			Strategy: StrategyNameUsage,
+		}
+		log.Log.Debugw(
+			"generated cost item",
+			zap.String("pod", ci.Pod.ObjectMeta.Name),
+			zap.String("strategy", ci.Strategy),
+			zap.Int64("value", ci.Value),
+		)
+		cis = append(cis, ci)
+	}
+	return cis
+})
+
+// CPUPerContainerPricingStrategy prices pods like the CPUPricingStrategy but
+// emits a CostItem per container, carrying its ContainerName, rather than per
+// pod. Init containers are not priced.
+var CPUPerContainerPricingStrategy = perContainerPricingStrategy(ResourceCostCPU, core_v1.ResourceCPU, StrategyNameCPU, (*CostTableEntry).CPUCostMicroCents)
+
+// MemoryPerContainerPricingStrategy prices pods like the MemoryPricingStrategy
+// but emits a CostItem per container, carrying its ContainerName, rather than
+// per pod. Init containers are not priced.
+var MemoryPerContainerPricingStrategy = perContainerPricingStrategy(ResourceCostMemory, core_v1.ResourceMemory, StrategyNameMemory, (*CostTableEntry).MemoryCostMicroCents)
+
+func perContainerPricingStrategy(
+	kind ResourceCostKind,
+	resource core_v1.ResourceName,
+	strategy string,
+	cost func(te *CostTableEntry, v float64, duration time.Duration) int64,
+) ClusterStatePricingStrategyFunc {
+	return ClusterStatePricingStrategyFunc(func(table CostTable, duration time.Duration, cs *ClusterState) []CostItem {
+		nm := cs.nodeMap
+		requests := cs.requests()
+		cis := []CostItem{}
+		for _, p := range cs.Pods {
+			node, ok := nm[p.Spec.NodeName]
+			if !ok {
+				log.Log.Warnw("could not find nodeResourceMap for node", zap.String("nodeName", p.Spec.NodeName))
+				continue
+			}
+
+			te, err := findNodeEntry(table, node, strategy)
+			if err != nil {
+				log.Log.Warnw("could not find pricing entry for node", zap.String("nodeName", node.ObjectMeta.Name))
+				continue
+			}
+
+			for _, c := range p.Spec.Containers {
+				ci := CostItem{
+					Kind:          kind,
+					Value:         cost(te, float64(containerResource(requests(c), resource)), duration),
+					Pod:           p,
+					Node:          node,
+					Strategy:      strategy,
+					ContainerName: c.Name,
+				}
+				log.Log.Debugw(
+					"generated cost item",
+					zap.String("pod", ci.Pod.ObjectMeta.Name),
+					zap.String("container", ci.ContainerName),
+					zap.String("strategy", ci.Strategy),
+					zap.Int64("value", ci.Value),
+				)
+				cis = append(cis, ci)
+			}
+		}
+		return cis
+	})
+}
+
+// strategiesByName maps the names reported by each strategy in its CostItems
+// to the strategy itself.
+var strategiesByName = map[string]PricingStrategy{
+	StrategyNameCPU:              CPUPricingStrategy,
+	StrategyNameMemory:           MemoryPricingStrategy,
+	StrategyNameEphemeralStorage: EphemeralStoragePricingStrategy,
+	StrategyNameGPU:              GPUPricingStrategy,
+	StrategyNameWeighted:         WeightedPricingStrategy,
+	StrategyNameLimits:           LimitsBasedPricingStrategy,
+	StrategyNameNode:             NodePricingStrategy,
+	StrategyNameUnallocated:      UnallocatedPricingStrategy,
+	StrategyNameReserved:         ReservedPricingStrategy,
+	StrategyNameStorage:          StoragePricingStrategy,
+	StrategyNameUsage:            UsagePricingStrategy,
+	StrategyNameNodePool:         NodePoolPricingStrategy,
+	StrategyNameLoadBalancer:     LoadBalancerPricingStrategy,
+}
+
+// perContainerStrategiesByName maps strategy names to the strategies used in
+// their place when per-container costs are enabled.
+var perContainerStrategiesByName = map[string]PricingStrategy{
+	StrategyNameCPU:    CPUPerContainerPricingStrategy,
+	StrategyNameMemory: MemoryPerContainerPricingStrategy,
+}
+
+// defaultStrategyNames are the strategies used by a coster by default, in
+// the order they are calculated.
+var defaultStrategyNames = []string{
+	StrategyNameGPU,
+	StrategyNameCPU,
+	StrategyNameMemory,
+	StrategyNameEphemeralStorage,
+	StrategyNameWeighted,
+	StrategyNameNode,
+	StrategyNameUnallocated,
+}
+
+// nodeCost returns the cost of the full capacity of a node over the provided
+// duration. The boolean return value is false if the node's capacity could
+// not be determined.
+func nodeCost(te *CostTableEntry, n *core_v1.Node, duration time.Duration) (int64, bool) {
+	c := n.Status.Capacity.Cpu()
+	if c == nil {
+		log.Log.Warnw("could not get node cpu capacity, skipping", zap.String("nodeName", n.ObjectMeta.Name))
+		return 0, false
+	}
+
+	m := n.Status.Capacity.Memory()
+	if m == nil {
+		log.Log.Warnw("could not get node memory capacity, skipping", zap.String("nodeName", n.ObjectMeta.Name))
+		return 0, false
+	}
+
+	memcost := te.MemoryCostMicroCents(float64(m.MilliValue())/1000, duration)
+	cpucost := te.CPUCostMicroCents(float64(c.MilliValue()), duration)
+
+	storagecost := int64(0)
+	if s := n.Status.Capacity.StorageEphemeral(); s != nil {
+		storagecost = te.EphemeralStorageCostMicroCents(float64(s.Value()), duration)
+	}
+
+	total := memcost + cpucost + storagecost
+	if gpucost, ok := nodeGPUCost(te, n, duration); ok {
+		total += gpucost
+	}
+	return total, true
+}
+
+// nodeGPUCost returns the cost of the gpu capacity of a node over the provided
+// duration. The boolean return value is false if the node has no gpu
+// capacity, i.e. no gpu resource or only gpu resources with no units, as
+// opposed to gpus that are priced at zero.
+func nodeGPUCost(te *CostTableEntry, n *core_v1.Node, duration time.Duration) (int64, bool) {
+	cost := int64(0)
+	present := false
+	for _, name := range gpuResourceNames(n.Status.Capacity) {
+		units := containerResource(n.Status.Capacity, name)
+		if units <= 0 {
+			continue
+		}
+		present = true
+		cost += te.GPUResourceCostMicroCents(string(name), float64(units), duration)
+	}
+	return cost, present
+}
+
+// weightedPodCost returns the cost of a pod given its share of the allocated
+// resources on its node, as used by the WeightedPricingStrategy.
+//
+// The cpu and memory components are scaled by their weights and then
+// rescaled so that the node's combined cpu and memory cost is still attributed
+// in full. Weights therefore shift cost between pods on a node without
+// changing the total.
+//
+// Nodes priced by an entry with an OvercommitFactor are normalized against
+// their overcommitted cpu and memory capacity, each unit of which costs the
+// factor less. Uncapped, the factor cancels out and the node's cost is still
+// attributed in full; it only changes costs where MaxScale caps scaling.
+func weightedPodCost(te *CostTableEntry, nr allocatedNodeResources, r podResources, duration time.Duration, cpuWeight, memoryWeight float64) int64 {
+	f := te.overcommitFactor()
+	oc := nr.overcommitted(f)
+
+	// We "normalize" cpu, memory, and gpu utilization by scaling the utilized resources
+	// of pods by the global utilization of the respective resource on the node.
+	cpucost := te.CPUCostMicroCents(float64(r.cpu)*oc.CPUScale()/f, duration)
+	memcost := te.MemoryCostMicroCents(float64(r.memory)*oc.MemoryScale()/f, duration)
+	gpucost := gpuCost(te, r.gpus, nr.GPUScale(), duration)
+
+	if cpuWeight == memoryWeight {
+		return cpucost + memcost + gpucost
+	}
+
+	nodecpu := float64(te.CPUCostMicroCents(float64(nr.cpuAvailable), duration))
+	nodemem := float64(te.MemoryCostMicroCents(float64(nr.memoryAvailable), duration))
+	weighted := cpuWeight*nodecpu + memoryWeight*nodemem
+	if weighted == 0 {
+		return cpucost + memcost + gpucost
+	}
+
+	rescale := (nodecpu + nodemem) / weighted
+	return int64((cpuWeight*float64(cpucost)+memoryWeight*float64(memcost))*rescale) + gpucost
+}
+
+// sumPodResource calculates the effective resource requests of `kind` for a
+// given Pod. The meaning of the value returned depends on the kind chosen:
 // 	- cpu: The number of millicpus. 1 cpu is 1000.
 //  - memory: The number of bytes.
-//  - nvidia.com/gpu: The number of gpu units regardless of model.
+//  - ephemeral-storage: The number of bytes.
+//  - nvidia.com/*: The number of units of the gpu resource, e.g. MIG slices.
+//
+// Init containers run one at a time before the regular containers start, so
+// the effective request is the larger of the biggest init container request
+// and the sum of the regular container requests, as in the Kubernetes
+// scheduler. Ephemeral containers may not declare resources and are ignored.
+// Containers that limit but do not request `kind` are counted by their limit,
+// per effectiveRequests.
 func sumPodResource(p *core_v1.Pod, kind core_v1.ResourceName) int64 {
+	return sumContainerResources(p, kind, effectiveRequests)
+}
+
+// sumPodLimit calculates the effective resource limits of `kind` for a given
+// Pod, using the same init container semantics as sumPodResource. Values are
+// expressed in the same units as sumPodResource.
+func sumPodLimit(p *core_v1.Pod, kind core_v1.ResourceName) int64 {
+	return sumContainerResources(p, kind, containerLimits)
+}
+
+// sumContainerResources totals the quantities of `kind` found in the
+// ResourceList returned by `list` for every container in the pod, raising the
+// total to that of the largest init container if it is greater.
+func sumContainerResources(p *core_v1.Pod, kind core_v1.ResourceName, list func(c core_v1.Container) core_v1.ResourceList) int64 {
 	total := int64(0)
 	for _, c := range p.Spec.Containers {
-		res, ok := c.Resources.Requests[kind]
-		if !ok {
-			continue
-		}
+		total = total + containerResource(list(c), kind)
+	}
 
-		if kind == core_v1.ResourceMemory {
-			total = total + (&res).Value()
-		} else if kind == ResourceGPU {
-			total = total + (&res).Value()
-		} else {
-			total = total + (&res).MilliValue()
+	for _, c := range p.Spec.InitContainers {
+		if v := containerResource(list(c), kind); v > total {
+			total = v
 		}
 	}
 
 	return total
 }
 
+// containerResource returns the quantity of `kind` in the provided
+// ResourceList in the units described by sumPodResource, or 0 if absent.
+func containerResource(rl core_v1.ResourceList, kind core_v1.ResourceName) int64 {
+	res, ok := rl[kind]
+	if !ok {
+		return 0
+	}
+
+	if kind == core_v1.ResourceMemory || kind == core_v1.ResourceEphemeralStorage {
+		return (&res).Value()
+	} else if IsGPUResource(kind) {
+		return (&res).Value()
+	}
+	return (&res).MilliValue()
+}
+
 type nodeResourceMap map[string]allocatedNodeResources
 type nodeMap map[string]*core_v1.Node
 
@@ -370,11 +1344,11 @@ func buildNodeMap(nodes []*core_v1.Node) nodeMap {
 // e.g. my pod uses 500 cpu
 // the node has 1 cpu
 // my pod is the only pod on the node, and total nod resources are 500
-func buildNormalizedNodeResourceMap(pods []*core_v1.Pod, nodes []*core_v1.Node) nodeResourceMap { // nolint: gocyclo
+func buildNormalizedNodeResourceMap(pods []*core_v1.Pod, nodes []*core_v1.Node, maxScale float64, resources func(p *core_v1.Pod) podResources) nodeResourceMap { // nolint: gocyclo
 	nrm := nodeResourceMap{}
 
 	for _, n := range nodes {
-		nrm[n.ObjectMeta.Name] = allocatedNodeResources{node: n}
+		nrm[n.ObjectMeta.Name] = allocatedNodeResources{node: n, maxScale: maxScale}
 	}
 
 	// We sum the total allocated resources on every node from our list of pods.
@@ -389,9 +1363,10 @@ func buildNormalizedNodeResourceMap(pods []*core_v1.Pod, nodes []*core_v1.Node)
 			log.Log.Warnw("unexpected missing node from NodeMap", zap.String("nodeName", p.Spec.NodeName))
 			continue
 		}
-		nr.cpuUsed += sumPodResource(p, core_v1.ResourceCPU)
-		nr.memoryUsed += sumPodResource(p, core_v1.ResourceMemory)
-		nr.gpuUsed += sumPodResource(p, ResourceGPU)
+		r := resources(p)
+		nr.cpuUsed += r.cpu
+		nr.memoryUsed += r.memory
+		nr.gpuUsed += r.gpuTotal()
 		nrm[p.Spec.NodeName] = nr
 	}
 
@@ -406,10 +1381,7 @@ func buildNormalizedNodeResourceMap(pods []*core_v1.Pod, nodes []*core_v1.Node)
 			v.memoryAvailable = m.Value()
 		}
 
-		g := gpuCapacity(&v.node.Status.Capacity)
-		if g != nil {
-			v.gpuAvailable = g.Value()
-		}
+		v.gpuAvailable = gpuCapacity(v.node.Status.Capacity)
 
 		// The ratio of cpuUsed / cpuAvailable is used for proportional scaling of
 		// resources to "normalize" pod resource utilization to a full node. If
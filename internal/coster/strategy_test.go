@@ -15,6 +15,7 @@
 package coster
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -22,6 +23,7 @@ import (
 	core_v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
 )
 
 const strategyTestNodeName = "strategy-test-node"
@@ -85,6 +87,39 @@ var (
 			},
 		},
 	}
+	testStrategyPodLimits = &core_v1.Pod{
+		Spec: core_v1.PodSpec{
+			NodeName: strategyTestNodeName,
+			Containers: []core_v1.Container{
+				core_v1.Container{
+					Resources: core_v1.ResourceRequirements{
+						Requests: core_v1.ResourceList{
+							"cpu":    resource.MustParse("250m"),
+							"memory": resource.MustParse("16Mi"),
+						},
+						Limits: core_v1.ResourceList{
+							"cpu":    resource.MustParse("1000m"),
+							"memory": resource.MustParse("32Mi"),
+						},
+					},
+				},
+			},
+		},
+	}
+	testStrategyPodEphemeralStorage = &core_v1.Pod{
+		Spec: core_v1.PodSpec{
+			NodeName: strategyTestNodeName,
+			Containers: []core_v1.Container{
+				core_v1.Container{
+					Resources: core_v1.ResourceRequirements{
+						Requests: core_v1.ResourceList{
+							"ephemeral-storage": resource.MustParse("10Gi"),
+						},
+					},
+				},
+			},
+		},
+	}
 	testStrategyPodTwoGPU = &core_v1.Pod{
 		Spec: core_v1.PodSpec{
 			NodeName: strategyTestNodeName,
@@ -99,6 +134,42 @@ var (
 			},
 		},
 	}
+	testStrategyPodMultiContainer = &core_v1.Pod{
+		Spec: core_v1.PodSpec{
+			NodeName: strategyTestNodeName,
+			InitContainers: []core_v1.Container{
+				core_v1.Container{
+					Name: "init",
+					Resources: core_v1.ResourceRequirements{
+						Requests: core_v1.ResourceList{
+							"cpu":    resource.MustParse("2000m"),
+							"memory": resource.MustParse("1Gi"),
+						},
+					},
+				},
+			},
+			Containers: []core_v1.Container{
+				core_v1.Container{
+					Name: "app",
+					Resources: core_v1.ResourceRequirements{
+						Requests: core_v1.ResourceList{
+							"cpu":    resource.MustParse("500m"),
+							"memory": resource.MustParse("32Mi"),
+						},
+					},
+				},
+				core_v1.Container{
+					Name: "sidecar",
+					Resources: core_v1.ResourceRequirements{
+						Requests: core_v1.ResourceList{
+							"cpu":    resource.MustParse("100m"),
+							"memory": resource.MustParse("16Mi"),
+						},
+					},
+				},
+			},
+		},
+	}
 )
 
 var testStrategyNode = &core_v1.Node{
@@ -114,6 +185,19 @@ var testStrategyNode = &core_v1.Node{
 	},
 }
 
+var testStrategyNodeEphemeralStorage = &core_v1.Node{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:   strategyTestNodeName,
+		Labels: strategyTestNodeLabels,
+	},
+	Status: core_v1.NodeStatus{
+		Capacity: core_v1.ResourceList{
+			"cpu":               resource.MustParse("1"),
+			"ephemeral-storage": resource.MustParse("100Gi"),
+		},
+	},
+}
+
 var testStrategyNodeGPU = &core_v1.Node{
 	ObjectMeta: metav1.ObjectMeta{
 		Name:   strategyTestNodeName,
@@ -127,6 +211,47 @@ var testStrategyNodeGPU = &core_v1.Node{
 	},
 }
 
+var testStrategyNodeMIG = &core_v1.Node{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:   strategyTestNodeName,
+		Labels: strategyTestNodeLabels,
+	},
+	Status: core_v1.NodeStatus{
+		Capacity: core_v1.ResourceList{
+			"cpu":                   resource.MustParse("1"),
+			"nvidia.com/mig-1g.5gb": resource.MustParse("7"),
+		},
+	},
+}
+
+var testStrategyPodMIG = &core_v1.Pod{
+	Spec: core_v1.PodSpec{
+		NodeName: strategyTestNodeName,
+		Containers: []core_v1.Container{
+			core_v1.Container{
+				Resources: core_v1.ResourceRequirements{
+					Requests: core_v1.ResourceList{
+						"nvidia.com/mig-1g.5gb": resource.MustParse("2"),
+					},
+				},
+			},
+		},
+	},
+}
+
+// testStrategyMIGCostTable prices a 1g.5gb MIG slice at a seventh of a gpu.
+var testStrategyMIGCostTable = CostTable{
+	Entries: []*CostTableEntry{
+		&CostTableEntry{
+			Labels:                  strategyTestNodeLabels,
+			HourlyGPUCostMicroCents: 7000000,
+			HourlyGPUResourceCostMicroCents: map[string]float64{
+				"nvidia.com/mig-1g.5gb": 1000000,
+			},
+		},
+	},
+}
+
 var testStrategyNodeMultiGPU = &core_v1.Node{
 	ObjectMeta: metav1.ObjectMeta{
 		Name:   strategyTestNodeName,
@@ -143,10 +268,11 @@ var testStrategyNodeMultiGPU = &core_v1.Node{
 var testStrategyCostTable = CostTable{
 	Entries: []*CostTableEntry{
 		&CostTableEntry{
-			Labels:                         strategyTestNodeLabels,
-			HourlyMilliCPUCostMicroCents:   1000,
-			HourlyMemoryByteCostMicroCents: 1,
-			HourlyGPUCostMicroCents:        7000000,
+			Labels:                                   strategyTestNodeLabels,
+			HourlyMilliCPUCostMicroCents:             1000,
+			HourlyMemoryByteCostMicroCents:           1,
+			HourlyGPUCostMicroCents:                  7000000,
+			HourlyEphemeralStorageByteCostMicroCents: 0.001,
 		},
 	},
 }
@@ -294,168 +420,1356 @@ var testCPUStrategyCases = []struct {
 		},
 	},
 	{
-		name:     "Happy day NodePricingStrategy.",
-		pods:     []*core_v1.Pod{},
+		name:     "Happy day LimitsBasedPricingStrategy with a limited pod.",
+		pods:     []*core_v1.Pod{testStrategyPodLimits},
 		nodes:    []*core_v1.Node{testStrategyNode},
 		table:    testStrategyCostTable,
 		duration: time.Hour,
-		strategy: NodePricingStrategy,
+		strategy: LimitsBasedPricingStrategy,
 		expectedCostItems: []CostItem{
 			CostItem{
-				Value:    1074741824, // 1073741824 (gibibyte) + 1e6 (1000 millicpus * 1000 per millicpu hour)
-				Kind:     ResourceCostNode,
+				Value:    34554432, // 33554432 (32 mebibytes) + 1e6 (1000 millicpus * 1000 per millicpu hour)
+				Kind:     ResourceCostLimits,
+				Pod:      testStrategyPodLimits,
 				Node:     testStrategyNode,
-				Strategy: StrategyNameNode,
+				Strategy: StrategyNameLimits,
 			},
 		},
 	},
-}
-
-func TestCPUStrategyCalculations(t *testing.T) {
-	for _, tt := range testCPUStrategyCases {
-		t.Run(tt.name, func(t *testing.T) {
-			ci := tt.strategy.Calculate(tt.table, tt.duration, tt.pods, tt.nodes)
-			if diff := deep.Equal(ci, tt.expectedCostItems); diff != nil {
-				t.Fatal(diff)
-			}
-		})
-	}
-}
-
-var testGPUStrategyCases = []struct {
-	name              string
-	pods              []*core_v1.Pod
-	nodes             []*core_v1.Node
-	table             CostTable
-	duration          time.Duration
-	strategy          PricingStrategy
-	expectedCostItems []CostItem
-}{
 	{
-		name:              "GPUPricingStrategy Pod with no GPU on node without GPUs contains no entries",
-		pods:              []*core_v1.Pod{testStrategyPodA},
-		nodes:             []*core_v1.Node{testStrategyNode},
-		table:             testStrategyCostTable,
-		duration:          time.Hour,
-		strategy:          GPUPricingStrategy,
-		expectedCostItems: []CostItem{},
+		name:     "LimitsBasedPricingStrategy with a pod that only sets requests.",
+		pods:     []*core_v1.Pod{testStrategyPodA},
+		nodes:    []*core_v1.Node{testStrategyNode},
+		table:    testStrategyCostTable,
+		duration: time.Hour,
+		strategy: LimitsBasedPricingStrategy,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    0,
+				Kind:     ResourceCostLimits,
+				Pod:      testStrategyPodA,
+				Node:     testStrategyNode,
+				Strategy: StrategyNameLimits,
+			},
+		},
 	},
 	{
-		name:     "GPUPricingStrategy for a pod on a node with GPU",
-		pods:     []*core_v1.Pod{testStrategyPodGPU},
-		nodes:    []*core_v1.Node{testStrategyNodeGPU},
+		name:     "Happy day EphemeralStoragePricingStrategy with a single pod.",
+		pods:     []*core_v1.Pod{testStrategyPodEphemeralStorage},
+		nodes:    []*core_v1.Node{testStrategyNodeEphemeralStorage},
 		table:    testStrategyCostTable,
 		duration: time.Hour,
-		strategy: GPUPricingStrategy,
+		strategy: EphemeralStoragePricingStrategy,
 		expectedCostItems: []CostItem{
 			CostItem{
-				Value:    7000000,
-				Kind:     ResourceCostGPU,
-				Pod:      testStrategyPodGPU,
-				Node:     testStrategyNodeMultiGPU,
-				Strategy: StrategyNameGPU,
+				Value:    10737418, // 10 gibibytes at 0.001 per byte hour
+				Kind:     ResourceCostEphemeralStorage,
+				Pod:      testStrategyPodEphemeralStorage,
+				Node:     testStrategyNodeEphemeralStorage,
+				Strategy: StrategyNameEphemeralStorage,
 			},
 		},
 	},
 	{
-		name:     "GPUPricingStrategy for a pod on a node with multi GPU",
-		pods:     []*core_v1.Pod{testStrategyPodGPU},
-		nodes:    []*core_v1.Node{testStrategyNodeMultiGPU},
+		name:     "NodePricingStrategy with ephemeral storage capacity.",
+		pods:     []*core_v1.Pod{},
+		nodes:    []*core_v1.Node{testStrategyNodeEphemeralStorage},
 		table:    testStrategyCostTable,
 		duration: time.Hour,
-		strategy: GPUPricingStrategy,
+		strategy: NodePricingStrategy,
 		expectedCostItems: []CostItem{
 			CostItem{
-				Value:    7000000,
-				Kind:     ResourceCostGPU,
-				Pod:      testStrategyPodGPU,
-				Node:     testStrategyNodeGPU,
-				Strategy: StrategyNameGPU,
+				Value:    1000000 + 107374182, // 1000 millicpus plus 100 gibibytes of ephemeral storage
+				Kind:     ResourceCostNode,
+				Node:     testStrategyNodeEphemeralStorage,
+				Strategy: StrategyNameNode,
 			},
 		},
 	},
 	{
-		name:     "WeightedPricingStrategy with a GPU pod.",
-		pods:     []*core_v1.Pod{testStrategyPodA, testStrategyPodGPU},
-		nodes:    []*core_v1.Node{testStrategyNodeGPU},
+		name:     "Happy day NodePricingStrategy.",
+		pods:     []*core_v1.Pod{},
+		nodes:    []*core_v1.Node{testStrategyNode},
 		table:    testStrategyCostTable,
 		duration: time.Hour,
-		strategy: WeightedPricingStrategy,
+		strategy: NodePricingStrategy,
 		expectedCostItems: []CostItem{
 			CostItem{
-				Value:    1000000,
-				Kind:     ResourceCostWeighted,
-				Pod:      testStrategyPodA,
-				Node:     testStrategyNodeGPU,
-				Strategy: StrategyNameWeighted,
+				Value:    1074741824, // 1073741824 (gibibyte) + 1e6 (1000 millicpus * 1000 per millicpu hour)
+				Kind:     ResourceCostNode,
+				Node:     testStrategyNode,
+				Strategy: StrategyNameNode,
 			},
+		},
+	},
+	{
+		name:     "CPUPerContainerPricingStrategy emits an item per container.",
+		pods:     []*core_v1.Pod{testStrategyPodMultiContainer},
+		nodes:    []*core_v1.Node{testStrategyNode},
+		table:    testStrategyCostTable,
+		duration: time.Hour,
+		strategy: CPUPerContainerPricingStrategy,
+		expectedCostItems: []CostItem{
 			CostItem{
-				Value:    7000000,
-				Kind:     ResourceCostWeighted,
-				Pod:      testStrategyPodGPU,
-				Node:     testStrategyNodeGPU,
-				Strategy: StrategyNameWeighted,
+				Value:         500000,
+				Kind:          ResourceCostCPU,
+				Pod:           testStrategyPodMultiContainer,
+				Node:          testStrategyNode,
+				Strategy:      StrategyNameCPU,
+				ContainerName: "app",
+			},
+			CostItem{
+				Value:         100000,
+				Kind:          ResourceCostCPU,
+				Pod:           testStrategyPodMultiContainer,
+				Node:          testStrategyNode,
+				Strategy:      StrategyNameCPU,
+				ContainerName: "sidecar",
 			},
 		},
 	},
 	{
-		name:     "WeightedPricingStrategy with a multi GPU pod.",
-		pods:     []*core_v1.Pod{testStrategyPodTwoGPU},
-		nodes:    []*core_v1.Node{testStrategyNodeMultiGPU},
+		name:     "MemoryPerContainerPricingStrategy emits an item per container.",
+		pods:     []*core_v1.Pod{testStrategyPodMultiContainer},
+		nodes:    []*core_v1.Node{testStrategyNode},
 		table:    testStrategyCostTable,
 		duration: time.Hour,
-		strategy: WeightedPricingStrategy,
+		strategy: MemoryPerContainerPricingStrategy,
 		expectedCostItems: []CostItem{
 			CostItem{
-				Value:    14000000,
-				Kind:     ResourceCostWeighted,
-				Pod:      testStrategyPodTwoGPU,
-				Node:     testStrategyNodeMultiGPU,
-				Strategy: StrategyNameWeighted,
+				Value:         33554432,
+				Kind:          ResourceCostMemory,
+				Pod:           testStrategyPodMultiContainer,
+				Node:          testStrategyNode,
+				Strategy:      StrategyNameMemory,
+				ContainerName: "app",
+			},
+			CostItem{
+				Value:         16777216,
+				Kind:          ResourceCostMemory,
+				Pod:           testStrategyPodMultiContainer,
+				Node:          testStrategyNode,
+				Strategy:      StrategyNameMemory,
+				ContainerName: "sidecar",
 			},
 		},
 	},
+}
+
+var testUnallocatedStrategyCases = []struct {
+	name              string
+	pods              []*core_v1.Pod
+	nodes             []*core_v1.Node
+	table             CostTable
+	duration          time.Duration
+	expectedCostItems []CostItem
+}{
 	{
-		name:     "NodePricingStrategy with a GPU node.",
+		name:     "UnallocatedPricingStrategy on an empty node is the whole node cost.",
 		pods:     []*core_v1.Pod{},
-		nodes:    []*core_v1.Node{testStrategyNodeGPU},
+		nodes:    []*core_v1.Node{testStrategyNode},
 		table:    testStrategyCostTable,
 		duration: time.Hour,
-		strategy: NodePricingStrategy,
 		expectedCostItems: []CostItem{
 			CostItem{
-				Value:    1000000 + 7000000,
-				Kind:     ResourceCostNode,
-				Node:     testStrategyNodeGPU,
-				Strategy: StrategyNameNode,
+				Value:    1074741824,
+				Kind:     ResourceCostUnallocated,
+				Node:     testStrategyNode,
+				Strategy: StrategyNameUnallocated,
 			},
 		},
 	},
 	{
-		name:     "NodePricingStrategy with a multi GPU node.",
-		pods:     []*core_v1.Pod{},
-		nodes:    []*core_v1.Node{testStrategyNodeMultiGPU},
+		name:     "UnallocatedPricingStrategy with a pod that requests no resources.",
+		pods:     []*core_v1.Pod{testStrategyPodNoResources},
+		nodes:    []*core_v1.Node{testStrategyNode},
 		table:    testStrategyCostTable,
 		duration: time.Hour,
-		strategy: NodePricingStrategy,
 		expectedCostItems: []CostItem{
 			CostItem{
-				Value:    1000000 + 14000000,
-				Kind:     ResourceCostNode,
-				Node:     testStrategyNodeGPU,
-				Strategy: StrategyNameNode,
+				Value:    1074741824,
+				Kind:     ResourceCostUnallocated,
+				Node:     testStrategyNode,
+				Strategy: StrategyNameUnallocated,
+			},
+		},
+	},
+	{
+		name:     "UnallocatedPricingStrategy with pods that are fully attributed.",
+		pods:     []*core_v1.Pod{testStrategyPodA, testStrategyPodB},
+		nodes:    []*core_v1.Node{testStrategyNode},
+		table:    testStrategyCostTable,
+		duration: time.Hour,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    1, // 1074741824 - (537537578 + 537204245), the remainder is lost to truncation.
+				Kind:     ResourceCostUnallocated,
+				Node:     testStrategyNode,
+				Strategy: StrategyNameUnallocated,
 			},
 		},
 	},
 }
 
-func TestGPUStrategyCalculations(t *testing.T) {
-	for _, tt := range testGPUStrategyCases {
+func TestUnallocatedStrategyCalculations(t *testing.T) {
+	for _, tt := range testUnallocatedStrategyCases {
 		t.Run(tt.name, func(t *testing.T) {
-			ci := tt.strategy.Calculate(tt.table, tt.duration, tt.pods, tt.nodes)
+			ci := UnallocatedPricingStrategy.Calculate(tt.table, tt.duration, tt.pods, tt.nodes)
 			if diff := deep.Equal(ci, tt.expectedCostItems); diff != nil {
 				t.Fatal(diff)
 			}
 		})
 	}
 }
+
+var testStrategyNodeReserved = &core_v1.Node{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:   strategyTestNodeName,
+		Labels: strategyTestNodeLabels,
+	},
+	Status: core_v1.NodeStatus{
+		Capacity: core_v1.ResourceList{
+			"cpu":            resource.MustParse("2"),
+			"memory":         resource.MustParse("1Gi"),
+			"nvidia.com/gpu": resource.MustParse("2"),
+		},
+		Allocatable: core_v1.ResourceList{
+			"cpu":            resource.MustParse("1900m"),
+			"memory":         resource.MustParse("768Mi"),
+			"nvidia.com/gpu": resource.MustParse("1"),
+		},
+	},
+}
+
+var testReservedStrategyCases = []struct {
+	name              string
+	nodes             []*core_v1.Node
+	expectedCostItems []CostItem
+}{
+	{
+		name:  "ReservedPricingStrategy prices the difference between capacity and allocatable.",
+		nodes: []*core_v1.Node{testStrategyNodeReserved},
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    100000 + 268435456 + 7000000, // 100 millicpus, 256 mebibytes and 1 gpu
+				Kind:     ResourceCostReserved,
+				Node:     testStrategyNodeReserved,
+				Strategy: StrategyNameReserved,
+			},
+		},
+	},
+	{
+		name:  "ReservedPricingStrategy on a node without allocatable resources reserves nothing.",
+		nodes: []*core_v1.Node{testStrategyNode},
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    0,
+				Kind:     ResourceCostReserved,
+				Node:     testStrategyNode,
+				Strategy: StrategyNameReserved,
+			},
+		},
+	},
+}
+
+func TestReservedStrategyCalculations(t *testing.T) {
+	for _, tt := range testReservedStrategyCases {
+		t.Run(tt.name, func(t *testing.T) {
+			ci := ReservedPricingStrategy.Calculate(testStrategyCostTable, time.Hour, []*core_v1.Pod{testStrategyPodA}, tt.nodes)
+			if diff := deep.Equal(ci, tt.expectedCostItems); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestCPUStrategyCalculations(t *testing.T) {
+	for _, tt := range testCPUStrategyCases {
+		t.Run(tt.name, func(t *testing.T) {
+			ci := tt.strategy.Calculate(tt.table, tt.duration, tt.pods, tt.nodes)
+			if diff := deep.Equal(ci, tt.expectedCostItems); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+var testGPUStrategyCases = []struct {
+	name              string
+	pods              []*core_v1.Pod
+	nodes             []*core_v1.Node
+	table             CostTable
+	duration          time.Duration
+	strategy          PricingStrategy
+	expectedCostItems []CostItem
+}{
+	{
+		name:     "GPUPricingStrategy prices MIG slices by resource name",
+		pods:     []*core_v1.Pod{testStrategyPodMIG},
+		nodes:    []*core_v1.Node{testStrategyNodeMIG},
+		table:    testStrategyMIGCostTable,
+		duration: time.Hour,
+		strategy: GPUPricingStrategy,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    2000000,
+				Kind:     ResourceCostGPU,
+				Pod:      testStrategyPodMIG,
+				Node:     testStrategyNodeMIG,
+				Strategy: StrategyNameGPU,
+			},
+		},
+	},
+	{
+		name:     "GPUPricingStrategy prices unlisted gpu resources as full gpus",
+		pods:     []*core_v1.Pod{testStrategyPodMIG},
+		nodes:    []*core_v1.Node{testStrategyNodeMIG},
+		table:    testStrategyCostTable,
+		duration: time.Hour,
+		strategy: GPUPricingStrategy,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    14000000,
+				Kind:     ResourceCostGPU,
+				Pod:      testStrategyPodMIG,
+				Node:     testStrategyNodeMIG,
+				Strategy: StrategyNameGPU,
+			},
+		},
+	},
+	{
+		name:     "NodePricingStrategy prices MIG capacity by resource name",
+		pods:     []*core_v1.Pod{},
+		nodes:    []*core_v1.Node{testStrategyNodeMIG},
+		table:    testStrategyMIGCostTable,
+		duration: time.Hour,
+		strategy: NodePricingStrategy,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    7000000,
+				Kind:     ResourceCostNode,
+				Node:     testStrategyNodeMIG,
+				Strategy: StrategyNameNode,
+			},
+		},
+	},
+	{
+		name:              "GPUPricingStrategy Pod with no GPU on node without GPUs contains no entries",
+		pods:              []*core_v1.Pod{testStrategyPodA},
+		nodes:             []*core_v1.Node{testStrategyNode},
+		table:             testStrategyCostTable,
+		duration:          time.Hour,
+		strategy:          GPUPricingStrategy,
+		expectedCostItems: []CostItem{},
+	},
+	{
+		name:     "GPUPricingStrategy for a pod on a node with GPU",
+		pods:     []*core_v1.Pod{testStrategyPodGPU},
+		nodes:    []*core_v1.Node{testStrategyNodeGPU},
+		table:    testStrategyCostTable,
+		duration: time.Hour,
+		strategy: GPUPricingStrategy,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    7000000,
+				Kind:     ResourceCostGPU,
+				Pod:      testStrategyPodGPU,
+				Node:     testStrategyNodeMultiGPU,
+				Strategy: StrategyNameGPU,
+			},
+		},
+	},
+	{
+		name:     "GPUPricingStrategy for a pod on a node with multi GPU",
+		pods:     []*core_v1.Pod{testStrategyPodGPU},
+		nodes:    []*core_v1.Node{testStrategyNodeMultiGPU},
+		table:    testStrategyCostTable,
+		duration: time.Hour,
+		strategy: GPUPricingStrategy,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    7000000,
+				Kind:     ResourceCostGPU,
+				Pod:      testStrategyPodGPU,
+				Node:     testStrategyNodeGPU,
+				Strategy: StrategyNameGPU,
+			},
+		},
+	},
+	{
+		name:     "WeightedPricingStrategy with a GPU pod.",
+		pods:     []*core_v1.Pod{testStrategyPodA, testStrategyPodGPU},
+		nodes:    []*core_v1.Node{testStrategyNodeGPU},
+		table:    testStrategyCostTable,
+		duration: time.Hour,
+		strategy: WeightedPricingStrategy,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    1000000,
+				Kind:     ResourceCostWeighted,
+				Pod:      testStrategyPodA,
+				Node:     testStrategyNodeGPU,
+				Strategy: StrategyNameWeighted,
+			},
+			CostItem{
+				Value:    7000000,
+				Kind:     ResourceCostWeighted,
+				Pod:      testStrategyPodGPU,
+				Node:     testStrategyNodeGPU,
+				Strategy: StrategyNameWeighted,
+			},
+		},
+	},
+	{
+		name:     "WeightedPricingStrategy with a multi GPU pod.",
+		pods:     []*core_v1.Pod{testStrategyPodTwoGPU},
+		nodes:    []*core_v1.Node{testStrategyNodeMultiGPU},
+		table:    testStrategyCostTable,
+		duration: time.Hour,
+		strategy: WeightedPricingStrategy,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    14000000,
+				Kind:     ResourceCostWeighted,
+				Pod:      testStrategyPodTwoGPU,
+				Node:     testStrategyNodeMultiGPU,
+				Strategy: StrategyNameWeighted,
+			},
+		},
+	},
+	{
+		name:     "NodePricingStrategy with a GPU node.",
+		pods:     []*core_v1.Pod{},
+		nodes:    []*core_v1.Node{testStrategyNodeGPU},
+		table:    testStrategyCostTable,
+		duration: time.Hour,
+		strategy: NodePricingStrategy,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    1000000 + 7000000,
+				Kind:     ResourceCostNode,
+				Node:     testStrategyNodeGPU,
+				Strategy: StrategyNameNode,
+			},
+		},
+	},
+	{
+		name:     "NodePricingStrategy with a multi GPU node.",
+		pods:     []*core_v1.Pod{},
+		nodes:    []*core_v1.Node{testStrategyNodeMultiGPU},
+		table:    testStrategyCostTable,
+		duration: time.Hour,
+		strategy: NodePricingStrategy,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    1000000 + 14000000,
+				Kind:     ResourceCostNode,
+				Node:     testStrategyNodeGPU,
+				Strategy: StrategyNameNode,
+			},
+		},
+	},
+}
+
+func TestGPUStrategyCalculations(t *testing.T) {
+	for _, tt := range testGPUStrategyCases {
+		t.Run(tt.name, func(t *testing.T) {
+			ci := tt.strategy.Calculate(tt.table, tt.duration, tt.pods, tt.nodes)
+			if diff := deep.Equal(ci, tt.expectedCostItems); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+// testAcceleratorNode returns a gpu node with the provided name and gke
+// accelerator label.
+func testAcceleratorNode(name, accelerator string) *core_v1.Node {
+	return &core_v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"cloud.google.com/gke-accelerator": accelerator},
+		},
+		Status: core_v1.NodeStatus{
+			Capacity: core_v1.ResourceList{"nvidia.com/gpu": resource.MustParse("1")},
+		},
+	}
+}
+
+// testAcceleratorPod returns a pod requesting a single gpu on the named node.
+func testAcceleratorPod(node string) *core_v1.Pod {
+	return &core_v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: node},
+		Spec: core_v1.PodSpec{
+			NodeName: node,
+			Containers: []core_v1.Container{
+				core_v1.Container{
+					Resources: core_v1.ResourceRequirements{
+						Requests: core_v1.ResourceList{"nvidia.com/gpu": resource.MustParse("1")},
+					},
+				},
+			},
+		},
+	}
+}
+
+var (
+	testTableEntryT4 = &CostTableEntry{
+		Labels:                  Labels{"cloud.google.com/gke-accelerator": "nvidia-tesla-t4"},
+		HourlyGPUCostMicroCents: 35000000,
+	}
+	testTableEntryA100 = &CostTableEntry{
+		Labels:                  Labels{"cloud.google.com/gke-accelerator": "nvidia-tesla-a100"},
+		HourlyGPUCostMicroCents: 293000000,
+	}
+	testTableEntryAnyGPU = &CostTableEntry{
+		HourlyGPUCostMicroCents: 100000000,
+	}
+)
+
+var testGPUAcceleratorCases = []struct {
+	name  string
+	table CostTable
+}{
+	{
+		name:  "first match with specific entries first",
+		table: CostTable{Entries: []*CostTableEntry{testTableEntryT4, testTableEntryA100, testTableEntryAnyGPU}},
+	},
+	{
+		name: "most specific match",
+		table: CostTable{
+			MatchMode: MatchModeMostSpecific,
+			Entries:   []*CostTableEntry{testTableEntryAnyGPU, testTableEntryA100, testTableEntryT4},
+		},
+	},
+}
+
+func TestGPUStrategyAcceleratorPricing(t *testing.T) {
+	nodes := []*core_v1.Node{
+		testAcceleratorNode("t4", "nvidia-tesla-t4"),
+		testAcceleratorNode("a100", "nvidia-tesla-a100"),
+		testAcceleratorNode("l4", "nvidia-l4"),
+	}
+	pods := []*core_v1.Pod{testAcceleratorPod("t4"), testAcceleratorPod("a100"), testAcceleratorPod("l4")}
+
+	for _, tt := range testGPUAcceleratorCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.table.Compile(); err != nil {
+				t.Fatalf("unexpected error compiling table: %v", err)
+			}
+
+			cis := GPUPricingStrategy.Calculate(tt.table, time.Hour, pods, nodes)
+			costs := map[string]int64{}
+			for _, ci := range cis {
+				costs[ci.Node.ObjectMeta.Name] = ci.Value
+			}
+
+			expected := map[string]int64{"t4": 35000000, "a100": 293000000, "l4": 100000000}
+			if diff := deep.Equal(costs, expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+var testStrategyHugeNode = &core_v1.Node{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:   strategyTestNodeName,
+		Labels: strategyTestNodeLabels,
+	},
+	Status: core_v1.NodeStatus{
+		Capacity: core_v1.ResourceList{
+			"cpu":    resource.MustParse("64"),
+			"memory": resource.MustParse("256Gi"),
+		},
+	},
+}
+
+var testStrategyTinyPod = &core_v1.Pod{
+	ObjectMeta: metav1.ObjectMeta{Name: "tiny"},
+	Spec: core_v1.PodSpec{
+		NodeName: strategyTestNodeName,
+		Containers: []core_v1.Container{
+			core_v1.Container{
+				Resources: core_v1.ResourceRequirements{
+					Requests: core_v1.ResourceList{
+						"cpu":    resource.MustParse("100m"),
+						"memory": resource.MustParse("128Mi"),
+					},
+				},
+			},
+		},
+	},
+}
+
+func TestWeightedStrategyMaxScale(t *testing.T) {
+	pods := []*core_v1.Pod{testStrategyTinyPod}
+	nodes := []*core_v1.Node{testStrategyHugeNode}
+
+	nci := NodePricingStrategy.Calculate(testStrategyCostTable, time.Hour, pods, nodes)
+	if len(nci) != 1 {
+		t.Fatalf("expected a single node cost item, got %d", len(nci))
+	}
+
+	uncapped := WeightedPricingStrategy.Calculate(testStrategyCostTable, time.Hour, pods, nodes)
+	if len(uncapped) != 1 {
+		t.Fatalf("expected a single weighted cost item, got %d", len(uncapped))
+	}
+	if uncapped[0].Value > nci[0].Value {
+		t.Fatalf("lone pod billed %d, more than the whole node cost of %d", uncapped[0].Value, nci[0].Value)
+	}
+
+	capped := testStrategyCostTable
+	capped.MaxScale = 2
+	ci := WeightedPricingStrategy.Calculate(capped, time.Hour, pods, nodes)
+	if len(ci) != 1 {
+		t.Fatalf("expected a single weighted cost item, got %d", len(ci))
+	}
+
+	// 100 millicpu and 128Mi scaled by 2 at 1000µ¢ per millicpu and 1µ¢ per byte.
+	expected := int64(2*100*1000 + 2*134217728)
+	if ci[0].Value != expected {
+		t.Fatalf("expected capped cost of %d, got %d", expected, ci[0].Value)
+	}
+}
+
+var (
+	testStrategyPodCPUHeavy = &core_v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "cpu-heavy"},
+		Spec: core_v1.PodSpec{
+			NodeName: strategyTestNodeName,
+			Containers: []core_v1.Container{
+				core_v1.Container{
+					Resources: core_v1.ResourceRequirements{
+						Requests: core_v1.ResourceList{
+							"cpu":    resource.MustParse("750m"),
+							"memory": resource.MustParse("256Mi"),
+						},
+					},
+				},
+			},
+		},
+	}
+	testStrategyPodMemoryHeavy = &core_v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "memory-heavy"},
+		Spec: core_v1.PodSpec{
+			NodeName: strategyTestNodeName,
+			Containers: []core_v1.Container{
+				core_v1.Container{
+					Resources: core_v1.ResourceRequirements{
+						Requests: core_v1.ResourceList{
+							"cpu":    resource.MustParse("250m"),
+							"memory": resource.MustParse("768Mi"),
+						},
+					},
+				},
+			},
+		},
+	}
+)
+
+func TestWeightedStrategyWeights(t *testing.T) {
+	pods := []*core_v1.Pod{testStrategyPodCPUHeavy, testStrategyPodMemoryHeavy}
+	nodes := []*core_v1.Node{testStrategyNode}
+
+	calculate := func(cpuWeight, memoryWeight float64) (int64, int64) {
+		cs := NewClusterState(pods, nodes)
+		cs.CPUWeight = cpuWeight
+		cs.MemoryWeight = memoryWeight
+		cis := WeightedPricingStrategy.CalculateClusterState(testStrategyCostTable, time.Hour, cs)
+		if len(cis) != 2 {
+			t.Fatalf("expected two weighted cost items, got %d", len(cis))
+		}
+		return cis[0].Value, cis[1].Value
+	}
+
+	cpuHeavy, memoryHeavy := calculate(0, 0)
+	// 750 and 250 millicpu at 1000µ¢ plus 256Mi and 768Mi at 1µ¢ per byte.
+	if cpuHeavy != 750000+268435456 || memoryHeavy != 250000+805306368 {
+		t.Fatalf("expected unweighted costs to be unchanged, got %d and %d", cpuHeavy, memoryHeavy)
+	}
+
+	if a, b := calculate(2, 2); a != cpuHeavy || b != memoryHeavy {
+		t.Errorf("expected equal weights to match the unweighted costs, got %d and %d", a, b)
+	}
+
+	weightedCPUHeavy, weightedMemoryHeavy := calculate(100, 1)
+	if weightedCPUHeavy <= cpuHeavy {
+		t.Errorf("expected cpu weighting to raise the cpu heavy pod's cost above %d, got %d", cpuHeavy, weightedCPUHeavy)
+	}
+	if weightedMemoryHeavy >= memoryHeavy {
+		t.Errorf("expected cpu weighting to lower the memory heavy pod's cost below %d, got %d", memoryHeavy, weightedMemoryHeavy)
+	}
+
+	// Rounding may lose at most a microcent per pod.
+	total, weightedTotal := cpuHeavy+memoryHeavy, weightedCPUHeavy+weightedMemoryHeavy
+	if diff := total - weightedTotal; diff < 0 || diff > 2 {
+		t.Errorf("expected weights to preserve the total cost of %d, got %d", total, weightedTotal)
+	}
+}
+
+var testStrategyPodOvercommit = &core_v1.Pod{
+	ObjectMeta: metav1.ObjectMeta{Name: "overcommit"},
+	Spec: core_v1.PodSpec{
+		NodeName: strategyTestNodeName,
+		Containers: []core_v1.Container{
+			core_v1.Container{
+				Resources: core_v1.ResourceRequirements{
+					Requests: core_v1.ResourceList{
+						"cpu":    resource.MustParse("500m"),
+						"memory": resource.MustParse("512Mi"),
+					},
+				},
+			},
+		},
+	},
+}
+
+func TestWeightedStrategyOvercommit(t *testing.T) {
+	nodes := []*core_v1.Node{testStrategyNode}
+	nodecost := int64(1000000 + 1073741824)
+
+	overcommitted := CostTable{Entries: []*CostTableEntry{
+		&CostTableEntry{
+			Labels:                         strategyTestNodeLabels,
+			HourlyMilliCPUCostMicroCents:   1000,
+			HourlyMemoryByteCostMicroCents: 1,
+			OvercommitFactor:               1.5,
+		},
+	}}
+
+	sum := func(table CostTable, pods []*core_v1.Pod) (int64, []CostItem) {
+		cis := WeightedPricingStrategy.Calculate(table, time.Hour, pods, nodes)
+		if len(cis) != len(pods) {
+			t.Fatalf("expected %d weighted cost items, got %d", len(pods), len(cis))
+		}
+		total := int64(0)
+		for _, ci := range cis {
+			total += ci.Value
+		}
+		return total, cis
+	}
+
+	// Requests summing to 150% of the node's 1 cpu and 1Gi.
+	pods := []*core_v1.Pod{testStrategyPodCPUHeavy, testStrategyPodMemoryHeavy, testStrategyPodOvercommit}
+
+	// Rounding may lose at most a microcent per cost component per pod.
+	total, cis := sum(overcommitted, pods)
+	if diff := nodecost - total; diff < 0 || diff > 6 {
+		t.Fatalf("expected overcommitted pods to be attributed the node cost of %d, got %d", nodecost, total)
+	}
+
+	// 500 millicpu and 512Mi at the overcommitted 1000/1.5µ¢ per millicpu and
+	// 1/1.5µ¢ per byte.
+	expected := int64(500000+536870912) * 2 / 3
+	if diff := expected - cis[2].Value; diff < 0 || diff > 2 {
+		t.Errorf("expected the overcommit pod to cost %d, got %d", expected, cis[2].Value)
+	}
+
+	uncapped, _ := sum(testStrategyCostTable, pods)
+	if diff := nodecost - uncapped; diff < 0 || diff > 6 {
+		t.Errorf("expected pods without an overcommit factor to be attributed the node cost of %d, got %d", nodecost, uncapped)
+	}
+
+	// Requests summing to the node's capacity fill two thirds of an
+	// overcommitted node, so a MaxScale of 1 bills them for only their
+	// requests at the overcommitted price.
+	capped := overcommitted
+	capped.MaxScale = 1
+	total, _ = sum(capped, []*core_v1.Pod{testStrategyPodCPUHeavy, testStrategyPodMemoryHeavy})
+	expected = int64(float64(nodecost) / 1.5)
+	if diff := expected - total; diff < -4 || diff > 4 {
+		t.Errorf("expected capped overcommitted pods to be attributed %d, got %d", expected, total)
+	}
+}
+
+func TestUnallocatedStrategyWeights(t *testing.T) {
+	cs := NewClusterState([]*core_v1.Pod{testStrategyPodCPUHeavy, testStrategyPodMemoryHeavy}, []*core_v1.Node{testStrategyNode})
+	cs.CPUWeight = 100
+	cis := UnallocatedPricingStrategy.CalculateClusterState(testStrategyCostTable, time.Hour, cs)
+	if len(cis) != 1 {
+		t.Fatalf("expected a single unallocated cost item, got %d", len(cis))
+	}
+	if cis[0].Value > 2 {
+		t.Errorf("expected a fully allocated node to have no unallocated cost, got %d", cis[0].Value)
+	}
+}
+
+// buildSyntheticCluster returns nodeCount nodes priced by the
+// testStrategyCostTable, each running podsPerNode pods.
+func buildSyntheticCluster(nodeCount, podsPerNode int) ([]*core_v1.Pod, []*core_v1.Node) {
+	pods := make([]*core_v1.Pod, 0, nodeCount*podsPerNode)
+	nodes := make([]*core_v1.Node, 0, nodeCount)
+	for i := 0; i < nodeCount; i++ {
+		n := &core_v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   fmt.Sprintf("node-%d", i),
+				Labels: strategyTestNodeLabels,
+			},
+			Status: core_v1.NodeStatus{
+				Capacity: core_v1.ResourceList{
+					"cpu":    resource.MustParse("4000m"),
+					"memory": resource.MustParse("16Gi"),
+				},
+			},
+		}
+		nodes = append(nodes, n)
+
+		for j := 0; j < podsPerNode; j++ {
+			p := testStrategyPodA.DeepCopy()
+			p.ObjectMeta.Name = fmt.Sprintf("pod-%d-%d", i, j)
+			p.Spec.NodeName = n.ObjectMeta.Name
+			pods = append(pods, p)
+		}
+	}
+	return pods, nodes
+}
+
+// BenchmarkStrategiesLargeCluster compares rebuilding lookups in every
+// strategy against sharing a single ClusterState, as calculate() does.
+func BenchmarkStrategiesLargeCluster(b *testing.B) {
+	pods, nodes := buildSyntheticCluster(5000, 10)
+	strategies := []PricingStrategy{}
+	for _, n := range defaultStrategyNames {
+		strategies = append(strategies, strategiesByName[n])
+	}
+
+	b.Run("unshared", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, s := range strategies {
+				s.Calculate(testStrategyCostTable, time.Hour, pods, nodes)
+			}
+		}
+	})
+
+	b.Run("shared", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			cs := NewClusterState(pods, nodes)
+			for _, s := range strategies {
+				calculateStrategy(s, testStrategyCostTable, time.Hour, cs)
+			}
+		}
+	})
+}
+
+func TestCalculateStrategyAdaptsPricingStrategyFunc(t *testing.T) {
+	pods := []*core_v1.Pod{testStrategyPodA}
+	nodes := []*core_v1.Node{testStrategyNode}
+	f := PricingStrategyFunc(func(table CostTable, duration time.Duration, p []*core_v1.Pod, n []*core_v1.Node) []CostItem {
+		return CPUPricingStrategy.Calculate(table, duration, p, n)
+	})
+
+	expected := CPUPricingStrategy.Calculate(testStrategyCostTable, time.Hour, pods, nodes)
+	ci := calculateStrategy(f, testStrategyCostTable, time.Hour, NewClusterState(pods, nodes))
+	if diff := deep.Equal(ci, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+var testStrategyStorageClass = "standard"
+
+var testStrategyStorageCostTable = CostTable{
+	Entries: []*CostTableEntry{
+		&CostTableEntry{
+			Labels:                          Labels{LabelStorageClass: testStrategyStorageClass},
+			HourlyStorageByteCostMicroCents: 0.001,
+		},
+	},
+}
+
+var testStrategyClaim = &core_v1.PersistentVolumeClaim{
+	ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Name:      "data",
+	},
+	Spec: core_v1.PersistentVolumeClaimSpec{
+		StorageClassName: &testStrategyStorageClass,
+	},
+	Status: core_v1.PersistentVolumeClaimStatus{
+		Phase: core_v1.ClaimBound,
+		Capacity: core_v1.ResourceList{
+			"storage": resource.MustParse("100Gi"),
+		},
+	},
+}
+
+func testStrategyPodWithClaim(name, claim string) *core_v1.Pod {
+	return &core_v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+		},
+		Spec: core_v1.PodSpec{
+			NodeName: strategyTestNodeName,
+			Volumes: []core_v1.Volume{
+				core_v1.Volume{
+					Name: "data",
+					VolumeSource: core_v1.VolumeSource{
+						PersistentVolumeClaim: &core_v1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+					},
+				},
+			},
+		},
+	}
+}
+
+var (
+	testStrategyPodClaimA = testStrategyPodWithClaim("a", "data")
+	testStrategyPodClaimB = testStrategyPodWithClaim("b", "data")
+)
+
+var testStorageStrategyCases = []struct {
+	name              string
+	pods              []*core_v1.Pod
+	claims            []*core_v1.PersistentVolumeClaim
+	expectedCostItems []CostItem
+}{
+	{
+		name:   "StoragePricingStrategy prices a pod mounting a 100Gi claim",
+		pods:   []*core_v1.Pod{testStrategyPodClaimA},
+		claims: []*core_v1.PersistentVolumeClaim{testStrategyClaim},
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    107374182, // 100 gibibytes
+				Kind:     ResourceCostStorage,
+				Pod:      testStrategyPodClaimA,
+				Node:     testStrategyNode,
+				Strategy: StrategyNameStorage,
+			},
+		},
+	},
+	{
+		name:   "StoragePricingStrategy splits a shared claim between pods",
+		pods:   []*core_v1.Pod{testStrategyPodClaimA, testStrategyPodClaimB},
+		claims: []*core_v1.PersistentVolumeClaim{testStrategyClaim},
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    53687091,
+				Kind:     ResourceCostStorage,
+				Pod:      testStrategyPodClaimA,
+				Node:     testStrategyNode,
+				Strategy: StrategyNameStorage,
+			},
+			CostItem{
+				Value:    53687091,
+				Kind:     ResourceCostStorage,
+				Pod:      testStrategyPodClaimB,
+				Node:     testStrategyNode,
+				Strategy: StrategyNameStorage,
+			},
+		},
+	},
+	{
+		name:              "StoragePricingStrategy ignores pods mounting unknown claims",
+		pods:              []*core_v1.Pod{testStrategyPodWithClaim("c", "missing")},
+		claims:            []*core_v1.PersistentVolumeClaim{testStrategyClaim},
+		expectedCostItems: []CostItem{},
+	},
+	{
+		name:              "StoragePricingStrategy ignores pods without claims",
+		pods:              []*core_v1.Pod{testStrategyPodA},
+		claims:            []*core_v1.PersistentVolumeClaim{testStrategyClaim},
+		expectedCostItems: []CostItem{},
+	},
+}
+
+func TestStorageStrategyCalculations(t *testing.T) {
+	for _, tt := range testStorageStrategyCases {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := NewClusterState(tt.pods, []*core_v1.Node{testStrategyNode})
+			cs.Claims = tt.claims
+			ci := StoragePricingStrategy.CalculateClusterState(testStrategyStorageCostTable, time.Hour, cs)
+			if diff := deep.Equal(ci, tt.expectedCostItems); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestStorageStrategyIgnoresCatchAllEntries(t *testing.T) {
+	table := CostTable{
+		Entries: append(
+			[]*CostTableEntry{&CostTableEntry{Name: "fallback", HourlyMilliCPUCostMicroCents: 1}},
+			testStrategyStorageCostTable.Entries...,
+		),
+	}
+	cs := NewClusterState([]*core_v1.Pod{testStrategyPodClaimA}, []*core_v1.Node{testStrategyNode})
+	cs.Claims = []*core_v1.PersistentVolumeClaim{testStrategyClaim}
+
+	ci := StoragePricingStrategy.CalculateClusterState(table, time.Hour, cs)
+	if len(ci) != 1 || ci[0].Value != 107374182 {
+		t.Fatalf("expected the claim to be priced by the storage entry, got %+v", ci)
+	}
+}
+
+var testStrategyLoadBalancerCostTable = CostTable{
+	Entries: []*CostTableEntry{
+		&CostTableEntry{
+			Labels:                           Labels{LabelServiceType: string(core_v1.ServiceTypeLoadBalancer)},
+			HourlyLoadBalancerCostMicroCents: 2500000,
+		},
+	},
+}
+
+func testStrategyService(name string, t core_v1.ServiceType) *core_v1.Service {
+	return &core_v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+		},
+		Spec: core_v1.ServiceSpec{Type: t},
+	}
+}
+
+var (
+	testStrategyServiceClusterIP = testStrategyService("internal", core_v1.ServiceTypeClusterIP)
+	testStrategyServiceNodePort  = testStrategyService("nodeport", core_v1.ServiceTypeNodePort)
+	testStrategyServiceLBA       = testStrategyService("frontend", core_v1.ServiceTypeLoadBalancer)
+	testStrategyServiceLBB       = testStrategyService("ingress", core_v1.ServiceTypeLoadBalancer)
+)
+
+var testLoadBalancerStrategyCases = []struct {
+	name              string
+	services          []*core_v1.Service
+	duration          time.Duration
+	expectedCostItems []CostItem
+}{
+	{
+		name:     "LoadBalancerPricingStrategy charges only services of type LoadBalancer",
+		services: []*core_v1.Service{testStrategyServiceClusterIP, testStrategyServiceLBA, testStrategyServiceNodePort, testStrategyServiceLBB},
+		duration: time.Hour,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    2500000,
+				Kind:     ResourceCostLoadBalancer,
+				Service:  testStrategyServiceLBA,
+				Strategy: StrategyNameLoadBalancer,
+			},
+			CostItem{
+				Value:    2500000,
+				Kind:     ResourceCostLoadBalancer,
+				Service:  testStrategyServiceLBB,
+				Strategy: StrategyNameLoadBalancer,
+			},
+		},
+	},
+	{
+		name:     "LoadBalancerPricingStrategy charges for the duration priced",
+		services: []*core_v1.Service{testStrategyServiceLBA},
+		duration: time.Minute * 30,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    1250000,
+				Kind:     ResourceCostLoadBalancer,
+				Service:  testStrategyServiceLBA,
+				Strategy: StrategyNameLoadBalancer,
+			},
+		},
+	},
+	{
+		name:              "LoadBalancerPricingStrategy ignores clusters without load balancers",
+		services:          []*core_v1.Service{testStrategyServiceClusterIP, testStrategyServiceNodePort},
+		duration:          time.Hour,
+		expectedCostItems: []CostItem{},
+	},
+}
+
+func TestLoadBalancerStrategyCalculations(t *testing.T) {
+	for _, tt := range testLoadBalancerStrategyCases {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := NewClusterState(nil, []*core_v1.Node{testStrategyNode})
+			cs.Services = tt.services
+			ci := LoadBalancerPricingStrategy.CalculateClusterState(testStrategyLoadBalancerCostTable, tt.duration, cs)
+			if diff := deep.Equal(ci, tt.expectedCostItems); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestLoadBalancerStrategyWithoutEntry(t *testing.T) {
+	cs := NewClusterState(nil, nil)
+	cs.Services = []*core_v1.Service{testStrategyServiceLBA}
+	ci := LoadBalancerPricingStrategy.CalculateClusterState(testStrategyStorageCostTable, time.Hour, cs)
+	if len(ci) != 0 {
+		t.Fatalf("expected no cost items without a load balancer entry, got %+v", ci)
+	}
+}
+
+var testStrategyPodUsage = &core_v1.Pod{
+	ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "usage"},
+	Spec: core_v1.PodSpec{
+		NodeName: strategyTestNodeName,
+		Containers: []core_v1.Container{
+			core_v1.Container{
+				Resources: core_v1.ResourceRequirements{
+					Requests: core_v1.ResourceList{
+						"cpu":    resource.MustParse("500m"),
+						"memory": resource.MustParse("32Mi"),
+					},
+				},
+			},
+		},
+	},
+}
+
+var testStrategyPodUsageMetrics = &metricsv1beta1.PodMetrics{
+	ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "usage"},
+	Containers: []metricsv1beta1.ContainerMetrics{
+		metricsv1beta1.ContainerMetrics{
+			Name: "main",
+			Usage: core_v1.ResourceList{
+				"cpu":    resource.MustParse("60m"),
+				"memory": resource.MustParse("8Mi"),
+			},
+		},
+		metricsv1beta1.ContainerMetrics{
+			Name: "sidecar",
+			Usage: core_v1.ResourceList{
+				"cpu":    resource.MustParse("40m"),
+				"memory": resource.MustParse("8Mi"),
+			},
+		},
+	},
+}
+
+var testUsageStrategyCases = []struct {
+	name              string
+	pods              []*core_v1.Pod
+	usage             []*metricsv1beta1.PodMetrics
+	expectedCostItems []CostItem
+}{
+	{
+		name:  "UsagePricingStrategy prices a pod by its usage rather than its requests",
+		pods:  []*core_v1.Pod{testStrategyPodUsage},
+		usage: []*metricsv1beta1.PodMetrics{testStrategyPodUsageMetrics},
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    100000 + 16777216, // 100 millicores and 16 mebibytes
+				Kind:     ResourceCostUsage,
+				Pod:      testStrategyPodUsage,
+				Node:     testStrategyNode,
+				Strategy: StrategyNameUsage,
+			},
+		},
+	},
+	{
+		name:              "UsagePricingStrategy ignores pods without metrics",
+		pods:              []*core_v1.Pod{testStrategyPodUsage, testStrategyPodA},
+		usage:             []*metricsv1beta1.PodMetrics{},
+		expectedCostItems: []CostItem{},
+	},
+	{
+		name:              "UsagePricingStrategy prices nothing when metrics are unavailable",
+		pods:              []*core_v1.Pod{testStrategyPodUsage},
+		usage:             nil,
+		expectedCostItems: []CostItem{},
+	},
+}
+
+func TestUsageStrategyCalculations(t *testing.T) {
+	for _, tt := range testUsageStrategyCases {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := NewClusterState(tt.pods, []*core_v1.Node{testStrategyNode})
+			cs.Usage = tt.usage
+			ci := UsagePricingStrategy.CalculateClusterState(testStrategyCostTable, time.Hour, cs)
+			if diff := deep.Equal(ci, tt.expectedCostItems); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+// testStrategyPoolNode returns a node in the named pool, labelled with both
+// the default node pool label and a custom one.
+func testStrategyPoolNode(name, pool string, cpu string) *core_v1.Node {
+	return &core_v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"test":               "strategy",
+				DefaultNodePoolLabel: pool,
+				"example.com/pool":   "custom-" + pool,
+			},
+		},
+		Status: core_v1.NodeStatus{
+			Capacity: core_v1.ResourceList{
+				"cpu":    resource.MustParse(cpu),
+				"memory": resource.MustParse("1Gi"),
+			},
+		},
+	}
+}
+
+var testNodePoolStrategyNodes = []*core_v1.Node{
+	testStrategyPoolNode("default-a", "default", "1"),
+	testStrategyPoolNode("highcpu-a", "highcpu", "4"),
+	testStrategyPoolNode("default-b", "default", "2"),
+	testStrategyPoolNode("highcpu-b", "highcpu", "4"),
+	testStrategyPoolNode("default-c", "default", "1"),
+}
+
+var testNodePoolStrategyCases = []struct {
+	name              string
+	label             string
+	nodes             []*core_v1.Node
+	expectedCostItems []CostItem
+}{
+	{
+		name:  "NodePoolPricingStrategy sums the cost of the nodes in each pool.",
+		nodes: testNodePoolStrategyNodes,
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    4000000 + 3*1073741824, // 4 cpus and 3 gibibytes
+				Kind:     ResourceCostNodePool,
+				NodePool: "default",
+				Strategy: StrategyNameNodePool,
+			},
+			CostItem{
+				Value:    8000000 + 2*1073741824, // 8 cpus and 2 gibibytes
+				Kind:     ResourceCostNodePool,
+				NodePool: "highcpu",
+				Strategy: StrategyNameNodePool,
+			},
+		},
+	},
+	{
+		name:  "NodePoolPricingStrategy groups nodes by a configured label.",
+		label: "example.com/pool",
+		nodes: testNodePoolStrategyNodes[:2],
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    1000000 + 1073741824,
+				Kind:     ResourceCostNodePool,
+				NodePool: "custom-default",
+				Strategy: StrategyNameNodePool,
+			},
+			CostItem{
+				Value:    4000000 + 1073741824,
+				Kind:     ResourceCostNodePool,
+				NodePool: "custom-highcpu",
+				Strategy: StrategyNameNodePool,
+			},
+		},
+	},
+	{
+		name:  "NodePoolPricingStrategy groups nodes without the label into an unnamed pool.",
+		nodes: []*core_v1.Node{testStrategyNode},
+		expectedCostItems: []CostItem{
+			CostItem{
+				Value:    1000000 + 1073741824,
+				Kind:     ResourceCostNodePool,
+				Strategy: StrategyNameNodePool,
+			},
+		},
+	},
+}
+
+func TestNodePoolStrategyCalculations(t *testing.T) {
+	for _, tt := range testNodePoolStrategyCases {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := NewClusterState([]*core_v1.Pod{testStrategyPodA}, tt.nodes)
+			cs.NodePoolLabel = tt.label
+			ci := NodePoolPricingStrategy.CalculateClusterState(testStrategyCostTable, time.Hour, cs)
+			if diff := deep.Equal(ci, tt.expectedCostItems); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+var testStrategyNodeZeroGPU = &core_v1.Node{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:   strategyTestNodeName,
+		Labels: strategyTestNodeLabels,
+	},
+	Status: core_v1.NodeStatus{
+		Capacity: core_v1.ResourceList{
+			"cpu":            resource.MustParse("1"),
+			"nvidia.com/gpu": resource.MustParse("0"),
+		},
+	},
+}
+
+var testStrategyFreeGPUCostTable = CostTable{
+	Entries: []*CostTableEntry{
+		&CostTableEntry{
+			Labels:                       strategyTestNodeLabels,
+			HourlyMilliCPUCostMicroCents: 1000,
+		},
+	},
+}
+
+var nodeGPUCostCases = []struct {
+	name            string
+	node            *core_v1.Node
+	table           CostTable
+	expectedGPUCost int64
+	expectedGPU     bool
+	expectedValue   int64
+}{
+	{
+		name:          "node without gpus excludes any gpu cost",
+		node:          testStrategyNode,
+		table:         testStrategyCostTable,
+		expectedValue: 1000000 + 1073741824, // 1 cpu and 1 gibibyte
+	},
+	{
+		name:          "node advertising no gpu units excludes any gpu cost",
+		node:          testStrategyNodeZeroGPU,
+		table:         testStrategyCostTable,
+		expectedValue: 1000000,
+	},
+	{
+		name:            "node with a gpu includes its cost",
+		node:            testStrategyNodeGPU,
+		table:           testStrategyCostTable,
+		expectedGPUCost: 7000000,
+		expectedGPU:     true,
+		expectedValue:   1000000 + 7000000,
+	},
+	{
+		name:          "node with a gpu priced at zero",
+		node:          testStrategyNodeGPU,
+		table:         testStrategyFreeGPUCostTable,
+		expectedGPU:   true,
+		expectedValue: 1000000,
+	},
+}
+
+func TestNodeGPUCost(t *testing.T) {
+	for _, tt := range nodeGPUCostCases {
+		t.Run(tt.name, func(t *testing.T) {
+			te, err := tt.table.FindByNode(tt.node)
+			if err != nil {
+				t.Fatalf("could not find pricing entry: %v", err)
+			}
+
+			cost, ok := nodeGPUCost(te, tt.node, time.Hour)
+			if cost != tt.expectedGPUCost || ok != tt.expectedGPU {
+				t.Fatalf("expected gpu cost %d (present %v), got %d (present %v)", tt.expectedGPUCost, tt.expectedGPU, cost, ok)
+			}
+
+			cis := NodePricingStrategy.Calculate(tt.table, time.Hour, nil, []*core_v1.Node{tt.node})
+			if len(cis) != 1 || cis[0].Value != tt.expectedValue {
+				t.Fatalf("expected a node cost of %d, got %#v", tt.expectedValue, cis)
+			}
+		})
+	}
+}
+
+func TestLoadBalancerStrategyIgnoresCatchAllEntries(t *testing.T) {
+	table := CostTable{
+		Entries: append(
+			[]*CostTableEntry{&CostTableEntry{Name: "fallback", HourlyMilliCPUCostMicroCents: 1}},
+			testStrategyLoadBalancerCostTable.Entries...,
+		),
+	}
+	cs := NewClusterState(nil, []*core_v1.Node{testStrategyNode})
+	cs.Services = []*core_v1.Service{testStrategyServiceLBA}
+
+	ci := LoadBalancerPricingStrategy.CalculateClusterState(table, time.Hour, cs)
+	if len(ci) != 1 || ci[0].Value != 2500000 {
+		t.Fatalf("expected the service to be priced by the load balancer entry, got %+v", ci)
+	}
+}
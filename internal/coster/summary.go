@@ -0,0 +1,92 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"sort"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// cycleSummary summarizes the cost items of a calculation, so that cost
+// figures can be sanity checked without enabling per item debug logs.
+type cycleSummary struct {
+	StartTime       time.Time
+	EndTime         time.Time
+	Pods            int
+	Nodes           int
+	OrphanedPods    int
+	Items           int
+	ItemsByStrategy map[string]int
+	ValueByKind     map[ResourceCostKind]int64
+}
+
+// summarize returns a cycleSummary of the cost items of the most recent
+// calculation.
+func (c *coster) summarize(cis []CostItem) cycleSummary {
+	s := cycleSummary{
+		StartTime:       c.intervalStart,
+		EndTime:         c.intervalEnd,
+		Pods:            c.podCount,
+		Nodes:           c.nodeCount,
+		OrphanedPods:    c.orphanedPods,
+		Items:           len(cis),
+		ItemsByStrategy: map[string]int{},
+		ValueByKind:     map[ResourceCostKind]int64{},
+	}
+	for _, ci := range cis {
+		s.ItemsByStrategy[ci.Strategy]++
+		s.ValueByKind[ci.Kind] += ci.Value
+	}
+	return s
+}
+
+// MarshalLogObject exports cycleSummary fields for the zap logger. Strategies
+// and kinds are encoded in sorted order.
+func (s cycleSummary) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddTime("StartTime", s.StartTime)
+	enc.AddTime("EndTime", s.EndTime)
+	enc.AddInt("Pods", s.Pods)
+	enc.AddInt("Nodes", s.Nodes)
+	enc.AddInt("OrphanedPods", s.OrphanedPods)
+	enc.AddInt("Items", s.Items)
+
+	strategies := make([]string, 0, len(s.ItemsByStrategy))
+	for k := range s.ItemsByStrategy {
+		strategies = append(strategies, k)
+	}
+	sort.Strings(strategies)
+	if err := enc.AddObject("ItemsByStrategy", zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+		for _, k := range strategies {
+			enc.AddInt(k, s.ItemsByStrategy[k])
+		}
+		return nil
+	})); err != nil {
+		return err
+	}
+
+	kinds := make([]string, 0, len(s.ValueByKind))
+	for k := range s.ValueByKind {
+		kinds = append(kinds, string(k))
+	}
+	sort.Strings(kinds)
+	return enc.AddObject("ValueByKind", zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+		for _, k := range kinds {
+			enc.AddInt64(k, s.ValueByKind[ResourceCostKind(k)])
+		}
+		return nil
+	}))
+}
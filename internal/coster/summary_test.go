@@ -0,0 +1,89 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	core_v1 "k8s.io/api/core/v1"
+
+	"github.com/planetlabs/kostanza/internal/lister"
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+func TestCalculateAndEmitCycleSummary(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	defer func(l *zap.SugaredLogger) { log.Log = l }(log.Log)
+	log.Log = zap.New(core).Sugar()
+
+	tt := calculateCases[0]
+	orphan := testCalculationPod.DeepCopy()
+	orphan.Name = "orphan"
+	orphan.Spec.NodeName = "missing-node"
+
+	for _, enabled := range []bool{false, true} {
+		c := &coster{
+			interval:   time.Hour,
+			nodeLister: &lister.FakeNodeLister{Nodes: tt.nodes},
+			podLister:  &lister.FakePodLister{Pods: []*core_v1.Pod{testCalculationPod, orphan}},
+			config:     tt.config,
+			strategies: []PricingStrategy{CPUPricingStrategy, NodePricingStrategy},
+		}
+		if enabled {
+			WithCycleSummary()(c)
+		}
+
+		if err := c.CalculateAndEmit(); err != nil {
+			t.Fatalf("unexpected calculation error: %v", err)
+		}
+
+		summaries := logs.FilterMessage("calculated costs").TakeAll()
+		if !enabled {
+			if len(summaries) != 0 {
+				t.Fatalf("expected no summary unless enabled, got %d", len(summaries))
+			}
+			continue
+		}
+		if len(summaries) != 1 {
+			t.Fatalf("expected a single summary, got %d", len(summaries))
+		}
+
+		summary := summaries[0].ContextMap()["summary"].(map[string]interface{})
+		delete(summary, "StartTime")
+		delete(summary, "EndTime")
+		expected := map[string]interface{}{
+			"Pods":         2,
+			"Nodes":        1,
+			"OrphanedPods": 1,
+			"Items":        2,
+			"ItemsByStrategy": map[string]interface{}{
+				StrategyNameCPU:  1,
+				StrategyNameNode: 1,
+			},
+			"ValueByKind": map[string]interface{}{
+				string(ResourceCostCPU):  int64(1000000),
+				string(ResourceCostNode): int64(0),
+			},
+		}
+		if diff := deep.Equal(summary, expected); diff != nil {
+			t.Fatal(diff)
+		}
+	}
+}
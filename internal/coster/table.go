@@ -15,11 +15,58 @@
 package coster
 
 import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/big"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	core_v1 "k8s.io/api/core/v1"
+
+	"github.com/planetlabs/kostanza/internal/log"
 )
 
+const (
+	// LabelGlobPrefix marks a label value as a glob pattern, as understood by
+	// filepath.Match, e.g. "glob:n1-standard-*".
+	LabelGlobPrefix = "glob:"
+	// LabelRegexPrefix marks a label value as a regular expression which must
+	// match the entire label value, e.g. "regex:n1-(standard|highcpu)-.*".
+	LabelRegexPrefix = "regex:"
+
+	// LabelInstanceType is a canonical label holding a node's instance type,
+	// regardless of the cloud provider specific label it was derived from.
+	LabelInstanceType = "kostanza.io/instance-type"
+	// LabelRegion is a canonical label holding a node's region.
+	LabelRegion = "kostanza.io/region"
+	// LabelZone is a canonical label holding a node's zone.
+	LabelZone = "kostanza.io/zone"
+	// LabelStorageClass is the label persistent volume claims are priced by,
+	// holding the name of the claim's storage class.
+	LabelStorageClass = "kostanza.io/storage-class"
+	// LabelServiceType is the label services are priced by, holding the
+	// service's type, e.g. LoadBalancer.
+	LabelServiceType = "kostanza.io/service-type"
+)
+
+// canonicalLabelSources lists, for each canonical label, the well known labels
+// it may be derived from in order of preference. GA labels are preferred over
+// their deprecated beta equivalents.
+var canonicalLabelSources = []struct {
+	canonical string
+	sources   []string
+}{
+	{LabelInstanceType, []string{"node.kubernetes.io/instance-type", "beta.kubernetes.io/instance-type"}},
+	{LabelRegion, []string{"topology.kubernetes.io/region", "failure-domain.beta.kubernetes.io/region"}},
+	{LabelZone, []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}},
+}
+
 var (
 	// ErrNoCostEntry is returned when we cannot find a suitable CostEntry in a CostTable.
 	ErrNoCostEntry = errors.New("could not find an appropriate cost entry")
@@ -28,23 +75,181 @@ var (
 // Labels augments a slice ofa labels with matching functionality.
 type Labels map[string]string
 
-// Match checks if the provided label exists within the available labels.
+// Match checks if the provided label exists within the available labels. The
+// value may be a glob or regular expression pattern if prefixed with
+// LabelGlobPrefix or LabelRegexPrefix respectively.
 func (l Labels) Match(key, value string) bool {
-	for k, v := range l {
-		if k == key && v == value {
-			return true
+	if strings.HasPrefix(value, LabelRegexPrefix) {
+		re, err := compileLabelRegexp(value)
+		if err != nil {
+			return false
 		}
+		return l.matchRegexp(key, re)
+	}
+
+	v, ok := l[key]
+	if !ok {
+		return false
+	}
+
+	if strings.HasPrefix(value, LabelGlobPrefix) {
+		matched, err := filepath.Match(strings.TrimPrefix(value, LabelGlobPrefix), v)
+		return err == nil && matched
+	}
+
+	return v == value
+}
+
+// Canonical returns the labels augmented with the canonical LabelInstanceType,
+// LabelRegion and LabelZone labels, populated from whichever cloud provider
+// specific label is present. This allows a single cost table to match nodes
+// across clouds. Canonical labels that are already set are left untouched.
+// The receiver is never modified; it is returned as is if nothing is added.
+func (l Labels) Canonical() Labels {
+	var ret Labels
+	for _, cl := range canonicalLabelSources {
+		if _, ok := l[cl.canonical]; ok {
+			continue
+		}
+
+		for _, src := range cl.sources {
+			v, ok := l[src]
+			if !ok {
+				continue
+			}
+
+			if ret == nil {
+				ret = make(Labels, len(l)+len(canonicalLabelSources))
+				for k, v := range l {
+					ret[k] = v
+				}
+			}
+			ret[cl.canonical] = v
+			break
+		}
+	}
+
+	if ret == nil {
+		return l
+	}
+	return ret
+}
+
+func (l Labels) matchRegexp(key string, re *regexp.Regexp) bool {
+	v, ok := l[key]
+	return ok && re.MatchString(v)
+}
+
+// compileLabelRegexp compiles a LabelRegexPrefix prefixed label value,
+// anchoring it so that it must match the entire label value.
+func compileLabelRegexp(value string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + strings.TrimPrefix(value, LabelRegexPrefix) + ")$")
+}
+
+// Taint identifies a node taint that a CostTableEntry requires. An empty
+// Value or Effect matches any value or effect for the Key.
+type Taint struct {
+	Key    string
+	Value  string
+	Effect core_v1.TaintEffect
+}
+
+// Match returns true if the node taint provided satisfies the Taint.
+func (t Taint) Match(nt core_v1.Taint) bool {
+	if t.Key != nt.Key {
+		return false
+	}
+	if t.Value != "" && t.Value != nt.Value {
+		return false
+	}
+	return t.Effect == "" || t.Effect == nt.Effect
+}
+
+// Condition identifies a node condition that a CostTableEntry requires, e.g.
+// one reporting that a spot node is about to be reclaimed. An empty Status
+// matches conditions that are True.
+type Condition struct {
+	Type   core_v1.NodeConditionType
+	Status core_v1.ConditionStatus
+}
+
+// Match returns true if the node condition provided satisfies the Condition.
+func (c Condition) Match(nc core_v1.NodeCondition) bool {
+	if c.Type != nc.Type {
+		return false
 	}
-	return false
+	status := c.Status
+	if status == "" {
+		status = core_v1.ConditionTrue
+	}
+	return status == nc.Status
 }
 
-// CostTableEntry models the cost of a nodes resources. The labels are used to
-// identify nodes.
+// CostTableEntry models the cost of a nodes resources. The labels, and
+// optionally taints and conditions, are used to identify nodes.
 type CostTableEntry struct {
-	Labels                         Labels
-	HourlyMemoryByteCostMicroCents float64
-	HourlyMilliCPUCostMicroCents   float64
-	HourlyGPUCostMicroCents        float64
+	// Name identifies the entry in exported cost data, see ID.
+	Name   string
+	Labels Labels
+	// Taints must all be present on a node for the entry to match it, e.g.
+	// to identify spot nodes by kubernetes.azure.com/scalesetpriority=spot.
+	// Entries with taints only match via CostTable.FindByNode.
+	Taints                                   []Taint
+	HourlyMemoryByteCostMicroCents           float64
+	HourlyMilliCPUCostMicroCents             float64
+	HourlyGPUCostMicroCents                  float64
+	HourlyEphemeralStorageByteCostMicroCents float64
+	// HourlyStorageByteCostMicroCents prices the capacity of persistent volume
+	// claims. Only entries with a LabelStorageClass label price claims.
+	HourlyStorageByteCostMicroCents float64
+	// HourlyLoadBalancerCostMicroCents is the flat cost of the cloud load
+	// balancer provisioned for a service of type LoadBalancer. Only entries
+	// with a LabelServiceType label price load balancers.
+	HourlyLoadBalancerCostMicroCents float64
+	// HourlyGPUResourceCostMicroCents prices gpu resources by name, e.g.
+	// "nvidia.com/mig-1g.5gb", so that a MIG slice or shared gpu can cost a
+	// fraction of a full gpu. Resources absent from the map, including
+	// "nvidia.com/gpu" unless overridden, cost HourlyGPUCostMicroCents.
+	HourlyGPUResourceCostMicroCents map[string]float64
+	// Multiplier scales every cost derived from the entry, e.g. 0.3 for
+	// preemptible nodes priced at 30% of on-demand. Defaults to 1 when unset.
+	Multiplier float64
+	// OvercommitFactor is the ratio by which the cpu and memory of matching
+	// nodes are deliberately overcommitted, e.g. 1.5 for nodes whose pod
+	// requests may total 150% of capacity. The WeightedPricingStrategy
+	// normalizes requests against the overcommitted capacity, so that
+	// CostTable.MaxScale bounds scaling relative to it. The factor only
+	// changes costs on nodes where MaxScale caps scaling, as node costs are
+	// otherwise attributed in full either way. Must be at least 1, and
+	// defaults to 1 when unset.
+	OvercommitFactor float64
+	// Conditions must all be reported by a node for the entry to match it,
+	// e.g. to price spot nodes that are about to be reclaimed at a discount
+	// for the remaining interval. Entries with conditions only match via
+	// CostTable.FindByNode.
+	Conditions []Condition
+
+	// regexps caches compiled LabelRegexPrefix label values by label key.
+	regexps map[string]*regexp.Regexp
+}
+
+// Compile prepares any regular expression label values so that they need not
+// be compiled on every match, returning an error if any are invalid.
+func (e *CostTableEntry) Compile() error {
+	regexps := map[string]*regexp.Regexp{}
+	for k, v := range e.Labels {
+		if !strings.HasPrefix(v, LabelRegexPrefix) {
+			continue
+		}
+
+		re, err := compileLabelRegexp(v)
+		if err != nil {
+			return errors.Wrapf(err, "invalid regular expression for label %s", k)
+		}
+		regexps[k] = re
+	}
+	e.regexps = regexps
+	return nil
 }
 
 // Match returns true if all of the CostTableEntry's labels match some subeset
@@ -58,6 +263,9 @@ type CostTableEntry struct {
 // - failure-domain.beta.kubernetes.io/region: us-central1
 // - failure-domain.beta.kubernetes.io/zone: us-central1-b
 //
+// Entry label values may also be glob or regular expression patterns, see
+// LabelGlobPrefix and LabelRegexPrefix.
+//
 // Note: A special case of match against an empty list of labels will always match
 // a CostTableEntry with no Labels.
 func (e *CostTableEntry) Match(labels Labels) bool {
@@ -66,6 +274,13 @@ func (e *CostTableEntry) Match(labels Labels) bool {
 	}
 
 	for k, v := range e.Labels {
+		if re, ok := e.regexps[k]; ok {
+			if !labels.matchRegexp(k, re) {
+				return false
+			}
+			continue
+		}
+
 		if !labels.Match(k, v) {
 			return false
 		}
@@ -73,37 +288,230 @@ func (e *CostTableEntry) Match(labels Labels) bool {
 	return true
 }
 
+// MatchNode returns true if the CostTableEntry's labels match the node's
+// labels, as per Match, and every one of the entry's taints and conditions is
+// present on the node.
+func (e *CostTableEntry) MatchNode(labels Labels, taints []core_v1.Taint, conditions []core_v1.NodeCondition) bool {
+	if !e.Match(labels) {
+		return false
+	}
+
+	for _, t := range e.Taints {
+		found := false
+		for _, nt := range taints {
+			if t.Match(nt) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, c := range e.Conditions {
+		found := false
+		for _, nc := range conditions {
+			if c.Match(nc) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// specificity is the number of labels, taints and conditions the entry
+// constrains.
+func (e *CostTableEntry) specificity() int {
+	return len(e.Labels) + len(e.Taints) + len(e.Conditions)
+}
+
+// ID returns the entry's Name or, when it is unset, an identifier derived by
+// hashing the entry's labels, taints and conditions, e.g. "entry-1a2b3c4d".
+func (e *CostTableEntry) ID() string {
+	if e.Name != "" {
+		return e.Name
+	}
+
+	keys := make([]string, 0, len(e.Labels))
+	for k := range e.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := fnv.New32a()
+	for _, k := range keys {
+		fmt.Fprintf(h, "label:%s=%s\n", k, e.Labels[k])
+	}
+	for _, t := range e.Taints {
+		fmt.Fprintf(h, "taint:%s=%s:%s\n", t.Key, t.Value, t.Effect)
+	}
+	for _, c := range e.Conditions {
+		fmt.Fprintf(h, "condition:%s=%s\n", c.Type, c.Status)
+	}
+	return fmt.Sprintf("entry-%08x", h.Sum32())
+}
+
+// multiplier returns the entry's Multiplier, treating an unset value as 1.
+func (e *CostTableEntry) multiplier() float64 {
+	if e.Multiplier == 0 {
+		return 1
+	}
+	return e.Multiplier
+}
+
+// overcommitFactor returns the entry's OvercommitFactor, treating an unset
+// value as 1.
+func (e *CostTableEntry) overcommitFactor() float64 {
+	if e.OvercommitFactor == 0 {
+		return 1
+	}
+	return e.OvercommitFactor
+}
+
+// maxExactCost is the largest cost in microcents, 2^53, below which float64
+// arithmetic is exact to the microcent.
+const maxExactCost = 1 << 53
+
+// costPrecision is the precision in bits of the arithmetic used for costs of
+// at least maxExactCost.
+const costPrecision = 256
+
+// costMicroCents returns the cost in microcents of quantity units priced at
+// hourly microcents per hour over duration, scaled by multiplier. Costs that
+// float64 cannot represent exactly are recalculated at costPrecision, and
+// costs that overflow an int64 are clamped with a logged error.
+func costMicroCents(quantity, hourly float64, duration time.Duration, multiplier float64) int64 {
+	durfrac := float64(duration) / float64(time.Hour)
+	cost := quantity * durfrac * hourly * multiplier
+	if math.IsNaN(cost) {
+		log.Log.Errorw("cost is not a number, using 0", zap.Float64("quantity", quantity), zap.Float64("hourly", hourly), zap.Duration("duration", duration))
+		return 0
+	}
+	if math.Abs(cost) < maxExactCost {
+		return int64(cost)
+	}
+
+	// The float64 cost is not NaN, so neither is any intermediate product.
+	prec := func() *big.Float { return new(big.Float).SetPrec(costPrecision) }
+	precise := prec().SetFloat64(quantity)
+	precise.Mul(precise, prec().SetInt64(int64(duration)))
+	precise.Mul(precise, prec().SetFloat64(hourly))
+	precise.Mul(precise, prec().SetFloat64(multiplier))
+	precise.Quo(precise, prec().SetInt64(int64(time.Hour)))
+
+	// Int64 truncates toward zero as int64 does, and returns the nearest
+	// bound for values out of range.
+	v, acc := precise.Int64()
+	if acc != big.Exact && (v == math.MaxInt64 || v == math.MinInt64) {
+		log.Log.Errorw(
+			"cost overflows int64, clamping",
+			zap.Float64("quantity", quantity),
+			zap.Float64("hourly", hourly),
+			zap.Duration("duration", duration),
+			zap.Int64("clamped", v),
+		)
+	}
+	return v
+}
+
 // CPUCostMicroCents returns the cost of the provided cpu over a given duration
 // in millionths of a cent.
 func (e *CostTableEntry) CPUCostMicroCents(millicpu float64, duration time.Duration) int64 {
-	durfrac := float64(duration) / float64(time.Hour)
-	return int64(millicpu * durfrac * float64(e.HourlyMilliCPUCostMicroCents))
+	return costMicroCents(millicpu, float64(e.HourlyMilliCPUCostMicroCents), duration, e.multiplier())
 }
 
 // MemoryCostMicroCents returns the cost of the provided memory in bytes
 // over a given duration in millionths of a cent.
 func (e *CostTableEntry) MemoryCostMicroCents(membytes float64, duration time.Duration) int64 {
-	durfrac := float64(duration) / float64(time.Hour)
-	return int64(membytes * durfrac * float64(e.HourlyMemoryByteCostMicroCents))
+	return costMicroCents(membytes, float64(e.HourlyMemoryByteCostMicroCents), duration, e.multiplier())
 }
 
 // GPUCostMicroCents returns the cost of the provided number of gpus over a
 // given duration in millionths of a cent.
 func (e *CostTableEntry) GPUCostMicroCents(gpus float64, duration time.Duration) int64 {
-	durfrac := float64(duration) / float64(time.Hour)
-	return int64(gpus * durfrac * float64(e.HourlyGPUCostMicroCents))
+	return costMicroCents(gpus, float64(e.HourlyGPUCostMicroCents), duration, e.multiplier())
+}
+
+// StorageCostMicroCents returns the cost of the provided persistent storage in
+// bytes over a given duration in millionths of a cent.
+func (e *CostTableEntry) StorageCostMicroCents(storagebytes float64, duration time.Duration) int64 {
+	return costMicroCents(storagebytes, float64(e.HourlyStorageByteCostMicroCents), duration, e.multiplier())
+}
+
+// LoadBalancerCostMicroCents returns the cost of a single load balancer over a
+// given duration in millionths of a cent.
+func (e *CostTableEntry) LoadBalancerCostMicroCents(duration time.Duration) int64 {
+	return costMicroCents(1, e.HourlyLoadBalancerCostMicroCents, duration, e.multiplier())
+}
+
+// GPUResourceCostMicroCents returns the cost of the provided number of units
+// of the named gpu resource over a given duration in millionths of a cent.
+func (e *CostTableEntry) GPUResourceCostMicroCents(name string, gpus float64, duration time.Duration) int64 {
+	hourly, ok := e.HourlyGPUResourceCostMicroCents[name]
+	if !ok {
+		hourly = e.HourlyGPUCostMicroCents
+	}
+	return costMicroCents(gpus, hourly, duration, e.multiplier())
+}
+
+// EphemeralStorageCostMicroCents returns the cost of the provided
+// ephemeral-storage in bytes over a given duration in millionths of a cent.
+func (e *CostTableEntry) EphemeralStorageCostMicroCents(storagebytes float64, duration time.Duration) int64 {
+	return costMicroCents(storagebytes, float64(e.HourlyEphemeralStorageByteCostMicroCents), duration, e.multiplier())
+}
+
+// MatchMode determines how a CostTable chooses between multiple entries that
+// match the same set of labels.
+type MatchMode string
+
+const (
+	// MatchModeFirst selects the first matching entry in source order. This is
+	// the default when no MatchMode is configured.
+	MatchModeFirst = MatchMode("first")
+	// MatchModeMostSpecific selects the matching entry that constrains the most
+	// labels. Ties are broken by source order.
+	MatchModeMostSpecific = MatchMode("most-specific")
+)
+
+// Valid returns true if the match mode is known. An unset match mode is valid
+// and defaults to MatchModeFirst.
+func (m MatchMode) Valid() bool {
+	return m == "" || m == MatchModeFirst || m == MatchModeMostSpecific
 }
 
 // CostTable is a collection of CostTableEntries, generally used to look up pricing
 // data via a set of labels provided callers of it's FindByLabels method.
 // The order of of entries determines precedence of potentially multiple
-// applicable matches.
+// applicable matches, unless the MatchMode prefers the most specific entry.
 type CostTable struct {
-	Entries []*CostTableEntry
+	Entries   []*CostTableEntry
+	MatchMode MatchMode
+	// MaxScale caps the factor by which the WeightedPricingStrategy scales pod
+	// requests to attribute node costs. When unset, node costs are fully
+	// attributed to the pods running on them.
+	MaxScale float64
+}
+
+// Compile prepares every entry in the table for matching, see
+// CostTableEntry.Compile.
+func (ct *CostTable) Compile() error {
+	for i, e := range ct.Entries {
+		if err := e.Compile(); err != nil {
+			return errors.Wrapf(err, "could not compile pricing entry %d", i)
+		}
+	}
+	return nil
 }
 
 // FindByLabels returns the first matching CostTableEntry whose labels
-// are a subset of those provided.
+// are a subset of those provided. When the table's MatchMode is
+// MatchModeMostSpecific, the matching entry with the most labels is returned
+// instead.
 //
 // A CostTableEntry with labels:
 // 	{"size": "large", "region": usa"}
@@ -115,11 +523,65 @@ type CostTable struct {
 //
 // but will not match:
 // 	{"region": "usa"}
+//
+// The provided labels are augmented with canonical labels before matching, as
+// per Labels.Canonical.
 func (ct *CostTable) FindByLabels(labels Labels) (*CostTableEntry, error) {
+	return ct.find(labels, nil, nil)
+}
+
+// withLabel returns a table of only the entries that constrain the label, so
+// that resources priced by a label of their own, such as claims, are never
+// priced by entries that match any node.
+func (ct *CostTable) withLabel(key string) *CostTable {
+	t := *ct
+	t.Entries = nil
+	for _, e := range ct.Entries {
+		if _, ok := e.Labels[key]; ok {
+			t.Entries = append(t.Entries, e)
+		}
+	}
+	return &t
+}
+
+// FindByNode returns the CostTableEntry matching the node's labels, taints and
+// conditions, as per FindByLabels and CostTableEntry.MatchNode. Unlike
+// FindByLabels, it may return entries that require taints or conditions.
+func (ct *CostTable) FindByNode(n *core_v1.Node) (*CostTableEntry, error) {
+	return ct.find(n.Labels, n.Spec.Taints, n.Status.Conditions)
+}
+
+func (ct *CostTable) find(labels Labels, taints []core_v1.Taint, conditions []core_v1.NodeCondition) (*CostTableEntry, error) {
+	labels = labels.Canonical()
+	if ct.MatchMode == MatchModeMostSpecific {
+		return ct.findMostSpecific(labels, taints, conditions)
+	}
+
 	for _, e := range ct.Entries {
-		if e.Match(labels) {
+		if e.MatchNode(labels, taints, conditions) {
 			return e, nil
 		}
 	}
 	return nil, ErrNoCostEntry
 }
+
+// findMostSpecific scores every matching entry by the number of labels,
+// taints and conditions it constrains and returns the highest scoring one.
+// Because only a strictly greater score replaces the current best, earlier
+// entries win ties.
+func (ct *CostTable) findMostSpecific(labels Labels, taints []core_v1.Taint, conditions []core_v1.NodeCondition) (*CostTableEntry, error) {
+	var best *CostTableEntry
+	for _, e := range ct.Entries {
+		if !e.MatchNode(labels, taints, conditions) {
+			continue
+		}
+		if best == nil || e.specificity() > best.specificity() {
+			best = e
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNoCostEntry
+	}
+	return best, nil
+}
@@ -15,8 +15,15 @@
 package coster
 
 import (
+	"math"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/go-test/deep"
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var (
@@ -39,6 +46,9 @@ var (
 	fallbackCostTableEntry = CostTableEntry{
 		Labels: Labels{},
 	}
+	duplicateSingleLabelCostTableEntry = CostTableEntry{
+		Labels: Labels{"beta.kubernetes.io/instance-type": "n1-standard-16"},
+	}
 )
 
 var costTableCases = []struct {
@@ -106,6 +116,65 @@ var costTableCases = []struct {
 		// arguably, more precise regionZoneAndInstanceType entry.
 		expectedEntry: &regionAndInstanceTypeCostTableEntry,
 	},
+	{
+		name: "most specific match mode prefers the entry with the most labels",
+		table: CostTable{
+			MatchMode: MatchModeMostSpecific,
+			Entries: []*CostTableEntry{
+				&fallbackCostTableEntry,
+				&regionAndInstanceTypeCostTableEntry,
+				&regionZoneAndInstanceTypeCostTableEntry,
+				&singleLabelCostTableEntry,
+			},
+		},
+		labels: Labels{
+			"beta.kubernetes.io/instance-type":         "n1-standard-16",
+			"failure-domain.beta.kubernetes.io/region": "us-central1",
+			"failure-domain.beta.kubernetes.io/zone":   "us-central1-b",
+		},
+		expectedEntry: &regionZoneAndInstanceTypeCostTableEntry,
+	},
+	{
+		name: "most specific match mode ignores more specific entries that do not match",
+		table: CostTable{
+			MatchMode: MatchModeMostSpecific,
+			Entries: []*CostTableEntry{
+				&singleLabelCostTableEntry,
+				&regionZoneAndInstanceTypeCostTableEntry,
+				&regionAndInstanceTypeCostTableEntry,
+			},
+		},
+		labels: Labels{
+			"beta.kubernetes.io/instance-type":         "n1-standard-16",
+			"failure-domain.beta.kubernetes.io/region": "us-central1",
+			"failure-domain.beta.kubernetes.io/zone":   "us-central1-c",
+		},
+		expectedEntry: &regionAndInstanceTypeCostTableEntry,
+	},
+	{
+		name: "most specific match mode breaks ties by ordering",
+		table: CostTable{
+			MatchMode: MatchModeMostSpecific,
+			Entries: []*CostTableEntry{
+				&fallbackCostTableEntry,
+				&singleLabelCostTableEntry,
+				&duplicateSingleLabelCostTableEntry,
+			},
+		},
+		labels:        singleLabelCostTableEntry.Labels,
+		expectedEntry: &singleLabelCostTableEntry,
+	},
+	{
+		name: "most specific match mode null case",
+		table: CostTable{
+			MatchMode: MatchModeMostSpecific,
+			Entries: []*CostTableEntry{
+				&regionAndInstanceTypeCostTableEntry,
+			},
+		},
+		labels:      singleLabelCostTableEntry.Labels,
+		expectedErr: ErrNoCostEntry,
+	},
 }
 
 func TestFindByLabels(t *testing.T) {
@@ -128,6 +197,13 @@ var (
 		HourlyMemoryByteCostMicroCents: 1,
 		HourlyMilliCPUCostMicroCents:   15000,
 	}
+
+	preemptibleSingleCPU32MebEntry = &CostTableEntry{
+		HourlyMemoryByteCostMicroCents: 1,
+		HourlyMilliCPUCostMicroCents:   15000,
+		HourlyGPUCostMicroCents:        1000000,
+		Multiplier:                     0.3,
+	}
 )
 
 var costEntryCPUCalculations = []struct {
@@ -152,6 +228,13 @@ var costEntryCPUCalculations = []struct {
 		duration:     time.Minute * 5,
 		expectedCost: 625000,
 	},
+	{
+		name:         "half preemptible cpu for an hour",
+		entry:        preemptibleSingleCPU32MebEntry,
+		milliCPU:     500,
+		duration:     time.Hour,
+		expectedCost: 2250000,
+	},
 }
 
 func TestCostEntryCPUCalculations(t *testing.T) {
@@ -187,6 +270,13 @@ var costEntryMemoryCalculations = []struct {
 		duration:     time.Minute,
 		expectedCost: 17476,
 	},
+	{
+		name:         "mebibyte of preemptible memory for an hour",
+		entry:        preemptibleSingleCPU32MebEntry,
+		mib:          1048576,
+		duration:     time.Hour,
+		expectedCost: 314572,
+	},
 }
 
 func TestCostEntryMemoryCalculations(t *testing.T) {
@@ -199,3 +289,465 @@ func TestCostEntryMemoryCalculations(t *testing.T) {
 		})
 	}
 }
+
+var (
+	ephemeralStorageEntry = &CostTableEntry{
+		HourlyEphemeralStorageByteCostMicroCents: 0.001,
+	}
+)
+
+var costEntryEphemeralStorageCalculations = []struct {
+	name         string
+	entry        *CostTableEntry
+	quantity     string
+	duration     time.Duration
+	expectedCost int64
+}{
+	{
+		name:         "ten gibibytes of ephemeral storage for an hour",
+		entry:        ephemeralStorageEntry,
+		quantity:     "10Gi",
+		duration:     time.Hour,
+		expectedCost: 10737418,
+	},
+	{
+		name:         "ten gibibytes of ephemeral storage for a minute",
+		entry:        ephemeralStorageEntry,
+		quantity:     "10Gi",
+		duration:     time.Minute,
+		expectedCost: 178956,
+	},
+	{
+		name:         "no ephemeral storage",
+		entry:        ephemeralStorageEntry,
+		quantity:     "0",
+		duration:     time.Hour,
+		expectedCost: 0,
+	},
+}
+
+func TestCostEntryEphemeralStorageCalculations(t *testing.T) {
+	for _, tt := range costEntryEphemeralStorageCalculations {
+		t.Run(tt.name, func(t *testing.T) {
+			q := resource.MustParse(tt.quantity)
+			got := tt.entry.EphemeralStorageCostMicroCents(float64(q.Value()), tt.duration)
+			if got != tt.expectedCost {
+				t.Fatalf("expected ephemeral storage cost of %v got %v", tt.expectedCost, got)
+			}
+		})
+	}
+}
+
+var labelPatternCases = []struct {
+	name     string
+	entry    CostTableEntry
+	labels   Labels
+	expected bool
+}{
+	{
+		name:     "glob matches an instance type family",
+		entry:    CostTableEntry{Labels: Labels{"beta.kubernetes.io/instance-type": "glob:n1-standard-*"}},
+		labels:   Labels{"beta.kubernetes.io/instance-type": "n1-standard-16"},
+		expected: true,
+	},
+	{
+		name:     "glob matches another member of the instance type family",
+		entry:    CostTableEntry{Labels: Labels{"beta.kubernetes.io/instance-type": "glob:n1-standard-*"}},
+		labels:   Labels{"beta.kubernetes.io/instance-type": "n1-standard-32"},
+		expected: true,
+	},
+	{
+		name:     "glob does not match a different family",
+		entry:    CostTableEntry{Labels: Labels{"beta.kubernetes.io/instance-type": "glob:n1-standard-*"}},
+		labels:   Labels{"beta.kubernetes.io/instance-type": "n1-highmem-16"},
+		expected: false,
+	},
+	{
+		name:     "glob requires the label to be present",
+		entry:    CostTableEntry{Labels: Labels{"beta.kubernetes.io/instance-type": "glob:*"}},
+		labels:   Labels{"failure-domain.beta.kubernetes.io/region": "us-central1"},
+		expected: false,
+	},
+	{
+		name:     "regex matches alternatives",
+		entry:    CostTableEntry{Labels: Labels{"beta.kubernetes.io/instance-type": "regex:n1-(standard|highcpu)-(16|32)"}},
+		labels:   Labels{"beta.kubernetes.io/instance-type": "n1-highcpu-32"},
+		expected: true,
+	},
+	{
+		name:     "regex must match the entire value",
+		entry:    CostTableEntry{Labels: Labels{"beta.kubernetes.io/instance-type": "regex:n1-standard-1"}},
+		labels:   Labels{"beta.kubernetes.io/instance-type": "n1-standard-16"},
+		expected: false,
+	},
+	{
+		name:     "patterns combine with exact labels",
+		entry:    CostTableEntry{Labels: Labels{"beta.kubernetes.io/instance-type": "glob:n1-standard-*", "failure-domain.beta.kubernetes.io/region": "us-central1"}},
+		labels:   Labels{"beta.kubernetes.io/instance-type": "n1-standard-16", "failure-domain.beta.kubernetes.io/region": "us-east1"},
+		expected: false,
+	},
+}
+
+func TestLabelPatternMatching(t *testing.T) {
+	for _, tt := range labelPatternCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.entry.Match(tt.labels); got != tt.expected {
+				t.Fatalf("expected uncompiled match to be %v, got %v", tt.expected, got)
+			}
+
+			if err := tt.entry.Compile(); err != nil {
+				t.Fatalf("unexpected error compiling entry: %v", err)
+			}
+			if got := tt.entry.Match(tt.labels); got != tt.expected {
+				t.Fatalf("expected compiled match to be %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestGlobEntryMatchesMultipleInstanceTypes(t *testing.T) {
+	standard := &CostTableEntry{Labels: Labels{"beta.kubernetes.io/instance-type": "glob:n1-standard-*"}}
+	fallback := &CostTableEntry{Labels: Labels{}}
+	ct := CostTable{Entries: []*CostTableEntry{standard, fallback}}
+	if err := ct.Compile(); err != nil {
+		t.Fatalf("unexpected error compiling table: %v", err)
+	}
+
+	for _, it := range []string{"n1-standard-16", "n1-standard-32", "n1-standard-96"} {
+		e, err := ct.FindByLabels(Labels{"beta.kubernetes.io/instance-type": it})
+		if err != nil {
+			t.Fatalf("unexpected error finding %s: %v", it, err)
+		}
+		if e != standard {
+			t.Fatalf("expected %s to match the glob entry, got %#v", it, e)
+		}
+	}
+
+	e, err := ct.FindByLabels(Labels{"beta.kubernetes.io/instance-type": "n1-highmem-16"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e != fallback {
+		t.Fatalf("expected n1-highmem-16 to match the fallback entry, got %#v", e)
+	}
+}
+
+var canonicalLabelCases = []struct {
+	name     string
+	labels   Labels
+	expected Labels
+}{
+	{
+		name: "GA labels",
+		labels: Labels{
+			"node.kubernetes.io/instance-type": "m5.xlarge",
+			"topology.kubernetes.io/region":    "us-east-1",
+			"topology.kubernetes.io/zone":      "us-east-1a",
+		},
+		expected: Labels{
+			"node.kubernetes.io/instance-type": "m5.xlarge",
+			"topology.kubernetes.io/region":    "us-east-1",
+			"topology.kubernetes.io/zone":      "us-east-1a",
+			LabelInstanceType:                  "m5.xlarge",
+			LabelRegion:                        "us-east-1",
+			LabelZone:                          "us-east-1a",
+		},
+	},
+	{
+		name: "beta labels",
+		labels: Labels{
+			"beta.kubernetes.io/instance-type":         "n1-standard-16",
+			"failure-domain.beta.kubernetes.io/region": "us-central1",
+		},
+		expected: Labels{
+			"beta.kubernetes.io/instance-type":         "n1-standard-16",
+			"failure-domain.beta.kubernetes.io/region": "us-central1",
+			LabelInstanceType:                          "n1-standard-16",
+			LabelRegion:                                "us-central1",
+		},
+	},
+	{
+		name: "GA labels are preferred over beta labels",
+		labels: Labels{
+			"beta.kubernetes.io/instance-type": "old",
+			"node.kubernetes.io/instance-type": "new",
+		},
+		expected: Labels{
+			"beta.kubernetes.io/instance-type": "old",
+			"node.kubernetes.io/instance-type": "new",
+			LabelInstanceType:                  "new",
+		},
+	},
+	{
+		name: "existing canonical labels are left untouched",
+		labels: Labels{
+			"node.kubernetes.io/instance-type": "m5.xlarge",
+			LabelInstanceType:                  "custom",
+		},
+		expected: Labels{
+			"node.kubernetes.io/instance-type": "m5.xlarge",
+			LabelInstanceType:                  "custom",
+		},
+	},
+	{
+		name:     "no cloud labels",
+		labels:   Labels{"size": "large"},
+		expected: Labels{"size": "large"},
+	},
+}
+
+func TestCanonicalLabels(t *testing.T) {
+	for _, tt := range canonicalLabelCases {
+		t.Run(tt.name, func(t *testing.T) {
+			original := Labels{}
+			for k, v := range tt.labels {
+				original[k] = v
+			}
+
+			if diff := deep.Equal(tt.labels.Canonical(), tt.expected); diff != nil {
+				t.Fatal(diff)
+			}
+			if diff := deep.Equal(tt.labels, original); diff != nil {
+				t.Fatalf("labels were modified: %v", diff)
+			}
+		})
+	}
+}
+
+func TestCanonicalLabelsMatchAcrossClouds(t *testing.T) {
+	canonical := &CostTableEntry{Labels: Labels{LabelInstanceType: "m5.xlarge", LabelRegion: "us-east-1"}}
+	fallback := &CostTableEntry{Labels: Labels{}}
+	ct := CostTable{Entries: []*CostTableEntry{canonical, fallback}}
+
+	aws := Labels{
+		"node.kubernetes.io/instance-type": "m5.xlarge",
+		"topology.kubernetes.io/region":    "us-east-1",
+		"topology.kubernetes.io/zone":      "us-east-1a",
+	}
+	gke := Labels{
+		"beta.kubernetes.io/instance-type":         "m5.xlarge",
+		"failure-domain.beta.kubernetes.io/region": "us-east-1",
+		"failure-domain.beta.kubernetes.io/zone":   "us-east-1a",
+	}
+
+	for _, labels := range []Labels{aws, gke} {
+		e, err := ct.FindByLabels(labels)
+		if err != nil {
+			t.Fatalf("unexpected error finding %v: %v", labels, err)
+		}
+		if e != canonical {
+			t.Fatalf("expected %v to match the canonical entry, got %#v", labels, e)
+		}
+	}
+}
+
+var (
+	spotTaintCostTableEntry = &CostTableEntry{
+		Labels:     Labels{LabelInstanceType: "Standard_D4s_v3"},
+		Taints:     []Taint{{Key: "kubernetes.azure.com/scalesetpriority", Value: "spot", Effect: core_v1.TaintEffectNoSchedule}},
+		Multiplier: 0.2,
+	}
+	onDemandCostTableEntry = &CostTableEntry{
+		Labels: Labels{LabelInstanceType: "Standard_D4s_v3"},
+	}
+	anySpotTaintCostTableEntry = &CostTableEntry{
+		Taints: []Taint{{Key: "kubernetes.azure.com/scalesetpriority"}},
+	}
+	spotTaint = core_v1.Taint{Key: "kubernetes.azure.com/scalesetpriority", Value: "spot", Effect: core_v1.TaintEffectNoSchedule}
+
+	reclaimConditionType           = core_v1.NodeConditionType("SpotInterruptionNotice")
+	reclaimConditionCostTableEntry = &CostTableEntry{
+		Labels:     Labels{LabelInstanceType: "Standard_D4s_v3"},
+		Taints:     []Taint{{Key: "kubernetes.azure.com/scalesetpriority"}},
+		Conditions: []Condition{{Type: reclaimConditionType}},
+		Multiplier: 0.05,
+	}
+	reclaimCondition = core_v1.NodeCondition{Type: reclaimConditionType, Status: core_v1.ConditionTrue}
+)
+
+var findByNodeCases = []struct {
+	name       string
+	table      CostTable
+	taints     []core_v1.Taint
+	conditions []core_v1.NodeCondition
+	expected   *CostTableEntry
+}{
+	{
+		name:     "spot taint matches discounted entry",
+		table:    CostTable{Entries: []*CostTableEntry{spotTaintCostTableEntry, onDemandCostTableEntry}},
+		taints:   []core_v1.Taint{{Key: "example.com/other", Effect: core_v1.TaintEffectNoExecute}, spotTaint},
+		expected: spotTaintCostTableEntry,
+	},
+	{
+		name:     "untainted node falls through to on-demand entry",
+		table:    CostTable{Entries: []*CostTableEntry{spotTaintCostTableEntry, onDemandCostTableEntry}},
+		expected: onDemandCostTableEntry,
+	},
+	{
+		name:     "taint with a different value does not match",
+		table:    CostTable{Entries: []*CostTableEntry{spotTaintCostTableEntry, onDemandCostTableEntry}},
+		taints:   []core_v1.Taint{{Key: spotTaint.Key, Value: "regular", Effect: spotTaint.Effect}},
+		expected: onDemandCostTableEntry,
+	},
+	{
+		name:     "empty value and effect match any",
+		table:    CostTable{Entries: []*CostTableEntry{anySpotTaintCostTableEntry, onDemandCostTableEntry}},
+		taints:   []core_v1.Taint{spotTaint},
+		expected: anySpotTaintCostTableEntry,
+	},
+	{
+		name:     "most specific prefers the tainted entry",
+		table:    CostTable{Entries: []*CostTableEntry{onDemandCostTableEntry, spotTaintCostTableEntry}, MatchMode: MatchModeMostSpecific},
+		taints:   []core_v1.Taint{spotTaint},
+		expected: spotTaintCostTableEntry,
+	},
+	{
+		name:       "reclaim condition matches discounted entry",
+		table:      CostTable{Entries: []*CostTableEntry{reclaimConditionCostTableEntry, spotTaintCostTableEntry, onDemandCostTableEntry}},
+		taints:     []core_v1.Taint{spotTaint},
+		conditions: []core_v1.NodeCondition{{Type: core_v1.NodeReady, Status: core_v1.ConditionTrue}, reclaimCondition},
+		expected:   reclaimConditionCostTableEntry,
+	},
+	{
+		name:     "spot node without a reclaim condition falls through",
+		table:    CostTable{Entries: []*CostTableEntry{reclaimConditionCostTableEntry, spotTaintCostTableEntry, onDemandCostTableEntry}},
+		taints:   []core_v1.Taint{spotTaint},
+		expected: spotTaintCostTableEntry,
+	},
+	{
+		name:       "reclaim condition that is not true does not match",
+		table:      CostTable{Entries: []*CostTableEntry{reclaimConditionCostTableEntry, spotTaintCostTableEntry, onDemandCostTableEntry}},
+		taints:     []core_v1.Taint{spotTaint},
+		conditions: []core_v1.NodeCondition{{Type: reclaimConditionType, Status: core_v1.ConditionFalse}},
+		expected:   spotTaintCostTableEntry,
+	},
+	{
+		name:       "most specific prefers the reclaim condition entry",
+		table:      CostTable{Entries: []*CostTableEntry{spotTaintCostTableEntry, reclaimConditionCostTableEntry}, MatchMode: MatchModeMostSpecific},
+		taints:     []core_v1.Taint{spotTaint},
+		conditions: []core_v1.NodeCondition{reclaimCondition},
+		expected:   reclaimConditionCostTableEntry,
+	},
+}
+
+func TestFindByNode(t *testing.T) {
+	for _, tt := range findByNodeCases {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &core_v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"node.kubernetes.io/instance-type": "Standard_D4s_v3"}},
+				Spec:       core_v1.NodeSpec{Taints: tt.taints},
+				Status:     core_v1.NodeStatus{Conditions: tt.conditions},
+			}
+			e, err := tt.table.FindByNode(n)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if e != tt.expected {
+				t.Fatalf("expected entry %#v, got %#v", tt.expected, e)
+			}
+		})
+	}
+}
+
+func TestFindByLabelsIgnoresTaintedEntries(t *testing.T) {
+	ct := CostTable{Entries: []*CostTableEntry{spotTaintCostTableEntry, onDemandCostTableEntry}}
+	e, err := ct.FindByLabels(Labels{LabelInstanceType: "Standard_D4s_v3"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e != onDemandCostTableEntry {
+		t.Fatalf("expected the untainted entry, got %#v", e)
+	}
+}
+
+func TestCostTableEntryID(t *testing.T) {
+	named := &CostTableEntry{Name: "azure-spot", Labels: spotTaintCostTableEntry.Labels}
+	if id := named.ID(); id != "azure-spot" {
+		t.Fatalf("expected the entry's name, got %q", id)
+	}
+
+	ids := map[string]bool{}
+	for _, e := range []*CostTableEntry{spotTaintCostTableEntry, onDemandCostTableEntry, &CostTableEntry{}, reclaimConditionCostTableEntry} {
+		id := e.ID()
+		if !strings.HasPrefix(id, "entry-") {
+			t.Fatalf("expected a generated id, got %q", id)
+		}
+		if id != e.ID() {
+			t.Fatalf("expected a stable id for %#v", e)
+		}
+		ids[id] = true
+	}
+	if len(ids) != 4 {
+		t.Fatalf("expected distinct ids for distinct entries, got %v", ids)
+	}
+}
+
+func TestInvalidLabelRegexFailsConfigLoad(t *testing.T) {
+	cfg := `{"Pricing": {"Entries": [{"Labels": {"beta.kubernetes.io/instance-type": "regex:n1-(standard"}}]}, "Mapper": {"Entries": [{"Destination": "service", "Source": "{.Pod.ObjectMeta.Labels.service}"}]}}`
+	if _, err := NewConfigFromReader(strings.NewReader(cfg)); err == nil {
+		t.Fatal("expected an invalid label regex to fail configuration loading")
+	}
+}
+
+func TestCostEntryMultiplier(t *testing.T) {
+	if got := preemptibleSingleCPU32MebEntry.GPUCostMicroCents(2, time.Hour); got != 600000 {
+		t.Fatalf("expected preemptible gpu cost of 600000, got %v", got)
+	}
+
+	if got := singleCPU32MebEntry.GPUCostMicroCents(2, time.Hour); got != 0 {
+		t.Fatalf("expected no gpu cost, got %v", got)
+	}
+
+	unset := &CostTableEntry{HourlyGPUCostMicroCents: 1000000}
+	if got := unset.GPUCostMicroCents(2, time.Hour); got != 2000000 {
+		t.Fatalf("expected an unset multiplier to leave cost unchanged, got %v", got)
+	}
+}
+
+var memoryCostOverflowCases = []struct {
+	name     string
+	membytes float64
+	duration time.Duration
+	hourly   float64
+	expected int64
+}{
+	{
+		name:     "a petabyte for a decade clamps to the largest cost",
+		membytes: 1 << 50,
+		duration: 10 * 365 * 24 * time.Hour,
+		hourly:   1000,
+		expected: math.MaxInt64,
+	},
+	{
+		name:     "the largest duration clamps to the largest cost",
+		membytes: 64 << 40,
+		duration: math.MaxInt64,
+		hourly:   1,
+		expected: math.MaxInt64,
+	},
+	{
+		name:     "costs beyond float64 precision are exact",
+		membytes: 3002399751580331,
+		duration: time.Hour,
+		hourly:   3,
+		expected: 9007199254740993,
+	},
+	{
+		name:     "large costs within range are not clamped",
+		membytes: 1 << 62,
+		duration: time.Hour,
+		hourly:   1,
+		expected: 1 << 62,
+	},
+}
+
+func TestMemoryCostMicroCentsOverflow(t *testing.T) {
+	for _, tt := range memoryCostOverflowCases {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &CostTableEntry{HourlyMemoryByteCostMicroCents: tt.hourly}
+			if got := e.MemoryCostMicroCents(tt.membytes, tt.duration); got != tt.expected {
+				t.Fatalf("expected %d, got %d", tt.expected, got)
+			}
+		})
+	}
+}
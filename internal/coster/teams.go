@@ -0,0 +1,105 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"fmt"
+	"path"
+)
+
+// DefaultTeam is the team of namespaces no TeamTable entry matches unless
+// otherwise configured.
+const DefaultTeam = "unknown"
+
+// TeamTableEntry maps the namespaces matching a pattern to a team.
+type TeamTableEntry struct {
+	// Namespace is a namespace name or a glob pattern, as understood by
+	// path.Match, e.g. `payments-*`.
+	Namespace string
+	// Team is the team the matching namespaces belong to.
+	Team string
+}
+
+// TeamTable maps the namespace of each cost item to the team that owns it, as
+// DimensionTeam, for organizations whose namespace ownership is recorded in a
+// static table rather than in labels. Unlike a Mapping it does not evaluate
+// the cost item, only its pod's namespace.
+type TeamTable struct {
+	// Default is the team of namespaces no entry matches, and of cost items
+	// without a pod. Defaults to DefaultTeam.
+	Default string
+	// Entries match namespaces exactly before they are matched against glob
+	// patterns, which are tried in order.
+	Entries []TeamTableEntry
+}
+
+// Enabled reports whether the table has entries to map.
+func (tt *TeamTable) Enabled() bool {
+	return len(tt.Entries) > 0
+}
+
+// Team returns the team owning the provided namespace.
+func (tt *TeamTable) Team(namespace string) string {
+	if namespace != "" {
+		for _, e := range tt.Entries {
+			if e.Namespace == namespace {
+				return e.Team
+			}
+		}
+		for _, e := range tt.Entries {
+			if ok, _ := path.Match(e.Namespace, namespace); ok {
+				return e.Team
+			}
+		}
+	}
+
+	if tt.Default == "" {
+		return DefaultTeam
+	}
+	return tt.Default
+}
+
+// mapCostItem adds the team owning the cost item's pod, or service, to dims
+// as DimensionTeam, unless the mapping already defined it.
+func (tt *TeamTable) mapCostItem(ci CostItem, dims map[string]string) {
+	if !tt.Enabled() {
+		return
+	}
+	if _, ok := dims[DimensionTeam]; ok {
+		return
+	}
+
+	namespace := ""
+	if ci.Pod != nil {
+		namespace = ci.Pod.Namespace
+	} else if ci.Service != nil {
+		namespace = ci.Service.Namespace
+	}
+	dims[DimensionTeam] = tt.Team(namespace)
+}
+
+// problems returns the problems found validating the table.
+func (tt *TeamTable) problems() []string {
+	problems := []string{}
+	for i, e := range tt.Entries {
+		if _, err := path.Match(e.Namespace, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("team entry %d has invalid namespace pattern %q: %v", i, e.Namespace, err))
+		}
+		if e.Team == "" {
+			problems = append(problems, fmt.Sprintf("team entry %d (%s) has no team", i, e.Namespace))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/planetlabs/kostanza/internal/lister"
+)
+
+var testTeamTable = TeamTable{Entries: []TeamTableEntry{
+	TeamTableEntry{Namespace: "payments-*", Team: "billing"},
+	TeamTableEntry{Namespace: "payments-ledger", Team: "ledger"},
+	TeamTableEntry{Namespace: "data-*", Team: "data"},
+	TeamTableEntry{Namespace: "data-warehouse", Team: "analytics"},
+}}
+
+var teamTableCases = []struct {
+	name      string
+	table     TeamTable
+	namespace string
+	expected  string
+}{
+	{
+		name:      "exact match",
+		table:     testTeamTable,
+		namespace: "data-warehouse",
+		expected:  "analytics",
+	},
+	{
+		name:      "exact match before earlier glob",
+		table:     testTeamTable,
+		namespace: "payments-ledger",
+		expected:  "ledger",
+	},
+	{
+		name:      "glob match",
+		table:     testTeamTable,
+		namespace: "payments-api",
+		expected:  "billing",
+	},
+	{
+		name:      "unmatched namespace",
+		table:     testTeamTable,
+		namespace: "kube-system",
+		expected:  DefaultTeam,
+	},
+	{
+		name:      "unmatched namespace with configured default",
+		table:     TeamTable{Default: "platform", Entries: testTeamTable.Entries},
+		namespace: "kube-system",
+		expected:  "platform",
+	},
+	{
+		name:      "no namespace",
+		table:     TeamTable{Entries: []TeamTableEntry{TeamTableEntry{Namespace: "*", Team: "everyone"}}},
+		namespace: "",
+		expected:  DefaultTeam,
+	},
+}
+
+func TestTeamTable(t *testing.T) {
+	for _, tt := range teamTableCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.table.Team(tt.namespace); got != tt.expected {
+				t.Fatalf("expected team %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+var teamMapCostItemCases = []struct {
+	name     string
+	table    TeamTable
+	ci       CostItem
+	dims     map[string]string
+	expected map[string]string
+}{
+	{
+		name:     "pod namespace",
+		table:    testTeamTable,
+		ci:       CostItem{Pod: &core_v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "payments-api"}}},
+		dims:     map[string]string{"service": "api"},
+		expected: map[string]string{"service": "api", DimensionTeam: "billing"},
+	},
+	{
+		name:     "no pod",
+		table:    TeamTable{Default: "platform", Entries: testTeamTable.Entries},
+		ci:       CostItem{Kind: ResourceCostNode},
+		dims:     map[string]string{},
+		expected: map[string]string{DimensionTeam: "platform"},
+	},
+	{
+		name:     "service namespace",
+		table:    testTeamTable,
+		ci:       CostItem{Kind: ResourceCostLoadBalancer, Service: &core_v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "payments-api"}}},
+		dims:     map[string]string{},
+		expected: map[string]string{DimensionTeam: "billing"},
+	},
+	{
+		name:     "mapped team",
+		table:    testTeamTable,
+		ci:       CostItem{Pod: &core_v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "payments-api"}}},
+		dims:     map[string]string{DimensionTeam: "mapped"},
+		expected: map[string]string{DimensionTeam: "mapped"},
+	},
+	{
+		name:     "disabled",
+		table:    TeamTable{Default: "platform"},
+		ci:       CostItem{Pod: &core_v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "payments-api"}}},
+		dims:     map[string]string{},
+		expected: map[string]string{},
+	},
+}
+
+func TestTeamTableMapCostItem(t *testing.T) {
+	for _, tt := range teamMapCostItemCases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.table.mapCostItem(tt.ci, tt.dims)
+			if diff := deep.Equal(tt.dims, tt.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestCalculateAndEmitTeamDimension(t *testing.T) {
+	tt := calculateCases[0]
+	cfg := *tt.config
+	cfg.Mapper = Mapper{Entries: []Mapping{Mapping{Destination: "kind", Source: "{.Kind}"}}}
+	cfg.Teams = TeamTable{Entries: []TeamTableEntry{TeamTableEntry{Namespace: "*", Team: "everyone"}}}
+
+	pod := testCalculationPod.DeepCopy()
+	pod.Namespace = "default"
+
+	re := &recordingExporter{}
+	c := &coster{
+		interval:      time.Hour,
+		nodeLister:    &lister.FakeNodeLister{Nodes: tt.nodes},
+		podLister:     &lister.FakePodLister{Pods: []*core_v1.Pod{pod}},
+		config:        &cfg,
+		strategies:    []PricingStrategy{CPUPricingStrategy},
+		costExporters: []CostExporter{re},
+	}
+
+	if err := c.CalculateAndEmit(); err != nil {
+		t.Fatalf("unexpected calculation error: %v", err)
+	}
+
+	if len(re.data) != 1 {
+		t.Fatalf("expected a single exported cost datum, got %d", len(re.data))
+	}
+
+	expected := map[string]string{"kind": string(ResourceCostCPU), DimensionTeam: "everyone"}
+	if diff := deep.Equal(re.data[0].Dimensions, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
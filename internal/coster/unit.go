@@ -0,0 +1,61 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+// CostUnit is the unit in which costs are reported to consumers of CostData.
+// Costs are always calculated in microcents internally.
+type CostUnit string
+
+const (
+	// CostUnitMicroCents reports costs in millionths of a cent. This is the
+	// default, and is exact.
+	CostUnitMicroCents = CostUnit("microcents")
+	// CostUnitCents reports costs in cents.
+	CostUnitCents = CostUnit("cents")
+	// CostUnitDollars reports costs in dollars.
+	CostUnitDollars = CostUnit("dollars")
+)
+
+// microCentsPerUnit is the number of microcents in each CostUnit.
+var microCentsPerUnit = map[CostUnit]float64{
+	CostUnitMicroCents: 1,
+	CostUnitCents:      1e6,
+	CostUnitDollars:    1e8,
+}
+
+// orDefault returns the unit, or CostUnitMicroCents if it is unset.
+func (u CostUnit) orDefault() CostUnit {
+	if u == "" {
+		return CostUnitMicroCents
+	}
+	return u
+}
+
+// Valid returns true if the unit is known. An unset unit is valid and
+// defaults to CostUnitMicroCents.
+func (u CostUnit) Valid() bool {
+	_, ok := microCentsPerUnit[u.orDefault()]
+	return ok
+}
+
+// Convert returns the provided cost in microcents expressed in the unit.
+// Unknown units are treated as CostUnitMicroCents.
+func (u CostUnit) Convert(microcents int64) float64 {
+	per, ok := microCentsPerUnit[u.orDefault()]
+	if !ok {
+		return float64(microcents)
+	}
+	return float64(microcents) / per
+}
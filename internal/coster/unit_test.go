@@ -0,0 +1,94 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"testing"
+)
+
+var costUnitCases = []struct {
+	name     string
+	unit     CostUnit
+	value    int64
+	expected float64
+}{
+	{
+		name:     "unset units default to microcents",
+		unit:     "",
+		value:    1500000,
+		expected: 1500000,
+	},
+	{
+		name:     "microcents",
+		unit:     CostUnitMicroCents,
+		value:    1500000,
+		expected: 1500000,
+	},
+	{
+		name:     "cents",
+		unit:     CostUnitCents,
+		value:    1500000,
+		expected: 1.5,
+	},
+	{
+		name:     "dollars",
+		unit:     CostUnitDollars,
+		value:    250000000,
+		expected: 2.5,
+	},
+}
+
+func TestCostUnitConvert(t *testing.T) {
+	for _, tt := range costUnitCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.unit.Convert(tt.value); got != tt.expected {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+
+			cd := CostData{Value: tt.value}
+			cd.setUnit(tt.unit)
+			if cd.Value != tt.value || cd.UnitValue != tt.expected || cd.Unit != tt.unit.orDefault() {
+				t.Fatalf("unexpected cost data: %#v", cd)
+			}
+		})
+	}
+}
+
+func TestCostUnitValid(t *testing.T) {
+	for _, u := range []CostUnit{"", CostUnitMicroCents, CostUnitCents, CostUnitDollars} {
+		if !u.Valid() {
+			t.Fatalf("expected %q to be valid", u)
+		}
+	}
+	if CostUnit("euros").Valid() {
+		t.Fatal("expected an unknown unit to be invalid")
+	}
+}
+
+func TestBufferingExporterConvertsMergedUnits(t *testing.T) {
+	ce := &BufferingCostExporter{ctx: context.Background(), buffer: map[CostDataKey]CostData{}}
+
+	for i := 0; i < 2; i++ {
+		cd := CostData{Kind: ResourceCostNode, Value: 500000}
+		cd.setUnit(CostUnitCents)
+		ce.ExportCost(cd)
+	}
+
+	merged := ce.buffer[CostDataKey{Kind: ResourceCostNode}]
+	if merged.Value != 1000000 || merged.UnitValue != 1 {
+		t.Fatalf("unexpected merged cost data: %#v", merged)
+	}
+}
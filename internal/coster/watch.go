@@ -0,0 +1,108 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+// configMapDataDir is the symlink swapped by the kubelet when a mounted
+// ConfigMap is updated.
+const configMapDataDir = "..data"
+
+// WatchConfigFile watches the configuration file at path and invokes reload
+// with the newly parsed Config whenever it changes. Configurations that fail
+// to load are logged and ignored, leaving the last good configuration in
+// place. It blocks until the provided context is cancelled.
+func WatchConfigFile(ctx context.Context, path string, reload func(*Config)) error {
+	return WatchConfigFiles(ctx, []string{path}, reload)
+}
+
+// WatchConfigFiles behaves like WatchConfigFile, but watches every one of the
+// provided configuration files and reloads the configuration merged from all
+// of them, as per NewConfigFromFiles, whenever any of them changes.
+func WatchConfigFiles(ctx context.Context, paths []string, reload func(*Config)) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close() // nolint: errcheck
+
+	// We watch the parent directory rather than the file itself since editors
+	// and ConfigMap volumes replace files by renaming over them, which would
+	// silently drop a watch placed on the original file.
+	cleaned := []string{}
+	dirs := map[string]bool{}
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		cleaned = append(cleaned, path)
+
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
+		}
+		if err := w.Add(dir); err != nil {
+			return err
+		}
+		dirs[dir] = true
+	}
+
+	log.Log.Infow("watching configuration for changes", zap.Strings("paths", cleaned))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev := <-w.Events:
+			if !isAnyConfigEvent(cleaned, ev) {
+				continue
+			}
+
+			cfg, err := NewConfigFromFiles(cleaned...)
+			if err != nil {
+				log.Log.Errorw("ignoring invalid configuration", zap.Strings("paths", cleaned), zap.Error(err))
+				continue
+			}
+
+			log.Log.Infow("reloading configuration", zap.Strings("paths", cleaned), zap.String("changed", ev.Name))
+			reload(cfg)
+		case err := <-w.Errors:
+			log.Log.Errorw("error watching configuration", zap.Strings("paths", cleaned), zap.Error(err))
+		}
+	}
+}
+
+func isAnyConfigEvent(paths []string, ev fsnotify.Event) bool {
+	for _, path := range paths {
+		if isConfigEvent(path, ev) {
+			return true
+		}
+	}
+	return false
+}
+
+func isConfigEvent(path string, ev fsnotify.Event) bool {
+	if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+		return false
+	}
+
+	name := filepath.Clean(ev.Name)
+	return name == path || (filepath.Base(name) == configMapDataDir && filepath.Dir(name) == filepath.Dir(path))
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coster
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	watchTestInitialConfig = `{"Pricing": {"Entries": [{"HourlyMilliCPUCostMicroCents": 1}]}, "Mapper": {"Entries": [{"Destination": "service", "Source": "{.Pod.ObjectMeta.Labels.service}"}]}}`
+	watchTestInvalidConfig = `{"Pricing": `
+	watchTestUpdatedConfig = `{"Pricing": {"Entries": [{"HourlyMilliCPUCostMicroCents": 2}]}, "Mapper": {"Entries": [{"Destination": "service", "Source": "{.Pod.ObjectMeta.Labels.service}"}]}}`
+)
+
+func TestWatchConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kostanza-watch")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(watchTestInitialConfig), 0644); err != nil {
+		t.Fatalf("could not write configuration: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloads := make(chan *Config, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- WatchConfigFile(ctx, path, func(c *Config) { reloads <- c })
+	}()
+
+	// Give the watcher a moment to register before we start writing.
+	time.Sleep(100 * time.Millisecond)
+
+	if err := ioutil.WriteFile(path, []byte(watchTestInvalidConfig), 0644); err != nil {
+		t.Fatalf("could not write configuration: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(watchTestUpdatedConfig), 0644); err != nil {
+		t.Fatalf("could not write configuration: %v", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case c := <-reloads:
+			if len(c.Pricing.Entries) != 1 {
+				t.Fatalf("unexpected reloaded configuration: %#v", c)
+			}
+			if c.Pricing.Entries[0].HourlyMilliCPUCostMicroCents != 2 {
+				continue
+			}
+			cancel()
+			if err := <-errs; err != nil {
+				t.Fatalf("unexpected watch error: %v", err)
+			}
+			return
+		case <-timeout:
+			t.Fatal("timed out waiting for configuration reload")
+		}
+	}
+}
@@ -15,19 +15,24 @@
 package kubernetes
 
 import (
+	"github.com/pkg/errors"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/clientcmd/api"
 )
 
 // BuildConfigFromFlags is clientcmd.BuildConfigFromFlags with no annoying
-// dependencies on glog.
+// dependencies on glog. A non-empty context selects the named context of the
+// kubeconfig in place of its current context.
 // https://godoc.org/k8s.io/client-go/tools/clientcmd#BuildConfigFromFlags
-func BuildConfigFromFlags(apiserver, kubecfg string) (*rest.Config, error) {
+func BuildConfigFromFlags(apiserver, kubecfg, context string) (*rest.Config, error) {
+	if context != "" && kubecfg == "" {
+		return nil, errors.New("a kubeconfig is required to select a context")
+	}
 	if kubecfg != "" || apiserver != "" {
 		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
 			&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubecfg},
-			&clientcmd.ConfigOverrides{ClusterInfo: api.Cluster{Server: apiserver}}).ClientConfig()
+			&clientcmd.ConfigOverrides{ClusterInfo: api.Cluster{Server: apiserver}, CurrentContext: context}).ClientConfig()
 	}
 	return rest.InClusterConfig()
 }
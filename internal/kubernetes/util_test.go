@@ -0,0 +1,98 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: staging
+clusters:
+- name: staging
+  cluster:
+    server: https://staging.example.com
+- name: production
+  cluster:
+    server: https://production.example.com
+users:
+- name: operator
+  user:
+    token: s3cr3t
+contexts:
+- name: staging
+  context:
+    cluster: staging
+    user: operator
+- name: production
+  context:
+    cluster: production
+    user: operator
+`
+
+var buildConfigCases = []struct {
+	name     string
+	context  string
+	expected string
+}{
+	{
+		name:     "current context",
+		expected: "https://staging.example.com",
+	},
+	{
+		name:     "selected context",
+		context:  "production",
+		expected: "https://production.example.com",
+	},
+}
+
+func TestBuildConfigFromFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kostanza-kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	kubecfg := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(kubecfg, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range buildConfigCases {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := BuildConfigFromFlags("", kubecfg, tt.context)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if c.Host != tt.expected {
+				t.Fatalf("expected server %s, got %s", tt.expected, c.Host)
+			}
+			if c.BearerToken != "s3cr3t" {
+				t.Fatalf("expected the context's user to be used, got token %q", c.BearerToken)
+			}
+		})
+	}
+
+	if _, err := BuildConfigFromFlags("", kubecfg, "missing"); err == nil {
+		t.Fatal("expected an unknown context to be rejected")
+	}
+	if _, err := BuildConfigFromFlags("", "", "production"); err == nil {
+		t.Fatal("expected a context without a kubeconfig to be rejected")
+	}
+}
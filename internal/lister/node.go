@@ -27,8 +27,6 @@ import (
 	"k8s.io/client-go/tools/cache"
 )
 
-const nodeResyncPeriod = time.Minute * 15
-
 var _ NodeLister = (*kubernetesNodeLister)(nil)
 var _ NodeLister = (*FakeNodeLister)(nil)
 
@@ -39,12 +37,15 @@ var _ NodeLister = (*FakeNodeLister)(nil)
 type NodeLister interface {
 	List(selector labels.Selector) (ret []*core_v1.Node, err error)
 	Run(stopCh <-chan struct{}) error
+	HasSynced() bool
 }
 
 // NewKubernetesNodeLister returns a NodeLister that provides simplified
-// listing of nodes via the underlying client-go SharedInformer APIs
-func NewKubernetesNodeLister(client kubernetes.Interface) *kubernetesNodeLister { // nolint: golint
-	informerFactory := informers.NewSharedInformerFactory(client, nodeResyncPeriod)
+// listing of nodes via the underlying client-go SharedInformer APIs. The
+// informer resyncs its cache every resync, or only reacts to events when
+// resync is 0.
+func NewKubernetesNodeLister(client kubernetes.Interface, resync time.Duration) *kubernetesNodeLister { // nolint: golint
+	informerFactory := informers.NewSharedInformerFactory(client, resync)
 	ni := informerFactory.Core().V1().Nodes()
 	nl := ni.Lister()
 
@@ -78,13 +79,24 @@ func (k *kubernetesNodeLister) Run(stopCh <-chan struct{}) error {
 	return nil
 }
 
+// HasSynced reports whether the underlying informer has completed its initial
+// node listing.
+func (k *kubernetesNodeLister) HasSynced() bool {
+	return k.informer.Informer().HasSynced()
+}
+
 // FakeNodeLister provides a mock NodeLister implementation.
 type FakeNodeLister struct {
 	Nodes []*core_v1.Node
+	// Err, if set, is returned by List in place of the nodes.
+	Err error
 }
 
 // List returns the slice of nodes provided to this NodeLister.
 func (l *FakeNodeLister) List(selector labels.Selector) ([]*core_v1.Node, error) {
+	if l.Err != nil {
+		return nil, l.Err
+	}
 	return l.Nodes, nil
 }
 
@@ -93,3 +105,8 @@ func (l *FakeNodeLister) Run(stopCh <-chan struct{}) error {
 	<-stopCh
 	return nil
 }
+
+// HasSynced always reports true as the FakeNodeLister has no cache to sync.
+func (l *FakeNodeLister) HasSynced() bool {
+	return true
+}
@@ -28,7 +28,9 @@ import (
 	"github.com/planetlabs/kostanza/internal/log"
 )
 
-const podResyncPeriod = time.Minute * 15
+// DefaultResyncPeriod is the default interval at which pod and node informers
+// resync their caches.
+const DefaultResyncPeriod = time.Minute * 15
 
 var _ PodLister = (*kubernetesPodLister)(nil)
 var _ PodLister = (*FakePodLister)(nil)
@@ -40,12 +42,14 @@ var _ PodLister = (*FakePodLister)(nil)
 type PodLister interface {
 	List(selector labels.Selector) ([]*core_v1.Pod, error)
 	Run(stopCh <-chan struct{}) error
+	HasSynced() bool
 }
 
 // NewKubernetesPodLister returns a PodLister that provides simplified listing
-// of pods via the underlying client-go SharedInformer APIs.
-func NewKubernetesPodLister(client kubernetes.Interface) *kubernetesPodLister { // nolint: golint
-	informerFactory := informers.NewSharedInformerFactory(client, podResyncPeriod)
+// of pods via the underlying client-go SharedInformer APIs. The informer
+// resyncs its cache every resync, or only reacts to events when resync is 0.
+func NewKubernetesPodLister(client kubernetes.Interface, resync time.Duration) *kubernetesPodLister { // nolint: golint
+	informerFactory := informers.NewSharedInformerFactory(client, resync)
 	pi := informerFactory.Core().V1().Pods()
 	pl := pi.Lister()
 
@@ -74,13 +78,24 @@ func (k *kubernetesPodLister) Run(stopCh <-chan struct{}) error {
 	return nil
 }
 
+// HasSynced reports whether the underlying informer has completed its initial
+// pod listing.
+func (k *kubernetesPodLister) HasSynced() bool {
+	return k.informer.Informer().HasSynced()
+}
+
 // FakePodLister provides a mock PodLister implementation.
 type FakePodLister struct {
 	Pods []*core_v1.Pod
+	// Err, if set, is returned by List in place of the pods.
+	Err error
 }
 
 // List returns the list of pods provided to the FakePodLister.
 func (l *FakePodLister) List(selector labels.Selector) ([]*core_v1.Pod, error) {
+	if l.Err != nil {
+		return nil, l.Err
+	}
 	return l.Pods, nil
 }
 
@@ -89,3 +104,8 @@ func (l *FakePodLister) Run(stopCh <-chan struct{}) error {
 	<-stopCh
 	return nil
 }
+
+// HasSynced always reports true as the FakePodLister has no cache to sync.
+func (l *FakePodLister) HasSynced() bool {
+	return true
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lister
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	metrics "k8s.io/metrics/pkg/client/clientset_generated/clientset"
+)
+
+var _ PodMetricsLister = (*kubernetesPodMetricsLister)(nil)
+var _ PodMetricsLister = (*FakePodMetricsLister)(nil)
+
+// PodMetricsLister lists the resource usage of pods in a kubernetes cluster,
+// as reported by the metrics.k8s.io API. Metrics cannot be watched, so unlike
+// the other listers each call to List queries the API server.
+type PodMetricsLister interface {
+	List(selector labels.Selector) (ret []*metricsv1beta1.PodMetrics, err error)
+}
+
+// NewKubernetesPodMetricsLister returns a PodMetricsLister that lists pod
+// metrics via the provided metrics.k8s.io client.
+func NewKubernetesPodMetricsLister(client metrics.Interface) *kubernetesPodMetricsLister { // nolint: golint
+	return &kubernetesPodMetricsLister{client: client}
+}
+
+// kubernetesPodMetricsLister lists pod metrics via a metrics.k8s.io client.
+type kubernetesPodMetricsLister struct {
+	client metrics.Interface
+}
+
+// List returns the metrics of the pods in all namespaces matching the
+// provided labels.
+func (k *kubernetesPodMetricsLister) List(selector labels.Selector) ([]*metricsv1beta1.PodMetrics, error) {
+	pml, err := k.client.MetricsV1beta1().PodMetricses(metav1.NamespaceAll).List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*metricsv1beta1.PodMetrics, 0, len(pml.Items))
+	for i := range pml.Items {
+		ret = append(ret, &pml.Items[i])
+	}
+	return ret, nil
+}
+
+// FakePodMetricsLister provides a mock PodMetricsLister implementation.
+type FakePodMetricsLister struct {
+	Metrics []*metricsv1beta1.PodMetrics
+	// Err, if set, is returned by List in place of the metrics.
+	Err error
+}
+
+// List returns the slice of metrics provided to this PodMetricsLister.
+func (l *FakePodMetricsLister) List(selector labels.Selector) ([]*metricsv1beta1.PodMetrics, error) {
+	if l.Err != nil {
+		return nil, l.Err
+	}
+	return l.Metrics, nil
+}
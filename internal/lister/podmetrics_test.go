@@ -0,0 +1,67 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lister
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	"k8s.io/metrics/pkg/client/clientset_generated/clientset/fake"
+)
+
+func podMetrics(namespace, name, cpu string) metricsv1beta1.PodMetrics {
+	return metricsv1beta1.PodMetrics{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Containers: []metricsv1beta1.ContainerMetrics{{
+			Name:  "main",
+			Usage: core_v1.ResourceList{core_v1.ResourceCPU: resource.MustParse(cpu)},
+		}},
+	}
+}
+
+func TestKubernetesPodMetricsList(t *testing.T) {
+	a := podMetrics("default", "a", "100m")
+	b := podMetrics("kube-system", "b", "250m")
+	// The generated fake tracker registers pod metrics under the wrong group,
+	// so listing is answered by a reactor instead.
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, &metricsv1beta1.PodMetricsList{Items: []metricsv1beta1.PodMetrics{a, b}}, nil
+	})
+	l := NewKubernetesPodMetricsLister(client)
+
+	got, err := l.List(labels.Everything())
+	if err != nil {
+		t.Fatalf("unexpected error listing pod metrics: %v", err)
+	}
+
+	names := map[string]string{}
+	for _, pm := range got {
+		cpu := pm.Containers[0].Usage[core_v1.ResourceCPU]
+		names[pm.Namespace+"/"+pm.Name] = cpu.String()
+	}
+
+	expected := map[string]string{"default/a": "100m", "kube-system/b": "250m"}
+	if diff := deep.Equal(names, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lister
+
+import (
+	"time"
+
+	"github.com/planetlabs/kostanza/internal/log"
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	informersv1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const pvcResyncPeriod = time.Minute * 15
+
+var _ PVCLister = (*kubernetesPVCLister)(nil)
+var _ PVCLister = (*FakePVCLister)(nil)
+
+// PVCLister lists persistent volume claims in a kubernetes cluster. The
+// canonical implementation uses the kubernetes informer mechanism, which is
+// expected to be started via a call to the Run method. Prior to this, a
+// concrete implementation will generally not succesfully return claims.
+type PVCLister interface {
+	List(selector labels.Selector) (ret []*core_v1.PersistentVolumeClaim, err error)
+	Run(stopCh <-chan struct{}) error
+	HasSynced() bool
+}
+
+// NewKubernetesPVCLister returns a PVCLister that provides simplified listing
+// of persistent volume claims via the underlying client-go SharedInformer APIs.
+func NewKubernetesPVCLister(client kubernetes.Interface) *kubernetesPVCLister { // nolint: golint
+	informerFactory := informers.NewSharedInformerFactory(client, pvcResyncPeriod)
+	ci := informerFactory.Core().V1().PersistentVolumeClaims()
+	cl := ci.Lister()
+
+	return &kubernetesPVCLister{
+		lister:   cl,
+		informer: ci,
+	}
+}
+
+// kubernetesPVCLister uses an underlying client-go informer to synchronize a
+// local in-memory cache of kubernetes persistent volume claims.
+type kubernetesPVCLister struct {
+	lister   listersv1.PersistentVolumeClaimLister
+	informer informersv1.PersistentVolumeClaimInformer
+}
+
+// List returns the slice of claims matching the provided labels.
+func (k *kubernetesPVCLister) List(selector labels.Selector) (ret []*core_v1.PersistentVolumeClaim, err error) {
+	return k.lister.List(selector)
+}
+
+// Run starts the asynchronous watch loop using the underlying client-go
+// informer. The stopCh can be used to signal when we should cancel.
+func (k *kubernetesPVCLister) Run(stopCh <-chan struct{}) error {
+	k.informer.Informer().Run(stopCh)
+	log.Log.Debug("waiting for persistent volume claim cache to sync")
+	if ok := cache.WaitForCacheSync(stopCh, k.informer.Informer().HasSynced); !ok {
+		log.Log.Error("persistent volume claim cache did not sync")
+		return ErrCacheSyncFailed
+	}
+	return nil
+}
+
+// HasSynced reports whether the underlying informer has completed its initial
+// claim listing.
+func (k *kubernetesPVCLister) HasSynced() bool {
+	return k.informer.Informer().HasSynced()
+}
+
+// FakePVCLister provides a mock PVCLister implementation.
+type FakePVCLister struct {
+	Claims []*core_v1.PersistentVolumeClaim
+	// Err, if set, is returned by List in place of the claims.
+	Err error
+}
+
+// List returns the slice of claims provided to this PVCLister.
+func (l *FakePVCLister) List(selector labels.Selector) ([]*core_v1.PersistentVolumeClaim, error) {
+	if l.Err != nil {
+		return nil, l.Err
+	}
+	return l.Claims, nil
+}
+
+// Run mimics the run loop of a concrete PVCLister.
+func (l *FakePVCLister) Run(stopCh <-chan struct{}) error {
+	<-stopCh
+	return nil
+}
+
+// HasSynced always reports true as the FakePVCLister has no cache to sync.
+func (l *FakePVCLister) HasSynced() bool {
+	return true
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lister
+
+import (
+	"time"
+
+	"github.com/planetlabs/kostanza/internal/log"
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	informersv1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const serviceResyncPeriod = time.Minute * 15
+
+var _ ServiceLister = (*kubernetesServiceLister)(nil)
+var _ ServiceLister = (*FakeServiceLister)(nil)
+
+// ServiceLister lists services in a kubernetes cluster. The canonical
+// implementation uses the kubernetes informer mechanism, which is expected to
+// be started via a call to the Run method. Prior to this, a concrete
+// implementation will generally not succesfully return services.
+type ServiceLister interface {
+	List(selector labels.Selector) (ret []*core_v1.Service, err error)
+	Run(stopCh <-chan struct{}) error
+	HasSynced() bool
+}
+
+// NewKubernetesServiceLister returns a ServiceLister that provides simplified
+// listing of services via the underlying client-go SharedInformer APIs.
+func NewKubernetesServiceLister(client kubernetes.Interface) *kubernetesServiceLister { // nolint: golint
+	informerFactory := informers.NewSharedInformerFactory(client, serviceResyncPeriod)
+	ci := informerFactory.Core().V1().Services()
+	cl := ci.Lister()
+
+	return &kubernetesServiceLister{
+		lister:   cl,
+		informer: ci,
+	}
+}
+
+// kubernetesServiceLister uses an underlying client-go informer to synchronize
+// a local in-memory cache of kubernetes services.
+type kubernetesServiceLister struct {
+	lister   listersv1.ServiceLister
+	informer informersv1.ServiceInformer
+}
+
+// List returns the slice of services matching the provided labels.
+func (k *kubernetesServiceLister) List(selector labels.Selector) (ret []*core_v1.Service, err error) {
+	return k.lister.List(selector)
+}
+
+// Run starts the asynchronous watch loop using the underlying client-go
+// informer. The stopCh can be used to signal when we should cancel.
+func (k *kubernetesServiceLister) Run(stopCh <-chan struct{}) error {
+	k.informer.Informer().Run(stopCh)
+	log.Log.Debug("waiting for service cache to sync")
+	if ok := cache.WaitForCacheSync(stopCh, k.informer.Informer().HasSynced); !ok {
+		log.Log.Error("service cache did not sync")
+		return ErrCacheSyncFailed
+	}
+	return nil
+}
+
+// HasSynced reports whether the underlying informer has completed its initial
+// service listing.
+func (k *kubernetesServiceLister) HasSynced() bool {
+	return k.informer.Informer().HasSynced()
+}
+
+// FakeServiceLister provides a mock ServiceLister implementation.
+type FakeServiceLister struct {
+	Services []*core_v1.Service
+	// Err, if set, is returned by List in place of the services.
+	Err error
+}
+
+// List returns the slice of services provided to this ServiceLister.
+func (l *FakeServiceLister) List(selector labels.Selector) ([]*core_v1.Service, error) {
+	if l.Err != nil {
+		return nil, l.Err
+	}
+	return l.Services, nil
+}
+
+// Run mimics the run loop of a concrete ServiceLister.
+func (l *FakeServiceLister) Run(stopCh <-chan struct{}) error {
+	<-stopCh
+	return nil
+}
+
+// HasSynced always reports true as the FakeServiceLister has no cache to sync.
+func (l *FakeServiceLister) HasSynced() bool {
+	return true
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lister
+
+import (
+	"sync"
+	"time"
+
+	apps_v1 "k8s.io/api/apps/v1"
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersappsv1 "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/planetlabs/kostanza/internal/log"
+)
+
+const (
+	workloadKindReplicaSet = "ReplicaSet"
+	workloadKindDeployment = "Deployment"
+)
+
+var _ WorkloadResolver = (*kubernetesWorkloadResolver)(nil)
+var _ WorkloadResolver = (*FakeWorkloadResolver)(nil)
+
+// WorkloadResolver resolves the workload controlling a pod. The canonical
+// implementation uses the kubernetes informer mechanism, which is expected to
+// be started via a call to the Run method. Prior to this, a concrete
+// implementation will generally resolve pods to their immediate controller.
+type WorkloadResolver interface {
+	Resolve(p *core_v1.Pod) (kind, name string)
+	Run(stopCh <-chan struct{}) error
+	HasSynced() bool
+}
+
+// NewKubernetesWorkloadResolver returns a WorkloadResolver that follows pod
+// owner references through the ReplicaSets and Deployments watched by the
+// underlying client-go SharedInformer APIs.
+func NewKubernetesWorkloadResolver(client kubernetes.Interface, resync time.Duration) *kubernetesWorkloadResolver { // nolint: golint
+	informerFactory := informers.NewSharedInformerFactory(client, resync)
+	ri := informerFactory.Apps().V1().ReplicaSets()
+	di := informerFactory.Apps().V1().Deployments()
+
+	k := &kubernetesWorkloadResolver{
+		factory:           informerFactory,
+		replicaSets:       ri.Lister(),
+		replicaSetsSynced: ri.Informer().HasSynced,
+		deployments:       di.Lister(),
+		deploymentsSynced: di.Informer().HasSynced,
+		cache:             map[types.UID]workload{},
+	}
+
+	ri.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) { k.forgetReplicaSet(obj) },
+		DeleteFunc: k.forgetReplicaSet,
+	})
+	di.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: k.forgetDeployment,
+	})
+
+	return k
+}
+
+// workload is a resolved controller, along with the namespace it lives in.
+type workload struct {
+	namespace string
+	kind      string
+	name      string
+}
+
+// kubernetesWorkloadResolver uses underlying client-go informers to
+// synchronize local in-memory caches of kubernetes ReplicaSets and
+// Deployments. Resolutions of ReplicaSets are memoized by UID until the
+// ReplicaSet or its Deployment changes. ReplicaSets whose Deployment has not
+// been observed are resolved afresh every time.
+type kubernetesWorkloadResolver struct {
+	factory           informers.SharedInformerFactory
+	replicaSets       listersappsv1.ReplicaSetLister
+	replicaSetsSynced cache.InformerSynced
+	deployments       listersappsv1.DeploymentLister
+	deploymentsSynced cache.InformerSynced
+
+	mux   sync.RWMutex
+	cache map[types.UID]workload
+}
+
+// Resolve returns the kind and name of the workload controlling the provided
+// pod, or empty strings if it has no controller. Pods controlled by a
+// ReplicaSet resolve to the Deployment controlling that ReplicaSet, if any.
+// StatefulSets, DaemonSets and other controllers are taken from the pod's
+// owner reference as is.
+func (k *kubernetesWorkloadResolver) Resolve(p *core_v1.Pod) (string, string) {
+	ref := metav1.GetControllerOf(p)
+	if ref == nil {
+		return "", ""
+	}
+	if ref.Kind != workloadKindReplicaSet {
+		return ref.Kind, ref.Name
+	}
+
+	k.mux.RLock()
+	w, ok := k.cache[ref.UID]
+	k.mux.RUnlock()
+	if ok {
+		return w.kind, w.name
+	}
+
+	w, cacheable := k.resolveReplicaSet(p.Namespace, ref)
+	if !cacheable {
+		return w.kind, w.name
+	}
+
+	k.mux.Lock()
+	k.cache[ref.UID] = w
+	k.mux.Unlock()
+	return w.kind, w.name
+}
+
+// resolveReplicaSet looks up the referenced ReplicaSet and its controlling
+// Deployment. It returns false if the resolution may be incomplete and must
+// not be cached, because either the ReplicaSet or the Deployment controlling
+// it has not been observed yet, e.g. as the Deployment informer lags behind.
+func (k *kubernetesWorkloadResolver) resolveReplicaSet(namespace string, ref *metav1.OwnerReference) (workload, bool) {
+	w := workload{namespace: namespace, kind: ref.Kind, name: ref.Name}
+
+	rs, err := k.replicaSets.ReplicaSets(namespace).Get(ref.Name)
+	if err != nil || rs.UID != ref.UID {
+		return w, false
+	}
+
+	dref := metav1.GetControllerOf(rs)
+	if dref == nil || dref.Kind != workloadKindDeployment {
+		return w, true
+	}
+
+	d, err := k.deployments.Deployments(namespace).Get(dref.Name)
+	if err != nil || d.UID != dref.UID {
+		return w, false
+	}
+
+	w.kind, w.name = workloadKindDeployment, d.Name
+	return w, true
+}
+
+// forgetReplicaSet drops the cached resolution of a ReplicaSet, e.g. because
+// it was adopted, orphaned or deleted.
+func (k *kubernetesWorkloadResolver) forgetReplicaSet(obj interface{}) {
+	if t, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = t.Obj
+	}
+	rs, ok := obj.(*apps_v1.ReplicaSet)
+	if !ok {
+		return
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	delete(k.cache, rs.UID)
+}
+
+// forgetDeployment drops the cached resolution of every ReplicaSet that
+// resolved to a deleted Deployment.
+func (k *kubernetesWorkloadResolver) forgetDeployment(obj interface{}) {
+	if t, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = t.Obj
+	}
+	d, ok := obj.(*apps_v1.Deployment)
+	if !ok {
+		return
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	for uid, w := range k.cache {
+		if w.kind == workloadKindDeployment && w.namespace == d.Namespace && w.name == d.Name {
+			delete(k.cache, uid)
+		}
+	}
+}
+
+// Run starts the asynchronous watch loops of the underlying client-go
+// informers and blocks until the stopCh is closed.
+func (k *kubernetesWorkloadResolver) Run(stopCh <-chan struct{}) error {
+	k.factory.Start(stopCh)
+	log.Log.Debug("waiting for workload caches to sync")
+	if ok := cache.WaitForCacheSync(stopCh, k.HasSynced); !ok {
+		log.Log.Error("workload caches did not sync")
+		return ErrCacheSyncFailed
+	}
+	<-stopCh
+	return nil
+}
+
+// HasSynced reports whether the underlying informers have completed their
+// initial ReplicaSet and Deployment listings.
+func (k *kubernetesWorkloadResolver) HasSynced() bool {
+	return k.replicaSetsSynced() && k.deploymentsSynced()
+}
+
+// FakeWorkloadResolver provides a mock WorkloadResolver implementation.
+type FakeWorkloadResolver struct {
+	// Workloads maps pod names to the workload they resolve to. Pods that are
+	// not present resolve to empty strings.
+	Workloads map[string]FakeWorkload
+}
+
+// FakeWorkload is the kind and name a FakeWorkloadResolver resolves a pod to.
+type FakeWorkload struct {
+	Kind string
+	Name string
+}
+
+// Resolve returns the workload provided to this WorkloadResolver for the pod.
+func (f *FakeWorkloadResolver) Resolve(p *core_v1.Pod) (string, string) {
+	w := f.Workloads[p.Name]
+	return w.Kind, w.Name
+}
+
+// Run mimics the run loop of a concrete WorkloadResolver.
+func (f *FakeWorkloadResolver) Run(stopCh <-chan struct{}) error {
+	<-stopCh
+	return nil
+}
+
+// HasSynced always reports true as the FakeWorkloadResolver has no cache to
+// sync.
+func (f *FakeWorkloadResolver) HasSynced() bool {
+	return true
+}
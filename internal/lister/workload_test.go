@@ -0,0 +1,193 @@
+// Copyright 2018 Planet Labs Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lister
+
+import (
+	"testing"
+	"time"
+
+	apps_v1 "k8s.io/api/apps/v1"
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func controllerRef(kind, name string, uid types.UID) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, UID: uid, Controller: &controller}}
+}
+
+func ownedPod(name string, refs []metav1.OwnerReference) *core_v1.Pod {
+	return &core_v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, OwnerReferences: refs}}
+}
+
+var testWorkloadObjects = []runtime.Object{
+	&apps_v1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "deploy-web"},
+	},
+	&apps_v1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            "web-5d4f8c",
+			UID:             "rs-web",
+			OwnerReferences: controllerRef("Deployment", "web", "deploy-web"),
+		},
+	},
+	&apps_v1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "standalone", UID: "rs-standalone"},
+	},
+	&apps_v1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            "gone-7b9f",
+			UID:             "rs-gone",
+			OwnerReferences: controllerRef("Deployment", "gone", "deploy-gone"),
+		},
+	},
+}
+
+var resolveWorkloadCases = []struct {
+	name     string
+	pod      *core_v1.Pod
+	wantKind string
+	wantName string
+}{
+	{
+		name: "no controller",
+		pod:  ownedPod("bare", nil),
+	},
+	{
+		name:     "replicaset controlled by a deployment",
+		pod:      ownedPod("web-5d4f8c-abcde", controllerRef("ReplicaSet", "web-5d4f8c", "rs-web")),
+		wantKind: "Deployment",
+		wantName: "web",
+	},
+	{
+		name:     "replicaset without a controller",
+		pod:      ownedPod("standalone-abcde", controllerRef("ReplicaSet", "standalone", "rs-standalone")),
+		wantKind: "ReplicaSet",
+		wantName: "standalone",
+	},
+	{
+		name:     "replicaset controlled by a missing deployment",
+		pod:      ownedPod("gone-7b9f-abcde", controllerRef("ReplicaSet", "gone-7b9f", "rs-gone")),
+		wantKind: "ReplicaSet",
+		wantName: "gone-7b9f",
+	},
+	{
+		name:     "unknown replicaset",
+		pod:      ownedPod("unknown-abcde", controllerRef("ReplicaSet", "unknown", "rs-unknown")),
+		wantKind: "ReplicaSet",
+		wantName: "unknown",
+	},
+	{
+		name:     "replicaset with a mismatched uid",
+		pod:      ownedPod("web-5d4f8c-fghij", controllerRef("ReplicaSet", "web-5d4f8c", "rs-previous")),
+		wantKind: "ReplicaSet",
+		wantName: "web-5d4f8c",
+	},
+	{
+		name:     "statefulset",
+		pod:      ownedPod("db-0", controllerRef("StatefulSet", "db", "sts-db")),
+		wantKind: "StatefulSet",
+		wantName: "db",
+	},
+	{
+		name:     "daemonset",
+		pod:      ownedPod("agent-abcde", controllerRef("DaemonSet", "agent", "ds-agent")),
+		wantKind: "DaemonSet",
+		wantName: "agent",
+	},
+}
+
+func runWorkloadResolver(t *testing.T, client *fake.Clientset) (*kubernetesWorkloadResolver, func()) {
+	t.Helper()
+
+	r := NewKubernetesWorkloadResolver(client, 0)
+	stopCh := make(chan struct{})
+	go r.Run(stopCh) // nolint: errcheck
+	if !cache.WaitForCacheSync(stopCh, r.HasSynced) {
+		t.Fatal("workload caches did not sync")
+	}
+	return r, func() { close(stopCh) }
+}
+
+func TestKubernetesWorkloadResolver(t *testing.T) {
+	r, stop := runWorkloadResolver(t, fake.NewSimpleClientset(testWorkloadObjects...))
+	defer stop()
+
+	for _, tt := range resolveWorkloadCases {
+		t.Run(tt.name, func(t *testing.T) {
+			// Resolve twice so that cached resolutions are exercised.
+			for i := 0; i < 2; i++ {
+				kind, name := r.Resolve(tt.pod)
+				if kind != tt.wantKind || name != tt.wantName {
+					t.Errorf("Resolve(): want %s/%s, got %s/%s", tt.wantKind, tt.wantName, kind, name)
+				}
+			}
+		})
+	}
+}
+
+func TestKubernetesWorkloadResolverForgets(t *testing.T) {
+	client := fake.NewSimpleClientset(testWorkloadObjects...)
+	r, stop := runWorkloadResolver(t, client)
+	defer stop()
+
+	pod := ownedPod("web-5d4f8c-abcde", controllerRef("ReplicaSet", "web-5d4f8c", "rs-web"))
+	if kind, name := r.Resolve(pod); kind != "Deployment" || name != "web" {
+		t.Fatalf("Resolve(): want Deployment/web, got %s/%s", kind, name)
+	}
+
+	if err := client.AppsV1().Deployments("default").Delete("web", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		kind, name := r.Resolve(pod)
+		return kind == "ReplicaSet" && name == "web-5d4f8c", nil
+	})
+	if err != nil {
+		t.Errorf("Resolve(): deleted deployment was not forgotten: %v", err)
+	}
+}
+
+func TestKubernetesWorkloadResolverLateDeployment(t *testing.T) {
+	client := fake.NewSimpleClientset(testWorkloadObjects...)
+	r, stop := runWorkloadResolver(t, client)
+	defer stop()
+
+	pod := ownedPod("gone-7b9f-abcde", controllerRef("ReplicaSet", "gone-7b9f", "rs-gone"))
+	if kind, name := r.Resolve(pod); kind != "ReplicaSet" || name != "gone-7b9f" {
+		t.Fatalf("Resolve(): want ReplicaSet/gone-7b9f, got %s/%s", kind, name)
+	}
+
+	d := &apps_v1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "gone", UID: "deploy-gone"}}
+	if _, err := client.AppsV1().Deployments("default").Create(d); err != nil {
+		t.Fatal(err)
+	}
+
+	err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		kind, name := r.Resolve(pod)
+		return kind == "Deployment" && name == "gone", nil
+	})
+	if err != nil {
+		t.Errorf("Resolve(): late deployment was not resolved: %v", err)
+	}
+}